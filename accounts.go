@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// NextAccountSequenceStatement is unqualified so that each tenant draws from the sequence within its own schema.
+	NextAccountSequenceStatement = `SELECT nextval('account_id_seq')`
+
+	// accountIdMinimum is the smallest account ID allocated, ensuring all new IDs are nine digits.
+	accountIdMinimum = 100000000
+	// accountIdSpace is the amount of nine-digit account IDs available.
+	accountIdSpace = 900000000
+	// accountIdMultiplier is coprime with accountIdSpace, so that multiplying sequence values by it
+	// visits every ID exactly once. This avoids handing out sequential, easily guessed account IDs.
+	accountIdMultiplier = 104729
+
+	// MaxAccountIdAttempts is how many IDs we try before giving up on registration.
+	// Only accounts created before sequential allocation can collide.
+	MaxAccountIdAttempts = 5
+
+	// accountIdConstraint is the unique index preventing duplicate account IDs.
+	accountIdConstraint = "userbase_account_id_uindex"
+
+	QueryAccountSummary = `SELECT account_id, device_id, region, serial_number, device_code, balance
+		FROM userbase WHERE account_id = $1`
+
+	QueryAccountTickets = `SELECT title_id, version, item_id, date_purchased, date_expires
+		FROM owned_titles
+		WHERE account_id = $1
+		ORDER BY date_purchased`
+)
+
+// ErrTitleOwned is returned when granting a title the account already owns.
+var ErrTitleOwned = errors.New("title is already owned")
+
+// Account describes a registered console and its tickets for administrative use.
+type Account struct {
+	AccountId    int64         `json:"account_id"`
+	DeviceId     int64         `json:"device_id"`
+	Region       *string       `json:"region"`
+	SerialNumber *string       `json:"serial_number"`
+	DeviceCode   *string       `json:"device_code"`
+	Balance      int           `json:"balance"`
+	Tickets      []OwnedTicket `json:"tickets"`
+}
+
+// OwnedTicket describes a title owned by an account.
+type OwnedTicket struct {
+	TitleId       string     `json:"title_id"`
+	Version       *int       `json:"version"`
+	ItemId        *int       `json:"item_id"`
+	DatePurchased time.Time  `json:"date_purchased"`
+	DateExpires   *time.Time `json:"date_expires"`
+}
+
+// GrantRequest describes a title to grant an account without charge.
+type GrantRequest struct {
+	AccountId int64  `json:"account_id"`
+	TitleId   string `json:"title_id"`
+	ItemId    *int   `json:"item_id"`
+}
+
+// BalanceAdjustment describes an amount of points to credit, or debit if negative.
+type BalanceAdjustment struct {
+	AccountId int64 `json:"account_id"`
+	Amount    int   `json:"amount"`
+}
+
+// AccountBalance describes an account's balance following an adjustment.
+type AccountBalance struct {
+	AccountId int64 `json:"account_id"`
+	Balance   int   `json:"balance"`
+}
+
+func init() {
+	registerAdminEndpoint("/accounts", accountEndpoint)
+	registerAdminEndpoint("/accounts/titles", grantTitleEndpoint)
+	registerAdminEndpoint("/accounts/balance", adjustBalanceEndpoint)
+}
+
+// allocateAccountId returns an unused account ID derived from the account sequence.
+func allocateAccountId(ctx context.Context) (int64, error) {
+	var sequence int64
+	err := pool.QueryRow(ctx, NextAccountSequenceStatement).Scan(&sequence)
+	if err != nil {
+		return 0, err
+	}
+
+	return accountIdMinimum + (sequence*accountIdMultiplier)%accountIdSpace, nil
+}
+
+// isAccountIdCollision returns whether the given error was caused by an account ID already in use.
+func isAccountIdCollision(err error) bool {
+	driverErr, ok := err.(*pgconn.PgError)
+	return ok && driverErr.Code == "23505" && driverErr.ConstraintName == accountIdConstraint
+}
+
+// formatAccountId returns the account ID as sent to consoles, padded to nine digits.
+func formatAccountId(accountId int64) string {
+	return fmt.Sprintf("%09d", accountId)
+}
+
+// lookupAccount returns the given account alongside its tickets, or ErrUnknownAccount if it does not exist.
+func lookupAccount(ctx context.Context, accountId int64) (*Account, error) {
+	var account Account
+	err := pool.QueryRow(ctx, QueryAccountSummary, accountId).Scan(&account.AccountId, &account.DeviceId,
+		&account.Region, &account.SerialNumber, &account.DeviceCode, &account.Balance)
+	if err == pgx.ErrNoRows {
+		return nil, ErrUnknownAccount
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := pool.Query(ctx, QueryAccountTickets, accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	account.Tickets = []OwnedTicket{}
+	for rows.Next() {
+		var ticket OwnedTicket
+		err = rows.Scan(&ticket.TitleId, &ticket.Version, &ticket.ItemId, &ticket.DatePurchased, &ticket.DateExpires)
+		if err != nil {
+			return nil, err
+		}
+		account.Tickets = append(account.Tickets, ticket)
+	}
+
+	return &account, rows.Err()
+}
+
+// grantTitle issues a permanent ticket for a title to an account without charge.
+// Titles not within our catalog, such as hosted services, are granted at version 0.
+// Grants are audited by the admin API and companion service respectively, as with every request they serve.
+func grantTitle(ctx context.Context, grant GrantRequest) error {
+	version := 0
+	app, err := lookupTitle(ctx, grant.TitleId)
+	if err != nil {
+		return err
+	}
+	if app != nil {
+		version = app.Shop.Version
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var throwaway int
+	err = tx.QueryRow(ctx, QueryAccountExists, grant.AccountId).Scan(&throwaway)
+	if err == pgx.ErrNoRows {
+		return ErrUnknownAccount
+	} else if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(ctx, QueryOwnedTitle, grant.AccountId, grant.TitleId).Scan(&throwaway)
+	if err == nil {
+		return ErrTitleOwned
+	} else if err != pgx.ErrNoRows {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, AssociateTicketStatement, grant.AccountId, grant.TitleId, version, grant.ItemId, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// adjustBalance credits the given amount of points to an account, or debits it if negative, returning the new balance.
+func adjustBalance(ctx context.Context, adjustment BalanceAdjustment) (int, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var throwaway int
+	err = tx.QueryRow(ctx, QueryAccountExists, adjustment.AccountId).Scan(&throwaway)
+	if err == pgx.ErrNoRows {
+		return 0, ErrUnknownAccount
+	} else if err != nil {
+		return 0, err
+	}
+
+	if adjustment.Amount < 0 {
+		err = debitPoints(ctx, tx, adjustment.AccountId, -adjustment.Amount)
+	} else {
+		err = creditPoints(ctx, tx, adjustment.AccountId, adjustment.Amount)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var balance int
+	err = tx.QueryRow(ctx, QueryAccountBalance, adjustment.AccountId).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+
+	return balance, tx.Commit(ctx)
+}
+
+// accountEndpoint looks up an account and its tickets.
+func accountEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	accountId, err := strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
+
+	account, err := lookupAccount(r.Context(), accountId)
+	if err == ErrUnknownAccount {
+		writeAdminError(w, http.StatusNotFound, "account does not exist")
+		return
+	} else if err != nil {
+		log.Printf("error querying account: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account)
+}
+
+// grantTitleEndpoint grants a title to an account.
+func grantTitleEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var grant GrantRequest
+	err := readJSON(r, &grant)
+	if err != nil || grant.AccountId == 0 || grant.TitleId == "" {
+		writeAdminError(w, http.StatusBadRequest, "account_id and title_id are required")
+		return
+	}
+
+	err = grantTitle(r.Context(), grant)
+	if err == ErrUnknownAccount {
+		writeAdminError(w, http.StatusNotFound, "account does not exist")
+		return
+	} else if err == ErrTitleOwned {
+		writeAdminError(w, http.StatusConflict, "title is already owned")
+		return
+	} else if err != nil {
+		log.Printf("error granting title: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, grant)
+}
+
+// adjustBalanceEndpoint credits or debits points from an account.
+func adjustBalanceEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var adjustment BalanceAdjustment
+	err := readJSON(r, &adjustment)
+	if err != nil || adjustment.AccountId == 0 {
+		writeAdminError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
+
+	balance, err := adjustBalance(r.Context(), adjustment)
+	if err == ErrUnknownAccount {
+		writeAdminError(w, http.StatusNotFound, "account does not exist")
+		return
+	} else if err == ErrInsufficientPoints {
+		writeAdminError(w, http.StatusConflict, "account has insufficient points")
+		return
+	} else if err != nil {
+		log.Printf("error adjusting balance: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, AccountBalance{AccountId: adjustment.AccountId, Balance: balance})
+}
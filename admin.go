@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig configures the administrative JSON API.
+type AdminConfig struct {
+	Address string `xml:"Address"`
+	// Token is deprecated in favour of Secrets>AdminToken.
+	Token string `xml:"Token"`
+}
+
+// adminMux routes all administrative endpoints.
+var adminMux = http.NewServeMux()
+
+// registerAdminEndpoint associates a path within the admin API to a handler.
+// It is intended to be called from init functions within any module.
+func registerAdminEndpoint(path string, handler http.HandlerFunc) {
+	adminMux.HandleFunc(path, handler)
+}
+
+// serveAdmin exposes the admin API at the configured address in the background.
+// All requests must provide the configured token as a bearer token.
+// Requests apply to the default tenant unless another is named via TenantHeader.
+func serveAdmin(config AdminConfig) {
+	if config.Token == "" {
+		log.Fatalf("An admin token must be configured to serve the admin API.")
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if name := r.Header.Get(TenantHeader); name != "" {
+			tenant := lookupTenant(name)
+			if tenant == nil {
+				writeAdminError(w, http.StatusNotFound, "unknown tenant")
+				return
+			}
+			r = r.WithContext(withTenant(r.Context(), tenant))
+		}
+
+		log.Printf("[admin] %s %s", r.Method, r.URL)
+		auditAdminRequest(r)
+		adminMux.ServeHTTP(w, r)
+	})
+
+	go func() {
+		log.Printf("Serving admin API at %s", config.Address)
+		err := http.ListenAndServe(config.Address, handler)
+		if err != nil {
+			log.Printf("unable to serve admin API: %v", err)
+		}
+	}()
+}
+
+// writeJSON writes the given value as JSON with the given status.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeAdminError writes a JSON error with the given status.
+func writeAdminError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, map[string]string{"error": reason})
+}
+
+// readJSON decodes the request body into the given value.
+func readJSON(r *http.Request, value interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(value)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// QueryAllowlisted returns whether the given device ID or serial number is present within the allowlist.
+	QueryAllowlisted = `SELECT EXISTS (SELECT 1 FROM allowlist WHERE device_id = $1 OR serial_number = $2)`
+
+	QueryAllowlist = `SELECT entry_id, device_id, serial_number, note, date_added FROM allowlist ORDER BY entry_id`
+
+	// InsertAllowlistStatement adds an entry, returning nothing if its device ID or serial number is already present.
+	InsertAllowlistStatement = `INSERT INTO allowlist (device_id, serial_number, note)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		RETURNING entry_id, date_added`
+
+	DeleteAllowlistStatement = `DELETE FROM allowlist WHERE entry_id = $1`
+)
+
+// ErrRegistrationsClosed is returned when a console absent from the allowlist attempts to register.
+var ErrRegistrationsClosed = errors.New("registrations are closed")
+
+// AllowlistConfig restricts registrations to consoles present within the allowlist, such as during a beta.
+type AllowlistConfig struct {
+	Enabled bool `xml:"Enabled,attr"`
+	// Code replaces the error code sent to consoles refused registration, defaulting to ErrorCodeRegistrationsClosed.
+	Code int `xml:"Code,attr"`
+	// Message is the reason sent to consoles refused registration.
+	Message string `xml:"Message,attr"`
+}
+
+// AllowlistEntry permits a device ID or serial number to register while registrations are gated.
+type AllowlistEntry struct {
+	EntryId      int     `json:"entry_id"`
+	DeviceId     *int64  `json:"device_id"`
+	SerialNumber *string `json:"serial_number"`
+	// Note describes who the entry was issued to, such as a beta tester's name.
+	Note      *string   `json:"note"`
+	DateAdded time.Time `json:"date_added"`
+}
+
+// AllowlistImport summarizes entries imported via CSV.
+type AllowlistImport struct {
+	Added int `json:"added"`
+	// Skipped counts entries whose device ID or serial number was already present.
+	Skipped int `json:"skipped"`
+}
+
+// allowlistConfig holds the configured registration gate.
+var allowlistConfig AllowlistConfig
+
+func init() {
+	registerAdminEndpoint("/allowlist", allowlistEndpoint)
+	registerAdminEndpoint("/allowlist/import", allowlistImportEndpoint)
+}
+
+// loadAllowlist applies the given registration gate.
+func loadAllowlist(config AllowlistConfig) {
+	if config.Code == 0 {
+		config.Code = int(ErrorCodeRegistrationsClosed)
+	}
+	if config.Message == "" {
+		config.Message = "registrations are closed"
+	}
+	allowlistConfig = config
+}
+
+// isAllowlisted returns whether the given console is present within the allowlist.
+func isAllowlisted(ctx context.Context, deviceId int, serialNumber string) (bool, error) {
+	var allowlisted bool
+	err := pool.QueryRow(ctx, QueryAllowlisted, deviceId, strings.ToUpper(serialNumber)).Scan(&allowlisted)
+	return allowlisted, err
+}
+
+// enforceAllowlist refuses registrations and registration syncs from consoles absent from the allowlist while gated,
+// returning whether they may proceed.
+func (e *Envelope) enforceAllowlist(serialNumber string) bool {
+	if !allowlistConfig.Enabled {
+		return true
+	}
+
+	allowlisted, err := isAllowlisted(e.ctx, e.DeviceId(), serialNumber)
+	if err != nil {
+		log.Printf("error querying allowlist: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return false
+	} else if !allowlisted {
+		incrementMetric("registrations_closed")
+		e.Error(ErrorCode(allowlistConfig.Code), allowlistConfig.Message, ErrRegistrationsClosed)
+		return false
+	}
+	return true
+}
+
+// insertAllowlistEntry adds an entry, returning false if its device ID or serial number is already present.
+func insertAllowlistEntry(ctx context.Context, tx pgx.Tx, entry *AllowlistEntry) (bool, error) {
+	err := tx.QueryRow(ctx, InsertAllowlistStatement, entry.DeviceId, entry.SerialNumber, entry.Note).Scan(&entry.EntryId, &entry.DateAdded)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// allowlistEndpoint lists, adds or removes allowlist entries.
+func allowlistEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rows, err := pool.Query(r.Context(), QueryAllowlist)
+		if err != nil {
+			log.Printf("error querying allowlist: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		entries := []AllowlistEntry{}
+		for rows.Next() {
+			var entry AllowlistEntry
+			err = rows.Scan(&entry.EntryId, &entry.DeviceId, &entry.SerialNumber, &entry.Note, &entry.DateAdded)
+			if err != nil {
+				log.Printf("error querying allowlist: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			entries = append(entries, entry)
+		}
+
+		writeJSON(w, http.StatusOK, entries)
+	case "POST":
+		var entry AllowlistEntry
+		err := readJSON(r, &entry)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid entry")
+			return
+		}
+
+		if entry.DeviceId == nil && entry.SerialNumber == nil {
+			writeAdminError(w, http.StatusBadRequest, "device_id or serial_number is required")
+			return
+		}
+		if entry.SerialNumber != nil {
+			serialNumber := strings.ToUpper(*entry.SerialNumber)
+			entry.SerialNumber = &serialNumber
+		}
+
+		tx, err := pool.Begin(r.Context())
+		if err != nil {
+			log.Printf("error beginning transaction: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		added, err := insertAllowlistEntry(r.Context(), tx, &entry)
+		if err == nil && added {
+			err = tx.Commit(r.Context())
+		}
+		if err != nil {
+			log.Printf("error adding allowlist entry: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if !added {
+			writeAdminError(w, http.StatusConflict, "device_id or serial_number is already allowlisted")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, entry)
+	case "DELETE":
+		entryId, err := strconv.Atoi(r.URL.Query().Get("entry_id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "entry_id is required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), DeleteAllowlistStatement, entryId)
+		if err != nil {
+			log.Printf("error removing allowlist entry: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "entry does not exist")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// parseAllowlistRecord parses a device_id,serial_number,note row within an allowlist CSV, where any column may be empty.
+func parseAllowlistRecord(record []string) (AllowlistEntry, error) {
+	var entry AllowlistEntry
+	if deviceId := strings.TrimSpace(record[0]); deviceId != "" {
+		parsed, err := strconv.ParseInt(deviceId, 10, 64)
+		if err != nil {
+			return entry, errors.New("invalid device_id " + deviceId)
+		}
+		entry.DeviceId = &parsed
+	}
+	entry.SerialNumber = nullableString(strings.ToUpper(strings.TrimSpace(record[1])))
+	entry.Note = nullableString(strings.TrimSpace(record[2]))
+
+	if entry.DeviceId == nil && entry.SerialNumber == nil {
+		return entry, errors.New("device_id or serial_number is required")
+	}
+	return entry, nil
+}
+
+// allowlistImportEndpoint adds entries from a CSV body with a device_id,serial_number,note header.
+// Entries already present are skipped, and either all others are added or none are.
+func allowlistImportEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	defer r.Body.Close()
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = 3
+	header, err := reader.Read()
+	if err != nil || strings.Join(header, ",") != "device_id,serial_number,note" {
+		writeAdminError(w, http.StatusBadRequest, "expected a device_id,serial_number,note header")
+		return
+	}
+
+	var entries []AllowlistEntry
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		entry, err := parseAllowlistRecord(record)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "line "+strconv.Itoa(line)+": "+err.Error())
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	tx, err := pool.Begin(r.Context())
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	var summary AllowlistImport
+	for i := range entries {
+		added, err := insertAllowlistEntry(r.Context(), tx, &entries[i])
+		if err != nil {
+			log.Printf("error importing allowlist: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		if added {
+			summary.Added++
+		} else {
+			summary.Skipped++
+		}
+	}
+
+	err = tx.Commit(r.Context())
+	if err != nil {
+		log.Printf("error importing allowlist: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 )
 
-const oscAPIUrl = "https://hbb1.oscwii.org/api/v3/contents"
+// oscAPIUrl lists every title available from the Open Shop Channel.
+var oscAPIUrl = "https://hbb1.oscwii.org/api/v3/contents"
 
 type OSCApp struct {
 	Shop Shop `json:"shop"`
@@ -18,8 +20,13 @@ type Shop struct {
 	Version int    `json:"title_version"`
 }
 
-func GetOSCApp(titleId string) (*OSCApp, error) {
-	resp, err := http.Get(oscAPIUrl)
+func GetOSCApp(ctx context.Context, titleId string) (*OSCApp, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", oscAPIUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAssetsPrefix is the path assets are served beneath unless configured otherwise.
+	DefaultAssetsPrefix = "/oss/"
+	// DefaultAssetsMaxAge is how long consoles may cache assets unless configured otherwise.
+	DefaultAssetsMaxAge = time.Hour
+)
+
+// AssetsConfig configures serving the shop's pages, scripts and title artwork from a content directory.
+type AssetsConfig struct {
+	// Directory holds assets, optionally beneath region and language directories such as USA/en.
+	Directory string `xml:"Directory"`
+	// Prefix is the path assets are served beneath, defaulting to /oss/.
+	Prefix string `xml:"Prefix"`
+	// MaxAge is how long consoles may cache assets, defaulting to an hour.
+	MaxAge string `xml:"MaxAge"`
+}
+
+// assetsSettings holds parsed asset configuration.
+type assetsSettings struct {
+	root   http.FileSystem
+	prefix string
+	maxAge time.Duration
+}
+
+// assets is the configured asset directory, or nil if assets are not served.
+var assets *assetsSettings
+
+// loadAssets validates and applies the given asset configuration.
+func loadAssets(config AssetsConfig) error {
+	if config.Directory == "" {
+		assets = nil
+		return nil
+	}
+
+	settings := assetsSettings{
+		root:   http.Dir(config.Directory),
+		prefix: config.Prefix,
+		maxAge: DefaultAssetsMaxAge,
+	}
+	if settings.prefix == "" {
+		settings.prefix = DefaultAssetsPrefix
+	}
+	if !strings.HasPrefix(settings.prefix, "/") || !strings.HasSuffix(settings.prefix, "/") {
+		return fmt.Errorf("assets Prefix must begin and end with /")
+	}
+
+	if config.MaxAge != "" {
+		maxAge, err := time.ParseDuration(config.MaxAge)
+		if err != nil {
+			return err
+		}
+		settings.maxAge = maxAge
+	}
+
+	assets = &settings
+	return nil
+}
+
+// assetLanguage returns the language assets should be served in, preferring the language query parameter
+// over the first language the browser accepts.
+func assetLanguage(r *http.Request) string {
+	if language := r.URL.Query().Get("language"); language != "" {
+		return language
+	}
+
+	accepted := strings.Split(r.Header.Get("Accept-Language"), ",")[0]
+	return strings.TrimSpace(strings.Split(accepted, ";")[0])
+}
+
+// assetCandidates returns the paths an asset may be found at, most specific first.
+// Assets are looked up beneath the requested region and language, then either alone, then the directory itself.
+func assetCandidates(name string, region string, language string) []string {
+	var candidates []string
+	for _, directory := range [][]string{{region, language}, {region}, {language}, {}} {
+		valid := true
+		for _, component := range directory {
+			// Components must remain a single directory.
+			if component == "" || component != path.Base(component) || strings.HasPrefix(component, ".") {
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+
+		candidates = append(candidates, path.Join("/", path.Join(directory...), name))
+	}
+	return candidates
+}
+
+// serveAssets responds with the requested asset, returning whether the request was handled.
+// Requests beneath the assets prefix which cannot be served are responded to with an error, rather than being routed further.
+func serveAssets(w http.ResponseWriter, r *http.Request) bool {
+	if assets == nil || !strings.HasPrefix(r.URL.Path, assets.prefix) {
+		return false
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, assets.prefix))
+	for _, candidate := range assetCandidates(name, r.URL.Query().Get("region"), assetLanguage(r)) {
+		file, err := assets.root.Open(candidate)
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(assets.maxAge.Seconds())))
+		// Responses differ by language when negotiated via the browser.
+		w.Header().Set("Vary", "Accept-Language")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+		return true
+	}
+
+	http.NotFound(w, r)
+	return true
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	InsertAuditStatement = `INSERT INTO audit_log (device_id, account_id, action, parameters_hash, date)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	// QueryAuditLog filters entries by any non-null argument, most recent first.
+	QueryAuditLog = `SELECT audit_id, device_id, account_id, action, parameters_hash, date
+		FROM audit_log
+		WHERE ($1::integer IS NULL OR account_id = $1)
+		AND ($2::bigint IS NULL OR device_id = $2)
+		AND ($3::varchar IS NULL OR action = $3)
+		AND ($4::bigint IS NULL OR audit_id < $4)
+		ORDER BY audit_id DESC
+		LIMIT $5`
+
+	// DefaultAuditLimit is how many entries are returned by the admin API unless otherwise requested.
+	DefaultAuditLimit = 100
+	// MaxAuditLimit is the most entries the admin API returns at once.
+	MaxAuditLimit = 1000
+)
+
+// AuditEntry records a state-changing operation.
+// Parameters are only stored as a hash, so that entries can be correlated without retaining request contents.
+type AuditEntry struct {
+	AuditId        int64     `json:"audit_id"`
+	DeviceId       *int64    `json:"device_id"`
+	AccountId      *int64    `json:"account_id"`
+	Action         string    `json:"action"`
+	ParametersHash string    `json:"parameters_hash"`
+	Date           time.Time `json:"date"`
+}
+
+// auditExecutor allows audit entries to be recorded within a transaction, or directly against the pool.
+type auditExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+func init() {
+	registerAdminEndpoint("/audit", auditEndpoint)
+}
+
+// Audited marks this action as state-changing, recording every successful request within the audit log.
+func (a *Action) Audited() *Action {
+	a.Audit = true
+	return a
+}
+
+// hashParameters returns a SHA-256 hash of the given values.
+func hashParameters(values ...interface{}) string {
+	hash := sha256.New()
+	for _, value := range values {
+		fmt.Fprint(hash, value)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordAudit appends the given entry to the audit log.
+func recordAudit(ctx context.Context, executor auditExecutor, entry AuditEntry) error {
+	_, err := executor.Exec(ctx, InsertAuditStatement, entry.DeviceId, entry.AccountId, entry.Action, entry.ParametersHash, time.Now().UTC())
+	return err
+}
+
+// audit records the current request within the audit log under the given action.
+// Failures are logged rather than returned, as the request has already been handled.
+func (e *Envelope) audit(action string) {
+	deviceId := int64(e.DeviceId())
+	entry := AuditEntry{
+		DeviceId:       &deviceId,
+		Action:         action,
+		ParametersHash: hashParameters(redactTokens(e.doc.OutputXML(true))),
+	}
+	if accountId, err := e.AccountId(); err == nil && accountId != 0 {
+		entry.AccountId = &accountId
+	}
+
+	err := recordAudit(e.ctx, pool, entry)
+	if err != nil {
+		log.Printf("error recording audit entry for %s: %v\n", action, err)
+	}
+}
+
+// auditAdminRequest records a state-changing admin request within the audit log.
+func auditAdminRequest(r *http.Request) {
+	if r.Method == "GET" {
+		return
+	}
+
+	err := recordAudit(r.Context(), pool, AuditEntry{
+		Action:         "admin/" + r.Method + " " + r.URL.Path,
+		ParametersHash: hashParameters(r.URL.RawQuery),
+	})
+	if err != nil {
+		log.Printf("error recording audit entry for admin request: %v\n", err)
+	}
+}
+
+// optionalInt parses the named query parameter as an integer, returning nil if absent.
+func optionalInt(query url.Values, name string) (*int64, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseInt(query.Get(name), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// auditEndpoint lists audit log entries, optionally filtered by account_id, device_id or action.
+// Entries older than a given audit ID may be requested via before, for pagination.
+func auditEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	accountId, err := optionalInt(query, "account_id")
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid account_id")
+		return
+	}
+	deviceId, err := optionalInt(query, "device_id")
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid device_id")
+		return
+	}
+	before, err := optionalInt(query, "before")
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid before")
+		return
+	}
+
+	var action *string
+	if query.Has("action") {
+		value := strings.TrimSpace(query.Get("action"))
+		action = &value
+	}
+
+	limit := DefaultAuditLimit
+	if query.Has("limit") {
+		value, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || value <= 0 || value > MaxAuditLimit {
+			writeAdminError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxAuditLimit))
+			return
+		}
+		limit = value
+	}
+
+	rows, err := pool.Query(r.Context(), QueryAuditLog, accountId, deviceId, action, before, limit)
+	if err != nil {
+		log.Printf("error querying audit log: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		err = rows.Scan(&entry.AuditId, &entry.DeviceId, &entry.AccountId, &entry.Action, &entry.ParametersHash, &entry.Date)
+		if err != nil {
+			log.Printf("error querying audit log: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
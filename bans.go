@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// QueryActiveBan returns the active ban matching the given device ID or serial number, or the serial number
+	// the device ID is registered with. Permanent bans are preferred, followed by those expiring last.
+	QueryActiveBan = `SELECT ban_id, device_id, serial_number, reason, date_banned, date_expires FROM bans
+		WHERE (device_id = $1 OR serial_number = $2 OR serial_number IN (SELECT serial_number FROM userbase WHERE device_id = $1))
+		AND (date_expires IS NULL OR date_expires > $3)
+		ORDER BY date_expires DESC NULLS FIRST
+		LIMIT 1`
+
+	QueryAllBans = `SELECT ban_id, device_id, serial_number, reason, date_banned, date_expires FROM bans
+		WHERE $1 OR date_expires IS NULL OR date_expires > $2
+		ORDER BY ban_id`
+
+	InsertBanStatement = `INSERT INTO bans (device_id, serial_number, reason, date_expires)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ban_id, date_banned`
+
+	DeleteBanStatement = `DELETE FROM bans WHERE ban_id = $1`
+
+	PurgeExpiredBansStatement = `DELETE FROM bans WHERE date_expires <= $1`
+)
+
+// ErrDeviceBanned is returned when the requesting console's device ID or serial number is banned.
+var ErrDeviceBanned = errors.New("console is banned")
+
+// Ban describes a device ID or serial number refused by the shop.
+type Ban struct {
+	BanId        int       `json:"ban_id"`
+	DeviceId     *int64    `json:"device_id"`
+	SerialNumber *string   `json:"serial_number"`
+	Reason       *string   `json:"reason"`
+	DateBanned   time.Time `json:"date_banned"`
+	// DateExpires is when this ban lapses, or nil if it is permanent.
+	DateExpires *time.Time `json:"date_expires"`
+}
+
+func init() {
+	registerTenantJob("purge-expired-bans", time.Hour, purgeExpiredBans)
+	registerAdminEndpoint("/bans", bansEndpoint)
+}
+
+// purgeExpiredBans removes bans which have lapsed.
+func purgeExpiredBans(ctx context.Context) error {
+	_, err := pool.Exec(ctx, PurgeExpiredBansStatement, time.Now().UTC())
+	return err
+}
+
+// lookupBan returns the active ban for the given console, or nil if it is not banned.
+func lookupBan(ctx context.Context, deviceId int, serialNumber string) (*Ban, error) {
+	var ban Ban
+	err := pool.QueryRow(ctx, QueryActiveBan, deviceId, serialNumber, time.Now().UTC()).Scan(&ban.BanId, &ban.DeviceId, &ban.SerialNumber, &ban.Reason, &ban.DateBanned, &ban.DateExpires)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &ban, nil
+}
+
+// enforceBan refuses this request if the console is banned, returning whether it may proceed.
+// Banned consoles are sent DeviceStatus alongside the error, as the shop presents them as blocked.
+func (e *Envelope) enforceBan() bool {
+	serialNumber, _ := e.SerialNumber()
+	ban, err := lookupBan(e.ctx, e.DeviceId(), serialNumber)
+	if err != nil {
+		log.Printf("error querying bans: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return false
+	} else if ban == nil {
+		return true
+	}
+
+	reason := "console is banned"
+	if ban.Reason != nil {
+		reason = *ban.Reason
+	}
+	e.Error(ErrorCodeDeviceBanned, reason, ErrDeviceBanned)
+	e.AddKVNode("DeviceStatus", DeviceStatusBanned)
+	return false
+}
+
+// bansEndpoint lists, creates or lifts bans.
+// Lapsed bans are only listed if all is given, until they are purged.
+func bansEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		all := r.URL.Query().Get("all") == "true"
+		rows, err := pool.Query(r.Context(), QueryAllBans, all, time.Now().UTC())
+		if err != nil {
+			log.Printf("error querying bans: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		bans := []Ban{}
+		for rows.Next() {
+			var ban Ban
+			err = rows.Scan(&ban.BanId, &ban.DeviceId, &ban.SerialNumber, &ban.Reason, &ban.DateBanned, &ban.DateExpires)
+			if err != nil {
+				log.Printf("error querying bans: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			bans = append(bans, ban)
+		}
+
+		writeJSON(w, http.StatusOK, bans)
+	case "POST":
+		var ban Ban
+		err := readJSON(r, &ban)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid ban")
+			return
+		}
+
+		if ban.DeviceId == nil && ban.SerialNumber == nil {
+			writeAdminError(w, http.StatusBadRequest, "device_id or serial_number is required")
+			return
+		}
+		if ban.DateExpires != nil {
+			if !ban.DateExpires.After(time.Now()) {
+				writeAdminError(w, http.StatusBadRequest, "date_expires must be in the future")
+				return
+			}
+			expires := ban.DateExpires.UTC()
+			ban.DateExpires = &expires
+		}
+
+		err = pool.QueryRow(r.Context(), InsertBanStatement, ban.DeviceId, ban.SerialNumber, ban.Reason, ban.DateExpires).Scan(&ban.BanId, &ban.DateBanned)
+		if err != nil {
+			log.Printf("error creating ban: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, ban)
+	case "DELETE":
+		banId, err := strconv.Atoi(r.URL.Query().Get("ban_id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "ban_id is required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), DeleteBanStatement, banId)
+		if err != nil {
+			log.Printf("error lifting ban: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "ban does not exist")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
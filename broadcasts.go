@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// BroadcastCacheTTL is how long each tenant's broadcasts are cached for, and so how long changes take to apply.
+	BroadcastCacheTTL = 30 * time.Second
+
+	// BroadcastNoticeAction is the action notices are delivered within, as the shop sends it upon starting.
+	BroadcastNoticeAction = "CheckDeviceStatus"
+
+	// QueryPendingBroadcasts returns enabled broadcasts which have not yet ended, including those scheduled to start later.
+	QueryPendingBroadcasts = `SELECT broadcast_id, message, region, blocking, enabled, starts_at, ends_at FROM broadcasts
+		WHERE enabled AND (ends_at IS NULL OR ends_at > $1)
+		ORDER BY blocking DESC, starts_at, broadcast_id`
+
+	QueryAllBroadcasts = `SELECT broadcast_id, message, region, blocking, enabled, starts_at, ends_at FROM broadcasts
+		WHERE $1 OR ends_at IS NULL OR ends_at > $2
+		ORDER BY broadcast_id`
+
+	InsertBroadcastStatement = `INSERT INTO broadcasts (message, region, blocking, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING broadcast_id, enabled`
+
+	UpdateBroadcastEnabledStatement = `UPDATE broadcasts SET enabled = $2 WHERE broadcast_id = $1`
+
+	DeleteBroadcastStatement = `DELETE FROM broadcasts WHERE broadcast_id = $1`
+
+	// DeliverBroadcastStatement records a notice as shown to a console, affecting no rows if it has been already.
+	DeliverBroadcastStatement = `INSERT INTO broadcast_deliveries (broadcast_id, device_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	PurgeEndedBroadcastsStatement = `DELETE FROM broadcasts WHERE ends_at <= $1`
+)
+
+// Broadcast is a message from operators shown to consoles, such as to announce scheduled downtime.
+type Broadcast struct {
+	BroadcastId int    `json:"broadcast_id"`
+	Message     string `json:"message"`
+	// Region limits this broadcast to consoles of a region, such as USA, or nil for all consoles.
+	Region *string `json:"region"`
+	// Blocking broadcasts are shown in place of every response as maintenance until they end.
+	// Others are shown once to each console upon starting the shop.
+	Blocking bool `json:"blocking"`
+	Enabled  bool `json:"enabled"`
+	// StartsAt is when this broadcast is first shown, defaulting to upon creation.
+	StartsAt time.Time `json:"starts_at"`
+	// EndsAt is when this broadcast is no longer shown, or nil if it is shown until removed.
+	EndsAt *time.Time `json:"ends_at"`
+}
+
+// BroadcastToggle enables or disables a broadcast.
+type BroadcastToggle struct {
+	BroadcastId int  `json:"broadcast_id"`
+	Enabled     bool `json:"enabled"`
+}
+
+// broadcasts caches the pending broadcasts of each tenant by name.
+var broadcasts = newTTLCache[string, []Broadcast]()
+
+func init() {
+	broadcasts.SetTTL(BroadcastCacheTTL)
+	registerTenantJob("purge-ended-broadcasts", time.Hour, purgeEndedBroadcasts)
+	registerAdminEndpoint("/broadcasts", broadcastsEndpoint)
+}
+
+// purgeEndedBroadcasts removes broadcasts which have ended, alongside their deliveries.
+func purgeEndedBroadcasts(ctx context.Context) error {
+	_, err := pool.Exec(ctx, PurgeEndedBroadcastsStatement, time.Now().UTC())
+	return err
+}
+
+// pendingBroadcasts returns broadcasts which have not yet ended, preferring cached values.
+func pendingBroadcasts(ctx context.Context) ([]Broadcast, error) {
+	tenant := tenantFromContext(ctx).Name
+	if cached, exists := broadcasts.Get(tenant); exists {
+		return cached, nil
+	}
+
+	rows, err := pool.Query(ctx, QueryPendingBroadcasts, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []Broadcast
+	for rows.Next() {
+		var broadcast Broadcast
+		err = rows.Scan(&broadcast.BroadcastId, &broadcast.Message, &broadcast.Region, &broadcast.Blocking, &broadcast.Enabled, &broadcast.StartsAt, &broadcast.EndsAt)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, broadcast)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	broadcasts.Set(tenant, pending)
+	return pending, nil
+}
+
+// isShownTo returns whether this broadcast is currently shown to consoles of the given region.
+func (b Broadcast) isShownTo(region string, now time.Time) bool {
+	if now.Before(b.StartsAt) || (b.EndsAt != nil && !now.Before(*b.EndsAt)) {
+		return false
+	}
+	return b.Region == nil || strings.EqualFold(*b.Region, region)
+}
+
+// showBroadcast responds with a broadcast in place of this action, returning whether one was shown.
+// Blocking broadcasts are shown as maintenance in place of any action, whereas notices are shown once to each console.
+func (e *Envelope) showBroadcast() bool {
+	pending, err := pendingBroadcasts(e.ctx)
+	if err != nil {
+		// Broadcasts are informational, and should not prevent the shop from being used.
+		log.Printf("error querying broadcasts: %v\n", err)
+		return false
+	}
+
+	now := time.Now().UTC()
+	for _, broadcast := range pending {
+		if !broadcast.isShownTo(e.Region(), now) {
+			continue
+		}
+
+		if broadcast.Blocking {
+			e.broadcast(ErrorCodeServiceUnavailable, broadcast.Message)
+			e.Body.Response.ServiceStandbyMode = true
+			return true
+		}
+
+		if e.action != BroadcastNoticeAction {
+			continue
+		}
+		result, err := pool.Exec(e.ctx, DeliverBroadcastStatement, broadcast.BroadcastId, e.DeviceId())
+		if err != nil {
+			log.Printf("error recording broadcast delivery: %v\n", err)
+			return false
+		} else if result.RowsAffected() != 0 {
+			incrementMetric("broadcasts_delivered")
+			e.broadcast(ErrorCodeBroadcast, broadcast.Message)
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast responds with the given message verbatim, regardless of the configured error style.
+func (e *Envelope) broadcast(errorCode ErrorCode, message string) {
+	e.Body.Response.ErrorCode = errorCode
+	e.Body.Response.CustomFields = nil
+	e.AddKVNode("ErrorMessage", message)
+}
+
+// broadcastsEndpoint lists, creates, toggles or removes broadcasts.
+// Ended broadcasts are only listed if all is given, until they are purged.
+func broadcastsEndpoint(w http.ResponseWriter, r *http.Request) {
+	tenant := tenantFromContext(r.Context()).Name
+
+	switch r.Method {
+	case "GET":
+		all := r.URL.Query().Get("all") == "true"
+		rows, err := pool.Query(r.Context(), QueryAllBroadcasts, all, time.Now().UTC())
+		if err != nil {
+			log.Printf("error querying broadcasts: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		list := []Broadcast{}
+		for rows.Next() {
+			var broadcast Broadcast
+			err = rows.Scan(&broadcast.BroadcastId, &broadcast.Message, &broadcast.Region, &broadcast.Blocking, &broadcast.Enabled, &broadcast.StartsAt, &broadcast.EndsAt)
+			if err != nil {
+				log.Printf("error querying broadcasts: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			list = append(list, broadcast)
+		}
+
+		writeJSON(w, http.StatusOK, list)
+	case "POST":
+		var broadcast Broadcast
+		err := readJSON(r, &broadcast)
+		if err != nil || strings.TrimSpace(broadcast.Message) == "" {
+			writeAdminError(w, http.StatusBadRequest, "message is required")
+			return
+		}
+
+		if broadcast.StartsAt.IsZero() {
+			broadcast.StartsAt = time.Now()
+		}
+		broadcast.StartsAt = broadcast.StartsAt.UTC()
+		if broadcast.EndsAt != nil {
+			if !broadcast.EndsAt.After(broadcast.StartsAt) {
+				writeAdminError(w, http.StatusBadRequest, "ends_at must be after starts_at")
+				return
+			}
+			endsAt := broadcast.EndsAt.UTC()
+			broadcast.EndsAt = &endsAt
+		}
+		if broadcast.Region != nil {
+			region := strings.ToUpper(*broadcast.Region)
+			broadcast.Region = &region
+		}
+
+		err = pool.QueryRow(r.Context(), InsertBroadcastStatement, broadcast.Message, broadcast.Region, broadcast.Blocking, broadcast.StartsAt, broadcast.EndsAt).Scan(&broadcast.BroadcastId, &broadcast.Enabled)
+		if err != nil {
+			log.Printf("error creating broadcast: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		broadcasts.Delete(tenant)
+		writeJSON(w, http.StatusCreated, broadcast)
+	case "PUT":
+		var toggle BroadcastToggle
+		err := readJSON(r, &toggle)
+		if err != nil || toggle.BroadcastId == 0 {
+			writeAdminError(w, http.StatusBadRequest, "broadcast_id is required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), UpdateBroadcastEnabledStatement, toggle.BroadcastId, toggle.Enabled)
+		if err != nil {
+			log.Printf("error toggling broadcast: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "broadcast does not exist")
+			return
+		}
+
+		broadcasts.Delete(tenant)
+		writeJSON(w, http.StatusOK, toggle)
+	case "DELETE":
+		broadcastId, err := strconv.Atoi(r.URL.Query().Get("broadcast_id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "broadcast_id is required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), DeleteBroadcastStatement, broadcastId)
+		if err != nil {
+			log.Printf("error removing broadcast: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "broadcast does not exist")
+			return
+		}
+
+		broadcasts.Delete(tenant)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cacheEntry holds a cached value alongside when it should no longer be used.
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a concurrency-safe cache whose entries expire after a fixed duration.
+// A cache with a TTL of zero stores nothing.
+type ttlCache[K comparable, V any] struct {
+	lock    sync.RWMutex
+	ttl     time.Duration
+	entries map[K]cacheEntry[V]
+}
+
+// newTTLCache returns an empty cache with the given TTL.
+func newTTLCache[K comparable, V any]() *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		entries: map[K]cacheEntry[V]{},
+	}
+}
+
+// SetTTL updates the duration entries are kept for.
+func (c *ttlCache[K, V]) SetTTL(ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ttl = ttl
+}
+
+// Get returns the value for the given key, if present and not yet expired.
+func (c *ttlCache[K, V]) Get(key K) (V, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	entry, exists := c.entries[key]
+	if !exists || time.Now().After(entry.expires) {
+		var empty V
+		return empty, false
+	}
+
+	return entry.value, true
+}
+
+// Set stores the value for the given key.
+func (c *ttlCache[K, V]) Set(key K, value V) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ttl == 0 {
+		return
+	}
+
+	c.entries[key] = cacheEntry[V]{
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// Delete removes the value for the given key.
+func (c *ttlCache[K, V]) Delete(key K) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, key)
+}
+
+// DeleteMatching removes all values for which the given function returns true.
+func (c *ttlCache[K, V]) DeleteMatching(match func(key K, value V) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, entry := range c.entries {
+		if match(key, entry.value) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear removes all values.
+func (c *ttlCache[K, V]) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[K]cacheEntry[V]{}
+}
+
+// Keys returns the keys of all values not yet expired.
+func (c *ttlCache[K, V]) Keys() []K {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	now := time.Now()
+	var keys []K
+	for key, entry := range c.entries {
+		if !now.After(entry.expires) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Prune removes all expired values.
+func (c *ttlCache[K, V]) Prune() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// syncCacheKey identifies a console by its tenant, region and device ID, as looked up during SyncRegistration.
+type syncCacheKey struct {
+	tenant   string
+	region   string
+	deviceId int
+}
+
+// syncRecord holds registration details for a console.
+type syncRecord struct {
+	accountId    int64
+	deviceToken  string
+	serialNumber string
+}
+
+// catalogCacheKey identifies a catalog listing for a pricing code within a tenant's region.
+type catalogCacheKey struct {
+	tenant      string
+	pricingCode string
+	region      string
+	country     string
+}
+
+// catalogRecord holds the item and price for a catalog listing.
+type catalogRecord struct {
+	itemId int
+	price  int
+}
+
+var (
+	syncCache    = newTTLCache[syncCacheKey, syncRecord]()
+	catalogCache = newTTLCache[catalogCacheKey, catalogRecord]()
+)
+
+func init() {
+	registerJob("prune-caches", time.Minute, pruneCaches)
+	registerTenantJob("recompute-catalog-caches", time.Minute, recomputeCatalogCache)
+}
+
+// configureCaches applies the given TTL to all caches.
+func configureCaches(ttl time.Duration) {
+	syncCache.SetTTL(ttl)
+	catalogCache.SetTTL(ttl)
+}
+
+// pruneCaches removes expired entries from all caches.
+func pruneCaches() error {
+	syncCache.Prune()
+	catalogCache.Prune()
+	priceQuotes.Prune()
+	recordedActivity.Prune()
+	sessions.Prune()
+	sessionsByCredentials.Prune()
+	return nil
+}
+
+// invalidateItem removes cached catalog listings of the given item, such as once a purchase has been counted towards its cap.
+func invalidateItem(ctx context.Context, itemId int) {
+	tenant := tenantFromContext(ctx).Name
+	catalogCache.DeleteMatching(func(key catalogCacheKey, listing catalogRecord) bool {
+		return key.tenant == tenant && listing.itemId == itemId
+	})
+}
+
+// invalidateCatalog removes every cached catalog listing of the given context's tenant.
+func invalidateCatalog(ctx context.Context) {
+	tenant := tenantFromContext(ctx).Name
+	catalogCache.DeleteMatching(func(key catalogCacheKey, _ catalogRecord) bool {
+		return key.tenant == tenant
+	})
+}
+
+// invalidateRegistration removes any cached registration for the given console, ending its sessions.
+func invalidateRegistration(ctx context.Context, region string, deviceId int) {
+	syncCache.Delete(syncCacheKey{tenant: tenantFromContext(ctx).Name, region: region, deviceId: deviceId})
+	endSessions(ctx, deviceId)
+}
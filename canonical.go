@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// strictCompatibility emits responses in the exact form Nintendo's servers did,
+// for clients sensitive to element order or formatting.
+var strictCompatibility = false
+
+// canonicalOrders lists the order fields appear within responses from Nintendo's servers, per action.
+// Fields not listed are emitted afterwards in the order they were added.
+var canonicalOrders = map[string][]string{
+	"ecs/CheckDeviceStatus":   {"Balance", "ForceSyncTime", "ExtTicketTime", "SyncTime"},
+	"ecs/ListETickets":        {"Tickets", "ForceSyncTime", "ExtTicketTime", "SyncTime"},
+	"ecs/GetETickets":         {"ETickets", "Certs", "ForceSyncTime", "ExtTicketTime", "SyncTime"},
+	"ecs/PurchaseTitle":       {"Balance", "Transactions", "SyncTime", "ETickets", "Certs", "TitleId"},
+	"ecs/ListPurchaseHistory": {"ListResultTotalSize", "Transactions"},
+	"ecs/GetECConfig": {
+		"ContentPrefixURL", "UncachedContentPrefixURL", "SystemContentPrefixURL", "SystemUncachedContentPrefixURL",
+		"EcsURL", "IasURL", "CasURL", "NusURL", "Parameters",
+	},
+	"ias/CheckRegistration":   {"OriginalSerialNumber", "DeviceStatus"},
+	"ias/GetChallenge":        {"Challenge"},
+	"ias/GetRegistrationInfo": {"AccountId", "DeviceToken", "DeviceTokenExpired", "Country", "ExtAccountId", "DeviceCode", "DeviceStatus", "Currency"},
+	"ias/SyncRegistration":    {"AccountId", "DeviceToken", "DeviceTokenExpired", "Country", "ExtAccountId", "DeviceCode", "DeviceStatus", "Currency"},
+	"ias/Register":            {"AccountId", "DeviceToken", "DeviceTokenExpired", "Country", "ExtAccountId", "DeviceCode"},
+	"cas/ListItems":           {"ListResultTotalSize", "Items"},
+	"cas/SearchItems":         {"ListResultTotalSize", "Items"},
+	"cas/ListCategories":      {"ListResultTotalSize", "Categories"},
+	"cas/ListCategoryItems":   {"ListResultTotalSize", "Items"},
+	"nus/GetSystemUpdate":     {"ContentPrefixURL", "UncachedContentPrefixURL", "TitleVersion", "UploadAuditData"},
+}
+
+// fieldName returns the element name a custom field is marshalled as.
+func fieldName(field interface{}) string {
+	if kv, ok := field.(KVField); ok {
+		return kv.XMLName.Local
+	}
+	if node, ok := field.(*Node); ok {
+		return node.XMLName.Local
+	}
+
+	value := reflect.TypeOf(field)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Slice {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return value.Name()
+	}
+
+	if name, ok := value.FieldByName("XMLName"); ok && name.Type == reflect.TypeOf(xml.Name{}) {
+		tag := strings.Split(name.Tag.Get("xml"), ",")[0]
+		if tag != "" {
+			return tag
+		}
+	}
+	return value.Name()
+}
+
+// canonicalize reorders custom fields into the canonical order for this envelope's action.
+// Fields sharing a name, such as repeated Certs, retain their relative order.
+func (e *Envelope) canonicalize() {
+	order, known := canonicalOrders[e.service+"/"+e.action]
+	if !known || e.Body.Response.ErrorCode != ErrorCodeSuccess {
+		return
+	}
+
+	positions := map[string]int{}
+	for index, name := range order {
+		positions[name] = index
+	}
+
+	position := func(field interface{}) int {
+		if index, listed := positions[fieldName(field)]; listed {
+			return index
+		}
+		return len(order)
+	}
+
+	fields := e.Body.Response.CustomFields
+	sort.SliceStable(fields, func(i, j int) bool {
+		return position(fields[i]) < position(fields[j])
+	})
+}
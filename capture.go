@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// captureDirectory is where exchanges are recorded to. Capturing is disabled if empty.
+var captureDirectory string
+
+// tokenRedaction matches device tokens within requests and responses, regardless of namespace prefix.
+var tokenRedaction = regexp.MustCompile(`(<(?:\w+:)?DeviceToken>)[^<]*(</(?:\w+:)?DeviceToken>)`)
+
+// Capture represents a recorded request alongside the response we sent.
+type Capture struct {
+	Time       time.Time `json:"time"`
+	SOAPAction string    `json:"soap_action"`
+	Path       string    `json:"path"`
+	Request    string    `json:"request"`
+	Status     int       `json:"status"`
+	Response   string    `json:"response"`
+}
+
+// redactTokens replaces all device tokens within the given contents.
+func redactTokens(contents string) string {
+	return tokenRedaction.ReplaceAllString(contents, "${1}REDACTED${2}")
+}
+
+// captureExchange writes the given exchange to the capture directory, if enabled.
+func captureExchange(r *http.Request, request []byte, status int, response string) {
+	if captureDirectory == "" {
+		return
+	}
+
+	capture := Capture{
+		Time:       time.Now().UTC(),
+		SOAPAction: r.Header.Get("SOAPAction"),
+		Path:       r.URL.Path,
+		Request:    redactTokens(string(request)),
+		Status:     status,
+		Response:   redactTokens(response),
+	}
+
+	contents, err := json.MarshalIndent(capture, "", "  ")
+	if err != nil {
+		log.Printf("unable to marshal capture: %v", err)
+		return
+	}
+
+	_, action := parseAction(capture.SOAPAction)
+	name := fmt.Sprintf("%d-%s.json", capture.Time.UnixNano(), action)
+	err = os.WriteFile(filepath.Join(captureDirectory, name), contents, 0644)
+	if err != nil {
+		log.Printf("unable to write capture: %v", err)
+	}
+}
+
+// replayCommand re-sends captured requests against a running server.
+// Device tokens within captures are redacted, so the server should likely have authentication disabled.
+func replayCommand(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	server := flags.String("server", "http://127.0.0.1:8080", "base URL of the server to replay against")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap replay [-server url] capture.json...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range flags.Args() {
+		contents, err := os.ReadFile(path)
+		checkError(err)
+
+		var capture Capture
+		err = json.Unmarshal(contents, &capture)
+		checkError(err)
+
+		request, err := http.NewRequest("POST", *server+capture.Path, bytes.NewBufferString(capture.Request))
+		checkError(err)
+		request.Header.Set("SOAPAction", capture.SOAPAction)
+		request.Header.Set("Content-Type", "text/xml; charset=utf-8")
+
+		response, err := http.DefaultClient.Do(request)
+		checkError(err)
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		checkError(err)
+
+		fmt.Printf("==> %s (%s): %d, originally %d\n%s\n", path, capture.SOAPAction, response.StatusCode, capture.Status, body)
+	}
+}
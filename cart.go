@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/wii-tools/wadlib"
+	"log"
+	"strconv"
+	"time"
+)
+
+// MaxCartItems bounds how many items may be purchased within a single request.
+const MaxCartItems = 16
+
+// cartItem is a single item within a multi-item purchase.
+type cartItem struct {
+	itemId  int
+	titleId string
+	version int
+	price   int
+	ticket  []byte
+}
+
+// isCartPurchase returns whether this request purchases several items at once.
+func (e *Envelope) isCartPurchase() bool {
+	itemIds, err := e.getKeys("ItemId")
+	return err == nil && len(itemIds) > 1
+}
+
+// cartItems returns the items within a multi-item purchase, pairing each ItemId with the TitleId at the same position.
+func (e *Envelope) cartItems() ([]cartItem, error) {
+	itemIds, err := e.getKeys("ItemId")
+	if err != nil {
+		return nil, err
+	}
+	titleIds, err := e.getKeys("TitleId")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(itemIds) != len(titleIds) {
+		return nil, errors.New("each item must be accompanied by a title ID")
+	}
+	if len(itemIds) > MaxCartItems {
+		return nil, errors.New("too many items within purchase")
+	}
+
+	items := make([]cartItem, len(itemIds))
+	seen := map[int]bool{}
+	for i := range itemIds {
+		itemId, err := strconv.Atoi(itemIds[i].InnerText())
+		if err != nil {
+			return nil, err
+		}
+		if seen[itemId] {
+			return nil, errors.New("item is present within purchase more than once")
+		}
+		seen[itemId] = true
+
+		items[i] = cartItem{itemId: itemId, titleId: titleIds[i].InnerText()}
+	}
+	return items, nil
+}
+
+// purchaseCart purchases several titles at once, as sent by the shop within a single PurchaseTitle.
+func purchaseCart(e *Envelope, accountId int64) {
+	items, err := e.cartItems()
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "invalid items", err)
+		return
+	}
+
+	titleIds := make([]string, len(items))
+	for i, item := range items {
+		titleIds[i] = item.titleId
+	}
+	bundled, ok := e.enforceDependencies(accountId, titleIds)
+	if !ok {
+		return
+	}
+
+	purchaseItems(e, accountId, append(bundled, items...))
+}
+
+// purchaseItems purchases the given items together.
+// All items are validated and priced beforehand, and the combined price is debited while issuing every ticket in one transaction,
+// so that either all titles are purchased or none are.
+func purchaseItems(e *Envelope, accountId int64, items []cartItem) {
+	total := 0
+	for i := range items {
+		item := &items[i]
+
+		// Service titles require subscription records specific to each purchase, and must be bought alone.
+		if item.titleId == WiinoMaServiceTitleID {
+			e.Error(ErrorCodeGenericFailure, "title must be purchased alone", nil)
+			return
+		}
+
+		if !e.enforceRating(item.titleId) {
+			return
+		}
+
+		app, err := lookupTitle(e.ctx, item.titleId)
+		if err != nil {
+			e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+			return
+		}
+		if app == nil {
+			e.Error(ErrorCodeTitleUnavailable, "title does not exist", nil)
+			return
+		}
+		item.version = app.Shop.Version
+
+		// Each item must sell the title paired with it, as its price, window and cap are enforced by item.
+		if !e.verifyItem(item.itemId, item.titleId) {
+			return
+		}
+
+		item.price, err = itemPrice(e.ctx, item.itemId)
+		if err == nil {
+			item.price, err = e.chargedPrice(item.titleId, item.itemId, item.price, PERMANENT)
+		}
+		if err != nil {
+			log.Printf("error querying item price: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+			return
+		}
+		total += item.price
+
+		ticketStruct, err := newTitleTicket(e.ctx, item.titleId)
+		if err != nil {
+			e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+			return
+		}
+
+		ticket := new(bytes.Buffer)
+		err = writeTicket(e.ctx, ticket, ticketStruct)
+		if err != nil {
+			e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
+			return
+		}
+		item.ticket = ticket.Bytes()
+	}
+
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	transactionIds := make([]int, len(items))
+	for i, item := range items {
+		err = claimItem(e.ctx, tx, item.itemId)
+		if err == ErrItemUnavailable {
+			e.Error(ErrorCodeTitleUnavailable, "unable to purchase title", err)
+			return
+		} else if err != nil {
+			log.Printf("unexpected error claiming item: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+			return
+		}
+
+		_, err = tx.Exec(e.ctx, AssociateTicketStatement, accountId, item.titleId, item.version, item.itemId, time.Now().UTC())
+		if err != nil {
+			log.Printf("unexpected error purchasing: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+			return
+		}
+
+		transactionIds[i], err = recordTransaction(e.ctx, tx, Transaction{
+			AccountId: accountId,
+			Type:      TransactionPurchase,
+			TitleId:   item.titleId,
+			ItemId:    item.itemId,
+			TotalPaid: item.price,
+		})
+		if err != nil {
+			log.Printf("error recording transaction: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+			return
+		}
+	}
+
+	err = debitPoints(e.ctx, tx, accountId, total)
+	if err == ErrInsufficientPoints {
+		e.Error(ErrorCodeGenericFailure, "unable to purchase titles", err)
+		return
+	} else if err != nil {
+		log.Printf("error debiting points: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("unexpected error purchasing: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+	for _, item := range items {
+		invalidateItem(e.ctx, item.itemId)
+	}
+
+	if total != 0 {
+		emitEvent(e.ctx, EventPointsRedeemed, PointsRedeemedEvent{
+			AccountId: formatAccountId(accountId),
+			Amount:    total,
+			Reason:    "purchase",
+		})
+	}
+	for _, item := range items {
+		emitEvent(e.ctx, EventTitlePurchased, TitlePurchasedEvent{
+			AccountId:   formatAccountId(accountId),
+			TitleId:     item.titleId,
+			ItemId:      item.itemId,
+			LicenseKind: PERMANENT,
+		})
+	}
+
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
+	for i, item := range items {
+		e.AddCustomType(Transactions{
+			TransactionId: formatTransactionId(transactionIds[i]),
+			Date:          e.Timestamp(),
+			Type:          TransactionPurchase,
+			TotalPaid:     item.price,
+			Currency:      "POINTS",
+			ItemId:        item.itemId,
+			ItemPricing:   e.ItemPrice(item.itemId, item.price, PR, PERMANENT),
+			TitleId:       item.titleId,
+		})
+	}
+	e.AddKVNode("SyncTime", e.Timestamp())
+
+	// Each ticket is expected to have two other certificates associated.
+	for _, item := range items {
+		e.AddKVNode("ETickets", b64(append(item.ticket, wadlib.CertChainTemplate...)))
+	}
+	// Two cert types must be present.
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	for _, item := range items {
+		e.AddKVNode("TitleId", item.titleId)
+	}
+}
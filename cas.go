@@ -1,24 +1,187 @@
 package main
 
-import "log"
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"strconv"
+)
 
-const QueryTitlesTableByPriceCode = `SELECT item_id, price FROM service_titles WHERE price_code = $1`
+// registerCAS registers all actions handled by the Cataloging service.
+func registerCAS(r *Route) {
+	cas := r.HandleGroup("cas")
+	{
+		cas.Authenticated("ListItems", listItems, "TitleId", "AttributeFilters", "ListResultOffset", "ListResultLimit")
+		cas.Authenticated("SearchItems", searchItems, "SearchString", "ListResultOffset", "ListResultLimit")
+		cas.Authenticated("ListCategories", listCategories, "ParentCategoryId", "ListResultOffset", "ListResultLimit")
+		cas.Authenticated("ListCategoryItems", listCategoryItems, "CategoryId", "ListResultOffset", "ListResultLimit")
+	}
+}
+
+// lookupCatalogListing returns the item and price for a pricing code within a region, preferring cached values.
+func lookupCatalogListing(ctx context.Context, pricingCode string, region string, country string) (catalogRecord, error) {
+	key := catalogCacheKey{tenant: tenantFromContext(ctx).Name, pricingCode: pricingCode, region: region, country: country}
+	if listing, cached := catalogCache.Get(key); cached {
+		return listing, nil
+	}
+
+	var listing catalogRecord
+	err := replica.QueryRow(ctx, QueryRegionalTitleByPriceCode, pricingCode, region, country).Scan(&listing.itemId, &listing.price)
+	if err != nil {
+		return catalogRecord{}, err
+	}
+
+	catalogCache.Set(key, listing)
+	return listing, nil
+}
+
+// recomputeCatalogCache re-queries every listing cached for this tenant, so that long-lived entries
+// reflect price and availability changes made outside of this process, such as via import-titles.
+// Listings no longer available are removed.
+func recomputeCatalogCache(ctx context.Context) error {
+	tenant := tenantFromContext(ctx).Name
+	for _, key := range catalogCache.Keys() {
+		if key.tenant != tenant {
+			continue
+		}
+
+		var listing catalogRecord
+		err := replica.QueryRow(ctx, QueryRegionalTitleByPriceCode, key.pricingCode, key.region, key.country).Scan(&listing.itemId, &listing.price)
+		if err == pgx.ErrNoRows {
+			catalogCache.Delete(key)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		catalogCache.Set(key, listing)
+	}
+	return nil
+}
+
+// listCatalogItems responds with a page of the items returned by the given query, alongside their total count.
+// The query must return the item ID, title ID, title version, price and total number of matches for each row,
+// and accept the page's limit and offset as its final parameters following those given.
+// Its ordering must be unique per item, so that consecutive pages neither repeat nor skip items.
+func (e *Envelope) listCatalogItems(offset int, limit int, query string, args ...interface{}) {
+	rows, err := replica.Query(e.ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+		return
+	}
+	defer rows.Close()
+
+	total := 0
+	var items []Items
+	var prices []int
+	for rows.Next() {
+		var itemId, version, price int
+		var titleId string
+		err = rows.Scan(&itemId, &titleId, &version, &price, &total)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+			return
+		}
+
+		items = append(items, Items{
+			TitleId: titleId,
+			Contents: ContentsMetadata{
+				TitleIncluded: false,
+				ContentIndex:  0,
+			},
+			Attributes: []Attributes{
+				{
+					Name:  "TitleVersion",
+					Value: strconv.Itoa(version),
+				},
+				{
+					Name:  "Prices",
+					Value: "1",
+				},
+			},
+			Prices: Prices{ItemId: itemId},
+		})
+		prices = append(prices, price)
+	}
+	if rows.Err() != nil {
+		log.Printf("error executing statement: %v\n", rows.Err())
+		e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+		return
+	}
+	rows.Close()
+
+	// Pages past the end have no rows to count within, yet the console relies upon the total to stop paginating.
+	if len(items) == 0 && offset > 0 {
+		var itemId, version, price int
+		var titleId string
+		err = replica.QueryRow(e.ctx, query, append(args, 1, 0)...).Scan(&itemId, &titleId, &version, &price, &total)
+		if err != nil && err != pgx.ErrNoRows {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+			return
+		}
+	}
+
+	// Ratings, localized names and discounts are presented alongside each item, as they are within ListItems.
+	for i := range items {
+		items[i].Ratings, err = e.titleRatings(items[i].TitleId)
+		if err != nil {
+			log.Printf("error while querying title rating: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+			return
+		}
+
+		localized, err := e.localizedAttributes(items[i].TitleId)
+		if err != nil {
+			log.Printf("error while querying title localization: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+			return
+		}
+		items[i].Attributes = append(items[i].Attributes, localized...)
+
+		dependencies, err := e.dependencyAttributes(items[i].TitleId)
+		if err != nil {
+			log.Printf("error while querying title dependencies: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+			return
+		}
+		items[i].Attributes = append(items[i].Attributes, dependencies...)
+
+		itemId := items[i].Prices.ItemId
+		price, err := e.quotePrice(items[i].TitleId, itemId, prices[i], PERMANENT)
+		if err != nil {
+			log.Printf("error while querying discounts: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error listing titles", nil)
+			return
+		}
+		items[i].Prices = e.ItemPrice(itemId, price, PR, PERMANENT)
+	}
+
+	e.AddKVNode("ListResultTotalSize", strconv.Itoa(total))
+	for _, item := range items {
+		e.AddCustomType(item)
+	}
+}
 
 func listItems(e *Envelope) {
 	titleId, err := e.getKey("TitleId")
 	if err != nil {
-		e.Error(9, "Unable to obtain title.", err)
+		e.Error(ErrorCodeTitleUnavailable, "Unable to obtain title.", err)
+		return
 	}
 
 	attrs, err := e.getKeys("AttributeFilters")
 	if err != nil {
-		e.Error(5, "AttributeFilters key did not exist!", err)
+		e.Error(ErrorCodeInvalidRequest, "AttributeFilters key did not exist!", err)
+		return
 	}
 
 	var licenceStr string
 	var pricingCode string
 	for _, attr := range attrs {
-		name, value := parseNameValue(attr.InnerText())
+		name, value := parseNameValue(attr)
 		if name == "TitleKind" {
 			licenceStr = value
 		} else if name == "PricingCode" {
@@ -29,29 +192,86 @@ func listItems(e *Envelope) {
 	// Now validate
 	licenceKind, err := GetLicenceKind(licenceStr)
 	if err != nil {
-		e.Error(5, "Invalid TitleKind was passed by SOAP", err)
+		e.Error(ErrorCodeInvalidRequest, "Invalid TitleKind was passed by SOAP", err)
+		return
 	}
 
-	// Query the titles table to get our title
-	row := pool.QueryRow(ctx, QueryTitlesTableByPriceCode, pricingCode)
-
-	var itemId int
-	var price int
-	err = row.Scan(&itemId, &price)
+	// Query the titles table to get our title as available within this region.
+	listing, err := lookupCatalogListing(e.ctx, pricingCode, e.Region(), e.Country())
 	if err != nil {
 		log.Printf("error while querying titles table: %v", err)
-		e.Error(2, "error retrieving title", nil)
+		e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
 		return
 	}
+	itemId := listing.itemId
+	price := listing.price
 
+	if !e.enforceRating(titleId) {
+		return
+	}
+
+	ratings, err := e.titleRatings(titleId)
+	if err != nil {
+		log.Printf("error while querying title rating: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
+		return
+	}
+
+	localized, err := e.localizedAttributes(titleId)
+	if err != nil {
+		log.Printf("error while querying title localization: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
+		return
+	}
+
+	dependencies, err := e.dependencyAttributes(titleId)
+	if err != nil {
+		log.Printf("error while querying title dependencies: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
+		return
+	}
+
+	var prices Prices
+	if *licenceKind == RENTAL {
+		terms, err := lookupRentalTerms(e.ctx, itemId)
+		if err == ErrNotRentable {
+			e.Error(ErrorCodeTitleUnavailable, "title is not available for rental", err)
+			return
+		} else if err != nil {
+			log.Printf("error while querying rental terms: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
+			return
+		}
+
+		terms.Price, err = e.quotePrice(titleId, itemId, terms.Price, RENTAL)
+		if err != nil {
+			log.Printf("error while querying discounts: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
+			return
+		}
+		prices = e.RentalPrice(itemId, terms)
+	} else {
+		price, err = e.quotePrice(titleId, itemId, price, *licenceKind)
+		if err != nil {
+			log.Printf("error while querying discounts: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error retrieving title", nil)
+			return
+		}
+		prices = e.ItemPrice(itemId, price, PR, *licenceKind)
+	}
+
+	// A single item is listed, which is omitted should the client request a later page.
 	e.AddKVNode("ListResultTotalSize", "1")
+	if offset, end := e.paginate(1); offset == end {
+		return
+	}
 	e.AddCustomType(Items{
 		TitleId: titleId,
 		Contents: ContentsMetadata{
 			TitleIncluded: false,
 			ContentIndex:  0,
 		},
-		Attributes: []Attributes{
+		Attributes: append([]Attributes{
 			{
 				Name:  "TitleVersion",
 				Value: "0",
@@ -60,20 +280,8 @@ func listItems(e *Envelope) {
 				Name:  "Prices",
 				Value: "1",
 			},
-		},
-		Ratings: Ratings{
-			Name:   "E",
-			Rating: 1,
-			Age:    9,
-		},
-		Prices: Prices{
-			ItemId: itemId,
-			Price: Price{
-				Amount:   price,
-				Currency: "POINTS",
-			},
-			Limits:      LimitStruct(PR),
-			LicenseKind: *licenceKind,
-		},
+		}, append(localized, dependencies...)...),
+		Ratings: ratings,
+		Prices:  prices,
 	})
 }
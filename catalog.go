@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+const (
+	// QueryRegionalTitleByPriceCode returns the item and price for a title available to the given region and country.
+	// Titles without any regional entries are considered available everywhere at their default price.
+	// Country-specific entries take precedence over those applying to an entire region.
+	// Titles outside of their availability window or sold out are not listed.
+	QueryRegionalTitleByPriceCode = `SELECT service_titles.item_id, COALESCE(service_title_regions.price, service_titles.price)
+		FROM service_titles
+		LEFT JOIN service_title_regions
+			ON service_title_regions.item_id = service_titles.item_id
+			AND service_title_regions.region = $2
+			AND (service_title_regions.country IS NULL OR service_title_regions.country = $3)
+		WHERE service_titles.price_code = $1
+		AND (service_titles.available_from IS NULL OR service_titles.available_from <= now())
+		AND (service_titles.available_until IS NULL OR service_titles.available_until > now())
+		AND (service_titles.purchase_limit IS NULL OR service_titles.purchase_count < service_titles.purchase_limit)
+		AND (service_title_regions.item_id IS NOT NULL
+			OR NOT EXISTS (SELECT 1 FROM service_title_regions WHERE service_title_regions.item_id = service_titles.item_id))
+		ORDER BY service_title_regions.country NULLS LAST
+		LIMIT 1`
+
+	// QueryRegionalItemAvailability determines whether an item may be purchased within the given region and country.
+	QueryRegionalItemAvailability = `SELECT 1 FROM service_titles
+		WHERE service_titles.item_id = $1
+		AND (NOT EXISTS (SELECT 1 FROM service_title_regions WHERE service_title_regions.item_id = $1)
+			OR EXISTS (SELECT 1 FROM service_title_regions
+				WHERE service_title_regions.item_id = $1
+				AND service_title_regions.region = $2
+				AND (service_title_regions.country IS NULL OR service_title_regions.country = $3)))`
+
+	// ClaimItemStatement counts a purchase towards an item's cap, provided it is on sale and in stock.
+	ClaimItemStatement = `UPDATE service_titles SET purchase_count = purchase_count + 1
+		WHERE item_id = $1
+		AND (available_from IS NULL OR available_from <= $2)
+		AND (available_until IS NULL OR available_until > $2)
+		AND (purchase_limit IS NULL OR purchase_count < purchase_limit)`
+
+	// ReleaseItemStatement returns a purchase counted by ClaimItemStatement, such as upon a refund.
+	ReleaseItemStatement = `UPDATE service_titles SET purchase_count = purchase_count - 1
+		WHERE item_id = $1 AND purchase_count > 0`
+
+	QueryItemListed = `SELECT 1 FROM service_titles WHERE item_id = $1`
+
+	QueryItemTitle = `SELECT title_id FROM service_titles WHERE item_id = $1`
+
+	// QueryTitleListed returns whether a title is listed for sale via an item of its own.
+	QueryTitleListed = `SELECT EXISTS (SELECT 1 FROM service_titles WHERE title_id = $1)`
+)
+
+// ErrItemUnavailable is returned when an item is outside of its availability window, or has sold out.
+var ErrItemUnavailable = errors.New("item is not currently on sale")
+
+// ErrItemMismatch is returned when purchasing an item alongside a title it does not sell.
+var ErrItemMismatch = errors.New("item does not sell the requested title")
+
+// claimItem records a purchase of the given item within a transaction, enforcing its availability window and purchase cap.
+// Items not listed within service_titles, such as hosted services, are never limited.
+// Titles listed for sale are held to their own items beforehand via verifyItem, so that another item cannot evade their limits.
+func claimItem(ctx context.Context, tx pgx.Tx, itemId int) error {
+	result, err := tx.Exec(ctx, ClaimItemStatement, itemId, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() != 0 {
+		return nil
+	}
+
+	var throwaway int
+	err = tx.QueryRow(ctx, QueryItemListed, itemId).Scan(&throwaway)
+	if err == pgx.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return ErrItemUnavailable
+}
+
+// releaseItem returns a purchase of the given item towards its cap within a transaction.
+func releaseItem(ctx context.Context, tx pgx.Tx, itemId int) error {
+	_, err := tx.Exec(ctx, ReleaseItemStatement, itemId)
+	return err
+}
+
+// isItemAvailable returns whether the given item is available for purchase in the region and country of this request.
+func (e *Envelope) isItemAvailable(itemId int) (bool, error) {
+	var throwaway int
+	err := pool.QueryRow(e.ctx, QueryRegionalItemAvailability, itemId, e.Region(), e.Country()).Scan(&throwaway)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// verifyItem ensures a title listed for sale is purchased via an item selling it, available within this request's region,
+// responding with an error and returning false otherwise.
+// Prices, windows and caps of listed titles are enforced by item, so they must never be issued for an item selling another.
+// Titles without a listing of their own, such as those from the OSC API or federated upstreams, may be purchased via any item,
+// such as one shared by a pricing code, whose window and cap claimItem continues to enforce.
+func (e *Envelope) verifyItem(itemId int, titleId string) bool {
+	var listed bool
+	err := pool.QueryRow(e.ctx, QueryTitleListed, titleId).Scan(&listed)
+	if err != nil {
+		log.Printf("unexpected error querying item: %v", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return false
+	} else if !listed {
+		return true
+	}
+
+	var listedTitleId string
+	err = pool.QueryRow(e.ctx, QueryItemTitle, itemId).Scan(&listedTitleId)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("unexpected error querying item: %v", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return false
+	}
+
+	if listedTitleId != titleId {
+		e.Error(ErrorCodeTitleUnavailable, "item does not sell this title", ErrItemMismatch)
+		return false
+	}
+
+	available, err := e.isItemAvailable(itemId)
+	if err != nil {
+		log.Printf("unexpected error checking item availability: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return false
+	}
+	if !available {
+		e.Error(ErrorCodeGenericFailure, "item is not available in this region", nil)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestPurchaseSharedItem purchases a title known only to the OSC API via an item shared by a pricing code,
+// as ListItems offers it, and ensures titles listed for sale cannot be purchased via another title's item.
+func TestPurchaseSharedItem(t *testing.T) {
+	const (
+		oscTitleId    = "0001000148414241"
+		sharedTitleId = "0001000148414C45"
+		listedTitleId = "0001000148414D45"
+	)
+
+	osc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[{"shop": {"title_id": %q, "title_version": 1}}]`, oscTitleId)
+	}))
+	t.Cleanup(osc.Close)
+	defer func(url string) {
+		oscAPIUrl = url
+	}(oscAPIUrl)
+	oscAPIUrl = osc.URL
+
+	server := startServer(t, startDatabase(t))
+	_, err := pool.Exec(ctx, `INSERT INTO service_titles (item_id, price_code, price, title_id) VALUES (1, 1, 0, $1), (2, 2, 0, $2)`, sharedTitleId, listedTitleId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := testclient.New(server.URL, testclient.DefaultConsole)
+	for _, name := range []string{"ias/GetChallenge", "ias/Register", "ias/SyncRegistration"} {
+		request, _ := testclient.Lookup(name)
+		response, err := client.Send(request)
+		if err != nil {
+			t.Fatal(err)
+		} else if response.ErrorCode != 0 {
+			t.Fatalf("%s: %d %s", name, response.ErrorCode, response.ErrorMessage)
+		}
+	}
+
+	purchase := func(itemId string, titleId string) *testclient.Response {
+		response, err := client.Call("ecs", "PurchaseTitle", []testclient.Field{
+			testclient.Value("ItemId", itemId),
+			testclient.Value("TitleId", titleId),
+			testclient.Value("ReferenceId", "00000000000000000000000000000000"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if response := purchase("1", oscTitleId); response.ErrorCode != 0 {
+		t.Errorf("purchasing an OSC title via a shared item: %d %s", response.ErrorCode, response.ErrorMessage)
+	}
+	if response := purchase("1", listedTitleId); response.ErrorCode != int(ErrorCodeTitleUnavailable) {
+		t.Errorf("purchasing a listed title via another item: got %d %s, want %d", response.ErrorCode, response.ErrorMessage, ErrorCodeTitleUnavailable)
+	}
+	if response := purchase("2", listedTitleId); response.ErrorCode != 0 {
+		t.Errorf("purchasing a listed title via its item: %d %s", response.ErrorCode, response.ErrorMessage)
+	}
+}
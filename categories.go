@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/jackc/pgconn"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// DefaultCategoryLimit is how many titles within a category are returned unless the client requests otherwise.
+	DefaultCategoryLimit = 20
+	// MaxCategoryLimit is the most titles within a category returned at once.
+	MaxCategoryLimit = 100
+
+	// QueryCategories lists the children of the given category, or root categories if null.
+	// Title counts include those assigned to any descendant, with titles assigned to several only counted once.
+	QueryCategories = `WITH RECURSIVE subtree AS (
+			SELECT category_id AS root_id, category_id FROM categories
+			UNION ALL
+			SELECT subtree.root_id, categories.category_id
+			FROM categories JOIN subtree ON categories.parent_id = subtree.category_id
+		)
+		SELECT categories.category_id, categories.parent_id, categories.name,
+			(SELECT count(*) FROM categories AS children WHERE children.parent_id = categories.category_id),
+			(SELECT count(DISTINCT category_titles.title_id) FROM subtree
+				JOIN category_titles ON category_titles.category_id = subtree.category_id
+				WHERE subtree.root_id = categories.category_id)
+		FROM categories
+		WHERE categories.parent_id IS NOT DISTINCT FROM $1
+		ORDER BY categories.position, categories.name, categories.category_id`
+
+	// QueryCategoryTitles lists items assigned to a category which are available within the given region and country.
+	// Each row additionally includes the total number of items, prior to pagination.
+	QueryCategoryTitles = `SELECT item_id, title_id, version, price, count(*) OVER ()
+		FROM (
+			SELECT DISTINCT ON (service_titles.item_id) service_titles.item_id, service_titles.title_id,
+				COALESCE(titles.version, 0) AS version, titles.name,
+				COALESCE(service_title_regions.price, service_titles.price) AS price
+			FROM category_titles
+			JOIN service_titles ON service_titles.title_id = category_titles.title_id
+			LEFT JOIN titles ON titles.title_id = service_titles.title_id
+			LEFT JOIN service_title_regions
+				ON service_title_regions.item_id = service_titles.item_id
+				AND service_title_regions.region = $2
+				AND (service_title_regions.country IS NULL OR service_title_regions.country = $3)
+			WHERE category_titles.category_id = $1
+			AND (service_titles.available_from IS NULL OR service_titles.available_from <= now())
+			AND (service_titles.available_until IS NULL OR service_titles.available_until > now())
+			AND (service_titles.purchase_limit IS NULL OR service_titles.purchase_count < service_titles.purchase_limit)
+			AND (service_title_regions.item_id IS NOT NULL
+				OR NOT EXISTS (SELECT 1 FROM service_title_regions WHERE service_title_regions.item_id = service_titles.item_id))
+			ORDER BY service_titles.item_id, service_title_regions.country NULLS LAST
+		) AS listings
+		ORDER BY name, item_id
+		LIMIT $4 OFFSET $5`
+
+	QueryAllCategories = `SELECT category_id, parent_id, name, position FROM categories ORDER BY parent_id NULLS FIRST, position, name`
+
+	InsertCategoryStatement = `INSERT INTO categories (parent_id, name, position) VALUES ($1, $2, $3) RETURNING category_id`
+
+	UpdateCategoryStatement = `UPDATE categories SET parent_id = $2, name = $3, position = $4 WHERE category_id = $1`
+
+	DeleteCategoryStatement = `DELETE FROM categories WHERE category_id = $1`
+
+	// QueryCategoryWithin determines whether the second category is the first, or any of its descendants.
+	QueryCategoryWithin = `WITH RECURSIVE subtree AS (
+			SELECT $1::integer AS category_id
+			UNION ALL
+			SELECT categories.category_id FROM categories JOIN subtree ON categories.parent_id = subtree.category_id
+		)
+		SELECT EXISTS (SELECT 1 FROM subtree WHERE category_id = $2)`
+
+	QueryCategoryTitleIds = `SELECT title_id FROM category_titles WHERE category_id = $1 ORDER BY title_id`
+
+	AssignCategoryTitleStatement = `INSERT INTO category_titles (category_id, title_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	UnassignCategoryTitleStatement = `DELETE FROM category_titles WHERE category_id = $1 AND title_id = $2`
+)
+
+// Categories describes a single category within ListCategories.
+type Categories struct {
+	XMLName          xml.Name `xml:"Categories"`
+	CategoryId       int      `xml:"CategoryId"`
+	ParentCategoryId int      `xml:"ParentCategoryId,omitempty"`
+	Name             string   `xml:"Name"`
+	ChildCount       int      `xml:"ChildCount"`
+	TitleCount       int      `xml:"TitleCount"`
+}
+
+// Category describes a category within the admin API.
+type Category struct {
+	CategoryId int `json:"category_id"`
+	// ParentId is the category containing this category, or nil at the root.
+	ParentId *int   `json:"parent_id"`
+	Name     string `json:"name"`
+	// Position orders categories sharing a parent, ascending.
+	Position int `json:"position"`
+}
+
+// CategoryTitle assigns a title to a category.
+type CategoryTitle struct {
+	CategoryId int    `json:"category_id"`
+	TitleId    string `json:"title_id"`
+}
+
+func init() {
+	registerAdminEndpoint("/categories", categoriesEndpoint)
+	registerAdminEndpoint("/categories/titles", categoryTitlesEndpoint)
+}
+
+// listCategories lists the subcategories of the requested category, or all root categories.
+func listCategories(e *Envelope) {
+	var parentId *int
+	if value, err := e.getKey("ParentCategoryId"); err == nil && value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			e.Error(ErrorCodeInvalidRequest, "invalid parent category ID", err)
+			return
+		}
+		parentId = &parsed
+	}
+
+	rows, err := replica.Query(e.ctx, QueryCategories, parentId)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "error listing categories", nil)
+		return
+	}
+	defer rows.Close()
+
+	var categories []Categories
+	for rows.Next() {
+		var category Categories
+		var parent *int
+		err = rows.Scan(&category.CategoryId, &parent, &category.Name, &category.ChildCount, &category.TitleCount)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "error listing categories", nil)
+			return
+		}
+		if parent != nil {
+			category.ParentCategoryId = *parent
+		}
+		categories = append(categories, category)
+	}
+	if rows.Err() != nil {
+		log.Printf("error executing statement: %v\n", rows.Err())
+		e.Error(ErrorCodeGenericFailure, "error listing categories", nil)
+		return
+	}
+
+	offset, end := e.paginate(len(categories))
+	e.AddKVNode("ListResultTotalSize", strconv.Itoa(len(categories)))
+	e.AddCustomType(categories[offset:end])
+}
+
+// listCategoryItems lists items assigned to the requested category.
+func listCategoryItems(e *Envelope) {
+	value, err := e.getKey("CategoryId")
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "missing category ID", err)
+		return
+	}
+
+	categoryId, err := strconv.Atoi(value)
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "invalid category ID", err)
+		return
+	}
+
+	offset, limit := e.listPagination(DefaultCategoryLimit, MaxCategoryLimit)
+	e.listCatalogItems(offset, limit, QueryCategoryTitles, categoryId, e.Region(), e.Country())
+}
+
+// categoriesEndpoint lists, creates, updates or removes categories.
+func categoriesEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rows, err := pool.Query(r.Context(), QueryAllCategories)
+		if err != nil {
+			log.Printf("error querying categories: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		categories := []Category{}
+		for rows.Next() {
+			var category Category
+			err = rows.Scan(&category.CategoryId, &category.ParentId, &category.Name, &category.Position)
+			if err != nil {
+				log.Printf("error querying categories: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			categories = append(categories, category)
+		}
+
+		writeJSON(w, http.StatusOK, categories)
+	case "POST":
+		var category Category
+		err := readJSON(r, &category)
+		if err != nil || category.Name == "" {
+			writeAdminError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+
+		err = pool.QueryRow(r.Context(), InsertCategoryStatement, category.ParentId, category.Name, category.Position).Scan(&category.CategoryId)
+		if driverErr, ok := err.(*pgconn.PgError); ok && driverErr.Code == "23503" {
+			writeAdminError(w, http.StatusNotFound, "parent category does not exist")
+			return
+		} else if err != nil {
+			log.Printf("error creating category: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		invalidateCatalog(r.Context())
+		writeJSON(w, http.StatusCreated, category)
+	case "PUT":
+		var category Category
+		err := readJSON(r, &category)
+		if err != nil || category.CategoryId == 0 || category.Name == "" {
+			writeAdminError(w, http.StatusBadRequest, "category_id and name are required")
+			return
+		}
+
+		// Categories cannot be moved beneath themselves.
+		if category.ParentId != nil {
+			var within bool
+			err = pool.QueryRow(r.Context(), QueryCategoryWithin, category.CategoryId, *category.ParentId).Scan(&within)
+			if err != nil {
+				log.Printf("error querying categories: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			} else if within {
+				writeAdminError(w, http.StatusBadRequest, "a category cannot be its own descendant")
+				return
+			}
+		}
+
+		result, err := pool.Exec(r.Context(), UpdateCategoryStatement, category.CategoryId, category.ParentId, category.Name, category.Position)
+		if driverErr, ok := err.(*pgconn.PgError); ok && driverErr.Code == "23503" {
+			writeAdminError(w, http.StatusNotFound, "parent category does not exist")
+			return
+		} else if err != nil {
+			log.Printf("error updating category: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "category does not exist")
+			return
+		}
+
+		invalidateCatalog(r.Context())
+		writeJSON(w, http.StatusOK, category)
+	case "DELETE":
+		categoryId, err := strconv.Atoi(r.URL.Query().Get("category_id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "category_id is required")
+			return
+		}
+
+		_, err = pool.Exec(r.Context(), DeleteCategoryStatement, categoryId)
+		if driverErr, ok := err.(*pgconn.PgError); ok && driverErr.Code == "23503" {
+			writeAdminError(w, http.StatusConflict, "category has subcategories")
+			return
+		} else if err != nil {
+			log.Printf("error removing category: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		invalidateCatalog(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// categoryTitlesEndpoint lists, assigns or unassigns titles within a category.
+// A title may be assigned to any number of categories.
+func categoryTitlesEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		categoryId, err := strconv.Atoi(r.URL.Query().Get("category_id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "category_id is required")
+			return
+		}
+
+		rows, err := pool.Query(r.Context(), QueryCategoryTitleIds, categoryId)
+		if err != nil {
+			log.Printf("error querying category titles: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		defer rows.Close()
+
+		titleIds := []string{}
+		for rows.Next() {
+			var titleId string
+			err = rows.Scan(&titleId)
+			if err != nil {
+				log.Printf("error querying category titles: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			titleIds = append(titleIds, titleId)
+		}
+
+		writeJSON(w, http.StatusOK, titleIds)
+	case "PUT":
+		var assignment CategoryTitle
+		err := readJSON(r, &assignment)
+		if err != nil || assignment.CategoryId == 0 || assignment.TitleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "category_id and title_id are required")
+			return
+		}
+
+		_, err = pool.Exec(r.Context(), AssignCategoryTitleStatement, assignment.CategoryId, assignment.TitleId)
+		if driverErr, ok := err.(*pgconn.PgError); ok && driverErr.Code == "23503" {
+			writeAdminError(w, http.StatusNotFound, "category does not exist")
+			return
+		} else if err != nil {
+			log.Printf("error assigning category title: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		invalidateCatalog(r.Context())
+		writeJSON(w, http.StatusOK, assignment)
+	case "DELETE":
+		query := r.URL.Query()
+		categoryId, err := strconv.Atoi(query.Get("category_id"))
+		if err != nil || query.Get("title_id") == "" {
+			writeAdminError(w, http.StatusBadRequest, "category_id and title_id are required")
+			return
+		}
+
+		_, err = pool.Exec(r.Context(), UnassignCategoryTitleStatement, categoryId, query.Get("title_id"))
+		if err != nil {
+			log.Printf("error unassigning category title: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		invalidateCatalog(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
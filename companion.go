@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// CompanionServiceName is the gRPC service companion services call.
+const CompanionServiceName = "wiisoap.Companion"
+
+// CompanionConfig configures the gRPC API for companion services, such as bots or web shop front-ends.
+type CompanionConfig struct {
+	// Address may be a TCP address, or a Unix socket path prefixed with unix:.
+	Address string `xml:"Address"`
+	// Certificate and Key enable TLS. Plaintext is only suitable for Unix sockets or loopback addresses.
+	Certificate string `xml:"Certificate"`
+	Key         string `xml:"Key"`
+	// ClientCA is a PEM bundle of authorities whose client certificates are accepted, enabling mutual TLS.
+	ClientCA string `xml:"ClientCA"`
+	// APIKeys are accepted as bearer tokens within the authorization metadata.
+	APIKeys []string `xml:"APIKey"`
+}
+
+// jsonCodec encodes gRPC messages as JSON, so that messages need not be generated from protobuf definitions.
+// Clients must request the json content subtype.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// LookupAccountRequest names an account to look up.
+type LookupAccountRequest struct {
+	AccountId int64 `json:"account_id"`
+}
+
+// GrantTitleResponse confirms a title was granted.
+type GrantTitleResponse struct{}
+
+// companionServiceDesc describes the methods of CompanionServiceName.
+// They mirror the equivalent admin API endpoints.
+var companionServiceDesc = grpc.ServiceDesc{
+	ServiceName: CompanionServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		companionMethod("LookupAccount", companionLookupAccount),
+		companionMethod("GrantTitle", companionGrantTitle),
+		companionMethod("AdjustBalance", companionAdjustBalance),
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// companionMethod adapts a typed handler to a gRPC method.
+func companionMethod[Req any, Resp any](name string, handler func(ctx context.Context, request *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(_ interface{}, ctx context.Context, decode func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := new(Req)
+			if err := decode(request); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+
+			call := func(ctx context.Context, request interface{}) (interface{}, error) {
+				return handler(ctx, request.(*Req))
+			}
+			if interceptor == nil {
+				return call(ctx, request)
+			}
+
+			info := &grpc.UnaryServerInfo{FullMethod: "/" + CompanionServiceName + "/" + name}
+			return interceptor(ctx, request, info, call)
+		},
+	}
+}
+
+// serveCompanion exposes the companion gRPC API at the configured address in the background.
+// Callers must present a client certificate issued by the configured authority, or one of the configured API keys.
+// Requests apply to the default tenant unless another is named via TenantHeader within metadata.
+func serveCompanion(config CompanionConfig) {
+	// Unset keys within configuration must never match an absent key.
+	var keys []string
+	for _, key := range config.APIKeys {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	config.APIKeys = keys
+
+	if config.ClientCA == "" && len(config.APIKeys) == 0 {
+		log.Fatalf("A client CA or API key must be configured to serve the companion API.")
+	}
+
+	options := []grpc.ServerOption{
+		grpc.ForceServerCodec(jsonCodec{}),
+		grpc.UnaryInterceptor(companionInterceptor(config)),
+	}
+	if config.Certificate != "" {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			log.Fatalf("Unable to configure TLS for the companion API: %v", err)
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(options...)
+	server.RegisterService(&companionServiceDesc, struct{}{})
+
+	network, address := "tcp", config.Address
+	if strings.HasPrefix(config.Address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(config.Address, "unix:")
+		// Remove any socket left behind by a previous run.
+		os.Remove(address)
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatalf("Unable to listen for the companion API: %v", err)
+	}
+
+	go func() {
+		log.Printf("Serving companion API at %s", config.Address)
+		err := server.Serve(listener)
+		if err != nil {
+			log.Printf("unable to serve companion API: %v", err)
+		}
+	}()
+}
+
+// tlsConfig returns the TLS configuration for the companion API.
+// Client certificates are verified against ClientCA if given, and required unless API keys are also accepted.
+func (c CompanionConfig) tlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA == "" {
+		return config, nil
+	}
+
+	contents, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(contents) {
+		return nil, errors.New("no certificates found within the client CA bundle")
+	}
+
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(c.APIKeys) != 0 {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// companionInterceptor authenticates each call, selects its tenant and records it within the audit log.
+func companionInterceptor(config CompanionConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !config.authenticated(ctx) {
+			return nil, status.Error(codes.Unauthenticated, "unauthorized")
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		if names := md.Get(strings.ToLower(TenantHeader)); len(names) != 0 {
+			tenant := lookupTenant(names[0])
+			if tenant == nil {
+				return nil, status.Error(codes.NotFound, "unknown tenant")
+			}
+			ctx = withTenant(ctx, tenant)
+		}
+
+		log.Printf("[companion] %s", info.FullMethod)
+		err := recordAudit(ctx, pool, AuditEntry{
+			Action:         "companion" + strings.TrimPrefix(info.FullMethod, "/"+CompanionServiceName),
+			ParametersHash: hashParameters(request),
+		})
+		if err != nil {
+			log.Printf("error recording audit entry for companion request: %v\n", err)
+		}
+
+		return handler(ctx, request)
+	}
+}
+
+// authenticated returns whether the caller presented a verified client certificate or a configured API key.
+func (c CompanionConfig) authenticated(ctx context.Context) bool {
+	if caller, ok := peer.FromContext(ctx); ok {
+		if info, ok := caller.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) != 0 {
+			return true
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		key := strings.TrimPrefix(value, "Bearer ")
+		for _, allowed := range c.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(allowed)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// companionError converts errors from account operations to gRPC statuses.
+func companionError(err error) error {
+	switch err {
+	case ErrUnknownAccount:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrTitleOwned:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case ErrInsufficientPoints:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	log.Printf("error handling companion request: %v\n", err)
+	return status.Error(codes.Internal, "database error")
+}
+
+func companionLookupAccount(ctx context.Context, request *LookupAccountRequest) (*Account, error) {
+	if request.AccountId == 0 {
+		return nil, status.Error(codes.InvalidArgument, "account_id is required")
+	}
+
+	account, err := lookupAccount(ctx, request.AccountId)
+	if err != nil {
+		return nil, companionError(err)
+	}
+	return account, nil
+}
+
+func companionGrantTitle(ctx context.Context, request *GrantRequest) (*GrantTitleResponse, error) {
+	if request.AccountId == 0 || request.TitleId == "" {
+		return nil, status.Error(codes.InvalidArgument, "account_id and title_id are required")
+	}
+
+	err := grantTitle(ctx, *request)
+	if err != nil {
+		return nil, companionError(err)
+	}
+	return &GrantTitleResponse{}, nil
+}
+
+func companionAdjustBalance(ctx context.Context, request *BalanceAdjustment) (*AccountBalance, error) {
+	if request.AccountId == 0 {
+		return nil, status.Error(codes.InvalidArgument, "account_id is required")
+	}
+
+	balance, err := adjustBalance(ctx, *request)
+	if err != nil {
+		return nil, companionError(err)
+	}
+	return &AccountBalance{AccountId: request.AccountId, Balance: balance}, nil
+}
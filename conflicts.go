@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Policies for registrations from consoles whose device ID or serial number is already registered.
+const (
+	// DuplicatesReuse returns the existing account to a console re-registering with the same device ID,
+	// serial number and region, such as after a NAND restore, and refuses any other duplicate.
+	DuplicatesReuse = "reuse"
+	// DuplicatesReject refuses every registration for a device ID or serial number already registered.
+	DuplicatesReject = "reject"
+	// DuplicatesAllowSerials behaves as DuplicatesReuse, but permits a serial number to be registered
+	// by more than one device ID, such as for consoles whose motherboard has been replaced.
+	DuplicatesAllowSerials = "allow-serials"
+)
+
+// QueryConflictingRegistrations returns registrations sharing either the given device ID or serial number.
+const QueryConflictingRegistrations = `SELECT account_id, device_id, serial_number, region FROM userbase
+	WHERE device_id = $1 OR serial_number = $2
+	ORDER BY account_id`
+
+var (
+	// ErrDeviceRegistered is returned when the registering device ID belongs to another console.
+	ErrDeviceRegistered = errors.New("device ID is registered to another console")
+	// ErrSerialRegistered is returned when the registering serial number belongs to another device ID.
+	ErrSerialRegistered = errors.New("serial number is registered to another console")
+	// ErrAlreadyRegistered is returned when re-registration is refused under DuplicatesReject.
+	ErrAlreadyRegistered = errors.New("console is already registered")
+)
+
+// duplicateRegistrations is the configured policy for duplicate registrations.
+var duplicateRegistrations = DuplicatesReuse
+
+// loadDuplicateRegistrations applies the given policy, defaulting to DuplicatesReuse.
+func loadDuplicateRegistrations(policy string) error {
+	switch policy {
+	case "":
+		duplicateRegistrations = DuplicatesReuse
+	case DuplicatesReuse, DuplicatesReject, DuplicatesAllowSerials:
+		duplicateRegistrations = policy
+	default:
+		return fmt.Errorf("DuplicateRegistrations must be %s, %s or %s", DuplicatesReuse, DuplicatesReject, DuplicatesAllowSerials)
+	}
+	return nil
+}
+
+// checkDuplicateRegistration determines how a registration conflicts with those existing.
+// It returns whether the same console is re-registering and should be given its existing account,
+// or an error describing why the registration is refused. Neither indicates the console is unregistered.
+func checkDuplicateRegistration(ctx context.Context, deviceId int, serialNumber string, region string) (bool, error) {
+	rows, err := pool.Query(ctx, QueryConflictingRegistrations, deviceId, serialNumber)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	reregistering := false
+	for rows.Next() {
+		var accountId int64
+		var registeredDeviceId int
+		var registeredSerial, registeredRegion *string
+		err = rows.Scan(&accountId, &registeredDeviceId, &registeredSerial, &registeredRegion)
+		if err != nil {
+			return false, err
+		}
+
+		sameSerial := registeredSerial != nil && *registeredSerial == serialNumber
+		sameRegion := registeredRegion != nil && *registeredRegion == region
+		switch {
+		case registeredDeviceId == deviceId && sameSerial && sameRegion:
+			if duplicateRegistrations == DuplicatesReject {
+				return false, ErrAlreadyRegistered
+			}
+			reregistering = true
+		case registeredDeviceId == deviceId:
+			return false, ErrDeviceRegistered
+		case duplicateRegistrations != DuplicatesAllowSerials:
+			return false, ErrSerialRegistered
+		}
+	}
+
+	return reregistering, rows.Err()
+}
@@ -56,7 +56,7 @@ func LimitStruct(kind LimitKinds) Limits {
 	}
 
 	return Limits{
-		Limits:    kind,
+		Limits:    int(kind),
 		LimitKind: names[kind],
 	}
 }
@@ -72,6 +72,8 @@ type DeviceStatus string
 const (
 	DeviceStatusRegistered   = "R"
 	DeviceStatusUnregistered = "U"
+	// DeviceStatusBanned is specific to WiiSOAP, sent to consoles refused via bans.
+	DeviceStatusBanned = "B"
 )
 
 // TokenType represents a way to distinguish between ST- (unhashed)
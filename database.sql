@@ -20,6 +20,261 @@ SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: account_id_seq; Type: SEQUENCE; Schema: public; Owner: wiisoap
+--
+
+CREATE SEQUENCE public.account_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    MINVALUE 1
+    MAXVALUE 900000000
+    NO CYCLE
+    CACHE 1;
+
+
+ALTER TABLE public.account_id_seq OWNER TO wiisoap;
+
+--
+-- Name: allowlist; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.allowlist (
+                                  entry_id serial NOT NULL,
+                                  device_id bigint,
+                                  serial_number character varying(12),
+                                  note text,
+                                  date_added timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.allowlist OWNER TO wiisoap;
+
+--
+-- Name: audit_log; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.audit_log (
+                                  audit_id bigserial NOT NULL,
+                                  device_id bigint,
+                                  account_id integer,
+                                  action character varying(64) NOT NULL,
+                                  parameters_hash character varying(64) NOT NULL,
+                                  date timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.audit_log OWNER TO wiisoap;
+
+--
+-- Name: bans; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.bans (
+                             ban_id serial NOT NULL,
+                             device_id bigint,
+                             serial_number character varying(12),
+                             reason text,
+                             date_banned timestamp without time zone DEFAULT now() NOT NULL,
+                             date_expires timestamp without time zone
+);
+
+
+ALTER TABLE public.bans OWNER TO wiisoap;
+
+--
+-- Name: broadcast_deliveries; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.broadcast_deliveries (
+                                             broadcast_id integer NOT NULL,
+                                             device_id bigint NOT NULL,
+                                             date_delivered timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.broadcast_deliveries OWNER TO wiisoap;
+
+--
+-- Name: broadcasts; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.broadcasts (
+                                   broadcast_id serial NOT NULL,
+                                   message text NOT NULL,
+                                   region character varying(3),
+                                   blocking boolean DEFAULT false NOT NULL,
+                                   enabled boolean DEFAULT true NOT NULL,
+                                   starts_at timestamp without time zone DEFAULT now() NOT NULL,
+                                   ends_at timestamp without time zone,
+                                   date_created timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.broadcasts OWNER TO wiisoap;
+
+--
+-- Name: categories; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.categories (
+                                   category_id serial NOT NULL,
+                                   parent_id integer,
+                                   name character varying(64) NOT NULL,
+                                   "position" integer DEFAULT 0 NOT NULL
+);
+
+
+ALTER TABLE public.categories OWNER TO wiisoap;
+
+--
+-- Name: category_titles; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.category_titles (
+                                        category_id integer NOT NULL,
+                                        title_id character varying(16) NOT NULL
+);
+
+
+ALTER TABLE public.category_titles OWNER TO wiisoap;
+
+--
+-- Name: daily_stats; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.daily_stats (
+                                    day date NOT NULL,
+                                    registrations integer DEFAULT 0 NOT NULL,
+                                    active_devices integer DEFAULT 0 NOT NULL,
+                                    purchases integer DEFAULT 0 NOT NULL,
+                                    points_redeemed bigint DEFAULT 0 NOT NULL
+);
+
+
+ALTER TABLE public.daily_stats OWNER TO wiisoap;
+
+--
+-- Name: daily_title_stats; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.daily_title_stats (
+                                          day date NOT NULL,
+                                          title_id character varying(16) NOT NULL,
+                                          purchases integer DEFAULT 0 NOT NULL,
+                                          points_redeemed bigint DEFAULT 0 NOT NULL
+);
+
+
+ALTER TABLE public.daily_title_stats OWNER TO wiisoap;
+
+--
+-- Name: device_activity; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.device_activity (
+                                        day date NOT NULL,
+                                        account_id integer NOT NULL
+);
+
+
+ALTER TABLE public.device_activity OWNER TO wiisoap;
+
+--
+-- Name: discounts; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.discounts (
+                                  discount_id serial NOT NULL,
+                                  title_id character varying(16),
+                                  category_id integer,
+                                  percent_off integer,
+                                  points_off integer,
+                                  starts_at timestamp without time zone NOT NULL,
+                                  ends_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.discounts OWNER TO wiisoap;
+
+--
+-- Name: downloaded_contents; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.downloaded_contents (
+                                            account_id integer NOT NULL,
+                                            title_id character varying(16) NOT NULL,
+                                            version integer NOT NULL,
+                                            content_id character varying(8) NOT NULL,
+                                            date_downloaded timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.downloaded_contents OWNER TO wiisoap;
+
+--
+-- Name: fraud_holds; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.fraud_holds (
+                                    hold_id serial NOT NULL,
+                                    account_id integer,
+                                    rule character varying(64) NOT NULL,
+                                    points integer NOT NULL,
+                                    status character varying(16) DEFAULT 'pending'::character varying NOT NULL,
+                                    date_held timestamp without time zone DEFAULT now() NOT NULL,
+                                    date_reviewed timestamp without time zone
+);
+
+
+ALTER TABLE public.fraud_holds OWNER TO wiisoap;
+
+--
+-- Name: gifts; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.gifts (
+                              gift_id serial NOT NULL,
+                              sender_account_id integer NOT NULL,
+                              recipient_device_code character varying(16) NOT NULL,
+                              title_id character varying(16) NOT NULL,
+                              item_id integer,
+                              price integer NOT NULL,
+                              date_sent timestamp without time zone DEFAULT now() NOT NULL,
+                              date_received timestamp without time zone
+);
+
+
+ALTER TABLE public.gifts OWNER TO wiisoap;
+
+--
+-- Name: link_codes; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.link_codes (
+                                   code character varying(8) NOT NULL,
+                                   account_id integer NOT NULL,
+                                   date_expires timestamp without time zone NOT NULL,
+                                   purpose character varying(16) DEFAULT 'link'::character varying NOT NULL
+);
+
+
+ALTER TABLE public.link_codes OWNER TO wiisoap;
+
+--
+-- Name: linked_accounts; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.linked_accounts (
+                                        account_id integer NOT NULL,
+                                        provider character varying(32) NOT NULL,
+                                        external_id character varying(64) NOT NULL,
+                                        date_linked timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.linked_accounts OWNER TO wiisoap;
+
 --
 -- Name: owned_titles; Type: TABLE; Schema: public; Owner: wiisoap
 --
@@ -29,27 +284,190 @@ CREATE TABLE public.owned_titles (
                                      title_id character varying(16) NOT NULL,
                                      version integer,
                                      item_id integer,
-                                     date_purchased timestamp without time zone DEFAULT now() NOT NULL
+                                     date_purchased timestamp without time zone DEFAULT now() NOT NULL,
+                                     date_expires timestamp without time zone,
+                                     date_reissued timestamp without time zone,
+                                     key_id integer
 );
 
 
 ALTER TABLE public.owned_titles OWNER TO wiisoap;
 
+--
+-- Name: point_cards; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.point_cards (
+                                    code_hash character varying(64) NOT NULL,
+                                    points integer NOT NULL,
+                                    campaign character varying(64),
+                                    date_created timestamp without time zone DEFAULT now() NOT NULL,
+                                    date_expires timestamp without time zone,
+                                    account_id integer,
+                                    date_redeemed timestamp without time zone
+);
+
+
+ALTER TABLE public.point_cards OWNER TO wiisoap;
+
+--
+-- Name: recovery_codes; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.recovery_codes (
+                                       account_id integer NOT NULL,
+                                       code_hash character varying(64) NOT NULL,
+                                       date_created timestamp without time zone DEFAULT now() NOT NULL,
+                                       date_used timestamp without time zone
+);
+
+
+ALTER TABLE public.recovery_codes OWNER TO wiisoap;
+
 --
 -- Name: service_titles; Type: TABLE; Schema: public; Owner: wiisoap
 --
 
 CREATE TABLE public.service_titles (
-                               item_id integer NOT NULL,
+                               item_id serial NOT NULL,
                                price_code integer NOT NULL,
                                price integer NOT NULL,
                                title_id character varying(16) NOT NULL,
-                               reference_id character varying(32)
+                               reference_id character varying(32),
+                               rental_price integer,
+                               rental_days integer DEFAULT 2 NOT NULL,
+                               available_from timestamp without time zone,
+                               available_until timestamp without time zone,
+                               purchase_limit integer,
+                               purchase_count integer DEFAULT 0 NOT NULL
 );
 
 
 ALTER TABLE public.service_titles OWNER TO wiisoap;
 
+--
+-- Name: service_title_regions; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.service_title_regions (
+                               item_id integer NOT NULL,
+                               region character varying(3) NOT NULL,
+                               country character varying(2),
+                               price integer
+);
+
+
+ALTER TABLE public.service_title_regions OWNER TO wiisoap;
+
+--
+-- Name: subscriptions; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.subscriptions (
+                                      subscription_id serial NOT NULL,
+                                      account_id integer NOT NULL,
+                                      title_id character varying(16) NOT NULL,
+                                      item_id integer,
+                                      date_start timestamp without time zone DEFAULT now() NOT NULL,
+                                      date_end timestamp without time zone NOT NULL,
+                                      date_renewed timestamp without time zone
+);
+
+
+ALTER TABLE public.subscriptions OWNER TO wiisoap;
+
+--
+-- Name: ticket_keys; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.ticket_keys (
+                                    key_id serial NOT NULL,
+                                    common_key character varying(32),
+                                    signing_key text,
+                                    active boolean DEFAULT false NOT NULL,
+                                    date_added timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.ticket_keys OWNER TO wiisoap;
+
+--
+-- Name: title_dependencies; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.title_dependencies (
+                                      title_id character varying(16) NOT NULL,
+                                      required_title_id character varying(16) NOT NULL
+);
+
+
+ALTER TABLE public.title_dependencies OWNER TO wiisoap;
+
+--
+-- Name: title_localizations; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.title_localizations (
+                                      title_id character varying(16) NOT NULL,
+                                      language character varying(16) NOT NULL,
+                                      name character varying(64) NOT NULL,
+                                      description text
+);
+
+
+ALTER TABLE public.title_localizations OWNER TO wiisoap;
+
+--
+-- Name: title_ratings; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.title_ratings (
+                                      title_id character varying(16) NOT NULL,
+                                      rating_name character varying(16) NOT NULL,
+                                      age integer NOT NULL
+);
+
+
+ALTER TABLE public.title_ratings OWNER TO wiisoap;
+
+--
+-- Name: titles; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.titles (
+                               title_id character varying(16) NOT NULL,
+                               version integer NOT NULL,
+                               name character varying(64),
+                               description text,
+                               content_size bigint NOT NULL,
+                               content_count integer NOT NULL,
+                               date_imported timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.titles OWNER TO wiisoap;
+
+--
+-- Name: transactions; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.transactions (
+                                     transaction_id serial NOT NULL,
+                                     account_id integer,
+                                     type character varying(16) NOT NULL,
+                                     title_id character varying(16) NOT NULL,
+                                     item_id integer NOT NULL,
+                                     total_paid integer DEFAULT 0 NOT NULL,
+                                     reference_id character varying(32),
+                                     date timestamp without time zone DEFAULT now() NOT NULL,
+                                     date_refunded timestamp without time zone,
+                                     refund_reason text,
+                                     sandbox boolean DEFAULT false NOT NULL
+);
+
+
+ALTER TABLE public.transactions OWNER TO wiisoap;
+
 --
 -- Name: userbase; Type: TABLE; Schema: public; Owner: wiisoap
 --
@@ -57,93 +475,780 @@ ALTER TABLE public.service_titles OWNER TO wiisoap;
 CREATE TABLE public.userbase (
                                  device_id bigint NOT NULL,
                                  device_token character varying(21) NOT NULL,
-                                 device_token_hashed character varying(32) NOT NULL,
+                                 device_token_hashed character varying(71) NOT NULL,
                                  account_id integer NOT NULL,
                                  region character varying(3),
-                                 serial_number character varying(12)
+                                 serial_number character varying(12),
+                                 device_code character varying(16),
+                                 balance integer DEFAULT 2147483647 NOT NULL,
+                                 sync_version bigint DEFAULT 0 NOT NULL,
+                                 console_model character varying(16),
+                                 manufacturing_region character varying(16),
+                                 parental_age_limit integer,
+                                 date_erased timestamp without time zone,
+                                 date_registered timestamp without time zone DEFAULT now() NOT NULL,
+                                 sandbox boolean DEFAULT false NOT NULL
 );
 
 
 ALTER TABLE public.userbase OWNER TO wiisoap;
 
 --
--- Data for Name: owned_titles; Type: TABLE DATA; Schema: public; Owner: wiisoap
+-- Data for Name: allowlist; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-COPY public.owned_titles (account_id, title_id, version, item_id, date_purchased) FROM stdin;
+COPY public.allowlist (entry_id, device_id, serial_number, note, date_added) FROM stdin;
 \.
 
 --
--- Data for Name: service_titles; Type: TABLE DATA; Schema: public; Owner: wiisoap
+-- Data for Name: audit_log; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-COPY public.service_titles (item_id, price_code, price, title_id, reference_id) FROM stdin;
+COPY public.audit_log (audit_id, device_id, account_id, action, parameters_hash, date) FROM stdin;
 \.
 
+--
+-- Data for Name: bans; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.bans (ban_id, device_id, serial_number, reason, date_banned, date_expires) FROM stdin;
+\.
 
 --
--- Data for Name: userbase; Type: TABLE DATA; Schema: public; Owner: wiisoap
+-- Data for Name: broadcast_deliveries; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.broadcast_deliveries (broadcast_id, device_id, date_delivered) FROM stdin;
+\.
+
+--
+-- Data for Name: broadcasts; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-COPY public.userbase (device_id, device_token, device_token_hashed, account_id, region, serial_number) FROM stdin;
+COPY public.broadcasts (broadcast_id, message, region, blocking, enabled, starts_at, ends_at, date_created) FROM stdin;
 \.
 
 
 --
--- Name: service_titles item_id; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+-- Data for Name: categories; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-ALTER TABLE ONLY public.service_titles
-    ADD CONSTRAINT item_id PRIMARY KEY (item_id);
+COPY public.categories (category_id, parent_id, name, "position") FROM stdin;
+\.
 
 --
--- Name: service_titles service_titles_reference_id_key; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+-- Data for Name: category_titles; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-ALTER TABLE ONLY public.service_titles
-    ADD CONSTRAINT service_titles_reference_id_key UNIQUE (reference_id);
+COPY public.category_titles (category_id, title_id) FROM stdin;
+\.
 
 --
--- Name: userbase userbase_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+-- Data for Name: daily_stats; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-ALTER TABLE ONLY public.userbase
-    ADD CONSTRAINT userbase_pk PRIMARY KEY (account_id);
+COPY public.daily_stats (day, registrations, active_devices, purchases, points_redeemed) FROM stdin;
+\.
 
+--
+-- Data for Name: daily_title_stats; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.daily_title_stats (day, title_id, purchases, points_redeemed) FROM stdin;
+\.
 
 --
--- Name: owned_titles_account_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+-- Data for Name: device_activity; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-CREATE INDEX owned_titles_account_id_uindex ON public.owned_titles USING btree (account_id);
+COPY public.device_activity (day, account_id) FROM stdin;
+\.
+
+--
+-- Data for Name: discounts; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
 
+COPY public.discounts (discount_id, title_id, category_id, percent_off, points_off, starts_at, ends_at) FROM stdin;
+\.
 
 --
--- Name: userbase_account_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+-- Data for Name: downloaded_contents; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-CREATE UNIQUE INDEX userbase_account_id_uindex ON public.userbase USING btree (account_id);
+COPY public.downloaded_contents (account_id, title_id, version, content_id, date_downloaded) FROM stdin;
+\.
+
+--
+-- Data for Name: fraud_holds; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
 
+COPY public.fraud_holds (hold_id, account_id, rule, points, status, date_held, date_reviewed) FROM stdin;
+\.
 
 --
--- Name: userbase_device_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+-- Data for Name: gifts; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-CREATE UNIQUE INDEX userbase_device_id_uindex ON public.userbase USING btree (device_id);
+COPY public.gifts (gift_id, sender_account_id, recipient_device_code, title_id, item_id, price, date_sent, date_received) FROM stdin;
+\.
+
+--
+-- Data for Name: link_codes; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
 
+COPY public.link_codes (code, account_id, date_expires, purpose) FROM stdin;
+\.
 
 --
--- Name: userbase_device_token_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+-- Data for Name: linked_accounts; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-CREATE UNIQUE INDEX userbase_device_token_uindex ON public.userbase USING btree (device_token);
+COPY public.linked_accounts (account_id, provider, external_id, date_linked) FROM stdin;
+\.
 
 --
--- Name: owned_titles order_account_ids; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+-- Data for Name: owned_titles; Type: TABLE DATA; Schema: public; Owner: wiisoap
 --
 
-ALTER TABLE ONLY public.owned_titles
-    ADD CONSTRAINT order_account_ids FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+COPY public.owned_titles (account_id, title_id, version, item_id, date_purchased, date_expires, date_reissued, key_id) FROM stdin;
+\.
+
+--
+-- Data for Name: point_cards; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.point_cards (code_hash, points, campaign, date_created, date_expires, account_id, date_redeemed) FROM stdin;
+\.
+
+--
+-- Data for Name: recovery_codes; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.recovery_codes (account_id, code_hash, date_created, date_used) FROM stdin;
+\.
+
+--
+-- Data for Name: service_titles; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.service_titles (item_id, price_code, price, title_id, reference_id, rental_price, rental_days, available_from, available_until, purchase_limit, purchase_count) FROM stdin;
+\.
+
+
+--
+-- Data for Name: service_title_regions; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.service_title_regions (item_id, region, country, price) FROM stdin;
+\.
+
+
+--
+-- Data for Name: subscriptions; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.subscriptions (subscription_id, account_id, title_id, item_id, date_start, date_end, date_renewed) FROM stdin;
+\.
+
+
+--
+-- Data for Name: ticket_keys; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.ticket_keys (key_id, common_key, signing_key, active, date_added) FROM stdin;
+\.
+
+--
+-- Data for Name: title_dependencies; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.title_dependencies (title_id, required_title_id) FROM stdin;
+\.
+
+--
+-- Data for Name: title_localizations; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.title_localizations (title_id, language, name, description) FROM stdin;
+\.
+
+
+--
+-- Data for Name: title_ratings; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.title_ratings (title_id, rating_name, age) FROM stdin;
+\.
+
+
+--
+-- Data for Name: titles; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.titles (title_id, version, name, description, content_size, content_count, date_imported) FROM stdin;
+\.
+
+
+--
+-- Data for Name: transactions; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.transactions (transaction_id, account_id, type, title_id, item_id, total_paid, reference_id, date, date_refunded, refund_reason, sandbox) FROM stdin;
+\.
+
+
+--
+-- Data for Name: userbase; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+COPY public.userbase (device_id, device_token, device_token_hashed, account_id, region, serial_number, device_code, balance, sync_version, console_model, manufacturing_region, parental_age_limit, date_erased, date_registered, sandbox) FROM stdin;
+\.
+
+
+--
+-- Name: account_id_seq; Type: SEQUENCE SET; Schema: public; Owner: wiisoap
+--
+
+SELECT pg_catalog.setval('public.account_id_seq', 1, false);
+
+
+--
+-- Name: allowlist allowlist_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.allowlist
+    ADD CONSTRAINT allowlist_pk PRIMARY KEY (entry_id);
+
+--
+-- Name: audit_log audit_log_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.audit_log
+    ADD CONSTRAINT audit_log_pk PRIMARY KEY (audit_id);
+
+--
+-- Name: bans bans_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.bans
+    ADD CONSTRAINT bans_pk PRIMARY KEY (ban_id);
+
+--
+-- Name: broadcast_deliveries broadcast_deliveries_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.broadcast_deliveries
+    ADD CONSTRAINT broadcast_deliveries_pk PRIMARY KEY (broadcast_id, device_id);
+
+--
+-- Name: broadcasts broadcasts_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.broadcasts
+    ADD CONSTRAINT broadcasts_pk PRIMARY KEY (broadcast_id);
+
+--
+-- Name: categories categories_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.categories
+    ADD CONSTRAINT categories_pk PRIMARY KEY (category_id);
+
+
+--
+-- Name: category_titles category_titles_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.category_titles
+    ADD CONSTRAINT category_titles_pk PRIMARY KEY (category_id, title_id);
+
+
+--
+-- Name: daily_stats daily_stats_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.daily_stats
+    ADD CONSTRAINT daily_stats_pk PRIMARY KEY (day);
+
+
+--
+-- Name: daily_title_stats daily_title_stats_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.daily_title_stats
+    ADD CONSTRAINT daily_title_stats_pk PRIMARY KEY (day, title_id);
+
+
+--
+-- Name: device_activity device_activity_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.device_activity
+    ADD CONSTRAINT device_activity_pk PRIMARY KEY (day, account_id);
+
+
+--
+-- Name: discounts discounts_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.discounts
+    ADD CONSTRAINT discounts_pk PRIMARY KEY (discount_id);
+
+
+--
+-- Name: downloaded_contents downloaded_contents_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.downloaded_contents
+    ADD CONSTRAINT downloaded_contents_pk PRIMARY KEY (account_id, title_id, version, content_id);
+
+
+--
+-- Name: fraud_holds fraud_holds_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.fraud_holds
+    ADD CONSTRAINT fraud_holds_pk PRIMARY KEY (hold_id);
+
+
+--
+-- Name: gifts gifts_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.gifts
+    ADD CONSTRAINT gifts_pk PRIMARY KEY (gift_id);
+
+--
+-- Name: link_codes link_codes_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.link_codes
+    ADD CONSTRAINT link_codes_pk PRIMARY KEY (code);
+
+--
+-- Name: linked_accounts linked_accounts_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.linked_accounts
+    ADD CONSTRAINT linked_accounts_pk PRIMARY KEY (provider, external_id);
+
+--
+-- Name: point_cards point_cards_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.point_cards
+    ADD CONSTRAINT point_cards_pk PRIMARY KEY (code_hash);
+
+--
+-- Name: recovery_codes recovery_codes_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.recovery_codes
+    ADD CONSTRAINT recovery_codes_pk PRIMARY KEY (code_hash);
+
+--
+-- Name: service_titles item_id; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.service_titles
+    ADD CONSTRAINT item_id PRIMARY KEY (item_id);
+
+--
+-- Name: service_titles service_titles_reference_id_key; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.service_titles
+    ADD CONSTRAINT service_titles_reference_id_key UNIQUE (reference_id);
+
+--
+-- Name: subscriptions subscriptions_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.subscriptions
+    ADD CONSTRAINT subscriptions_pk PRIMARY KEY (subscription_id);
+
+--
+-- Name: ticket_keys ticket_keys_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.ticket_keys
+    ADD CONSTRAINT ticket_keys_pk PRIMARY KEY (key_id);
+
+
+--
+-- Name: title_dependencies title_dependencies_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.title_dependencies
+    ADD CONSTRAINT title_dependencies_pk PRIMARY KEY (title_id, required_title_id);
+
+
+--
+-- Name: title_localizations title_localizations_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.title_localizations
+    ADD CONSTRAINT title_localizations_pk PRIMARY KEY (title_id, language);
+
+--
+-- Name: title_ratings title_ratings_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.title_ratings
+    ADD CONSTRAINT title_ratings_pk PRIMARY KEY (title_id);
+
+--
+-- Name: titles titles_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.titles
+    ADD CONSTRAINT titles_pk PRIMARY KEY (title_id);
+
+--
+-- Name: transactions transactions_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.transactions
+    ADD CONSTRAINT transactions_pk PRIMARY KEY (transaction_id);
+
+--
+-- Name: userbase userbase_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.userbase
+    ADD CONSTRAINT userbase_pk PRIMARY KEY (account_id);
+
+
+--
+-- Name: owned_titles_account_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX owned_titles_account_id_uindex ON public.owned_titles USING btree (account_id);
+
+
+--
+-- Name: service_title_regions_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX service_title_regions_uindex ON public.service_title_regions USING btree (item_id, region, country);
+
+
+--
+-- Name: service_title_regions_region_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX service_title_regions_region_uindex ON public.service_title_regions USING btree (item_id, region) WHERE (country IS NULL);
+
+
+--
+-- Name: allowlist_device_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX allowlist_device_id_uindex ON public.allowlist USING btree (device_id);
+
+
+--
+-- Name: allowlist_serial_number_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX allowlist_serial_number_uindex ON public.allowlist USING btree (serial_number);
+
+
+--
+-- Name: audit_log_account_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX audit_log_account_id_index ON public.audit_log USING btree (account_id);
+
+
+--
+-- Name: audit_log_device_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX audit_log_device_id_index ON public.audit_log USING btree (device_id);
+
+
+--
+-- Name: audit_log audit_log_no_delete; Type: RULE; Schema: public; Owner: wiisoap
+--
+
+CREATE RULE audit_log_no_delete AS
+    ON DELETE TO public.audit_log DO INSTEAD NOTHING;
+
+
+--
+-- Name: audit_log audit_log_no_update; Type: RULE; Schema: public; Owner: wiisoap
+--
+
+CREATE RULE audit_log_no_update AS
+    ON UPDATE TO public.audit_log
+   WHERE NOT (((new.device_id IS NULL) OR (new.device_id = old.device_id)) AND ((new.account_id IS NULL) OR (new.account_id = old.account_id)) AND (new.audit_id = old.audit_id) AND ((new.action)::text = (old.action)::text) AND ((new.parameters_hash)::text = (old.parameters_hash)::text) AND (new.date = old.date)) DO INSTEAD NOTHING;
+
+
+--
+-- Name: bans_device_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX bans_device_id_index ON public.bans USING btree (device_id);
+
+
+--
+-- Name: bans_serial_number_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX bans_serial_number_index ON public.bans USING btree (serial_number);
+
+
+--
+-- Name: broadcasts_ends_at_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX broadcasts_ends_at_index ON public.broadcasts USING btree (ends_at);
+
+
+--
+-- Name: categories_parent_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX categories_parent_id_index ON public.categories USING btree (parent_id);
+
+
+--
+-- Name: category_titles_title_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX category_titles_title_id_index ON public.category_titles USING btree (title_id);
+
+
+--
+-- Name: discounts_title_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX discounts_title_id_index ON public.discounts USING btree (title_id);
+
+
+--
+-- Name: discounts_category_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX discounts_category_id_index ON public.discounts USING btree (category_id);
+
+
+--
+-- Name: fraud_holds_status_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX fraud_holds_status_index ON public.fraud_holds USING btree (status);
+
+
+--
+-- Name: gifts_recipient_device_code_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX gifts_recipient_device_code_index ON public.gifts USING btree (recipient_device_code);
+
+
+--
+-- Name: linked_accounts_account_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX linked_accounts_account_id_index ON public.linked_accounts USING btree (account_id);
+
+
+--
+-- Name: point_cards_campaign_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX point_cards_campaign_index ON public.point_cards USING btree (campaign);
+
+
+--
+-- Name: recovery_codes_account_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX recovery_codes_account_id_index ON public.recovery_codes USING btree (account_id);
+
+
+--
+-- Name: subscriptions_account_id_title_id_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX subscriptions_account_id_title_id_index ON public.subscriptions USING btree (account_id, title_id);
+
+
+--
+-- Name: ticket_keys_active_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX ticket_keys_active_uindex ON public.ticket_keys USING btree (active) WHERE active;
+
+
+--
+-- Name: titles_search_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX titles_search_index ON public.titles USING gin (to_tsvector('simple'::regconfig, (((COALESCE(name, ''::character varying))::text || ' '::text) || COALESCE(description, ''::text))));
+
+
+--
+-- Name: transactions_account_id_date_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX transactions_account_id_date_index ON public.transactions USING btree (account_id, date);
+
+
+--
+-- Name: transactions_date_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX transactions_date_index ON public.transactions USING btree (date);
+
+
+--
+-- Name: userbase_date_registered_index; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE INDEX userbase_date_registered_index ON public.userbase USING btree (date_registered);
+
+
+--
+-- Name: userbase_account_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX userbase_account_id_uindex ON public.userbase USING btree (account_id);
+
+
+--
+-- Name: userbase_device_id_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX userbase_device_id_uindex ON public.userbase USING btree (device_id);
+
+
+--
+-- Name: userbase_device_token_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+--
+
+CREATE UNIQUE INDEX userbase_device_token_uindex ON public.userbase USING btree (device_token);
+
+--
+-- Name: owned_titles order_account_ids; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.owned_titles
+    ADD CONSTRAINT order_account_ids FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: service_title_regions service_title_regions_item_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.service_title_regions
+    ADD CONSTRAINT service_title_regions_item_id FOREIGN KEY (item_id) REFERENCES public.service_titles(item_id);
+
+
+--
+-- Name: broadcast_deliveries broadcast_deliveries_broadcast_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.broadcast_deliveries
+    ADD CONSTRAINT broadcast_deliveries_broadcast_id FOREIGN KEY (broadcast_id) REFERENCES public.broadcasts(broadcast_id) ON DELETE CASCADE;
+
+
+--
+-- Name: categories categories_parent_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.categories
+    ADD CONSTRAINT categories_parent_id FOREIGN KEY (parent_id) REFERENCES public.categories(category_id);
+
+
+--
+-- Name: category_titles category_titles_category_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.category_titles
+    ADD CONSTRAINT category_titles_category_id FOREIGN KEY (category_id) REFERENCES public.categories(category_id) ON DELETE CASCADE;
+
+
+--
+-- Name: discounts discounts_category_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.discounts
+    ADD CONSTRAINT discounts_category_id FOREIGN KEY (category_id) REFERENCES public.categories(category_id) ON DELETE CASCADE;
+
+
+--
+-- Name: downloaded_contents downloaded_contents_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.downloaded_contents
+    ADD CONSTRAINT downloaded_contents_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: fraud_holds fraud_holds_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.fraud_holds
+    ADD CONSTRAINT fraud_holds_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: gifts gifts_sender_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.gifts
+    ADD CONSTRAINT gifts_sender_account_id FOREIGN KEY (sender_account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: link_codes link_codes_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.link_codes
+    ADD CONSTRAINT link_codes_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: linked_accounts linked_accounts_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.linked_accounts
+    ADD CONSTRAINT linked_accounts_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: point_cards point_cards_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.point_cards
+    ADD CONSTRAINT point_cards_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: recovery_codes recovery_codes_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.recovery_codes
+    ADD CONSTRAINT recovery_codes_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: subscriptions subscriptions_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.subscriptions
+    ADD CONSTRAINT subscriptions_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
+
+
+--
+-- Name: transactions transactions_account_id; Type: FK CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.transactions
+    ADD CONSTRAINT transactions_account_id FOREIGN KEY (account_id) REFERENCES public.userbase(account_id);
 
 
 --
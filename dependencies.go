@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	QueryTitleDependencies = `SELECT required_title_id FROM title_dependencies WHERE title_id = $1 ORDER BY required_title_id`
+
+	// QueryMissingDependencies returns the base titles required by any of the given titles which the account lacks an unexpired ticket for.
+	QueryMissingDependencies = `SELECT DISTINCT required_title_id FROM title_dependencies
+		WHERE title_id = ANY($1)
+		AND required_title_id NOT IN (SELECT title_id FROM owned_titles
+			WHERE account_id = $2 AND (date_expires IS NULL OR date_expires > $3))
+		ORDER BY required_title_id`
+
+	// QueryRegionalItemByTitle returns the item selling a title within the given region and country, as a base title is bundled by.
+	// It applies the same availability rules as QueryRegionalTitleByPriceCode.
+	QueryRegionalItemByTitle = `SELECT service_titles.item_id
+		FROM service_titles
+		LEFT JOIN service_title_regions
+			ON service_title_regions.item_id = service_titles.item_id
+			AND service_title_regions.region = $2
+			AND (service_title_regions.country IS NULL OR service_title_regions.country = $3)
+		WHERE service_titles.title_id = $1
+		AND (service_titles.available_from IS NULL OR service_titles.available_from <= now())
+		AND (service_titles.available_until IS NULL OR service_titles.available_until > now())
+		AND (service_titles.purchase_limit IS NULL OR service_titles.purchase_count < service_titles.purchase_limit)
+		AND (service_title_regions.item_id IS NOT NULL
+			OR NOT EXISTS (SELECT 1 FROM service_title_regions WHERE service_title_regions.item_id = service_titles.item_id))
+		ORDER BY service_title_regions.country NULLS LAST, service_titles.item_id
+		LIMIT 1`
+
+	InsertTitleDependencyStatement = `INSERT INTO title_dependencies (title_id, required_title_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	DeleteTitleDependencyStatement = `DELETE FROM title_dependencies WHERE title_id = $1 AND required_title_id = $2`
+)
+
+// ErrBaseTitleRequired is returned when purchasing an add-on without owning the title it requires.
+var ErrBaseTitleRequired = errors.New("base title is required")
+
+// bundleBaseTitles purchases base titles alongside add-ons requiring them, rather than refusing the purchase.
+var bundleBaseTitles = false
+
+// TitleDependency describes an add-on title requiring ownership of a base title.
+type TitleDependency struct {
+	TitleId         string `json:"title_id"`
+	RequiredTitleId string `json:"required_title_id"`
+}
+
+func init() {
+	registerAdminEndpoint("/titles/dependencies", titleDependenciesEndpoint)
+}
+
+// lookupTitleDependencies returns the base titles the given title requires.
+func lookupTitleDependencies(ctx context.Context, titleId string) ([]string, error) {
+	rows, err := pool.Query(ctx, QueryTitleDependencies, titleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	required := []string{}
+	for rows.Next() {
+		var requiredTitleId string
+		err = rows.Scan(&requiredTitleId)
+		if err != nil {
+			return nil, err
+		}
+		required = append(required, requiredTitleId)
+	}
+	return required, rows.Err()
+}
+
+// dependencyAttributes returns an attribute for each base title the given title requires, so that the shop may mark it as an add-on.
+func (e *Envelope) dependencyAttributes(titleId string) ([]Attributes, error) {
+	required, err := lookupTitleDependencies(e.ctx, titleId)
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes []Attributes
+	for _, requiredTitleId := range required {
+		attributes = append(attributes, Attributes{Name: "RequiredTitleId", Value: requiredTitleId})
+	}
+	return attributes, nil
+}
+
+// missingDependencies returns the base titles required by the given titles that the account does not own.
+// Base titles among those given are not considered missing, as they are purchased alongside.
+func missingDependencies(ctx context.Context, accountId int64, titleIds []string) ([]string, error) {
+	rows, err := pool.Query(ctx, QueryMissingDependencies, titleIds, accountId, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	purchasing := map[string]bool{}
+	for _, titleId := range titleIds {
+		purchasing[titleId] = true
+	}
+
+	var missing []string
+	for rows.Next() {
+		var requiredTitleId string
+		err = rows.Scan(&requiredTitleId)
+		if err != nil {
+			return nil, err
+		}
+		if !purchasing[requiredTitleId] {
+			missing = append(missing, requiredTitleId)
+		}
+	}
+	return missing, rows.Err()
+}
+
+// enforceDependencies refuses purchasing the given titles should the account lack a base title they require, returning whether it may proceed.
+// With bundling enabled, missing base titles are instead returned as items to purchase alongside them, provided they are on sale.
+func (e *Envelope) enforceDependencies(accountId int64, titleIds []string) ([]cartItem, bool) {
+	missing, err := missingDependencies(e.ctx, accountId, titleIds)
+	if err != nil {
+		log.Printf("error querying title dependencies: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return nil, false
+	} else if len(missing) == 0 {
+		return nil, true
+	}
+
+	if !bundleBaseTitles {
+		e.Error(ErrorCodeBaseTitleRequired, "base title "+missing[0]+" is required", ErrBaseTitleRequired)
+		return nil, false
+	}
+
+	var bundled []cartItem
+	for _, titleId := range missing {
+		var itemId int
+		err = pool.QueryRow(e.ctx, QueryRegionalItemByTitle, titleId, e.Region(), e.Country()).Scan(&itemId)
+		if err == pgx.ErrNoRows {
+			e.Error(ErrorCodeBaseTitleRequired, "base title "+titleId+" is not on sale", ErrBaseTitleRequired)
+			return nil, false
+		} else if err != nil {
+			log.Printf("error querying base title item: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+			return nil, false
+		}
+
+		bundled = append(bundled, cartItem{itemId: itemId, titleId: titleId})
+	}
+
+	incrementMetric("base_titles_bundled")
+	return bundled, true
+}
+
+// titleDependenciesEndpoint lists, adds or removes the base titles required by a title.
+func titleDependenciesEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		titleId := r.URL.Query().Get("title_id")
+		if titleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id is required")
+			return
+		}
+
+		required, err := lookupTitleDependencies(r.Context(), titleId)
+		if err != nil {
+			log.Printf("error querying title dependencies: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		dependencies := []TitleDependency{}
+		for _, requiredTitleId := range required {
+			dependencies = append(dependencies, TitleDependency{TitleId: titleId, RequiredTitleId: requiredTitleId})
+		}
+		writeJSON(w, http.StatusOK, dependencies)
+	case "PUT":
+		var dependency TitleDependency
+		err := readJSON(r, &dependency)
+		if err != nil || dependency.TitleId == "" || dependency.RequiredTitleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id and required_title_id are required")
+			return
+		}
+		if dependency.TitleId == dependency.RequiredTitleId {
+			writeAdminError(w, http.StatusBadRequest, "a title cannot require itself")
+			return
+		}
+
+		_, err = pool.Exec(r.Context(), InsertTitleDependencyStatement, dependency.TitleId, dependency.RequiredTitleId)
+		if err != nil {
+			log.Printf("error adding title dependency: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, dependency)
+	case "DELETE":
+		titleId := r.URL.Query().Get("title_id")
+		requiredTitleId := r.URL.Query().Get("required_title_id")
+		if titleId == "" || requiredTitleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id and required_title_id are required")
+			return
+		}
+
+		_, err := pool.Exec(r.Context(), DeleteTitleDependencyStatement, titleId, requiredTitleId)
+		if err != nil {
+			log.Printf("error removing title dependency: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgconn"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PriceQuoteLifetime is how long a price displayed to a console is honoured for upon purchase.
+// This covers a typical shop session, so that a promotion ending mid-session does not alter what is charged.
+const PriceQuoteLifetime = 30 * time.Minute
+
+const (
+	// QueryDiscountedPrice returns the lowest price available for a title through any active discount.
+	// Discounts apply to titles directly, or to titles within a category or any of its descendants.
+	QueryDiscountedPrice = `WITH RECURSIVE ancestors AS (
+			SELECT category_titles.category_id FROM category_titles WHERE category_titles.title_id = $1
+			UNION
+			SELECT categories.parent_id FROM categories JOIN ancestors ON categories.category_id = ancestors.category_id
+			WHERE categories.parent_id IS NOT NULL
+		)
+		SELECT COALESCE(min(GREATEST(0, $2::integer - COALESCE(discounts.points_off, 0) - $2::integer * COALESCE(discounts.percent_off, 0) / 100)), $2::integer)
+		FROM discounts
+		WHERE (discounts.title_id = $1 OR discounts.category_id IN (SELECT category_id FROM ancestors))
+		AND discounts.starts_at <= $3 AND discounts.ends_at > $3`
+
+	QueryAllDiscounts = `SELECT discount_id, title_id, category_id, percent_off, points_off, starts_at, ends_at
+		FROM discounts ORDER BY starts_at, discount_id`
+
+	InsertDiscountStatement = `INSERT INTO discounts (title_id, category_id, percent_off, points_off, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING discount_id`
+
+	DeleteDiscountStatement = `DELETE FROM discounts WHERE discount_id = $1`
+)
+
+// Discount reduces the price of a title, or all titles within a category, for a window of time.
+// Exactly one of TitleId and CategoryId, and one of PercentOff and PointsOff, are set.
+type Discount struct {
+	DiscountId int     `json:"discount_id"`
+	TitleId    *string `json:"title_id"`
+	CategoryId *int    `json:"category_id"`
+	// PercentOff reduces the price by a percentage, rounding in favour of the shop.
+	PercentOff *int `json:"percent_off"`
+	// PointsOff reduces the price by a fixed amount of points, to no lower than zero.
+	PointsOff *int      `json:"points_off"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+}
+
+// priceQuoteKey identifies a price displayed to a console.
+type priceQuoteKey struct {
+	tenant   string
+	deviceId int
+	itemId   int
+	licence  LicenceKinds
+}
+
+// priceQuotes holds the most recent price displayed to each console for an item.
+var priceQuotes = newTTLCache[priceQuoteKey, int]()
+
+func init() {
+	priceQuotes.SetTTL(PriceQuoteLifetime)
+	registerAdminEndpoint("/discounts", discountsEndpoint)
+}
+
+// discountedPrice returns the given price for a title after applying the best discount active at the given time.
+func discountedPrice(ctx context.Context, titleId string, price int, at time.Time) (int, error) {
+	var discounted int
+	err := pool.QueryRow(ctx, QueryDiscountedPrice, titleId, price, at).Scan(&discounted)
+	if err != nil {
+		return 0, err
+	}
+
+	return discounted, nil
+}
+
+// priceQuote returns the key for a price displayed to this request's console.
+func (e *Envelope) priceQuote(itemId int, licence LicenceKinds) priceQuoteKey {
+	return priceQuoteKey{tenant: tenantFromContext(e.ctx).Name, deviceId: e.DeviceId(), itemId: itemId, licence: licence}
+}
+
+// quotePrice returns the price to display for an item after discounts,
+// remembering it for this console so that it is charged upon purchase.
+func (e *Envelope) quotePrice(titleId string, itemId int, price int, licence LicenceKinds) (int, error) {
+	discounted, err := discountedPrice(e.ctx, titleId, price, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	priceQuotes.Set(e.priceQuote(itemId, licence), discounted)
+	return discounted, nil
+}
+
+// chargedPrice returns the price to charge for an item: the price last displayed to this console if still honoured,
+// or otherwise its current price after discounts.
+func (e *Envelope) chargedPrice(titleId string, itemId int, price int, licence LicenceKinds) (int, error) {
+	if quoted, exists := priceQuotes.Get(e.priceQuote(itemId, licence)); exists {
+		return quoted, nil
+	}
+
+	return discountedPrice(e.ctx, titleId, price, time.Now().UTC())
+}
+
+// discountsEndpoint lists, creates or removes discounts.
+func discountsEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rows, err := pool.Query(r.Context(), QueryAllDiscounts)
+		if err != nil {
+			log.Printf("error querying discounts: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer rows.Close()
+
+		discounts := []Discount{}
+		for rows.Next() {
+			var discount Discount
+			err = rows.Scan(&discount.DiscountId, &discount.TitleId, &discount.CategoryId, &discount.PercentOff, &discount.PointsOff, &discount.StartsAt, &discount.EndsAt)
+			if err != nil {
+				log.Printf("error querying discounts: %v\n", err)
+				writeAdminError(w, http.StatusInternalServerError, "database error")
+				return
+			}
+			discounts = append(discounts, discount)
+		}
+
+		writeJSON(w, http.StatusOK, discounts)
+	case "POST":
+		var discount Discount
+		err := readJSON(r, &discount)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid discount")
+			return
+		}
+
+		if (discount.TitleId == nil) == (discount.CategoryId == nil) {
+			writeAdminError(w, http.StatusBadRequest, "exactly one of title_id and category_id is required")
+			return
+		}
+		if (discount.PercentOff == nil) == (discount.PointsOff == nil) {
+			writeAdminError(w, http.StatusBadRequest, "exactly one of percent_off and points_off is required")
+			return
+		}
+		if discount.PercentOff != nil && (*discount.PercentOff <= 0 || *discount.PercentOff > 100) {
+			writeAdminError(w, http.StatusBadRequest, "percent_off must be between 1 and 100")
+			return
+		}
+		if discount.PointsOff != nil && *discount.PointsOff <= 0 {
+			writeAdminError(w, http.StatusBadRequest, "points_off must be positive")
+			return
+		}
+		if !discount.EndsAt.After(discount.StartsAt) {
+			writeAdminError(w, http.StatusBadRequest, "ends_at must be after starts_at")
+			return
+		}
+
+		discount.StartsAt, discount.EndsAt = discount.StartsAt.UTC(), discount.EndsAt.UTC()
+		err = pool.QueryRow(r.Context(), InsertDiscountStatement, discount.TitleId, discount.CategoryId,
+			discount.PercentOff, discount.PointsOff, discount.StartsAt, discount.EndsAt).Scan(&discount.DiscountId)
+		if driverErr, ok := err.(*pgconn.PgError); ok && driverErr.Code == "23503" {
+			writeAdminError(w, http.StatusNotFound, "category does not exist")
+			return
+		} else if err != nil {
+			log.Printf("error creating discount: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, discount)
+	case "DELETE":
+		discountId, err := strconv.Atoi(r.URL.Query().Get("discount_id"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "discount_id is required")
+			return
+		}
+
+		// Prices already displayed remain honoured for the remainder of their quote.
+		result, err := pool.Exec(r.Context(), DeleteDiscountStatement, discountId)
+		if err != nil {
+			log.Printf("error removing discount: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "discount does not exist")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// DolphinPlaceholderDeviceId is the device ID Dolphin reports when no console keys have been dumped.
+const DolphinPlaceholderDeviceId = 0x0403AC68
+
+// dolphinCompatibility relaxes checks which emulated consoles are unable to pass.
+// It is intended for development, and should not be enabled on public instances.
+var dolphinCompatibility = false
+
+// isPlaceholderDeviceId returns whether the given device ID is shared by many emulated consoles.
+func isPlaceholderDeviceId(deviceId int) bool {
+	return deviceId == 0 || deviceId == DolphinPlaceholderDeviceId
+}
+
+// placeholderSerialNumber synthesizes a serial number for consoles which did not send one.
+// It is derived from the device ID so that it remains stable across requests.
+func placeholderSerialNumber(deviceId int) string {
+	return fmt.Sprintf("LU%09d", uint32(deviceId)%1000000000)
+}
+
+// SerialNumber returns the serial number sent within this request.
+// Under Dolphin compatibility, a placeholder is synthesized should it be missing.
+func (e *Envelope) SerialNumber() (string, error) {
+	serialNo, err := e.getKey("SerialNumber")
+	if err != nil && dolphinCompatibility {
+		return placeholderSerialNumber(e.DeviceId()), nil
+	}
+
+	return serialNo, err
+}
+
+// dolphinTLSConfig permits the TLS versions and cipher suites Dolphin negotiates alongside those of the Wii.
+func dolphinTLSConfig() *tls.Config {
+	suites := append([]uint16{}, wiiCipherSuites...)
+	for _, suite := range tls.CipherSuites() {
+		suites = append(suites, suite.ID)
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: suites,
+	}
+}
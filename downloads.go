@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	QueryOwnedTitle = `SELECT 1 FROM owned_titles WHERE account_id = $1 AND title_id = $2`
+
+	RecordDownloadedContentStatement = `INSERT INTO downloaded_contents (account_id, title_id, version, content_id, date_downloaded)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING`
+
+	// QueryDownloadProgress returns the contents confirmed for each version of a title an account has downloaded,
+	// alongside the number of contents within that version if its metadata has been imported.
+	QueryDownloadProgress = `SELECT downloaded_contents.title_id, downloaded_contents.version, titles.content_count,
+			array_agg(downloaded_contents.content_id ORDER BY downloaded_contents.content_id),
+			max(downloaded_contents.date_downloaded)
+		FROM downloaded_contents
+		LEFT JOIN titles ON titles.title_id = downloaded_contents.title_id AND titles.version = downloaded_contents.version
+		WHERE downloaded_contents.account_id = $1
+		GROUP BY downloaded_contents.title_id, downloaded_contents.version, titles.content_count
+		ORDER BY downloaded_contents.title_id, downloaded_contents.version`
+)
+
+// DownloadProgress describes the contents of a title version a console has confirmed downloading.
+type DownloadProgress struct {
+	TitleId string `json:"title_id"`
+	Version int    `json:"version"`
+	// ContentCount is the number of contents within this version, or nil if its metadata has not been imported.
+	ContentCount *int      `json:"content_count"`
+	ContentIds   []string  `json:"content_ids"`
+	Complete     bool      `json:"complete"`
+	LastUpdated  time.Time `json:"last_updated"`
+}
+
+// downloadKey identifies a single version of a title.
+type downloadKey struct {
+	titleId string
+	version int
+}
+
+func init() {
+	registerAdminEndpoint("/consoles/downloads", downloadsEndpoint)
+}
+
+// downloadProgress returns the progress of every title version the given account has begun downloading.
+// Titles whose contents are unknown are considered complete once any content is confirmed.
+func downloadProgress(ctx context.Context, accountId int64) ([]DownloadProgress, error) {
+	rows, err := pool.Query(ctx, QueryDownloadProgress, accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	progress := []DownloadProgress{}
+	for rows.Next() {
+		var download DownloadProgress
+		err = rows.Scan(&download.TitleId, &download.Version, &download.ContentCount, &download.ContentIds, &download.LastUpdated)
+		if err != nil {
+			return nil, err
+		}
+
+		download.Complete = download.ContentCount == nil || len(download.ContentIds) >= *download.ContentCount
+		progress = append(progress, download)
+	}
+
+	return progress, rows.Err()
+}
+
+// interruptedDownloads returns the title versions the given account has begun, but not finished, downloading.
+func interruptedDownloads(ctx context.Context, accountId int64) (map[downloadKey]DownloadProgress, error) {
+	progress, err := downloadProgress(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	interrupted := map[downloadKey]DownloadProgress{}
+	for _, download := range progress {
+		if !download.Complete {
+			interrupted[downloadKey{download.TitleId, download.Version}] = download
+		}
+	}
+	return interrupted, nil
+}
+
+// notifyContentsDownloaded is sent by the console as it finishes downloading contents of an owned title.
+func notifyContentsDownloaded(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	titleId, err := e.getKey("TitleId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing title ID", err)
+		return
+	}
+
+	tempVersion, err := e.getKey("TitleVersion")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing title version", err)
+		return
+	}
+
+	version, err := strconv.Atoi(tempVersion)
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "invalid title version", err)
+		return
+	}
+
+	nodes, err := e.getKeys("ContentId")
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "missing content IDs", err)
+		return
+	}
+
+	// Content IDs are 32-bit, and are normalised to how they appear within a TMD.
+	var contentIds []string
+	for _, node := range nodes {
+		contentId, err := strconv.ParseUint(node.InnerText(), 16, 32)
+		if err != nil {
+			e.Error(ErrorCodeInvalidRequest, "invalid content ID", err)
+			return
+		}
+		contentIds = append(contentIds, fmt.Sprintf("%08X", contentId))
+	}
+
+	var throwaway int
+	err = pool.QueryRow(e.ctx, QueryOwnedTitle, accountId, titleId).Scan(&throwaway)
+	if err == pgx.ErrNoRows {
+		e.Error(ErrorCodeTitleUnavailable, "title is not owned", nil)
+		return
+	} else if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	tx, err := pool.Begin(e.ctx)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	now := time.Now().UTC()
+	for _, contentId := range contentIds {
+		_, err = tx.Exec(e.ctx, RecordDownloadedContentStatement, accountId, titleId, version, contentId, now)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+			return
+		}
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("error committing downloaded contents: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+}
+
+// downloadsEndpoint reports the download progress of each title an account has begun downloading.
+func downloadsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	accountId, err := strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
+
+	progress, err := downloadProgress(r.Context(), accountId)
+	if err != nil {
+		log.Printf("error querying download progress: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, progress)
+}
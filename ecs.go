@@ -19,12 +19,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	v1Ticket "github.com/OpenShopChannel/V1TicketGenerator"
 	"github.com/wii-tools/wadlib"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
 	"math"
 	"strconv"
@@ -32,21 +34,21 @@ import (
 )
 
 const (
-	QueryOwnedTitles = `SELECT owned_titles.title_id
-		FROM owned_titles
-		WHERE owned_titles.account_id = $1`
-
 	QueryOwnedServiceTitles = `SELECT service_titles.reference_id, owned_titles.date_purchased, service_titles.item_id
 		FROM service_titles, owned_titles
 		WHERE service_titles.item_id = owned_titles.item_id
 		AND service_titles.title_id = $1
-		AND owned_titles.account_id = $2`
+		AND owned_titles.account_id = $2
+		ORDER BY owned_titles.date_purchased DESC, service_titles.item_id`
 
 	AssociateTicketStatement = `INSERT INTO owned_titles (account_id, title_id, version, item_id, date_purchased)
 		VALUES ($1, $2, $3, $4, $5)`
 
+	PurgeExpiredTicketsStatement = `DELETE FROM owned_titles
+		WHERE date_expires IS NOT NULL AND date_expires < $1`
+
 	// SharedBalanceAmount describes the maximum signed 32-bit integer value.
-	// It is not an actual tracked points value, but exists to permit reuse.
+	// It is the balance accounts are given upon registration, permitting reuse.
 	SharedBalanceAmount = math.MaxInt32
 
 	// WiinoMaApplicationID is the title ID for the Japanese channel Wii no Ma.
@@ -58,68 +60,94 @@ const (
 // contentAesKey is the AES key that is used to encrypt title contents.
 var contentAesKey = [16]byte{0x72, 0x95, 0xDB, 0xC0, 0x47, 0x3C, 0x90, 0x0B, 0xB5, 0x94, 0x19, 0x9C, 0xB5, 0xBC, 0xD3, 0xDC}
 
-func getBalance() Balance {
-	return Balance{
-		Amount:   SharedBalanceAmount,
-		Currency: "POINTS",
+func init() {
+	registerTenantJob("purge-expired-tickets", time.Hour, purgeExpiredTickets)
+}
+
+// registerECS registers all actions handled by the ECommerce service.
+func registerECS(r *Route) {
+	ecs := r.HandleGroup("ecs")
+	{
+		ecs.Authenticated("CheckDeviceStatus", checkDeviceStatus)
+		ecs.Authenticated("NotifyETicketsSynced", notifyETicketsSynced, "SyncTime")
+		ecs.Authenticated("NotifyContentsDownloaded", notifyContentsDownloaded, "TitleId", "TitleVersion", "ContentId")
+		ecs.Authenticated("ListETickets", listETickets)
+		ecs.Authenticated("GetETickets", getETickets)
+		ecs.Authenticated("ListTitlesUpdated", listTitlesUpdated, "ListResultOffset", "ListResultLimit")
+		ecs.Authenticated("PurchaseTitle", purchaseTitle, "ItemId", "TitleId", "ReferenceId").Audited()
+		ecs.Authenticated("PurchaseSubscription", purchaseSubscription, "ItemId", "TitleId").Audited()
+		ecs.Authenticated("PurchaseRental", purchaseRental, "ItemId", "TitleId").Audited()
+		ecs.Authenticated("CheckContentRights", checkContentRights, "TitleId")
+		ecs.Unauthenticated("GetECConfig", getECConfig)
+		ecs.Authenticated("GetTaxes", getTaxes, "Price")
+		ecs.Authenticated("GetTaxLocation", getTaxLocation)
+		ecs.Authenticated("ListPurchaseHistory", listPurchaseHistory, "ApplicationId", "ListResultOffset", "ListResultLimit")
+		ecs.Authenticated("SendGift", sendGift, "RecipientDeviceCode", "TitleId", "ItemId").Audited()
+		ecs.Authenticated("ListGifts", listGifts, "ListResultOffset", "ListResultLimit")
+		ecs.Authenticated("ReceiveGift", receiveGift, "GiftId").Audited()
+		ecs.Authenticated("PurchasePoints", purchasePoints, "ECardNumber").Audited()
 	}
 }
 
+// purgeExpiredTickets removes titles whose time-limited licences, such as trials, have lapsed.
+func purgeExpiredTickets(ctx context.Context) error {
+	_, err := pool.Exec(ctx, PurgeExpiredTicketsStatement, time.Now().UTC())
+	return err
+}
+
 func checkDeviceStatus(e *Envelope) {
-	e.AddCustomType(getBalance())
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
 	e.AddKVNode("ForceSyncTime", "0")
 	e.AddKVNode("ExtTicketTime", e.Timestamp())
 	e.AddKVNode("SyncTime", e.Timestamp())
 }
 
-func notifyETicketsSynced(e *Envelope) {
-	// TODO: Implement handling of synchronization timing
-}
-
 func listETickets(e *Envelope) {
 	accountId, err := e.AccountId()
 	if err != nil {
-		e.Error(2, "missing account ID", err)
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
 		return
 	}
 
-	rows, err := pool.Query(ctx, QueryOwnedTitles, accountId)
+	syncVersion, err := getSyncVersion(e.ctx, accountId)
 	if err != nil {
 		log.Printf("error executing statement: %v\n", err)
-		e.Error(2, "database error", errors.New("failed to execute db operation"))
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
 		return
 	}
 
-	// Add all available titles for this account.
-	defer rows.Close()
-	for rows.Next() {
-		var titleId string
-		err = rows.Scan(&titleId)
-		if err != nil {
-			log.Printf("error executing statement: %v\n", err)
-			e.Error(2, "database error", errors.New("failed to execute db operation"))
-			return
-		}
-
-		app, err := GetOSCApp(titleId)
-		if err != nil {
-			e.Error(2, "an error has occurred retrieving app metadata", err)
-			return
-		}
+	titles, err := syncedTitles(e.ctx, accountId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+		return
+	}
 
-		if app == nil {
-			// Quite possibly an app was de-listed?
-			e.Error(2, "title does not exist", nil)
-			return
+	// Add all titles for this account which the console has yet to acknowledge.
+	for _, title := range titles {
+		if !title.needsSync(syncVersion) {
+			continue
 		}
 
 		e.AddCustomType(Tickets{
-			TitleId: titleId,
-			Version: app.Shop.Version,
+			TitleId: title.TitleId,
+			Version: title.CurrentVersion,
 
-			// We do not support migration, ticket IDs, or revocation.
+			// We do not support migration or ticket IDs.
 			TicketId:     "0",
-			RevokeDate:   0,
+			RevokeDate:   title.revokeDate(),
 			MigrateCount: 0,
 			MigrateLimit: 0,
 		})
@@ -130,55 +158,206 @@ func listETickets(e *Envelope) {
 	e.AddKVNode("SyncTime", e.Timestamp())
 }
 
+// listTitlesUpdated lists owned titles whose version within our catalog is newer than the console's ticket.
+// Titles whose download of the current version was interrupted are listed as well, so that the console downloads them again.
+func listTitlesUpdated(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	titles, err := syncedTitles(e.ctx, accountId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+		return
+	}
+
+	interrupted, err := interruptedDownloads(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying download progress: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	var updated []UpdatedTitles
+	for _, title := range titles {
+		_, incomplete := interrupted[downloadKey{title.TitleId, title.CurrentVersion}]
+		if title.CurrentVersion <= title.Version && !incomplete {
+			continue
+		}
+
+		updated = append(updated, UpdatedTitles{
+			TitleId:        title.TitleId,
+			Version:        title.Version,
+			CurrentVersion: title.CurrentVersion,
+		})
+	}
+
+	offset, end := e.paginate(len(updated))
+	e.AddCustomType(updated[offset:end])
+	e.AddKVNode("ListResultTotalSize", strconv.Itoa(len(updated)))
+}
+
+// getETickets sends tickets for every owned title the console has yet to acknowledge, such as those re-issued under a new key.
 func getETickets(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	syncVersion, err := getSyncVersion(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	titles, err := syncedTitles(e.ctx, accountId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+		return
+	}
+
+	issued := 0
+	for _, title := range titles {
+		if !title.needsSync(syncVersion) {
+			continue
+		}
+
+		// Time-limited tickets are revoked per the RevokeDate sent within ListETickets.
+		ticketStruct, err := newTitleTicket(e.ctx, title.TitleId)
+		if err != nil {
+			e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+			return
+		}
+
+		key, err := ownedTicketKey(e.ctx, title.KeyId)
+		if err != nil {
+			e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+			return
+		}
+
+		ticket := new(bytes.Buffer)
+		err = writeTicketWithKey(ticket, ticketStruct, key)
+		if err != nil {
+			e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
+			return
+		}
+
+		// Each ticket is expected to have two other certificates associated.
+		e.AddKVNode("ETickets", b64(append(ticket.Bytes(), wadlib.CertChainTemplate...)))
+		issued++
+	}
+	if issued != 0 {
+		// Two cert types must be present.
+		e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+		e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	}
+
 	e.AddKVNode("ForceSyncTime", "0")
 	e.AddKVNode("ExtTicketTime", e.Timestamp())
 	e.AddKVNode("SyncTime", e.Timestamp())
 }
 
+// newTitleTicket formulates a ticket for the given title ID from the standard template.
+func newTitleTicket(ctx context.Context, titleId string) (*wadlib.Ticket, error) {
+	_, span := tracer.Start(ctx, "ticket.generate", trace.WithAttributes(attribute.String("wiisoap.title_id", titleId)))
+	defer span.End()
+
+	var ticket wadlib.Ticket
+	err := binary.Read(bytes.NewReader(wadlib.TicketTemplate), binary.BigEndian, &ticket)
+	if err != nil {
+		// Should never happen but report
+		return nil, err
+	}
+
+	intTitleId, err := strconv.ParseUint(titleId, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket.TitleID = intTitleId
+
+	// Title key is encrypted with the common key and current title ID
+	ticket.UpdateTitleKey(contentAesKey)
+	return &ticket, nil
+}
+
 func purchaseTitle(e *Envelope) {
 	accountId, err := e.AccountId()
 	if err != nil {
-		e.Error(2, "missing account ID", err)
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	// Every title within a multi-item purchase counts towards purchase velocity.
+	itemIds, _ := e.getKeys("ItemId")
+	if _, ok := e.enforceFraud(ErrorCodeGenericFailure, FraudEventPurchase, formatAccountId(accountId), len(itemIds)); !ok {
+		return
+	}
+
+	if e.isCartPurchase() {
+		purchaseCart(e, accountId)
 		return
 	}
 
 	tempItemId, err := e.getKey("ItemId")
 	if err != nil {
-		e.Error(2, "missing item ID", err)
+		e.Error(ErrorCodeGenericFailure, "missing item ID", err)
 		return
 	}
 
 	// Our struct takes an integer rather than a string.
-	itemId, _ := strconv.Atoi(tempItemId)
+	itemId, err := strconv.Atoi(tempItemId)
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "invalid item ID", err)
+		return
+	}
 
 	// Determine the title ID we're going to purchase.
 	titleId, err := e.getKey("TitleId")
 	if err != nil {
-		e.Error(2, "missing account ID", err)
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
 		return
 	}
 
-	ticket := new(bytes.Buffer)
-	var ticketStruct wadlib.Ticket
-	err = binary.Read(bytes.NewReader(wadlib.TicketTemplate), binary.BigEndian, &ticketStruct)
-	if err != nil {
-		// Should never happen but report
-		e.Error(2, "error reading ticket template", err)
+	// The item must sell this title, as its availability window and purchase cap are enforced by item.
+	if !e.verifyItem(itemId, titleId) {
 		return
 	}
 
-	// We will now formulate the ticket for this title.
-	intTitleId, err := strconv.ParseUint(titleId, 16, 64)
-	if err != nil {
-		e.Error(2, "invalid title id", err)
+	if !e.enforceRating(titleId) {
 		return
 	}
 
-	ticketStruct.TitleID = intTitleId
+	// Add-ons are purchased alongside any base titles bundled with them.
+	bundled, ok := e.enforceDependencies(accountId, []string{titleId})
+	if !ok {
+		return
+	} else if len(bundled) != 0 {
+		purchaseItems(e, accountId, append(bundled, cartItem{itemId: itemId, titleId: titleId}))
+		return
+	}
 
-	// Title key is encrypted with the common key and current title ID
-	ticketStruct.UpdateTitleKey(contentAesKey)
+	// Consoles are charged the price last displayed to them, as they are within multi-item purchases.
+	price, err := itemPrice(e.ctx, itemId)
+	if err == nil {
+		price, err = e.chargedPrice(titleId, itemId, price, PERMANENT)
+	}
+	if err != nil {
+		log.Printf("error querying item price: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	ticket := new(bytes.Buffer)
+	ticketStruct, err := newTitleTicket(e.ctx, titleId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+		return
+	}
 
 	version := 0
 	if titleId == WiinoMaServiceTitleID {
@@ -188,15 +367,15 @@ func purchaseTitle(e *Envelope) {
 		ticketStruct.AccessTitleMask = math.MaxUint32
 		ticketStruct.LicenseType = 5
 
-		err = binary.Write(ticket, binary.BigEndian, ticketStruct)
+		err = writeTicket(e.ctx, ticket, ticketStruct)
 		if err != nil {
-			e.Error(2, "failed to create ticket", err)
+			e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
 			return
 		}
 
 		refId, err := e.getKey("ReferenceId")
 		if err != nil {
-			e.Error(2, "missing reference ID", err)
+			e.Error(ErrorCodeGenericFailure, "missing reference ID", err)
 			return
 		}
 
@@ -204,7 +383,7 @@ func purchaseTitle(e *Envelope) {
 		refIdBytes, err := hex.DecodeString(refId)
 		if err != nil {
 			log.Printf("unexpected error converting reference id to bytes: %v", err)
-			e.Error(2, "error purchasing", nil)
+			e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
 			return
 		}
 
@@ -219,10 +398,10 @@ func purchaseTitle(e *Envelope) {
 		}
 
 		// Query the database for other purchased items of the same title id.
-		rows, err := pool.Query(ctx, QueryOwnedServiceTitles, titleId, accountId)
+		rows, err := pool.Query(e.ctx, QueryOwnedServiceTitles, titleId, accountId)
 		if err != nil {
 			log.Printf("unexpected error purchasing: %v", err)
-			e.Error(2, "error purchasing", nil)
+			e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
 			return
 		}
 
@@ -233,14 +412,14 @@ func purchaseTitle(e *Envelope) {
 			err = rows.Scan(&currentRefIdString, &purchasedTime, nil)
 			if err != nil {
 				log.Printf("unexpected error purchasing: %v", err)
-				e.Error(2, "error purchasing", nil)
+				e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
 				return
 			}
 
 			refIdBytes, err = hex.DecodeString(currentRefIdString)
 			if err != nil {
 				log.Printf("unexpected error converting reference id to bytes: %v", err)
-				e.Error(2, "error purchasing", nil)
+				e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
 				return
 			}
 
@@ -255,57 +434,123 @@ func purchaseTitle(e *Envelope) {
 		newTicket, err := v1Ticket.CreateV1Ticket(ticket.Bytes(), subscriptions)
 		if err != nil {
 			log.Printf("unexpected error creating v1Ticket: %v", err)
-			e.Error(2, "error creating ticket", nil)
+			e.Error(ErrorCodeGenericFailure, "error creating ticket", nil)
 			return
 		}
 
 		ticket = bytes.NewBuffer(newTicket)
 	} else {
 		// Validate that this title exists.
-		app, err := GetOSCApp(titleId)
+		app, err := lookupTitle(e.ctx, titleId)
 		if err != nil {
-			e.Error(2, "an error has occurred retrieving app metadata", err)
+			e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
 			return
 		}
 
 		if app == nil {
-			e.Error(2, "title does not exist", nil)
+			e.Error(ErrorCodeGenericFailure, "title does not exist", nil)
 			return
 		}
 
 		version = app.Shop.Version
 
-		err = binary.Write(ticket, binary.BigEndian, ticketStruct)
+		err = writeTicket(e.ctx, ticket, ticketStruct)
 		if err != nil {
-			e.Error(2, "failed to create ticket", err)
+			e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
 			return
 		}
 	}
 
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	err = claimItem(e.ctx, tx, itemId)
+	if err == ErrItemUnavailable {
+		e.Error(ErrorCodeTitleUnavailable, "unable to purchase title", err)
+		return
+	} else if err != nil {
+		log.Printf("unexpected error claiming item: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
 	// Associate the given title ID with the user.
-	_, err = pool.Exec(ctx, AssociateTicketStatement, accountId, titleId, version, itemId, time.Now().UTC())
+	_, err = tx.Exec(e.ctx, AssociateTicketStatement, accountId, titleId, version, itemId, time.Now().UTC())
 	if err != nil {
 		log.Printf("unexpected error purchasing: %v", err)
-		e.Error(2, "error purchasing", nil)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
 	}
 
+	transactionId, err := recordTransaction(e.ctx, tx, Transaction{
+		AccountId: accountId,
+		Type:      TransactionPurchase,
+		TitleId:   titleId,
+		ItemId:    itemId,
+		TotalPaid: price,
+	})
+	if err != nil {
+		log.Printf("error recording transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	err = debitPoints(e.ctx, tx, accountId, price)
+	if err == ErrInsufficientPoints {
+		e.Error(ErrorCodeGenericFailure, "unable to purchase title", err)
+		return
+	} else if err != nil {
+		log.Printf("error debiting points: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("unexpected error purchasing: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+	invalidateItem(e.ctx, itemId)
+
+	if price != 0 {
+		emitEvent(e.ctx, EventPointsRedeemed, PointsRedeemedEvent{
+			AccountId: formatAccountId(accountId),
+			Amount:    price,
+			Reason:    "purchase",
+		})
+	}
+	emitEvent(e.ctx, EventTitlePurchased, TitlePurchasedEvent{
+		AccountId:   formatAccountId(accountId),
+		TitleId:     titleId,
+		ItemId:      itemId,
+		LicenseKind: PERMANENT,
+	})
+
 	// The returned ticket is expected to have two other certificates associated.
 	ticketString := b64(append(ticket.Bytes(), wadlib.CertChainTemplate...))
 
-	e.AddCustomType(getBalance())
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
 	e.AddCustomType(Transactions{
-		TransactionId: "00000000",
+		TransactionId: formatTransactionId(transactionId),
 		Date:          e.Timestamp(),
-		Type:          "PURCHGAME",
-		TotalPaid:     0,
+		Type:          TransactionPurchase,
+		TotalPaid:     price,
 		Currency:      "POINTS",
 		ItemId:        itemId,
-		ItemPricing: Prices{
-			ItemId:      itemId,
-			Price:       Price{Amount: 0, Currency: "POINTS"},
-			Limits:      LimitStruct(PR),
-			LicenseKind: PERMANENT,
-		},
+		ItemPricing:   e.ItemPrice(itemId, price, PR, PERMANENT),
 	})
 	e.AddKVNode("SyncTime", e.Timestamp())
 
@@ -319,105 +564,70 @@ func purchaseTitle(e *Envelope) {
 func listPurchaseHistory(e *Envelope) {
 	accountId, err := e.AccountId()
 	if err != nil {
-		e.Error(2, "missing account ID", err)
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
 		return
 	}
 
 	titleId, err := e.getKey("ApplicationId")
 	if err != nil {
-		e.Error(2, "missing application ID", err)
+		e.Error(ErrorCodeGenericFailure, "missing application ID", err)
+		return
+	}
+
+	// Wii no Ma derives its history from owned service titles, whereas all others are recorded as transactions.
+	if titleId != WiinoMaApplicationID {
+		listTransactionHistory(e, accountId)
 		return
 	}
 
 	var transactions []Transactions
-	if titleId == WiinoMaApplicationID {
-		// We will query the database differently for Wii no Ma.
-		rows, err := pool.Query(ctx, QueryOwnedServiceTitles, WiinoMaServiceTitleID, accountId)
+	rows, err := pool.Query(e.ctx, QueryOwnedServiceTitles, WiinoMaServiceTitleID, accountId)
+	if err != nil {
+		log.Printf("unexpected error querying owned service titles: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var refId string
+		var purchasedTime time.Time
+		var itemId int
+		err = rows.Scan(&refId, &purchasedTime, &itemId)
 		if err != nil {
-			log.Printf("unexpected error querying owned service titles: %v", err)
-			e.Error(2, "error purchasing", nil)
+			log.Printf("unexpected error purchasing: %v", err)
+			e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
 			return
 		}
 
-		defer rows.Close()
-		for rows.Next() {
-			var refId string
-			var purchasedTime time.Time
-			var itemId int
-			err = rows.Scan(&refId, &purchasedTime, &itemId)
-			if err != nil {
-				log.Printf("unexpected error purchasing: %v", err)
-				e.Error(2, "error purchasing", nil)
-				return
-			}
-
-			transaction := Transactions{
-				TransactionId: "00000000",
-				// (Sketch) I don't know why but Wii no Ma won't acknowledge the entry if it isn't past a day from
-				// purchase.
-				Date:      strconv.Itoa(int(purchasedTime.AddDate(0, 0, -1).UnixMilli())),
-				Type:      "PURCHGAME",
-				TotalPaid: 0,
-				Currency:  "POINTS",
-				ItemId:    itemId,
-				ItemPricing: Prices{
-					ItemId: itemId,
-					Price: Price{
-						Amount:   0,
-						Currency: "POINTS",
-					},
-					Limits:      LimitStruct(PR),
-					LicenseKind: SERVICE,
-				},
-				TitleId:     WiinoMaServiceTitleID,
-				ItemCode:    itemId,
-				ReferenceId: refId,
-			}
-
-			transactions = append(transactions, transaction)
-		}
-	} else {
-		transactions = append(transactions, Transactions{
+		transaction := Transactions{
 			TransactionId: "00000000",
-			// Is timestamp in milliseconds, placeholder one is Wed Oct 19 2022 18:02:46
-			Date:      "1666202566218",
-			Type:      "PURCHGAME",
-			TotalPaid: 0,
-			Currency:  "POINTS",
-			ItemId:    0,
-			ItemPricing: Prices{
-				ItemId: 0,
-				Price: Price{
-					Amount:   0,
-					Currency: "POINTS",
-				},
-				Limits:      LimitStruct(PR),
-				LicenseKind: PERMANENT,
-			},
-			TitleId: "000101006843494A",
-		})
+			// (Sketch) I don't know why but Wii no Ma won't acknowledge the entry if it isn't past a day from
+			// purchase.
+			Date:        strconv.Itoa(int(purchasedTime.AddDate(0, 0, -1).UnixMilli())),
+			Type:        "PURCHGAME",
+			TotalPaid:   0,
+			Currency:    "POINTS",
+			ItemId:      itemId,
+			ItemPricing: e.ItemPrice(itemId, 0, PR, SERVICE),
+			TitleId:     WiinoMaServiceTitleID,
+			ItemCode:    itemId,
+			ReferenceId: refId,
+		}
+
+		transactions = append(transactions, transaction)
 	}
 
-	e.AddCustomType(transactions)
+	offset, end := e.paginate(len(transactions))
+	e.AddCustomType(transactions[offset:end])
 	e.AddKVNode("ListResultTotalSize", strconv.Itoa(len(transactions)))
 }
 
-// genServiceUrl returns a URL with the given service against a configured URL.
-// Given a baseUrl of example.com and genServiceUrl("ias", "IdentityAuthenticationSOAP"),
+// genServiceUrl returns a URL with the given service against the configured URL of the current tenant.
+// Given a base URL of example.com and genServiceUrl(ctx, "ias", "IdentityAuthenticationSOAP"),
 // it would return http://ias.example.com/ias/services/ias/IdentityAuthenticationSOAP.
-func genServiceUrl(service string, path string) string {
-	return fmt.Sprintf("http://%s.%s/%s/services/%s", service, baseUrl, service, path)
-}
-
-func getECConfig(e *Envelope) {
-	contentUrl := fmt.Sprintf("http://ccs.%s/ccs/download", baseUrl)
-	e.AddKVNode("ContentPrefixURL", contentUrl)
-	e.AddKVNode("UncachedContentPrefixURL", contentUrl)
-	e.AddKVNode("SystemContentPrefixURL", contentUrl)
-	e.AddKVNode("SystemUncachedContentPrefixURL", contentUrl)
-
-	e.AddKVNode("EcsURL", genServiceUrl("ecs", "ECommerceSOAP"))
-	e.AddKVNode("IasURL", genServiceUrl("ias", "IdentityAuthenticationSOAP"))
-	e.AddKVNode("CasURL", genServiceUrl("cas", "CatalogingSOAP"))
-	e.AddKVNode("NusURL", genServiceUrl("nus", "NetUpdateSOAP"))
+// Tenants routed by path prefix have their prefix included.
+func genServiceUrl(ctx context.Context, service string, path string) string {
+	tenant := tenantFromContext(ctx)
+	return fmt.Sprintf("http://%s.%s%s/%s/services/%s", service, tenant.BaseURL, tenant.PathPrefix, service, path)
 }
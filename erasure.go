@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Erasure modes.
+const (
+	// ErasureAnonymize retains the account's tickets and balance without any identifying details,
+	// so that it can no longer be signed in to.
+	ErasureAnonymize = "anonymize"
+	// ErasureFull removes the account entirely, retaining only its transactions without an owner for aggregate statistics.
+	ErasureFull = "erase"
+)
+
+const (
+	QueryErasableAccount = `SELECT device_id, region, device_code, date_erased FROM userbase
+		WHERE account_id = $1
+		FOR UPDATE`
+
+	// AnonymizeAccountStatement replaces the device ID and token with values derived from the account ID,
+	// satisfying their unique indexes without being usable to authenticate.
+	AnonymizeAccountStatement = `UPDATE userbase SET device_id = -account_id, device_token = 'erased-' || account_id,
+			device_token_hashed = '', serial_number = NULL, device_code = NULL, date_erased = $2
+		WHERE account_id = $1`
+
+	EraseAccountStatement = `DELETE FROM userbase WHERE account_id = $1`
+
+	ScrubGiftRecipientStatement = `UPDATE gifts SET recipient_device_code = '' WHERE recipient_device_code = $1`
+
+	ScrubTransactionReferencesStatement = `UPDATE transactions SET reference_id = NULL WHERE account_id = $1`
+
+	DisownTransactionsStatement = `UPDATE transactions SET account_id = NULL, reference_id = NULL WHERE account_id = $1`
+
+	// ScrubAuditDevicesStatement and ScrubAuditAccountsStatement are the only updates permitted against audit_log.
+	ScrubAuditDevicesStatement = `UPDATE audit_log SET device_id = NULL WHERE account_id = $1 OR device_id = $2`
+
+	ScrubAuditAccountsStatement = `UPDATE audit_log SET device_id = NULL, account_id = NULL WHERE account_id = $1 OR device_id = $2`
+)
+
+var (
+	// ErrAccountErased is returned when anonymizing an account which has already been.
+	ErrAccountErased = errors.New("account has already been erased")
+	// ErrUnknownErasureMode is returned for modes other than ErasureAnonymize and ErasureFull.
+	ErrUnknownErasureMode = errors.New("mode must be anonymize or erase")
+)
+
+// anonymizedTables lists statements removing personal data tied to an account when it is anonymized.
+var anonymizedTables = []string{
+	`DELETE FROM link_codes WHERE account_id = $1`,
+	`DELETE FROM linked_accounts WHERE account_id = $1`,
+	`DELETE FROM recovery_codes WHERE account_id = $1`,
+	`DELETE FROM downloaded_contents WHERE account_id = $1`,
+	`DELETE FROM device_activity WHERE account_id = $1`,
+}
+
+// erasedTables lists statements removing all other data tied to an account when it is fully erased.
+var erasedTables = []string{
+	`DELETE FROM owned_titles WHERE account_id = $1`,
+	`DELETE FROM subscriptions WHERE account_id = $1`,
+	`DELETE FROM gifts WHERE sender_account_id = $1`,
+	`UPDATE point_cards SET account_id = NULL WHERE account_id = $1`,
+	`UPDATE fraud_holds SET account_id = NULL WHERE account_id = $1`,
+}
+
+// ErasureRequest describes an account to erase.
+type ErasureRequest struct {
+	AccountId int64  `json:"account_id"`
+	Mode      string `json:"mode"`
+}
+
+func init() {
+	registerAdminEndpoint("/accounts/erase", eraseAccountEndpoint)
+	portalMux.HandleFunc("/portal/erase", portalAuthenticated(portalEraseEndpoint))
+}
+
+// eraseAccount anonymizes or fully erases an account within a single transaction,
+// across its registration, tickets, transactions and audit entries.
+func eraseAccount(ctx context.Context, accountId int64, mode string) error {
+	if mode != ErasureAnonymize && mode != ErasureFull {
+		return ErrUnknownErasureMode
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var deviceId int64
+	var region, deviceCode *string
+	var dateErased *time.Time
+	err = tx.QueryRow(ctx, QueryErasableAccount, accountId).Scan(&deviceId, &region, &deviceCode, &dateErased)
+	if err == pgx.ErrNoRows {
+		return ErrUnknownAccount
+	} else if err != nil {
+		return err
+	}
+	if dateErased != nil && mode == ErasureAnonymize {
+		return ErrAccountErased
+	}
+
+	statements := anonymizedTables
+	if mode == ErasureFull {
+		statements = append(statements, erasedTables...)
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(ctx, statement, accountId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Gifts pending for this console can no longer be matched to it by its friend code.
+	if deviceCode != nil {
+		_, err = tx.Exec(ctx, ScrubGiftRecipientStatement, *deviceCode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mode == ErasureFull {
+		_, err = tx.Exec(ctx, DisownTransactionsStatement, accountId)
+		if err == nil {
+			_, err = tx.Exec(ctx, ScrubAuditAccountsStatement, accountId, deviceId)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, EraseAccountStatement, accountId)
+		}
+	} else {
+		_, err = tx.Exec(ctx, ScrubTransactionReferencesStatement, accountId)
+		if err == nil {
+			_, err = tx.Exec(ctx, ScrubAuditDevicesStatement, accountId, deviceId)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, AnonymizeAccountStatement, accountId, time.Now().UTC())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Fully erased accounts are not referenced by their own audit entry.
+	entry := AuditEntry{
+		Action:         "account/Erase",
+		ParametersHash: hashParameters(mode),
+	}
+	if mode == ErasureAnonymize {
+		entry.AccountId = &accountId
+	}
+	err = recordAudit(ctx, tx, entry)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	if region != nil {
+		invalidateRegistration(ctx, *region, int(deviceId))
+	}
+	portalSessions.DeleteMatching(func(_ string, identity portalIdentity) bool {
+		return identity.tenant == tenantFromContext(ctx) && identity.accountId == accountId
+	})
+	return nil
+}
+
+// writeErasureError writes the response for an error returned by eraseAccount.
+func writeErasureError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrUnknownErasureMode:
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+	case ErrUnknownAccount:
+		writeAdminError(w, http.StatusNotFound, err.Error())
+	case ErrAccountErased:
+		writeAdminError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("error erasing account: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+	}
+}
+
+// eraseAccountEndpoint anonymizes or fully erases the given account.
+func eraseAccountEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request ErasureRequest
+	err := readJSON(r, &request)
+	if err != nil || request.AccountId == 0 {
+		writeAdminError(w, http.StatusBadRequest, "account_id and mode are required")
+		return
+	}
+
+	err = eraseAccount(r.Context(), request.AccountId, request.Mode)
+	if err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// portalEraseEndpoint allows users to erase their own account, fully unless anonymization is requested.
+func portalEraseEndpoint(w http.ResponseWriter, r *http.Request, accountId int64) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	request := ErasureRequest{Mode: ErasureFull}
+	if r.ContentLength != 0 {
+		err := readJSON(r, &request)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+	}
+
+	err := eraseAccount(r.Context(), accountId, request.Mode)
+	if err != nil {
+		writeErasureError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
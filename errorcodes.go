@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrorCode represents a value returned within the ErrorCode field of a response.
+// Any non-zero value is considered a failure by the client.
+type ErrorCode int
+
+const (
+	// ErrorCodeSuccess indicates the request was handled successfully.
+	ErrorCodeSuccess ErrorCode = 0
+	// ErrorCodeGenericFailure is a general failure, typically as a result of server-side issues.
+	ErrorCodeGenericFailure ErrorCode = 2
+	// ErrorCodeRequestTimeout indicates the request could not be handled within its deadline.
+	// It is specific to WiiSOAP, and is treated by the client as any other failure.
+	ErrorCodeRequestTimeout ErrorCode = 3
+	// ErrorCodeServiceUnavailable indicates the service is temporarily unable to handle requests, such as during database outages.
+	// It is specific to WiiSOAP, and is sent alongside ServiceStandbyMode.
+	ErrorCodeServiceUnavailable ErrorCode = 4
+	// ErrorCodeInvalidRequest indicates the request was missing or contained invalid values.
+	ErrorCodeInvalidRequest ErrorCode = 5
+	// ErrorCodeRegistrationFailure indicates the console could not be registered or synchronized.
+	ErrorCodeRegistrationFailure ErrorCode = 7
+	// ErrorCodeTitleUnavailable indicates the requested title could not be found.
+	ErrorCodeTitleUnavailable ErrorCode = 9
+	// ErrorCodeParentalRestriction indicates the title's rating exceeds the console's parental restriction.
+	ErrorCodeParentalRestriction ErrorCode = 10
+	// ErrorCodeDeviceConflict indicates the console's device ID or serial number is registered to another console.
+	// It is specific to WiiSOAP, and is treated by the client as any other registration failure.
+	ErrorCodeDeviceConflict ErrorCode = 11
+	// ErrorCodeDeviceBanned indicates the console's device ID or serial number is banned.
+	// It is specific to WiiSOAP, and is sent alongside a DeviceStatus of B.
+	ErrorCodeDeviceBanned ErrorCode = 12
+	// ErrorCodeRegistrationsClosed indicates registrations are limited to allowlisted consoles, such as during a beta.
+	// It is specific to WiiSOAP, and is treated by the client as any other registration failure.
+	ErrorCodeRegistrationsClosed ErrorCode = 13
+	// ErrorCodeBaseTitleRequired indicates an add-on was purchased without owning the base title it requires.
+	// It is specific to WiiSOAP, and is treated by the client as any other purchase failure.
+	ErrorCodeBaseTitleRequired ErrorCode = 14
+	// ErrorCodeBroadcast indicates the response carries an announcement from operators rather than a failure.
+	// It is specific to WiiSOAP, and is treated by the client as any other error, displaying its message.
+	ErrorCodeBroadcast ErrorCode = 15
+)
+
+var (
+	// ErrDatabase is reported to clients in place of the underlying error whenever a database operation fails.
+	ErrDatabase = errors.New("failed to execute db operation")
+	// ErrUnauthorized is reported when a request fails authentication, should its failure be overridden to respond with an error.
+	ErrUnauthorized = errors.New("request failed authentication")
+	// ErrPanic is reported in place of the panic whenever an action fails unexpectedly.
+	ErrPanic = errors.New("action failed unexpectedly")
+)
+
+// Classes of failures whose error code and behavior may be overridden per action.
+const (
+	// FailureDatabase is any failure reported with ErrDatabase.
+	FailureDatabase = "database"
+	// FailureAuthentication is a request failing authentication, which is otherwise responded to with a SOAP fault.
+	FailureAuthentication = "authentication"
+	// FailureValidation is any failure reported with ErrorCodeInvalidRequest.
+	FailureValidation = "validation"
+)
+
+// Behaviors upon a failure.
+const (
+	// FailureBehaviorError responds with the error code as usual.
+	FailureBehaviorError = "error"
+	// FailureBehaviorStandby additionally sets ServiceStandbyMode, so that the shop displays its maintenance message.
+	FailureBehaviorStandby = "standby"
+	// FailureBehaviorFault responds with a SOAP fault rather than a response envelope.
+	FailureBehaviorFault = "fault"
+)
+
+// ErrorDefinition describes a known error code.
+type ErrorDefinition struct {
+	// Name is a short, human-readable identifier for this error.
+	Name string
+	// Behavior describes how the client reacts to this error.
+	Behavior string
+	// Template is the message sent when using the serious message style.
+	Template string
+}
+
+// errorCatalog describes all known error codes.
+var errorCatalog = map[ErrorCode]ErrorDefinition{
+	ErrorCodeGenericFailure: {
+		Name:     "GenericFailure",
+		Behavior: "The shop displays a generic error and returns to its start page.",
+		Template: "An error occurred while processing your request. Please try again later.",
+	},
+	ErrorCodeRequestTimeout: {
+		Name:     "RequestTimeout",
+		Behavior: "The shop displays a generic error and returns to its start page.",
+		Template: "The server is taking too long to respond. Please try again later.",
+	},
+	ErrorCodeServiceUnavailable: {
+		Name:     "ServiceUnavailable",
+		Behavior: "The shop displays its maintenance message.",
+		Template: "The service is temporarily unavailable. Please try again later.",
+	},
+	ErrorCodeInvalidRequest: {
+		Name:     "InvalidRequest",
+		Behavior: "The shop displays an error and aborts the current operation.",
+		Template: "The request could not be processed.",
+	},
+	ErrorCodeRegistrationFailure: {
+		Name:     "RegistrationFailure",
+		Behavior: "The shop is unable to continue past its registration step.",
+		Template: "Your console could not be registered. Please try again later.",
+	},
+	ErrorCodeTitleUnavailable: {
+		Name:     "TitleUnavailable",
+		Behavior: "The shop reports the title could not be found.",
+		Template: "This title is currently unavailable.",
+	},
+	ErrorCodeParentalRestriction: {
+		Name:     "ParentalRestriction",
+		Behavior: "The shop reports the title is restricted and aborts the current operation.",
+		Template: "This title cannot be accessed due to Parental Controls.",
+	},
+	ErrorCodeDeviceConflict: {
+		Name:     "DeviceConflict",
+		Behavior: "The shop is unable to continue past its registration step.",
+		Template: "Your console is already registered. Please contact support.",
+	},
+	ErrorCodeDeviceBanned: {
+		Name:     "DeviceBanned",
+		Behavior: "The shop reports the console is unable to connect and returns to the Wii Menu.",
+		Template: "This console is unable to use the shop. Please contact support.",
+	},
+	ErrorCodeRegistrationsClosed: {
+		Name:     "RegistrationsClosed",
+		Behavior: "The shop is unable to continue past its registration step.",
+		Template: "Registrations are currently closed. Please try again later.",
+	},
+	ErrorCodeBaseTitleRequired: {
+		Name:     "BaseTitleRequired",
+		Behavior: "The shop displays an error and aborts the purchase.",
+		Template: "This content requires a title you do not own. Please purchase it first.",
+	},
+	ErrorCodeBroadcast: {
+		Name:     "Broadcast",
+		Behavior: "The shop displays the message, and may be reopened to continue.",
+		Template: "The shop has an announcement. Please try again.",
+	},
+}
+
+const (
+	// ErrorStyleDetailed includes the reason and underlying error within messages, useful for development.
+	ErrorStyleDetailed = "detailed"
+	// ErrorStyleSerious uses production phrasing from templates, omitting internal details.
+	ErrorStyleSerious = "serious"
+)
+
+// ErrorsConfig selects how error messages are phrased, and allows overriding templates per error code.
+// Templates may contain {reason} and {error}, replaced by the reason and underlying error respectively.
+type ErrorsConfig struct {
+	Style     string                `xml:"Style,attr"`
+	Templates []ErrorTemplateConfig `xml:"Template"`
+	// Actions override the error code and behavior of failures per action.
+	Actions []ErrorActionConfig `xml:"Action"`
+}
+
+// ErrorTemplateConfig overrides the template for a single error code.
+type ErrorTemplateConfig struct {
+	Code     int    `xml:"Code,attr"`
+	Template string `xml:",chardata"`
+}
+
+// ErrorActionConfig overrides failures of a single action, as different client patches interpret error codes differently.
+type ErrorActionConfig struct {
+	// Name is an action such as ecs/PurchaseTitle, or * for every action lacking an override of the same class.
+	Name     string               `xml:"Name,attr"`
+	Failures []ErrorFailureConfig `xml:"Failure"`
+}
+
+// ErrorFailureConfig overrides a single class of failure.
+type ErrorFailureConfig struct {
+	// Class is one of database, authentication or validation.
+	Class string `xml:"Class,attr"`
+	// Code replaces the error code sent, if non-zero.
+	Code int `xml:"Code,attr"`
+	// Behavior is one of error, standby or fault, defaulting to error.
+	Behavior string `xml:"Behavior,attr"`
+}
+
+// failureOverride is a parsed override for a class of failure.
+type failureOverride struct {
+	code     ErrorCode
+	behavior string
+}
+
+var (
+	// errorStyle is the configured message style.
+	errorStyle = ErrorStyleDetailed
+
+	// failureOverrides holds overrides per action, keyed by action and then by failure class.
+	failureOverrides = map[string]map[string]failureOverride{}
+)
+
+// loadErrors applies the given error configuration.
+func loadErrors(config ErrorsConfig) error {
+	if config.Style != "" {
+		errorStyle = config.Style
+	}
+
+	for _, override := range config.Templates {
+		code := ErrorCode(override.Code)
+		definition := errorCatalog[code]
+		if definition.Name == "" {
+			definition.Name = "Error" + strconv.Itoa(override.Code)
+		}
+		definition.Template = strings.TrimSpace(override.Template)
+		errorCatalog[code] = definition
+	}
+
+	overrides := map[string]map[string]failureOverride{}
+	for _, action := range config.Actions {
+		if action.Name == "" {
+			return errors.New("error overrides must name an action")
+		}
+		if overrides[action.Name] == nil {
+			overrides[action.Name] = map[string]failureOverride{}
+		}
+
+		for _, failure := range action.Failures {
+			switch failure.Class {
+			case FailureDatabase, FailureAuthentication, FailureValidation:
+			default:
+				return fmt.Errorf("%s: unknown failure class %q", action.Name, failure.Class)
+			}
+
+			behavior := failure.Behavior
+			if behavior == "" {
+				behavior = FailureBehaviorError
+			}
+			switch behavior {
+			case FailureBehaviorError, FailureBehaviorStandby, FailureBehaviorFault:
+			default:
+				return fmt.Errorf("%s: Behavior must be %s, %s or %s", action.Name, FailureBehaviorError, FailureBehaviorStandby, FailureBehaviorFault)
+			}
+
+			overrides[action.Name][failure.Class] = failureOverride{
+				code:     ErrorCode(failure.Code),
+				behavior: behavior,
+			}
+		}
+	}
+
+	failureOverrides = overrides
+	return nil
+}
+
+// failureClass returns the class of the given failure, or an empty string if it may not be overridden.
+func failureClass(code ErrorCode, err error) string {
+	switch {
+	case errors.Is(err, ErrDatabase):
+		return FailureDatabase
+	case errors.Is(err, ErrUnauthorized):
+		return FailureAuthentication
+	case code == ErrorCodeInvalidRequest:
+		return FailureValidation
+	default:
+		return ""
+	}
+}
+
+// failureOverride returns the override for the given class of failure within this action, if any.
+// Overrides for the action itself are preferred over those for every action.
+func (e *Envelope) failureOverride(class string) (failureOverride, bool) {
+	if class == "" {
+		return failureOverride{}, false
+	}
+
+	for _, name := range []string{e.service + "/" + e.action, "*"} {
+		if override, exists := failureOverrides[name][class]; exists {
+			return override, true
+		}
+	}
+	return failureOverride{}, false
+}
+
+// String returns the name of this error code.
+func (c ErrorCode) String() string {
+	if definition, exists := errorCatalog[c]; exists {
+		return definition.Name
+	}
+
+	return "Error" + strconv.Itoa(int(c))
+}
+
+// formatError returns the message sent to clients for the given error.
+func formatError(code ErrorCode, reason string, err error) string {
+	if errorStyle != ErrorStyleSerious {
+		return fmt.Sprintf("%s: %v", reason, err)
+	}
+
+	template := errorCatalog[code].Template
+	if template == "" {
+		template = errorCatalog[ErrorCodeGenericFailure].Template
+	}
+
+	details := "<nil>"
+	if err != nil {
+		details = err.Error()
+	}
+
+	return strings.NewReplacer("{reason}", reason, "{error}", details).Replace(template)
+}
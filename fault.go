@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/antchfx/xmlquery"
+	"github.com/logrusorgru/aurora/v3"
+	"net/http"
+	"strings"
+)
+
+const (
+	// FaultCodeClient indicates the request was malformed and should not be resent unchanged.
+	FaultCodeClient = "soapenv:Client"
+	// FaultCodeServer indicates the request could not be processed due to server-side issues.
+	FaultCodeServer = "soapenv:Server"
+)
+
+// FaultEnvelope is a SOAP 1.1 envelope containing a single fault.
+type FaultEnvelope struct {
+	XMLName string    `xml:"soapenv:Envelope"`
+	SOAPEnv string    `xml:"xmlns:soapenv,attr"`
+	Body    FaultBody `xml:"soapenv:Body"`
+}
+
+// FaultBody holds a SOAP fault within its envelope.
+type FaultBody struct {
+	Fault Fault `xml:"soapenv:Fault"`
+}
+
+// Fault describes a transport-level error, as opposed to an ErrorCode within a response.
+type Fault struct {
+	FaultCode   string `xml:"faultcode"`
+	FaultString string `xml:"faultstring"`
+}
+
+// writeFault responds with a SOAP fault and the given HTTP status.
+func writeFault(w http.ResponseWriter, status int, code string, reason string) {
+	contents, err := xml.Marshal(FaultEnvelope{
+		SOAPEnv: "http://schemas.xmlsoap.org/soap/envelope/",
+		Body: FaultBody{
+			Fault: Fault{
+				FaultCode:   code,
+				FaultString: reason,
+			},
+		},
+	})
+	if err != nil {
+		http.Error(w, reason, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(contents)
+	debugPrint("Failed to handle request: ", aurora.Red(reason))
+}
+
+// actionFromBody determines the service and action from the first element within a SOAP body,
+// such as <ecs:CheckDeviceStatus xmlns:ecs="urn:ecs.wsapi.broadon.com">.
+// It is used for clients which do not send a SOAPAction header.
+func actionFromBody(body []byte) (string, string) {
+	doc, err := xmlquery.Parse(bytes.NewReader(body))
+	if err != nil {
+		return "", ""
+	}
+
+	soapBody := xmlquery.FindOne(doc, "//*[local-name()='Envelope']/*[local-name()='Body']")
+	if soapBody == nil {
+		return "", ""
+	}
+
+	for child := soapBody.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != xmlquery.ElementNode {
+			continue
+		}
+
+		return parseAction(strings.TrimSuffix(child.NamespaceURI, "/") + "/" + child.Data)
+	}
+
+	return "", ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/wii-tools/wadlib"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Upstream kinds.
+const (
+	// UpstreamWiiSOAP is another WiiSOAP instance, queried via its admin API.
+	UpstreamWiiSOAP = "wiisoap"
+	// UpstreamNUS is a NUS-style content server, queried for title metadata such as /ccs/download.
+	UpstreamNUS = "nus"
+)
+
+const (
+	// DefaultFederationCacheTTL is how long upstream lookups are cached unless configured otherwise.
+	DefaultFederationCacheTTL = time.Hour
+	// FederationTimeout bounds every request made to an upstream.
+	FederationTimeout = 10 * time.Second
+	// MaxFederatedResponseSize bounds responses read from upstreams, as TMDs are far smaller.
+	MaxFederatedResponseSize = 1 << 20
+)
+
+// ErrUpstreamTitleUnknown is returned when an upstream does not know the requested title.
+var ErrUpstreamTitleUnknown = errors.New("title is unknown to upstream")
+
+// FederationConfig configures upstream servers queried for titles not within the local catalog.
+type FederationConfig struct {
+	// CacheTTL is how long upstream lookups are cached for, defaulting to an hour.
+	CacheTTL  string           `xml:"CacheTTL,attr"`
+	Upstreams []UpstreamConfig `xml:"Upstream"`
+}
+
+// UpstreamConfig describes a single trusted upstream, queried in the order configured.
+type UpstreamConfig struct {
+	// Kind is one of wiisoap or nus, defaulting to wiisoap.
+	Kind string `xml:"Kind,attr"`
+	// URL is the admin API of a WiiSOAP upstream, or the base path NUS-style content is served beneath.
+	URL string `xml:"URL,attr"`
+	// Token is sent as a bearer token, as required by a WiiSOAP upstream's admin API.
+	Token string `xml:"Token,attr"`
+	// Mirror imports titles found upstream into the local titles table, rather than only proxying their metadata.
+	Mirror bool `xml:"Mirror,attr"`
+}
+
+// federationKey identifies an upstream lookup of a title on behalf of a tenant.
+type federationKey struct {
+	tenant  string
+	titleId string
+}
+
+var (
+	// upstreams are the configured upstreams.
+	upstreams []UpstreamConfig
+
+	// federatedTitles caches titles found upstream, alongside nil for those known to be unavailable.
+	federatedTitles = newTTLCache[federationKey, *TitleMetadata]()
+
+	// federationClient is used for all requests made to upstreams.
+	federationClient = &http.Client{Timeout: FederationTimeout}
+)
+
+func init() {
+	federatedTitles.SetTTL(DefaultFederationCacheTTL)
+	registerJob("prune-federated-titles", time.Minute, func() error {
+		federatedTitles.Prune()
+		return nil
+	})
+}
+
+// loadFederation validates and applies the given federation configuration.
+func loadFederation(config FederationConfig) error {
+	if config.CacheTTL != "" {
+		ttl, err := time.ParseDuration(config.CacheTTL)
+		if err != nil {
+			return err
+		}
+		federatedTitles.SetTTL(ttl)
+	}
+
+	upstreams = nil
+	for _, upstream := range config.Upstreams {
+		if upstream.Kind == "" {
+			upstream.Kind = UpstreamWiiSOAP
+		}
+		if upstream.Kind != UpstreamWiiSOAP && upstream.Kind != UpstreamNUS {
+			return fmt.Errorf("upstream Kind must be %s or %s", UpstreamWiiSOAP, UpstreamNUS)
+		}
+
+		parsed, err := url.Parse(upstream.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return fmt.Errorf("upstream URL %q must be an HTTP or HTTPS URL", upstream.URL)
+		}
+		upstream.URL = strings.TrimSuffix(upstream.URL, "/")
+
+		upstreams = append(upstreams, upstream)
+	}
+	return nil
+}
+
+// lookupFederatedTitle returns metadata for the given title from the first upstream to know it, or nil if none do.
+// Upstreams failing to respond are logged and skipped, so that they do not prevent falling back to others.
+func lookupFederatedTitle(ctx context.Context, titleId string) (*TitleMetadata, error) {
+	if len(upstreams) == 0 {
+		return nil, nil
+	}
+
+	key := federationKey{tenant: tenantFromContext(ctx).Name, titleId: titleId}
+	if title, cached := federatedTitles.Get(key); cached {
+		return title, nil
+	}
+
+	definitive := true
+	for _, upstream := range upstreams {
+		title, err := upstream.lookupTitle(ctx, titleId)
+		if err == ErrUpstreamTitleUnknown {
+			continue
+		} else if err != nil {
+			log.Printf("error querying upstream %s: %v\n", upstream.URL, err)
+			definitive = false
+			continue
+		}
+
+		if upstream.Mirror {
+			_, err = pool.Exec(ctx, UpsertTitleStatement, title.TitleId, title.Version, title.Name, title.ContentSize, title.ContentCount)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		federatedTitles.Set(key, title)
+		return title, nil
+	}
+
+	// Titles are only cached as unavailable if every upstream said so.
+	if definitive {
+		federatedTitles.Set(key, nil)
+	}
+	return nil, nil
+}
+
+// lookupTitle queries this upstream for the given title.
+func (u UpstreamConfig) lookupTitle(ctx context.Context, titleId string) (*TitleMetadata, error) {
+	switch u.Kind {
+	case UpstreamNUS:
+		contents, err := u.fetch(ctx, u.URL+"/"+url.PathEscape(titleId)+"/tmd")
+		if err != nil {
+			return nil, err
+		}
+
+		var wad wadlib.WAD
+		err = wad.LoadTMD(contents)
+		if err != nil {
+			return nil, err
+		}
+
+		described := describeTMD(wad.TMD)
+		if described.TitleId != strings.ToUpper(titleId) {
+			return nil, errors.New("upstream returned metadata for another title")
+		}
+		return &TitleMetadata{
+			TitleId:      titleId,
+			Version:      described.Version,
+			ContentSize:  int64(described.ContentSize),
+			ContentCount: described.ContentCount,
+		}, nil
+	default:
+		contents, err := u.fetch(ctx, u.URL+"/titles?title_id="+url.QueryEscape(titleId))
+		if err != nil {
+			return nil, err
+		}
+
+		var title TitleMetadata
+		err = json.Unmarshal(contents, &title)
+		if err != nil {
+			return nil, err
+		}
+		if title.TitleId != titleId {
+			return nil, errors.New("upstream returned metadata for another title")
+		}
+		return &title, nil
+	}
+}
+
+// fetch performs a GET request to this upstream, returning its body.
+func (u UpstreamConfig) fetch(ctx context.Context, target string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+	}
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrUpstreamTitleUnknown
+	default:
+		return nil, fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, MaxFederatedResponseSize))
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Events fraud rules may apply to.
+const (
+	// FraudEventRegistration counts registrations from a single client address.
+	FraudEventRegistration = "registration"
+	// FraudEventRedemption counts points card redemptions attempted by an account, including invalid codes.
+	FraudEventRedemption = "redemption"
+	// FraudEventPoints sums points credited to an account by redemptions.
+	FraudEventPoints = "points"
+	// FraudEventPurchase counts titles purchased by an account.
+	FraudEventPurchase = "purchase"
+)
+
+// Actions taken once a fraud rule is triggered, in increasing severity.
+const (
+	// FraudActionLog only logs the triggering request.
+	FraudActionLog = "log"
+	// FraudActionHold withholds the points of a redemption until reviewed via the admin API.
+	FraudActionHold = "hold"
+	// FraudActionBlock refuses the triggering request.
+	FraudActionBlock = "block"
+)
+
+// Review states of a held redemption.
+const (
+	FraudHoldPending  = "pending"
+	FraudHoldApproved = "approved"
+	FraudHoldRejected = "rejected"
+)
+
+const (
+	InsertFraudHoldStatement = `INSERT INTO fraud_holds (account_id, rule, points)
+		VALUES ($1, $2, $3)
+		RETURNING hold_id`
+
+	QueryFraudHolds = `SELECT hold_id, account_id, rule, points, status, date_held, date_reviewed
+		FROM fraud_holds
+		WHERE status = $1
+		ORDER BY hold_id`
+
+	// QueryReviewableFraudHold locks a hold so that it cannot be reviewed twice concurrently.
+	QueryReviewableFraudHold = `SELECT hold_id, account_id, rule, points, status, date_held, date_reviewed
+		FROM fraud_holds
+		WHERE hold_id = $1
+		FOR UPDATE`
+
+	ReviewFraudHoldStatement = `UPDATE fraud_holds SET status = $2, date_reviewed = $3 WHERE hold_id = $1`
+)
+
+var (
+	// ErrFraudBlocked is returned when a request triggers a fraud rule which blocks it.
+	ErrFraudBlocked = errors.New("request refused by anti-fraud rules")
+	// ErrRedemptionHeld is returned when a redemption's points are withheld until reviewed.
+	ErrRedemptionHeld = errors.New("redemption is held for review")
+)
+
+// FraudConfig configures velocity rules flagging or blocking suspicious patterns.
+type FraudConfig struct {
+	Rules []FraudRuleConfig `xml:"Rule"`
+}
+
+// FraudRuleConfig triggers once the occurrences of an event for a single subject within a window exceed a threshold.
+type FraudRuleConfig struct {
+	Name string `xml:"Name,attr"`
+	// Event is one of registration, redemption, points or purchase.
+	Event string `xml:"Event,attr"`
+	// Threshold is the most occurrences, or points for the points event, permitted within the window.
+	Threshold int `xml:"Threshold,attr"`
+	// Window is how far back occurrences are counted, such as 1h.
+	Window string `xml:"Window,attr"`
+	// Action is one of log, hold or block. Only the redemption and points events may be held.
+	Action string `xml:"Action,attr"`
+}
+
+// FraudHold describes a redemption whose points are withheld until reviewed.
+type FraudHold struct {
+	HoldId    int    `json:"hold_id"`
+	AccountId *int64 `json:"account_id"`
+	// Rule is the name of the rule which held this redemption.
+	Rule         string     `json:"rule"`
+	Points       int        `json:"points"`
+	Status       string     `json:"status"`
+	DateHeld     time.Time  `json:"date_held"`
+	DateReviewed *time.Time `json:"date_reviewed"`
+}
+
+// FraudReviewRequest approves or rejects a held redemption.
+type FraudReviewRequest struct {
+	HoldId int `json:"hold_id"`
+	// Decision is either approve, crediting the withheld points, or reject, forfeiting them.
+	Decision string `json:"decision"`
+}
+
+// fraudRule is a parsed fraud rule.
+type fraudRule struct {
+	name      string
+	event     string
+	threshold int
+	window    time.Duration
+	action    string
+}
+
+// velocityKey identifies the occurrences counted by a rule for a single subject.
+type velocityKey struct {
+	tenant  string
+	rule    string
+	subject string
+}
+
+// velocityOccurrence is a single occurrence of an event.
+type velocityOccurrence struct {
+	date   time.Time
+	amount int
+}
+
+// fraudSeverity orders actions, so that the most severe of several triggered rules is taken.
+var fraudSeverity = map[string]int{
+	FraudActionLog:   1,
+	FraudActionHold:  2,
+	FraudActionBlock: 3,
+}
+
+// holdableFraudEvents lists the events whose requests may be held, as they credit points which can be withheld.
+var holdableFraudEvents = map[string]bool{
+	FraudEventRedemption: true,
+	FraudEventPoints:     true,
+}
+
+var (
+	// fraudRules are the configured fraud rules.
+	fraudRules []fraudRule
+
+	// velocityLock guards velocityWindows.
+	velocityLock sync.Mutex
+	// velocityWindows holds recent occurrences counted by each rule, oldest first.
+	velocityWindows = map[velocityKey][]velocityOccurrence{}
+)
+
+func init() {
+	registerJob("prune-fraud-windows", time.Minute, func() error {
+		pruneVelocityWindows()
+		return nil
+	})
+	registerAdminEndpoint("/fraud/holds", fraudHoldsEndpoint)
+	registerAdminEndpoint("/fraud/holds/review", fraudReviewEndpoint)
+}
+
+// loadFraudRules validates and applies the given fraud rules.
+func loadFraudRules(config FraudConfig) error {
+	rules := make([]fraudRule, 0, len(config.Rules))
+	names := map[string]bool{}
+	for _, ruleConfig := range config.Rules {
+		if ruleConfig.Name == "" || names[ruleConfig.Name] {
+			return errors.New("fraud rules must have unique names")
+		}
+		names[ruleConfig.Name] = true
+
+		switch ruleConfig.Event {
+		case FraudEventRegistration, FraudEventRedemption, FraudEventPoints, FraudEventPurchase:
+		default:
+			return fmt.Errorf("fraud rule %s: unknown event %q", ruleConfig.Name, ruleConfig.Event)
+		}
+		if _, exists := fraudSeverity[ruleConfig.Action]; !exists {
+			return fmt.Errorf("fraud rule %s: Action must be %s, %s or %s", ruleConfig.Name, FraudActionLog, FraudActionHold, FraudActionBlock)
+		}
+		if ruleConfig.Action == FraudActionHold && !holdableFraudEvents[ruleConfig.Event] {
+			return fmt.Errorf("fraud rule %s: %s events cannot be held", ruleConfig.Name, ruleConfig.Event)
+		}
+		if ruleConfig.Threshold <= 0 {
+			return fmt.Errorf("fraud rule %s: Threshold must be positive", ruleConfig.Name)
+		}
+
+		window, err := time.ParseDuration(ruleConfig.Window)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("fraud rule %s: invalid Window %q", ruleConfig.Name, ruleConfig.Window)
+		}
+
+		rules = append(rules, fraudRule{
+			name:      ruleConfig.Name,
+			event:     ruleConfig.Event,
+			threshold: ruleConfig.Threshold,
+			window:    window,
+			action:    ruleConfig.Action,
+		})
+	}
+
+	fraudRules = rules
+	return nil
+}
+
+// checkFraud records an occurrence of the given event for a subject, such as a client address or account ID,
+// returning the most severe rule it triggers, or nil if none.
+// Occurrences are counted per instance, so that thresholds apply to each instance of a deployment separately.
+func checkFraud(ctx context.Context, event string, subject string, amount int) *fraudRule {
+	tenant := tenantFromContext(ctx).Name
+	now := time.Now()
+
+	velocityLock.Lock()
+	defer velocityLock.Unlock()
+
+	var triggered *fraudRule
+	for i := range fraudRules {
+		rule := &fraudRules[i]
+		if rule.event != event {
+			continue
+		}
+
+		key := velocityKey{tenant: tenant, rule: rule.name, subject: subject}
+		occurrences := append(pruneOccurrences(velocityWindows[key], now.Add(-rule.window)), velocityOccurrence{date: now, amount: amount})
+		velocityWindows[key] = occurrences
+
+		total := 0
+		for _, occurrence := range occurrences {
+			total += occurrence.amount
+		}
+		if total <= rule.threshold {
+			continue
+		}
+
+		log.Printf("fraud rule %s triggered by %s %s within tenant %s: %d within %s, action %s", rule.name, event, subject, tenant, total, rule.window, rule.action)
+		incrementMetric("fraud_rule_" + rule.name)
+		if triggered == nil || fraudSeverity[rule.action] > fraudSeverity[triggered.action] {
+			triggered = rule
+		}
+	}
+	return triggered
+}
+
+// pruneOccurrences removes occurrences before the given time.
+func pruneOccurrences(occurrences []velocityOccurrence, since time.Time) []velocityOccurrence {
+	for len(occurrences) > 0 && occurrences[0].date.Before(since) {
+		occurrences = occurrences[1:]
+	}
+	return occurrences
+}
+
+// pruneVelocityWindows removes occurrences which no longer count towards any rule, alongside subjects left without any.
+func pruneVelocityWindows() {
+	windows := map[string]time.Duration{}
+	for _, rule := range fraudRules {
+		windows[rule.name] = rule.window
+	}
+
+	velocityLock.Lock()
+	defer velocityLock.Unlock()
+
+	now := time.Now()
+	for key, occurrences := range velocityWindows {
+		occurrences = pruneOccurrences(occurrences, now.Add(-windows[key.rule]))
+		if len(occurrences) == 0 {
+			delete(velocityWindows, key)
+		} else {
+			velocityWindows[key] = occurrences
+		}
+	}
+}
+
+// enforceFraud records an occurrence of the given event for a subject, refusing this request with the given code
+// should it trigger a rule which blocks it. The triggered rule is returned, alongside whether the request may proceed.
+func (e *Envelope) enforceFraud(code ErrorCode, event string, subject string, amount int) (*fraudRule, bool) {
+	rule := checkFraud(e.ctx, event, subject, amount)
+	if rule != nil && rule.action == FraudActionBlock {
+		e.Error(code, "request refused", ErrFraudBlocked)
+		return rule, false
+	}
+	return rule, true
+}
+
+// holds returns whether a triggered rule withholds the points of a redemption.
+func (r *fraudRule) holds() bool {
+	return r != nil && r.action == FraudActionHold
+}
+
+// scanFraudHold scans a single hold selected by QueryFraudHolds or QueryReviewableFraudHold.
+func scanFraudHold(row pgx.Row) (FraudHold, error) {
+	var hold FraudHold
+	err := row.Scan(&hold.HoldId, &hold.AccountId, &hold.Rule, &hold.Points, &hold.Status, &hold.DateHeld, &hold.DateReviewed)
+	return hold, err
+}
+
+// fraudHoldsEndpoint lists held redemptions, those pending review unless another status is given.
+func fraudHoldsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = FraudHoldPending
+	}
+
+	rows, err := pool.Query(r.Context(), QueryFraudHolds, status)
+	if err != nil {
+		log.Printf("error querying fraud holds: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	holds := []FraudHold{}
+	for rows.Next() {
+		hold, err := scanFraudHold(rows)
+		if err != nil {
+			log.Printf("error querying fraud holds: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		holds = append(holds, hold)
+	}
+
+	writeJSON(w, http.StatusOK, holds)
+}
+
+// fraudReviewEndpoint approves or rejects a held redemption.
+// Approving credits the withheld points and records the redemption's transaction, whereas rejecting forfeits them,
+// as the points card itself remains redeemed either way.
+func fraudReviewEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request FraudReviewRequest
+	err := readJSON(r, &request)
+	if err != nil || request.HoldId == 0 {
+		writeAdminError(w, http.StatusBadRequest, "hold_id is required")
+		return
+	}
+	if request.Decision != "approve" && request.Decision != "reject" {
+		writeAdminError(w, http.StatusBadRequest, "decision must be approve or reject")
+		return
+	}
+
+	tx, err := pool.Begin(r.Context())
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	hold, err := scanFraudHold(tx.QueryRow(r.Context(), QueryReviewableFraudHold, request.HoldId))
+	if err == pgx.ErrNoRows {
+		writeAdminError(w, http.StatusNotFound, "hold does not exist")
+		return
+	} else if err != nil {
+		log.Printf("error querying fraud hold: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	if hold.Status != FraudHoldPending {
+		writeAdminError(w, http.StatusConflict, "hold has already been reviewed")
+		return
+	}
+
+	hold.Status = FraudHoldRejected
+	if request.Decision == "approve" {
+		if hold.AccountId == nil {
+			writeAdminError(w, http.StatusGone, "the account for this hold has been erased")
+			return
+		}
+		hold.Status = FraudHoldApproved
+
+		err = creditPoints(r.Context(), tx, *hold.AccountId, hold.Points)
+		if err == nil {
+			_, err = recordTransaction(r.Context(), tx, Transaction{
+				AccountId: *hold.AccountId,
+				Type:      TransactionPointsCard,
+				TotalPaid: 0,
+			})
+		}
+		if err != nil {
+			log.Printf("error crediting held points: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+	}
+
+	reviewed := time.Now().UTC()
+	hold.DateReviewed = &reviewed
+	_, err = tx.Exec(r.Context(), ReviewFraudHoldStatement, hold.HoldId, hold.Status, reviewed)
+	if err != nil {
+		log.Printf("error reviewing fraud hold: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	err = tx.Commit(r.Context())
+	if err != nil {
+		log.Printf("error committing review: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	incrementMetric("fraud_holds_" + hold.Status)
+	writeJSON(w, http.StatusOK, hold)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	wiino "github.com/RiiConnect24/wiino/golang"
+	"strconv"
+	"sync"
+)
+
+// HardwareModelRVL is the hardware model of a retail Wii.
+const HardwareModelRVL = 1
+
+// friendCodeAreas maps a console region to the area code embedded within its friend code.
+var friendCodeAreas = map[string]uint8{
+	"JPN": 0,
+	"USA": 1,
+	"EUR": 2,
+	"TWN": 3,
+	"KOR": 4,
+	"HKG": 5,
+	"CHN": 6,
+}
+
+// wiinoLock guards usage of wiino, as it decodes friend codes into shared global state.
+var wiinoLock sync.Mutex
+
+// FriendCode describes the values encoded within a Wii friend code.
+type FriendCode struct {
+	Code          uint64
+	HollywoodId   uint32
+	IdCounter     uint16
+	HardwareModel string
+	AreaCode      string
+}
+
+// String returns the friend code as the 16-digit number displayed to users.
+func (f FriendCode) String() string {
+	return fmt.Sprintf("%016d", f.Code)
+}
+
+// parseFriendCode validates and decodes a friend code as sent by the console.
+func parseFriendCode(deviceCode string) (*FriendCode, error) {
+	code, err := strconv.ParseUint(deviceCode, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	wiinoLock.Lock()
+	defer wiinoLock.Unlock()
+
+	if wiino.NWC24CheckUserID(code) != 0 {
+		return nil, errors.New("friend code checksum mismatch")
+	}
+
+	return &FriendCode{
+		Code:          code,
+		HollywoodId:   wiino.NWC24GetHollywoodID(code),
+		IdCounter:     wiino.NWC24GetIDCounter(code),
+		HardwareModel: wiino.NWC24GetHardwareModel(code),
+		AreaCode:      wiino.NWC24GetAreaCode(code),
+	}, nil
+}
+
+// makeFriendCode derives a friend code for the given device ID within a region.
+// The counter is incremented by the console each time its friend code is regenerated, i.e. after a format.
+func makeFriendCode(deviceId uint32, counter uint16, region string) (*FriendCode, error) {
+	area, exists := friendCodeAreas[region]
+	if !exists {
+		return nil, errors.New("unknown region " + region)
+	}
+
+	// Only 5 bits are available to store the counter.
+	if counter > 0x1F {
+		return nil, errors.New("counter exceeds maximum value")
+	}
+
+	wiinoLock.Lock()
+	code := wiino.NWC24MakeUserID(deviceId, counter, HardwareModelRVL, area)
+	wiinoLock.Unlock()
+
+	return parseFriendCode(strconv.FormatUint(code, 10))
+}
+
+// generateDeviceCode issues a valid friend code for consoles lacking one, such as those running homebrew clients.
+func generateDeviceCode(e *Envelope) {
+	counter := uint64(0)
+	if value, err := e.getKey("IdCounter"); err == nil {
+		counter, err = strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			e.Error(ErrorCodeRegistrationFailure, "invalid counter", err)
+			return
+		}
+	}
+
+	friendCode, err := makeFriendCode(uint32(e.DeviceId()), uint16(counter), e.Region())
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "unable to generate friend code", err)
+		return
+	}
+
+	e.AddKVNode("DeviceCode", friendCode.String())
+	e.AddKVNode("IdCounter", strconv.Itoa(int(friendCode.IdCounter)))
+}
+
+// validateDeviceCode reports whether a given friend code is valid, and what it contains.
+// It is intended for usage by support tooling.
+func validateDeviceCode(e *Envelope) {
+	deviceCode, err := e.getKey("DeviceCode")
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "missing device code", err)
+		return
+	}
+
+	friendCode, err := parseFriendCode(deviceCode)
+	if err != nil {
+		e.AddKVNode("Valid", "false")
+		return
+	}
+
+	e.AddKVNode("Valid", "true")
+	e.AddKVNode("DeviceCode", friendCode.String())
+	e.AddKVNode("HardwareModel", friendCode.HardwareModel)
+	e.AddKVNode("AreaCode", friendCode.AreaCode)
+	e.AddKVNode("IdCounter", strconv.Itoa(int(friendCode.IdCounter)))
+	e.AddKVNode("DeviceIdMatches", strconv.FormatBool(friendCode.HollywoodId == uint32(e.DeviceId())))
+}
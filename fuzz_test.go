@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"testing"
+)
+
+// useUnreachableTenant replaces all tenants with one whose database is never connected to, restoring them once the test ends.
+func useUnreachableTenant(f *testing.F) {
+	// Connections are never attempted, as every query is made with a cancelled context.
+	config, err := pgxpool.ParseConfig("postgres://fuzz@127.0.0.1:1/fuzz")
+	if err != nil {
+		f.Fatal(err)
+	}
+	config.LazyConnect = true
+	db, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	previousTenants, previousDefault := tenants, defaultTenant
+	tenants = nil
+	addTenant(&Tenant{Name: "default", db: db})
+	defaultTenant = tenants[0]
+	f.Cleanup(func() {
+		db.Close()
+		tenants, defaultTenant = previousTenants, previousDefault
+	})
+}
+
+// FuzzEnvelope feeds arbitrary request bodies through the checks, envelope decoder and handler of the action they name,
+// exactly as an unauthenticated request from the internet would be, with the database unreachable.
+// Every canned console request seeds the corpus; run it via go test -fuzz=FuzzEnvelope.
+func FuzzEnvelope(f *testing.F) {
+	for _, request := range testclient.Requests {
+		f.Add(testclient.Envelope(request.Service, request.Action, testclient.DefaultConsole, "ETFuzz", request.Fields(testclient.DefaultConsole)))
+	}
+
+	useUnreachableTenant(f)
+	route := newRouter()
+
+	// Handlers reaching the database fail immediately, as they would during an outage.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if checkXMLDocument(data) != nil {
+			return
+		}
+
+		service, actionName := actionFromBody(data)
+		action, found := route.Lookup(service, actionName)
+		if !found {
+			return
+		}
+
+		e, err := NewEnvelope(service, actionName, data)
+		if err != nil {
+			return
+		}
+		e.ctx = cancelled
+
+		// Values interpreted by many handlers prior to reaching the database.
+		e.AccountId()
+		e.listPagination(DefaultHistoryLimit, MaxHistoryLimit)
+		if serialNo, err := e.SerialNumber(); err == nil {
+			parseSerialNumber(serialNo)
+		}
+		if deviceCode, err := e.getKey("DeviceCode"); err == nil {
+			parseFriendCode(deviceCode)
+		}
+		if deviceToken, err := e.getKey("DeviceToken"); err == nil {
+			determineTokenFormat(deviceToken)
+		}
+
+		action.Callback(e)
+
+		// Responses may echo request values, which must always serialize.
+		e.AddKVNode("MessageId", e.Body.Response.MessageId)
+		if _, err := xml.Marshal(e); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
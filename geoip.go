@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GeoIPTimeout is how long a single lookup may take before the registration proceeds unchecked.
+const GeoIPTimeout = 3 * time.Second
+
+var ErrGeoIPUnknownProvider = errors.New("unknown GeoIP provider")
+
+// GeoIPConfig configures checking the country consoles register from against the country they claim.
+type GeoIPConfig struct {
+	// Provider names the GeoIP provider to use, such as csv or http. Checks are disabled if unset.
+	Provider string `xml:"Provider,attr"`
+	// Path is the database file read by file-based providers.
+	Path string `xml:"Path,attr"`
+	// URL is requested by the http provider, with {ip} replaced by the client's address.
+	URL string `xml:"URL,attr"`
+	// Reject refuses mismatched registrations, rather than only recording them.
+	Reject bool `xml:"Reject,attr"`
+	// ForwardedHeader is read for the client's address when WiiSOAP runs behind a proxy, such as X-Forwarded-For.
+	ForwardedHeader string `xml:"ForwardedHeader,attr"`
+}
+
+// GeoIPProvider resolves an address to an ISO 3166 country code.
+// An empty country with no error indicates the address is unknown to the provider.
+type GeoIPProvider interface {
+	Country(ctx context.Context, ip net.IP) (string, error)
+}
+
+// geoIPProviders maps a provider name to a function creating it from configuration.
+var geoIPProviders = map[string]func(config GeoIPConfig) (GeoIPProvider, error){}
+
+var (
+	// geoIP is the configured provider, or nil if checks are disabled.
+	geoIP GeoIPProvider
+	// geoIPConfig holds the configuration geoIP was created with.
+	geoIPConfig GeoIPConfig
+)
+
+// wiiRegions maps countries to the console region sold within them.
+// Consoles registering from a country of their own region are never considered mismatched,
+// as neighbouring countries commonly share hardware.
+var wiiRegions = map[string]string{
+	"JP": "JPN",
+	"KR": "KOR",
+
+	"US": "USA", "CA": "USA", "MX": "USA", "BR": "USA", "AR": "USA", "CL": "USA", "CO": "USA",
+	"PE": "USA", "VE": "USA", "EC": "USA", "GT": "USA", "PA": "USA", "CR": "USA", "PR": "USA",
+
+	"GB": "EUR", "IE": "EUR", "FR": "EUR", "DE": "EUR", "IT": "EUR", "ES": "EUR", "PT": "EUR",
+	"NL": "EUR", "BE": "EUR", "LU": "EUR", "CH": "EUR", "AT": "EUR", "DK": "EUR", "NO": "EUR",
+	"SE": "EUR", "FI": "EUR", "PL": "EUR", "CZ": "EUR", "SK": "EUR", "HU": "EUR", "GR": "EUR",
+	"RU": "EUR", "ZA": "EUR", "AU": "EUR", "NZ": "EUR",
+}
+
+func init() {
+	registerGeoIPProvider("csv", newCSVGeoIP)
+	registerGeoIPProvider("http", newHTTPGeoIP)
+}
+
+// registerGeoIPProvider makes a provider available by name within configuration.
+// It is intended to be called from init functions within any module.
+func registerGeoIPProvider(name string, factory func(config GeoIPConfig) (GeoIPProvider, error)) {
+	geoIPProviders[name] = factory
+}
+
+// loadGeoIP creates the configured provider, if any.
+func loadGeoIP(config GeoIPConfig) error {
+	if config.Provider == "" {
+		return nil
+	}
+
+	factory, exists := geoIPProviders[config.Provider]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrGeoIPUnknownProvider, config.Provider)
+	}
+
+	provider, err := factory(config)
+	if err != nil {
+		return err
+	}
+
+	geoIP = provider
+	geoIPConfig = config
+	return nil
+}
+
+// clientAddress returns the address a request originated from, preferring the configured forwarding header.
+// Only the first address within the header is used, as it is the one the proxy received.
+func clientAddress(r *http.Request) net.IP {
+	if geoIPConfig.ForwardedHeader != "" {
+		forwarded, _, _ := strings.Cut(r.Header.Get(geoIPConfig.ForwardedHeader), ",")
+		if ip := net.ParseIP(strings.TrimSpace(forwarded)); ip != nil {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// countriesMismatch returns whether a console claiming one country plausibly registered from another.
+// Countries within the console's own region are permitted.
+func countriesMismatch(region string, claimed string, resolved string) bool {
+	claimed, resolved = strings.ToUpper(claimed), strings.ToUpper(resolved)
+	if resolved == "" || claimed == resolved {
+		return false
+	}
+
+	return wiiRegions[resolved] != region
+}
+
+// checkGeoCountry resolves the country this request originated from, reporting whether it mismatches the claimed country.
+// Lookup failures are logged and treated as matching, so that an unavailable provider never prevents registration.
+func (e *Envelope) checkGeoCountry() (string, bool) {
+	if geoIP == nil || e.clientIP == nil {
+		return "", false
+	}
+
+	lookupCtx, cancel := context.WithTimeout(e.ctx, GeoIPTimeout)
+	defer cancel()
+
+	resolved, err := geoIP.Country(lookupCtx, e.clientIP)
+	if err != nil {
+		log.Printf("unable to resolve country for %s: %v", e.clientIP, err)
+		return "", false
+	}
+
+	return resolved, countriesMismatch(e.Region(), e.Country(), resolved)
+}
+
+// recordGeoMismatch logs a mismatched registration, and records it within the audit log for operators to review.
+func (e *Envelope) recordGeoMismatch(accountId *int64, resolved string) {
+	incrementMetric("geoip_mismatches")
+	log.Printf("registration from %s claims country %s within %s, but resolved to %s", e.clientIP, e.Country(), e.Region(), resolved)
+
+	deviceId := int64(e.DeviceId())
+	err := recordAudit(e.ctx, pool, AuditEntry{
+		DeviceId:       &deviceId,
+		AccountId:      accountId,
+		Action:         "geoip/CountryMismatch",
+		ParametersHash: hashParameters(e.clientIP.String(), e.Country(), resolved),
+	})
+	if err != nil {
+		log.Printf("error recording audit entry for country mismatch: %v\n", err)
+	}
+}
+
+// geoIPRange maps an inclusive range of addresses to a country.
+type geoIPRange struct {
+	start   net.IP
+	end     net.IP
+	country string
+}
+
+// csvGeoIP resolves addresses from a CSV of ranges, in the form start,end,country as distributed by DB-IP and others.
+// The file is read entirely upon startup.
+type csvGeoIP struct {
+	ranges []geoIPRange
+}
+
+func newCSVGeoIP(config GeoIPConfig) (GeoIPProvider, error) {
+	file, err := os.Open(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	var ranges []geoIPRange
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			continue
+		}
+
+		start, end := net.ParseIP(record[0]), net.ParseIP(record[1])
+		if start == nil || end == nil {
+			// Likely a header.
+			continue
+		}
+		ranges = append(ranges, geoIPRange{start: start.To16(), end: end.To16(), country: strings.ToUpper(record[2])})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+	})
+	log.Printf("Loaded %d GeoIP ranges from %s", len(ranges), config.Path)
+	return &csvGeoIP{ranges: ranges}, nil
+}
+
+func (g *csvGeoIP) Country(_ context.Context, ip net.IP) (string, error) {
+	ip = ip.To16()
+	// Find the last range starting at or before this address.
+	index := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].start, ip) > 0
+	}) - 1
+	if index < 0 || bytes.Compare(ip, g.ranges[index].end) > 0 {
+		return "", nil
+	}
+	return g.ranges[index].country, nil
+}
+
+// httpGeoIP resolves addresses via an HTTP service responding with a plain country code,
+// such as https://ipapi.co/{ip}/country/.
+type httpGeoIP struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPGeoIP(config GeoIPConfig) (GeoIPProvider, error) {
+	if !strings.Contains(config.URL, "{ip}") {
+		return nil, errors.New("the http GeoIP provider requires a URL containing {ip}")
+	}
+
+	return &httpGeoIP{
+		url:    config.URL,
+		client: &http.Client{Timeout: GeoIPTimeout},
+	}, nil
+}
+
+func (g *httpGeoIP) Country(ctx context.Context, ip net.IP) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", strings.ReplaceAll(g.url, "{ip}", url.PathEscape(ip.String())), nil)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := g.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GeoIP service responded with status %d", response.StatusCode)
+	}
+
+	// Country codes are two characters, so anything beyond a few bytes is not what we expect.
+	contents, err := io.ReadAll(io.LimitReader(response.Body, 16))
+	if err != nil {
+		return "", err
+	}
+
+	country := strings.ToUpper(strings.TrimSpace(string(contents)))
+	if len(country) != 2 {
+		return "", nil
+	}
+	return country, nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/wii-tools/wadlib"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	QueryRecipientAccount = `SELECT account_id FROM userbase WHERE device_code = $1`
+
+	QueryItemPrice = `SELECT price FROM service_titles WHERE item_id = $1`
+
+	InsertGiftStatement = `INSERT INTO gifts
+		(sender_account_id, recipient_device_code, title_id, item_id, price, date_sent)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING gift_id`
+
+	QueryPendingGifts = `SELECT gifts.gift_id, gifts.sender_account_id, gifts.title_id, gifts.item_id, gifts.date_sent
+		FROM gifts, userbase
+		WHERE gifts.recipient_device_code = userbase.device_code
+		AND userbase.account_id = $1
+		AND gifts.date_received IS NULL
+		ORDER BY gifts.date_sent, gifts.gift_id`
+
+	// ReceiveGiftStatement marks a pending gift addressed to the given account as received.
+	ReceiveGiftStatement = `UPDATE gifts SET date_received = $3
+		FROM userbase
+		WHERE gifts.gift_id = $1
+		AND gifts.recipient_device_code = userbase.device_code
+		AND userbase.account_id = $2
+		AND gifts.date_received IS NULL
+		RETURNING gifts.title_id, gifts.item_id`
+)
+
+// itemPrice returns the price of the given item. Items not within our catalog are free.
+func itemPrice(ctx context.Context, itemId int) (int, error) {
+	var price int
+	err := pool.QueryRow(ctx, QueryItemPrice, itemId).Scan(&price)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+
+	return price, err
+}
+
+func sendGift(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	recipient, err := e.getKey("RecipientDeviceCode")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing recipient", err)
+		return
+	}
+
+	friendCode, err := parseFriendCode(recipient)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "invalid recipient friend code", err)
+		return
+	}
+
+	titleId, err := e.getKey("TitleId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing title ID", err)
+		return
+	}
+
+	// Service titles require subscription records, and cannot be gifted.
+	if titleId == WiinoMaServiceTitleID {
+		e.Error(ErrorCodeGenericFailure, "title cannot be gifted", nil)
+		return
+	}
+
+	tempItemId, err := e.getKey("ItemId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing item ID", err)
+		return
+	}
+
+	itemId, err := strconv.Atoi(tempItemId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "invalid item ID", err)
+		return
+	}
+
+	// Gifts are held to the same checks as purchases, as the gifted item is priced, windowed and capped by item.
+	if !e.verifyItem(itemId, titleId) {
+		return
+	}
+
+	if !e.enforceRating(titleId) {
+		return
+	}
+
+	// Ensure the recipient exists.
+	var recipientAccountId int64
+	err = pool.QueryRow(e.ctx, QueryRecipientAccount, friendCode.String()).Scan(&recipientAccountId)
+	if err == pgx.ErrNoRows {
+		e.Error(ErrorCodeGenericFailure, "recipient is not registered", nil)
+		return
+	} else if err != nil {
+		log.Printf("error querying recipient: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	// Add-ons may only be gifted to those owning their base title, as base titles cannot be bundled within gifts.
+	missing, err := missingDependencies(e.ctx, recipientAccountId, []string{titleId})
+	if err != nil {
+		log.Printf("error querying title dependencies: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	} else if len(missing) != 0 {
+		e.Error(ErrorCodeBaseTitleRequired, "recipient requires base title "+missing[0], ErrBaseTitleRequired)
+		return
+	}
+
+	price, err := itemPrice(e.ctx, itemId)
+	if err == nil {
+		price, err = e.chargedPrice(titleId, itemId, price, PERMANENT)
+	}
+	if err != nil {
+		log.Printf("error querying item price: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	// Debit the sender and record the gift together.
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	err = claimItem(e.ctx, tx, itemId)
+	if err == ErrItemUnavailable {
+		e.Error(ErrorCodeTitleUnavailable, "unable to send gift", err)
+		return
+	} else if err != nil {
+		log.Printf("unexpected error claiming item: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error sending gift", nil)
+		return
+	}
+
+	err = debitPoints(e.ctx, tx, accountId, price)
+	if err == ErrInsufficientPoints {
+		e.Error(ErrorCodeGenericFailure, "unable to send gift", err)
+		return
+	} else if err != nil {
+		log.Printf("error debiting points: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	var giftId int
+	err = tx.QueryRow(e.ctx, InsertGiftStatement, accountId, friendCode.String(), titleId, itemId, price, time.Now().UTC()).Scan(&giftId)
+	if err != nil {
+		log.Printf("error inserting gift: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	_, err = recordTransaction(e.ctx, tx, Transaction{
+		AccountId: accountId,
+		Type:      TransactionGiftSent,
+		TitleId:   titleId,
+		ItemId:    itemId,
+		TotalPaid: price,
+	})
+	if err != nil {
+		log.Printf("error recording transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("error committing gift: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	invalidateItem(e.ctx, itemId)
+
+	emitEvent(e.ctx, EventPointsRedeemed, PointsRedeemedEvent{
+		AccountId: formatAccountId(accountId),
+		Amount:    price,
+		Reason:    "gift",
+	})
+
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
+	e.AddKVNode("GiftId", strconv.Itoa(giftId))
+}
+
+func listGifts(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	rows, err := pool.Query(e.ctx, QueryPendingGifts, accountId)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	defer rows.Close()
+	var gifts []Gifts
+	for rows.Next() {
+		var gift Gifts
+		var dateSent time.Time
+		err = rows.Scan(&gift.GiftId, &gift.SenderAccountId, &gift.TitleId, &gift.ItemId, &dateSent)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+			return
+		}
+
+		gift.Date = strconv.FormatInt(dateSent.UnixMilli(), 10)
+		gifts = append(gifts, gift)
+	}
+
+	offset, end := e.paginate(len(gifts))
+	e.AddCustomType(gifts[offset:end])
+	e.AddKVNode("ListResultTotalSize", strconv.Itoa(len(gifts)))
+}
+
+func receiveGift(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	tempGiftId, err := e.getKey("GiftId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing gift ID", err)
+		return
+	}
+
+	giftId, err := strconv.Atoi(tempGiftId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "invalid gift ID", err)
+		return
+	}
+
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	var titleId string
+	var itemId int
+	err = tx.QueryRow(e.ctx, ReceiveGiftStatement, giftId, accountId, time.Now().UTC()).Scan(&titleId, &itemId)
+	if err == pgx.ErrNoRows {
+		e.Error(ErrorCodeGenericFailure, "gift does not exist", nil)
+		return
+	} else if err != nil {
+		log.Printf("error receiving gift: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	app, err := lookupTitle(e.ctx, titleId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+		return
+	}
+
+	if app == nil {
+		e.Error(ErrorCodeGenericFailure, "title does not exist", nil)
+		return
+	}
+
+	ticketStruct, err := newTitleTicket(e.ctx, titleId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+		return
+	}
+
+	ticket := new(bytes.Buffer)
+	err = writeTicket(e.ctx, ticket, ticketStruct)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
+		return
+	}
+
+	// The title now belongs to the recipient.
+	_, err = tx.Exec(e.ctx, AssociateTicketStatement, accountId, titleId, app.Shop.Version, itemId, time.Now().UTC())
+	if err != nil {
+		log.Printf("unexpected error receiving gift: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error receiving gift", nil)
+		return
+	}
+
+	_, err = recordTransaction(e.ctx, tx, Transaction{
+		AccountId: accountId,
+		Type:      TransactionGiftReceived,
+		TitleId:   titleId,
+		ItemId:    itemId,
+	})
+	if err != nil {
+		log.Printf("error recording transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "error receiving gift", nil)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("unexpected error receiving gift: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error receiving gift", nil)
+		return
+	}
+
+	emitEvent(e.ctx, EventTitlePurchased, TitlePurchasedEvent{
+		AccountId:   formatAccountId(accountId),
+		TitleId:     titleId,
+		ItemId:      itemId,
+		LicenseKind: PERMANENT,
+	})
+
+	e.AddKVNode("SyncTime", e.Timestamp())
+	e.AddKVNode("ETickets", b64(append(ticket.Bytes(), wadlib.CertChainTemplate...)))
+	// Two cert types must be present.
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("TitleId", titleId)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	"os"
+)
+
+// goldenCommand sends every canned console request against a running server, comparing responses against golden files.
+// The server should have a freshly initialized database, so that responses are reproducible.
+func goldenCommand(args []string) {
+	flags := flag.NewFlagSet("golden", flag.ExitOnError)
+	server := flags.String("server", "http://127.0.0.1:8080", "base URL of the server to test against")
+	directory := flags.String("dir", "testdata/golden", "directory holding golden responses")
+	update := flags.Bool("update", false, "replace golden responses with those received")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap golden [-server url] [-dir directory] [-update]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	client := testclient.New(*server, testclient.DefaultConsole)
+	errs := client.RunGolden(*directory, *update)
+	for _, err := range errs {
+		fmt.Printf("[!] %v\n", err)
+	}
+
+	if len(errs) != 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("All %d responses match.\n", len(testclient.Requests))
+}
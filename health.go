@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HealthCheckInterval is how often the database is pinged while healthy.
+	HealthCheckInterval = 10 * time.Second
+	// HealthCheckTimeout is how long a single ping may take before the database is considered unavailable.
+	HealthCheckTimeout = 5 * time.Second
+	// MaxReconnectBackoff limits how long we wait between pings while the database is unavailable.
+	MaxReconnectBackoff = 30 * time.Second
+)
+
+// databaseUnavailable is non-zero while the database cannot be reached.
+var databaseUnavailable int32
+
+// databaseAvailable returns whether the last health check succeeded.
+func databaseAvailable() bool {
+	return atomic.LoadInt32(&databaseUnavailable) == 0
+}
+
+// pingDatabase checks whether the database is reachable, recording the result.
+func pingDatabase() error {
+	pingCtx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+
+	err := pool.Ping(pingCtx)
+	if err != nil {
+		if atomic.SwapInt32(&databaseUnavailable, 1) == 0 {
+			incrementMetric("database_outages")
+			log.Printf("database is unavailable: %v", err)
+		}
+		return err
+	}
+
+	if atomic.SwapInt32(&databaseUnavailable, 0) == 1 {
+		log.Printf("database is available again")
+	}
+	return nil
+}
+
+// superviseDatabase continuously pings the database in the background.
+// While unavailable, pings are retried with exponential backoff until it returns.
+// The pool itself establishes new connections as needed, so no further action is necessary upon recovery.
+func superviseDatabase() {
+	go func() {
+		backoff := time.Second
+		for {
+			if pingDatabase() == nil {
+				backoff = time.Second
+				time.Sleep(HealthCheckInterval)
+				continue
+			}
+
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > MaxReconnectBackoff {
+				backoff = MaxReconnectBackoff
+			}
+		}
+	}()
+}
+
+// serveHealth responds to liveness and readiness probes, returning whether the request was handled.
+// Liveness only reflects that we are able to respond, whereas readiness requires the database to be available.
+func serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz":
+		w.Write([]byte("ok"))
+	case "/readyz":
+		if !databaseAvailable() {
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return true
+		}
+		w.Write([]byte("ok"))
+	default:
+		return false
+	}
+
+	return true
+}
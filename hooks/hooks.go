@@ -0,0 +1,92 @@
+// Package hooks is the interface between WiiSOAP and operator plugins, which inspect or modify requests and responses without forking the server.
+//
+// A plugin is a main package built via `go build -buildmode=plugin` against the same version of WiiSOAP and its dependencies,
+// exporting a Register function of type RegisterFunc:
+//
+//	func Register(registry hooks.Registry) error {
+//		registry.After("ias/Register", func(e hooks.Envelope) {
+//			...
+//		})
+//		return nil
+//	}
+package hooks
+
+import "context"
+
+// AllActions may be registered against in place of an action's name, such as ecs/CheckDeviceStatus, to hook every action.
+const AllActions = "*"
+
+// Hook inspects or modifies a single request or its response.
+type Hook func(e Envelope)
+
+// Registry accepts hooks from a plugin as it is loaded.
+type Registry interface {
+	// Before registers a hook run prior to the given action, once its request has authenticated should the action require so.
+	// Failing the envelope skips the action, responding with the failure instead.
+	Before(action string, hook Hook)
+	// After registers a hook run once the given action has populated its response, including should it have failed.
+	After(action string, hook Hook)
+}
+
+// RegisterFunc is the type of the Register function every plugin must export.
+type RegisterFunc = func(registry Registry) error
+
+// Attribute is a name and value describing an item, such as its TitleVersion.
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// Item is a catalog entry within a listing, such as within ListItems or SearchItems.
+// Changing its price alters the price displayed, not the price charged upon purchase.
+type Item struct {
+	TitleId    string
+	ItemId     int
+	Price      int
+	Attributes []Attribute
+}
+
+// Envelope is a request and the response being formed to it.
+// Hooks are run sequentially, and must not retain an envelope beyond their return.
+type Envelope interface {
+	// Context is cancelled once the request's deadline passes, and should be used for any work a hook performs.
+	Context() context.Context
+
+	// Service and Action identify what is being handled, such as ecs and CheckDeviceStatus.
+	Service() string
+	Action() string
+	// Tenant is the name of the shop this request is for.
+	Tenant() string
+
+	DeviceId() int
+	Region() string
+	Country() string
+	Language() string
+	// AccountId returns the account this request was sent on behalf of, and whether one was given.
+	AccountId() (int64, bool)
+
+	// Value returns the request's value of the given element, and whether it is present.
+	Value(key string) (string, bool)
+	// SetValue replaces the request's value of the given element, returning whether it is present.
+	// It should be used within hooks run before an action, as the action reads values afterwards.
+	SetValue(key string, value string) bool
+
+	// ErrorCode returns the response's error code, which is 0 unless the action has failed.
+	ErrorCode() int
+	// Fail responds with the given error code and message, discarding any other fields.
+	Fail(code int, message string)
+
+	// Field returns the response's value of the given top-level element, and whether it is present.
+	Field(key string) (string, bool)
+	// SetField replaces the response's value of the given top-level element, adding it if not present.
+	SetField(key string, value string)
+	// RemoveField removes the given top-level element from the response.
+	RemoveField(key string)
+
+	// RewriteItems calls the given function with each catalog item within the response, applying any changes made to it.
+	// Items are removed should it return false, in which case ListResultTotalSize should be adjusted via SetField.
+	RewriteItems(rewrite func(item *Item) bool)
+
+	// AdjustBalance credits, or should the amount be negative debits, the points balance of an account, returning its new balance.
+	AdjustBalance(accountId int64, amount int) (int, error)
+}
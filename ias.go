@@ -18,24 +18,18 @@
 package main
 
 import (
-	"bufio"
-	"crypto/md5"
+	"context"
 	"errors"
 	"fmt"
-	wiino "github.com/RiiConnect24/wiino/golang"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"log"
-	"math/rand"
-	"os"
-	"slices"
-	"strconv"
 )
 
 const (
 	PrepareUserStatement = `INSERT INTO userbase
-		(device_id, device_token, device_token_hashed, account_id, region, serial_number) 
-	VALUES ($1, $2, $3, $4, $5, $6)`
+		(device_id, device_token, device_token_hashed, account_id, region, serial_number, device_code, console_model, manufacturing_region) 
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
 	SyncUserStatement = `SELECT 
 		account_id, device_token, serial_number
 	FROM userbase WHERE 
@@ -49,15 +43,43 @@ const (
 		region = $3`
 )
 
+// registerIAS registers all actions handled by the Identity Authentication service.
+func registerIAS(r *Route) {
+	ias := r.HandleGroup("ias")
+	{
+		ias.Unauthenticated("CheckRegistration", checkRegistration, "SerialNumber")
+		ias.Unauthenticated("GetChallenge", getChallenge)
+		ias.Authenticated("GetRegistrationInfo", getRegistrationInfo)
+		ias.Unauthenticated("SyncRegistration", syncRegistration)
+		ias.Unauthenticated("Register", register, "DeviceCode", "RegisterRegion", "SerialNumber").Audited()
+		ias.Unauthenticated("RecoverAccount", recoverAccount, "DeviceCode", "RegisterRegion", "SerialNumber", "RecoveryCode").Audited()
+		ias.Authenticated("Unregister", unregister).Audited()
+		ias.Unauthenticated("GenerateDeviceCode", generateDeviceCode, "IdCounter")
+		ias.Unauthenticated("ValidateDeviceCode", validateDeviceCode, "DeviceCode")
+		ias.Authenticated("GetLinkCode", getLinkCode)
+		ias.Authenticated("GetPortalCode", getPortalCode)
+	}
+}
+
 func checkRegistration(e *Envelope) {
-	serialNo, err := e.getKey("SerialNumber")
+	serialNo, err := e.SerialNumber()
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "missing serial number", err)
+		return
+	}
+
+	_, err = checkSerialNumber(serialNo)
 	if err != nil {
-		e.Error(5, "missing serial number", err)
+		e.Error(ErrorCodeRegistrationFailure, "invalid serial number", err)
+		return
+	}
+
+	if !e.enforceBan() {
 		return
 	}
 
 	// We'll utilize our sync user statement.
-	query := pool.QueryRow(ctx, CheckUserStatement, e.DeviceId(), serialNo, e.Region())
+	query := pool.QueryRow(e.ctx, CheckUserStatement, e.DeviceId(), serialNo, e.Region())
 	err = query.Scan(nil)
 
 	// Formulate our response
@@ -69,7 +91,7 @@ func checkRegistration(e *Envelope) {
 			e.AddKVNode("DeviceStatus", DeviceStatusUnregistered)
 		} else {
 			log.Printf("error executing statement: %v\n", err)
-			e.Error(5, "server-side error", err)
+			e.Error(ErrorCodeInvalidRequest, "server-side error", err)
 		}
 	} else {
 		// No errors! We're safe.
@@ -81,8 +103,8 @@ func getChallenge(e *Envelope) {
 	// The official Wii Shop Channel requests a Challenge from the server, and promptly disregards it.
 	// (Sometimes, it may not request a challenge at all.) No attempt is made to validate the response.
 	// It then uses another hard-coded value in place of this returned value entirely in any situation.
-	// For this reason, we consider it irrelevant.
-	e.AddKVNode("Challenge", SharedChallenge)
+	// For this reason, we consider it irrelevant unless strict challenge mode is enabled for other clients.
+	e.AddKVNode("Challenge", issueChallenge(e.ctx, e.DeviceId()))
 }
 
 func getRegistrationInfo(e *Envelope) {
@@ -95,48 +117,46 @@ func getRegistrationInfo(e *Envelope) {
 	e.AddKVNode("Currency", "POINTS")
 }
 
-func getWhitelistedSerialNumbers() []string {
-	file, err := os.Open("whitelist.txt")
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-
-	// Read each line
-	var sns []string
-	for scanner.Scan() {
-		sns = append(sns, scanner.Text())
-
+// lookupSyncUser returns registration details for the given console, preferring cached values.
+func lookupSyncUser(ctx context.Context, region string, deviceId int) (syncRecord, error) {
+	key := syncCacheKey{tenant: tenantFromContext(ctx).Name, region: region, deviceId: deviceId}
+	if user, cached := syncCache.Get(key); cached {
+		return user, nil
 	}
 
-	// Check for errors during scanning
-	if err = scanner.Err(); err != nil {
-		panic(err)
+	var user syncRecord
+	err := replica.QueryRow(ctx, SyncUserStatement, region, deviceId).Scan(&user.accountId, &user.deviceToken, &user.serialNumber)
+	if err != nil {
+		return syncRecord{}, err
 	}
 
-	return sns
+	syncCache.Set(key, user)
+	return user, nil
 }
 
 func syncRegistration(e *Envelope) {
-	var accountId int64
-	var deviceToken string
-	var serialNumber string
-
-	user := pool.QueryRow(ctx, SyncUserStatement, e.Region(), e.DeviceId())
-	err := user.Scan(&accountId, &deviceToken, &serialNumber)
+	user, err := lookupSyncUser(e.ctx, e.Region(), e.DeviceId())
 	if err != nil {
-		e.Error(7, "An error occurred querying the database.", err)
+		e.Error(ErrorCodeRegistrationFailure, "An error occurred querying the database.", err)
+		return
 	}
+	accountId := user.accountId
+	deviceToken := user.deviceToken
+	serialNumber := user.serialNumber
 
-	if whitelistEnabled && !slices.Contains(getWhitelistedSerialNumbers(), serialNumber) {
-		// Since HTTP server runs on a separate Goroutine, this won't shut off the server,
-		// rather kill communication with the requesting console
-		panic(err)
+	// Registered consoles are gated alongside registrations, so that they are refused the same error.
+	if !e.enforceAllowlist(serialNumber) {
+		return
 	}
 
-	e.AddKVNode("AccountId", strconv.FormatInt(accountId, 10))
+	// A console syncing its registration has likely lost its tickets, such as via a NAND restore.
+	err = resetSyncVersion(e.ctx, e.Region(), e.DeviceId())
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "An error occurred querying the database.", err)
+		return
+	}
+
+	e.AddKVNode("AccountId", formatAccountId(accountId))
 	e.AddKVNode("DeviceToken", deviceToken)
 	e.AddKVNode("DeviceTokenExpired", "false")
 	e.AddKVNode("Country", e.Country())
@@ -144,71 +164,151 @@ func syncRegistration(e *Envelope) {
 	e.AddKVNode("DeviceStatus", "R")
 }
 
+// generateDeviceToken generates a device token alongside its hashed form.
+func generateDeviceToken() (string, string) {
+	// Generate a device token, 21 characters...
+	deviceToken := RandString(21)
+	// ...and then hash its md5, because the Wii sends this for most requests.
+	return deviceToken, hashDeviceToken(md5Token(deviceToken))
+}
+
 func register(e *Envelope) {
 	deviceCode, err := e.getKey("DeviceCode")
 	if err != nil {
-		e.Error(7, "missing device code", err)
+		e.Error(ErrorCodeRegistrationFailure, "missing device code", err)
 		return
 	}
 
 	registerRegion, err := e.getKey("RegisterRegion")
 	if err != nil {
-		e.Error(7, "missing registration region", err)
+		e.Error(ErrorCodeRegistrationFailure, "missing registration region", err)
 		return
 	}
-	if registerRegion != e.Region() {
-		e.Error(7, "mismatched region", errors.New("region does not match registration region"))
+	if registerRegion != e.Region() && !dolphinCompatibility {
+		e.Error(ErrorCodeRegistrationFailure, "mismatched region", errors.New("region does not match registration region"))
 		return
 	}
 
-	serialNo, err := e.getKey("SerialNumber")
+	serialNo, err := e.SerialNumber()
 	if err != nil {
-		e.Error(7, "missing serial number", err)
+		e.Error(ErrorCodeRegistrationFailure, "missing serial number", err)
 		return
 	}
 
-	if whitelistEnabled && !slices.Contains(getWhitelistedSerialNumbers(), serialNo) {
-		// Since HTTP server runs on a separate Goroutine, this won't shut off the server,
-		// rather kill communication with the requesting console
-		panic(err)
+	serial, err := checkSerialNumber(serialNo)
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "invalid serial number", err)
+		return
+	}
+
+	if !e.enforceBan() {
+		return
+	}
+
+	if !e.enforceAllowlist(serialNo) {
+		return
 	}
 
 	// Validate given friend code.
-	userId, err := strconv.ParseUint(deviceCode, 10, 64)
+	friendCode, err := parseFriendCode(deviceCode)
 	if err != nil {
-		e.Error(7, "invalid friend code", err)
+		e.Error(ErrorCodeRegistrationFailure, "invalid friend code", err)
 		return
 	}
-	if wiino.NWC24CheckUserID(userId) != 0 {
-		e.Error(7, "invalid friend code", err)
+
+	// Registrations from a country other than that claimed may be spoofed.
+	resolvedCountry, mismatched := e.checkGeoCountry()
+	if mismatched && geoIPConfig.Reject {
+		e.recordGeoMismatch(nil, resolvedCountry)
+		e.Error(ErrorCodeRegistrationFailure, "country mismatch", errors.New("registration country does not match client address"))
 		return
 	}
 
-	// Generate a random 9-digit number, padding zeros as necessary.
-	accountId := rand.Int63n(999999999)
+	if e.clientIP != nil {
+		if _, ok := e.enforceFraud(ErrorCodeRegistrationFailure, FraudEventRegistration, e.clientIP.String(), 1); !ok {
+			return
+		}
+	}
 
-	// Generate a device token, 21 characters...
-	deviceToken := RandString(21)
-	// ...and then its md5, because the Wii sends this for most requests.
-	md5DeviceToken := fmt.Sprintf("%x", md5.Sum([]byte(deviceToken)))
+	// Consoles re-registering, such as after a NAND restore, may be given their existing account.
+	// Emulated consoles sharing a placeholder device ID are handled as they were registered below.
+	if !(dolphinCompatibility && isPlaceholderDeviceId(e.DeviceId())) {
+		reregistering, err := checkDuplicateRegistration(e.ctx, e.DeviceId(), serialNo, e.Region())
+		if err == ErrDeviceRegistered || err == ErrSerialRegistered || err == ErrAlreadyRegistered {
+			log.Printf("refusing registration for device %d: %v\n", e.DeviceId(), err)
+			e.Error(ErrorCodeDeviceConflict, "duplicate registration", err)
+			return
+		} else if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeRegistrationFailure, "database error", ErrDatabase)
+			return
+		} else if reregistering {
+			syncRegistration(e)
+			e.AddKVNode("DeviceCode", deviceCode)
+			return
+		}
+	}
+
+	deviceToken, md5DeviceToken := newDeviceToken()
 
 	// Insert all of our obtained values to the database...
-	_, err = pool.Exec(ctx, PrepareUserStatement, e.DeviceId(), deviceToken, md5DeviceToken, accountId, e.Region(), serialNo)
+	// Account IDs allocated sequentially may collide with those randomly generated in the past, so we retry.
+	var accountId int64
+	for attempt := 0; attempt < MaxAccountIdAttempts; attempt++ {
+		accountId, err = allocateAccountId(e.ctx)
+		if err != nil {
+			break
+		}
+
+		_, err = pool.Exec(e.ctx, PrepareUserStatement, e.DeviceId(), deviceToken, md5DeviceToken, accountId, e.Region(), serialNo, friendCode.String(), nullableString(serial.Model), nullableString(serial.Region))
+		if !isAccountIdCollision(err) {
+			break
+		}
+	}
+
 	if err != nil {
 		// It's okay if this isn't a PostgreSQL error, as perhaps other issues have come in.
 		if driverErr, ok := err.(*pgconn.PgError); ok {
-			if driverErr.Code == "23505" {
-				e.Error(7, "database error", errors.New("user already exists"))
+			if driverErr.Code == "23505" && driverErr.ConstraintName != accountIdConstraint {
+				// Emulated consoles frequently share placeholder device IDs, so we reuse their registration.
+				if dolphinCompatibility && isPlaceholderDeviceId(e.DeviceId()) {
+					syncRegistration(e)
+					e.AddKVNode("DeviceCode", deviceCode)
+					return
+				}
+
+				// Another registration for this console raced with ours.
+				e.Error(ErrorCodeDeviceConflict, "duplicate registration", errors.New("user already exists"))
 				return
 			}
 		}
 		log.Printf("error executing statement: %v\n", err)
-		e.Error(7, "database error", errors.New("failed to execute db operation"))
+		e.Error(ErrorCodeRegistrationFailure, "database error", ErrDatabase)
 		return
 	}
 
+	// Ensure any previous lookups for this console are not reused.
+	invalidateRegistration(e.ctx, e.Region(), e.DeviceId())
+
+	if mismatched {
+		e.recordGeoMismatch(&accountId, resolvedCountry)
+	}
+
+	// Recovery codes are held for retrieval via the portal or admin API, and may be regenerated there should this fail.
+	err = issueRecoveryCodes(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error issuing recovery codes: %v\n", err)
+	}
+
+	emitEvent(e.ctx, EventDeviceRegistered, DeviceRegisteredEvent{
+		AccountId:    formatAccountId(accountId),
+		DeviceId:     e.DeviceId(),
+		Region:       e.Region(),
+		SerialNumber: serialNo,
+	})
+
 	fmt.Println("The request is valid! Responding...")
-	e.AddKVNode("AccountId", strconv.FormatInt(accountId, 10))
+	e.AddKVNode("AccountId", formatAccountId(accountId))
 	e.AddKVNode("DeviceToken", deviceToken)
 	e.AddKVNode("DeviceTokenExpired", "false")
 	e.AddKVNode("Country", e.Country())
@@ -220,4 +320,5 @@ func register(e *Envelope) {
 
 func unregister(e *Envelope) {
 	// how abnormal... ;3
+	invalidateRegistration(e.ctx, e.Region(), e.DeviceId())
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	"github.com/jackc/pgx/v4"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// updateGolden replaces golden responses and fixtures with those produced, rather than comparing against them.
+var updateGolden = flag.Bool("update", false, "replace golden responses and fixtures with those produced")
+
+// startDatabase runs a disposable PostgreSQL container initialized with database.sql, returning its connection string.
+// Tests are skipped should Docker be unavailable.
+func startDatabase(t *testing.T) string {
+	t.Helper()
+
+	dockerPool, err := dockertest.NewPool("")
+	if err == nil {
+		err = dockerPool.Client.Ping()
+	}
+	if err != nil {
+		t.Skipf("docker is unavailable: %v", err)
+	}
+	dockerPool.MaxWait = 2 * time.Minute
+
+	schema, err := filepath.Abs("database.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The image runs scripts within its init directory before accepting connections over TCP.
+	resource, err := dockerPool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "14",
+		Env: []string{
+			"POSTGRES_USER=wiisoap",
+			"POSTGRES_PASSWORD=wiisoap",
+			"POSTGRES_DB=wiisoap",
+		},
+		Mounts: []string{schema + ":/docker-entrypoint-initdb.d/database.sql:ro"},
+	}, removeContainer)
+	if err != nil {
+		t.Fatalf("error starting postgres: %v", err)
+	}
+	t.Cleanup(func() {
+		dockerPool.Purge(resource)
+	})
+
+	dbString := fmt.Sprintf("postgres://wiisoap:wiisoap@%s/wiisoap", resource.GetHostPort("5432/tcp"))
+	err = dockerPool.Retry(func() error {
+		conn, err := pgx.Connect(ctx, dbString)
+		if err != nil {
+			return err
+		}
+		defer conn.Close(ctx)
+		return conn.Ping(ctx)
+	})
+	if err != nil {
+		t.Fatalf("error connecting to postgres: %v", err)
+	}
+	return dbString
+}
+
+// removeContainer ensures containers do not outlive the test, even should it be interrupted.
+func removeContainer(config *docker.HostConfig) {
+	config.AutoRemove = true
+	config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+}
+
+// startServer serves every action in-process against the given database as the default tenant.
+func startServer(t *testing.T, dbString string) *httptest.Server {
+	t.Helper()
+
+	err := loadPoolConfig(PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadReplicaConfig(ReplicaConfig{}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadTenants(dbString, Tenant{Name: "default"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeTenants()
+		tenants, defaultTenant = nil, nil
+	})
+
+	r := newRouter()
+	server := httptest.NewServer(r.Handle())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestGolden replays every canned console request against a freshly initialized database,
+// comparing responses against those committed within testdata/golden.
+// Run with -update to regenerate them after intended changes.
+func TestGolden(t *testing.T) {
+	server := startServer(t, startDatabase(t))
+
+	directory := filepath.Join("testdata", "golden")
+	if _, err := os.Stat(directory); os.IsNotExist(err) && !*updateGolden {
+		t.Fatalf("%s does not exist; run go test -run TestGolden -update to record it", directory)
+	}
+
+	client := testclient.New(server.URL, testclient.DefaultConsole)
+	for _, err := range client.RunGolden(directory, *updateGolden) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/wii-tools/wadlib"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	QueryTicketKeys = `SELECT key_id, common_key, signing_key, active, date_added FROM ticket_keys ORDER BY key_id`
+
+	InsertTicketKeyStatement = `INSERT INTO ticket_keys (common_key, signing_key)
+		VALUES ($1, $2)
+		RETURNING key_id`
+
+	// Keys are deactivated prior to activating another, as at most one may be active at once.
+	DeactivateTicketKeysStatement = `UPDATE ticket_keys SET active = false WHERE active`
+	ActivateTicketKeyStatement    = `UPDATE ticket_keys SET active = true WHERE key_id = $1`
+
+	// ReissueTicketsStatement causes owners of a title to be sent its ticket again, issued under the given key.
+	ReissueTicketsStatement = `UPDATE owned_titles SET key_id = $2, date_reissued = $3 WHERE title_id = $1`
+
+	// BuiltinTicketKeyId identifies the keys configured within Secrets, used while no other key is active.
+	BuiltinTicketKeyId = 0
+
+	// KeyringTTL is how long each tenant's keys are cached, so that keys added by other instances are picked up.
+	KeyringTTL = time.Minute
+
+	// ticketSignedOffset is where the signed portion of a ticket begins, following its signature and padding.
+	ticketSignedOffset = 0x140
+)
+
+var (
+	// ErrUnknownTicketKey is returned when a key ID does not exist within the keystore.
+	ErrUnknownTicketKey = errors.New("ticket key does not exist")
+	// ErrInvalidSigningKey is returned when a signing key is not a PEM-encoded 2048-bit RSA private key.
+	ErrInvalidSigningKey = errors.New("signing key must be a PEM-encoded 2048-bit RSA private key")
+)
+
+// ticketKey is a generation of keys tickets are issued under.
+type ticketKey struct {
+	id int
+	// common is the common key title keys are encrypted with, or nil for that configured within Secrets.
+	common *[16]byte
+	// signing signs tickets, or is nil for tickets to be fakesigned as with the standard template.
+	signing   *rsa.PrivateKey
+	active    bool
+	dateAdded *time.Time
+}
+
+// keyring holds every key of a tenant, including those retired, so that tickets issued under them remain verifiable.
+type keyring struct {
+	keys   []*ticketKey
+	active *ticketKey
+}
+
+// TicketKey describes a key generation within the keystore. Key material itself is never returned.
+type TicketKey struct {
+	KeyId int `json:"key_id"`
+	// CommonKeyFingerprint and SigningKeyFingerprint are SHA-256 hashes of the common key and signing public key,
+	// or nil where those configured within Secrets and fakesigning are used respectively.
+	CommonKeyFingerprint  *string    `json:"common_key_fingerprint"`
+	SigningKeyFingerprint *string    `json:"signing_key_fingerprint"`
+	Active                bool       `json:"active"`
+	DateAdded             *time.Time `json:"date_added"`
+}
+
+// TicketKeyRequest adds a key generation. Either key may be omitted to retain that configured within Secrets or fakesigning.
+type TicketKeyRequest struct {
+	// CommonKey is 16 hex-encoded bytes.
+	CommonKey string `json:"common_key"`
+	// SigningKey is a PEM-encoded 2048-bit RSA private key, in PKCS #1 or PKCS #8 form.
+	SigningKey string `json:"signing_key"`
+	Activate   bool   `json:"activate"`
+}
+
+// TicketKeySelection identifies a key to activate, or to re-issue tickets under.
+type TicketKeySelection struct {
+	KeyId int `json:"key_id"`
+}
+
+// TicketVerifyRequest holds a ticket as returned to consoles, optionally followed by its certificate chain.
+type TicketVerifyRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+// TicketVerification reports the key a ticket was issued under.
+type TicketVerification struct {
+	Verified bool `json:"verified"`
+	KeyId    *int `json:"key_id"`
+}
+
+// ReissueRequest re-issues tickets for every owner of a title, under the given key or the active key if omitted.
+type ReissueRequest struct {
+	TitleId string `json:"title_id"`
+	KeyId   *int   `json:"key_id"`
+}
+
+// ReissueResult reports how many tickets were re-issued, and under which key.
+type ReissueResult struct {
+	KeyId    int   `json:"key_id"`
+	Reissued int64 `json:"reissued"`
+}
+
+// keyrings caches the keys of each tenant by name.
+var keyrings = newTTLCache[string, *keyring]()
+
+func init() {
+	keyrings.SetTTL(KeyringTTL)
+	registerAdminEndpoint("/keys", ticketKeysEndpoint)
+	registerAdminEndpoint("/keys/active", activeTicketKeyEndpoint)
+	registerAdminEndpoint("/keys/verify", verifyTicketEndpoint)
+	registerAdminEndpoint("/keys/reissue", reissueTicketsEndpoint)
+}
+
+// commonKey returns the common key of this generation.
+func (k *ticketKey) commonKey() [16]byte {
+	if k.common == nil {
+		return wadlib.CommonKey
+	}
+	return *k.common
+}
+
+// lookup returns the key with the given ID, or nil if it does not exist.
+func (r *keyring) lookup(keyId int) *ticketKey {
+	for _, key := range r.keys {
+		if key.id == keyId {
+			return key
+		}
+	}
+	return nil
+}
+
+// loadKeyring returns the keys of the tenant within the given context, preferring cached values.
+// The keys configured within Secrets are always present under BuiltinTicketKeyId, and active unless another key is.
+func loadKeyring(ctx context.Context) (*keyring, error) {
+	tenant := tenantFromContext(ctx).Name
+	if cached, exists := keyrings.Get(tenant); exists {
+		return cached, nil
+	}
+
+	builtin := &ticketKey{id: BuiltinTicketKeyId}
+	ring := &keyring{keys: []*ticketKey{builtin}, active: builtin}
+
+	rows, err := pool.Query(ctx, QueryTicketKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key := &ticketKey{}
+		var common, signing *string
+		err = rows.Scan(&key.id, &common, &signing, &key.active, &key.dateAdded)
+		if err != nil {
+			return nil, err
+		}
+
+		key.common, key.signing, err = parseTicketKey(common, signing)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys = append(ring.keys, key)
+		if key.active {
+			ring.active = key
+		}
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	builtin.active = ring.active == builtin
+
+	keyrings.Set(tenant, ring)
+	return ring, nil
+}
+
+// parseTicketKey decodes the given common and signing keys, either of which may be nil.
+func parseTicketKey(common *string, signing *string) (*[16]byte, *rsa.PrivateKey, error) {
+	var commonKey *[16]byte
+	if common != nil {
+		decoded, err := hex.DecodeString(*common)
+		if err != nil || len(decoded) != 16 {
+			return nil, nil, errors.New("common key must be 16 hex-encoded bytes")
+		}
+		commonKey = new([16]byte)
+		copy(commonKey[:], decoded)
+	}
+
+	var signingKey *rsa.PrivateKey
+	if signing != nil {
+		block, _ := pem.Decode([]byte(*signing))
+		if block == nil {
+			return nil, nil, ErrInvalidSigningKey
+		}
+
+		parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			pkcs8, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if pkcs8Err != nil {
+				return nil, nil, ErrInvalidSigningKey
+			}
+			var isRSA bool
+			if parsed, isRSA = pkcs8.(*rsa.PrivateKey); !isRSA {
+				return nil, nil, ErrInvalidSigningKey
+			}
+		}
+		if parsed.N.BitLen() != 2048 {
+			return nil, nil, ErrInvalidSigningKey
+		}
+		signingKey = parsed
+	}
+
+	return commonKey, signingKey, nil
+}
+
+// cryptTitleKey encrypts or decrypts a title key with the given common key, using the title ID as its IV.
+func cryptTitleKey(commonKey [16]byte, titleId uint64, titleKey [16]byte, encrypt bool) [16]byte {
+	// It should not be possible for our key not to be 16 bytes.
+	block, err := aes.NewCipher(commonKey[:])
+	if err != nil {
+		panic(err)
+	}
+
+	var iv [16]byte
+	binary.BigEndian.PutUint64(iv[:], titleId)
+
+	var result [16]byte
+	if encrypt {
+		cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(result[:], titleKey[:])
+	} else {
+		cipher.NewCBCDecrypter(block, iv[:]).CryptBlocks(result[:], titleKey[:])
+	}
+	return result
+}
+
+// ticketDigest returns the SHA-1 hash of the signed portion of a ticket.
+func ticketDigest(ticket *wadlib.Ticket) ([]byte, error) {
+	contents := new(bytes.Buffer)
+	err := binary.Write(contents, binary.BigEndian, ticket)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha1.Sum(contents.Bytes()[ticketSignedOffset:])
+	return digest[:], nil
+}
+
+// writeTicket issues the given ticket under the active key of the tenant within the given context, writing it to w.
+func writeTicket(ctx context.Context, w io.Writer, ticket *wadlib.Ticket) error {
+	ring, err := loadKeyring(ctx)
+	if err != nil {
+		return err
+	}
+	return writeTicketWithKey(w, ticket, ring.active)
+}
+
+// writeTicketWithKey encrypts the ticket's title key with the given key's common key and signs it, writing it to w.
+func writeTicketWithKey(w io.Writer, ticket *wadlib.Ticket, key *ticketKey) error {
+	ticket.TitleKey = cryptTitleKey(key.commonKey(), ticket.TitleID, contentAesKey, true)
+
+	if key.signing != nil {
+		digest, err := ticketDigest(ticket)
+		if err != nil {
+			return err
+		}
+
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key.signing, crypto.SHA1, digest)
+		if err != nil {
+			return err
+		}
+		copy(ticket.Signature[:], signature)
+	}
+
+	return binary.Write(w, binary.BigEndian, ticket)
+}
+
+// verifyTicket returns the key the given ticket was issued under, or nil if none within the keyring issued it.
+// Tickets verify against a key if their title key decrypts under its common key, and they are signed by its signing key
+// or, for keys without one, fakesigned as with the standard template.
+func verifyTicket(ring *keyring, ticket *wadlib.Ticket) (*ticketKey, error) {
+	var template wadlib.Ticket
+	err := binary.Read(bytes.NewReader(wadlib.TicketTemplate), binary.BigEndian, &template)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := ticketDigest(ticket)
+	if err != nil {
+		return nil, err
+	}
+
+	var fakesigned *ticketKey
+	for _, key := range ring.keys {
+		if cryptTitleKey(key.commonKey(), ticket.TitleID, ticket.TitleKey, false) != contentAesKey {
+			continue
+		}
+
+		if key.signing == nil {
+			if ticket.Signature == template.Signature && fakesigned == nil {
+				fakesigned = key
+			}
+			continue
+		}
+
+		// Keys which sign tickets are preferred, as fakesigned tickets are indistinguishable between generations.
+		if rsa.VerifyPKCS1v15(&key.signing.PublicKey, crypto.SHA1, digest, ticket.Signature[:]) == nil {
+			return key, nil
+		}
+	}
+	return fakesigned, nil
+}
+
+// describe returns this key for the admin API.
+func (k *ticketKey) describe() TicketKey {
+	described := TicketKey{
+		KeyId:     k.id,
+		Active:    k.active,
+		DateAdded: k.dateAdded,
+	}
+	if k.common != nil {
+		hash := sha256.Sum256(k.common[:])
+		fingerprint := hex.EncodeToString(hash[:])
+		described.CommonKeyFingerprint = &fingerprint
+	}
+	if k.signing != nil {
+		public, err := x509.MarshalPKIXPublicKey(&k.signing.PublicKey)
+		if err == nil {
+			hash := sha256.Sum256(public)
+			fingerprint := hex.EncodeToString(hash[:])
+			described.SigningKeyFingerprint = &fingerprint
+		}
+	}
+	return described
+}
+
+// activateTicketKey selects the key new tickets are issued under. No key within the database is active given BuiltinTicketKeyId.
+func activateTicketKey(ctx context.Context, tx pgx.Tx, keyId int) error {
+	_, err := tx.Exec(ctx, DeactivateTicketKeysStatement)
+	if err != nil || keyId == BuiltinTicketKeyId {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, ActivateTicketKeyStatement, keyId)
+	return err
+}
+
+// ticketKeysEndpoint lists key generations, or adds a new one, optionally activating it.
+func ticketKeysEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ring, err := loadKeyring(r.Context())
+		if err != nil {
+			log.Printf("error querying ticket keys: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		keys := []TicketKey{}
+		for _, key := range ring.keys {
+			keys = append(keys, key.describe())
+		}
+		writeJSON(w, http.StatusOK, keys)
+
+	case "POST":
+		var request TicketKeyRequest
+		err := readJSON(r, &request)
+		if err != nil || (request.CommonKey == "" && request.SigningKey == "") {
+			writeAdminError(w, http.StatusBadRequest, "common_key or signing_key is required")
+			return
+		}
+
+		common, signing := nullableString(request.CommonKey), nullableString(request.SigningKey)
+		_, _, err = parseTicketKey(common, signing)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tx, err := pool.Begin(r.Context())
+		if err != nil {
+			log.Printf("error beginning transaction: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		defer tx.Rollback(r.Context())
+
+		var keyId int
+		err = tx.QueryRow(r.Context(), InsertTicketKeyStatement, common, signing).Scan(&keyId)
+		if err == nil && request.Activate {
+			err = activateTicketKey(r.Context(), tx, keyId)
+		}
+		if err == nil {
+			err = tx.Commit(r.Context())
+		}
+		if err != nil {
+			log.Printf("error adding ticket key: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		keyrings.Delete(tenantFromContext(r.Context()).Name)
+		writeJSON(w, http.StatusCreated, TicketKeySelection{KeyId: keyId})
+
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// activeTicketKeyEndpoint selects the key new tickets are issued under. Key 0 reverts to the keys configured within Secrets.
+func activeTicketKeyEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request TicketKeySelection
+	err := readJSON(r, &request)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "key_id is required")
+		return
+	}
+
+	tenant := tenantFromContext(r.Context()).Name
+	keyrings.Delete(tenant)
+	ring, err := loadKeyring(r.Context())
+	if err != nil {
+		log.Printf("error querying ticket keys: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	if ring.lookup(request.KeyId) == nil {
+		writeAdminError(w, http.StatusNotFound, ErrUnknownTicketKey.Error())
+		return
+	}
+
+	tx, err := pool.Begin(r.Context())
+	if err == nil {
+		defer tx.Rollback(r.Context())
+		err = activateTicketKey(r.Context(), tx, request.KeyId)
+	}
+	if err == nil {
+		err = tx.Commit(r.Context())
+	}
+	if err != nil {
+		log.Printf("error activating ticket key: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	keyrings.Delete(tenant)
+	writeJSON(w, http.StatusOK, request)
+}
+
+// verifyTicketEndpoint reports which key a ticket was issued under, including retired keys.
+func verifyTicketEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request TicketVerifyRequest
+	err := readJSON(r, &request)
+	if err != nil || request.Ticket == "" {
+		writeAdminError(w, http.StatusBadRequest, "ticket is required")
+		return
+	}
+
+	contents, err := base64.StdEncoding.DecodeString(request.Ticket)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "ticket must be base64-encoded")
+		return
+	}
+
+	// Any certificate chain following the ticket is ignored.
+	var ticket wadlib.Ticket
+	err = binary.Read(bytes.NewReader(contents), binary.BigEndian, &ticket)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid ticket")
+		return
+	}
+
+	ring, err := loadKeyring(r.Context())
+	if err != nil {
+		log.Printf("error querying ticket keys: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	key, err := verifyTicket(ring, &ticket)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid ticket")
+		return
+	}
+
+	verification := TicketVerification{}
+	if key != nil {
+		verification.Verified = true
+		verification.KeyId = &key.id
+	}
+	writeJSON(w, http.StatusOK, verification)
+}
+
+// reissueTicketsEndpoint re-issues the tickets of every owner of a title under a key, such as after rotating keys.
+// Consoles are sent the re-issued ticket upon their next GetETickets.
+func reissueTicketsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request ReissueRequest
+	err := readJSON(r, &request)
+	if err != nil || request.TitleId == "" {
+		writeAdminError(w, http.StatusBadRequest, "title_id is required")
+		return
+	}
+	if _, err = strconv.ParseUint(request.TitleId, 16, 64); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid title_id")
+		return
+	}
+
+	ring, err := loadKeyring(r.Context())
+	if err != nil {
+		log.Printf("error querying ticket keys: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	key := ring.active
+	if request.KeyId != nil {
+		key = ring.lookup(*request.KeyId)
+		if key == nil {
+			writeAdminError(w, http.StatusNotFound, ErrUnknownTicketKey.Error())
+			return
+		}
+	}
+
+	tag, err := pool.Exec(r.Context(), ReissueTicketsStatement, request.TitleId, key.id, time.Now().UTC())
+	if err != nil {
+		log.Printf("error re-issuing tickets: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReissueResult{KeyId: key.id, Reissued: tag.RowsAffected()})
+}
+
+// ownedTicketKey returns the key an owned title's ticket was re-issued under, or the active key if it has not been.
+func ownedTicketKey(ctx context.Context, keyId *int) (*ticketKey, error) {
+	ring, err := loadKeyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if keyId == nil {
+		return ring.active, nil
+	}
+
+	key := ring.lookup(*keyId)
+	if key == nil {
+		return nil, ErrUnknownTicketKey
+	}
+	return key, nil
+}
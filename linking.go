@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// LinkCodeLength is the length of one-time codes shown to users.
+	LinkCodeLength = 8
+	// LinkCodeLifetime is how long a link code may be redeemed for.
+	LinkCodeLifetime = 15 * time.Minute
+
+	// linkCodeBytes omits characters easily confused with one another.
+	linkCodeBytes = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+	// LinkCodePurposeLink is the purpose of codes redeemed to link external identities.
+	LinkCodePurposeLink = "link"
+	// LinkCodePurposePortal is the purpose of codes redeemed to sign in to the self-service portal.
+	LinkCodePurposePortal = "portal"
+
+	InsertLinkCodeStatement = `INSERT INTO link_codes (code, account_id, date_expires, purpose)
+		VALUES ($1, $2, $3, $4)`
+
+	// RedeemLinkCodeStatement removes an unexpired code issued for the given purpose, returning its account.
+	RedeemLinkCodeStatement = `DELETE FROM link_codes
+		WHERE code = $1 AND date_expires > $2 AND purpose = $3
+		RETURNING account_id`
+
+	InsertLinkedAccountStatement = `INSERT INTO linked_accounts (account_id, provider, external_id, date_linked)
+		VALUES ($1, $2, $3, $4)`
+
+	QueryLinksByAccount = `SELECT account_id, provider, external_id, date_linked
+		FROM linked_accounts WHERE account_id = $1`
+
+	QueryLinksByExternalId = `SELECT account_id, provider, external_id, date_linked
+		FROM linked_accounts WHERE provider = $1 AND external_id = $2`
+
+	DeleteLinkedAccountStatement = `DELETE FROM linked_accounts WHERE provider = $1 AND external_id = $2`
+
+	PurgeLinkCodesStatement = `DELETE FROM link_codes WHERE date_expires < $1`
+)
+
+// LinkedAccount associates a Wii account with an identity on an external service, such as Discord.
+type LinkedAccount struct {
+	AccountId  int64     `json:"account_id"`
+	Provider   string    `json:"provider"`
+	ExternalId string    `json:"external_id"`
+	DateLinked time.Time `json:"date_linked"`
+}
+
+// RedeemLinkRequest is sent by an external service to link an identity using a code shown on-console.
+type RedeemLinkRequest struct {
+	Code       string `json:"code"`
+	Provider   string `json:"provider"`
+	ExternalId string `json:"external_id"`
+}
+
+func init() {
+	registerTenantJob("purge-link-codes", time.Hour, purgeLinkCodes)
+	registerAdminEndpoint("/links/redeem", redeemLinkEndpoint)
+	registerAdminEndpoint("/links", linksEndpoint)
+}
+
+// newLinkCode generates a random code suitable for users to type.
+func newLinkCode() string {
+	return randomString(linkCodeBytes, LinkCodeLength)
+}
+
+// purgeLinkCodes removes all expired link codes.
+func purgeLinkCodes(ctx context.Context) error {
+	_, err := pool.Exec(ctx, PurgeLinkCodesStatement, time.Now().UTC())
+	return err
+}
+
+// getLinkCode issues a one-time code for the user to redeem with an external service.
+func getLinkCode(e *Envelope) {
+	issueLinkCode(e, LinkCodePurposeLink)
+}
+
+// getPortalCode issues a one-time code for the user to sign in to the self-service portal with.
+func getPortalCode(e *Envelope) {
+	issueLinkCode(e, LinkCodePurposePortal)
+}
+
+// issueLinkCode issues a one-time code for the given purpose, displayed to the user on-console.
+func issueLinkCode(e *Envelope, purpose string) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	expires := time.Now().UTC().Add(LinkCodeLifetime)
+	code := newLinkCode()
+	_, err = pool.Exec(e.ctx, InsertLinkCodeStatement, code, accountId, expires, purpose)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddKVNode("LinkCode", code)
+	e.AddKVNode("LinkCodeExpiration", strconv.FormatInt(expires.UnixMilli(), 10))
+}
+
+// queryLinks returns all linked accounts for the given query.
+func queryLinks(ctx context.Context, query string, args ...interface{}) ([]LinkedAccount, error) {
+	rows, err := pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []LinkedAccount{}
+	for rows.Next() {
+		var link LinkedAccount
+		err = rows.Scan(&link.AccountId, &link.Provider, &link.ExternalId, &link.DateLinked)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// redeemLinkEndpoint links an external identity to the account a code was issued for.
+func redeemLinkEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request RedeemLinkRequest
+	err := readJSON(r, &request)
+	if err != nil || request.Code == "" || request.Provider == "" || request.ExternalId == "" {
+		writeAdminError(w, http.StatusBadRequest, "code, provider and external_id are required")
+		return
+	}
+
+	tx, err := pool.Begin(r.Context())
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	now := time.Now().UTC()
+	var accountId int64
+	err = tx.QueryRow(r.Context(), RedeemLinkCodeStatement, request.Code, now, LinkCodePurposeLink).Scan(&accountId)
+	if err == pgx.ErrNoRows {
+		writeAdminError(w, http.StatusNotFound, "invalid or expired code")
+		return
+	} else if err != nil {
+		log.Printf("error redeeming link code: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	_, err = tx.Exec(r.Context(), InsertLinkedAccountStatement, accountId, request.Provider, request.ExternalId, now)
+	if driverErr, ok := err.(*pgconn.PgError); ok && driverErr.Code == "23505" {
+		writeAdminError(w, http.StatusConflict, "identity is already linked")
+		return
+	} else if err != nil {
+		log.Printf("error linking account: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	err = tx.Commit(r.Context())
+	if err != nil {
+		log.Printf("error committing link: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, LinkedAccount{
+		AccountId:  accountId,
+		Provider:   request.Provider,
+		ExternalId: request.ExternalId,
+		DateLinked: now,
+	})
+}
+
+// linksEndpoint lists links for an account or external identity, or removes a link.
+func linksEndpoint(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	provider := query.Get("provider")
+	externalId := query.Get("external_id")
+
+	switch r.Method {
+	case "GET":
+		var links []LinkedAccount
+		var err error
+		if query.Has("account_id") {
+			accountId, parseErr := strconv.ParseInt(query.Get("account_id"), 10, 64)
+			if parseErr != nil {
+				writeAdminError(w, http.StatusBadRequest, "invalid account_id")
+				return
+			}
+			links, err = queryLinks(r.Context(), QueryLinksByAccount, accountId)
+		} else if provider != "" && externalId != "" {
+			links, err = queryLinks(r.Context(), QueryLinksByExternalId, provider, externalId)
+		} else {
+			writeAdminError(w, http.StatusBadRequest, "account_id, or provider and external_id, are required")
+			return
+		}
+
+		if err != nil {
+			log.Printf("error querying links: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, links)
+	case "DELETE":
+		if provider == "" || externalId == "" {
+			writeAdminError(w, http.StatusBadRequest, "provider and external_id are required")
+			return
+		}
+
+		_, err := pool.Exec(r.Context(), DeleteLinkedAccountStatement, provider, externalId)
+		if err != nil {
+			log.Printf("error removing link: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// loadtestSteps are the actions each simulated console sends upon first opening the shop, in order.
+var loadtestSteps = []string{
+	"ias/CheckRegistration",
+	"ias/GetChallenge",
+	"ias/Register",
+	"ias/SyncRegistration",
+	"ecs/ListETickets",
+}
+
+// loadtestResults collects the latency of every request sent, keyed by action.
+type loadtestResults struct {
+	lock      sync.Mutex
+	latencies map[string][]time.Duration
+	failures  map[string]int
+	// transferred sums the size of response bodies as transferred.
+	transferred map[string]int
+}
+
+// record notes the latency and response size of a single request, and whether it failed.
+func (l *loadtestResults) record(step string, latency time.Duration, size int, failed bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.latencies[step] = append(l.latencies[step], latency)
+	l.transferred[step] += size
+	if failed {
+		l.failures[step]++
+	}
+}
+
+// percentile returns the nearest-rank percentile of the given sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (len(sorted)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// report prints the request count, failures, average response size and latency percentiles of each step, and of all steps combined.
+func (l *loadtestResults) report() {
+	fmt.Printf("%-24s %8s %8s %10s %10s %10s %10s %10s\n", "Action", "Requests", "Failed", "Bytes", "p50", "p90", "p99", "Max")
+
+	var all []time.Duration
+	failed, transferred := 0, 0
+	for _, step := range append(loadtestSteps, "all") {
+		latencies := l.latencies[step]
+		failures := l.failures[step]
+		size := l.transferred[step]
+		if step == "all" {
+			latencies, failures, size = all, failed, transferred
+		} else {
+			all = append(all, latencies...)
+			failed += failures
+			transferred += size
+		}
+
+		average := 0
+		if len(latencies) != 0 {
+			average = size / len(latencies)
+		}
+
+		sorted := append([]time.Duration{}, latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		fmt.Printf("%-24s %8d %8d %10d %10s %10s %10s %10s\n", step, len(sorted), failures, average,
+			percentile(sorted, 50).Round(time.Millisecond), percentile(sorted, 90).Round(time.Millisecond),
+			percentile(sorted, 99).Round(time.Millisecond), percentile(sorted, 100).Round(time.Millisecond))
+	}
+}
+
+// loadtestConsole derives a distinct console from the given device ID, with a serial number and friend code passing validation.
+func loadtestConsole(deviceId uint32, region string, country string) (testclient.Console, error) {
+	friendCode, err := makeFriendCode(deviceId, 0, region)
+	if err != nil {
+		return testclient.Console{}, err
+	}
+
+	console := testclient.DefaultConsole
+	console.DeviceId = int64(deviceId)
+	console.Region = region
+	console.Country = country
+	console.SerialNumber = fmt.Sprintf("LU%09d", deviceId%1000000000)
+	console.DeviceCode = friendCode.String()
+	return console, nil
+}
+
+// simulateConsole sends each step on behalf of a single console, pausing between them as a user navigating the shop would.
+// Subsequent steps are skipped should one fail, as the console would display an error.
+func simulateConsole(server string, console testclient.Console, think time.Duration, compression bool, results *loadtestResults) {
+	client := testclient.New(server, console)
+	client.Compression = compression
+	pacing := mathrand.New(mathrand.NewSource(console.DeviceId))
+
+	for i, step := range loadtestSteps {
+		if i != 0 && think > 0 {
+			// Jitter pauses by up to half either way, so that consoles started together drift apart.
+			time.Sleep(think/2 + time.Duration(pacing.Int63n(int64(think))))
+		}
+
+		request, _ := testclient.Lookup(step)
+		start := time.Now()
+		response, err := client.Send(request)
+		latency := time.Since(start)
+		if err != nil {
+			results.record(step, latency, 0, true)
+			return
+		}
+
+		failed := response.Status != 200 || response.ErrorCode != 0
+		results.record(step, latency, response.TransferSize, failed)
+		if failed {
+			return
+		}
+	}
+}
+
+// loadtestCommand simulates many consoles booting into the shop at once against a running server, reporting latency percentiles.
+// Every console registers anew, so this should not be run against a production database.
+func loadtestCommand(args []string) {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	server := flags.String("server", "http://127.0.0.1:8080", "base URL of the server to test against")
+	consoles := flags.Int("n", 100, "number of consoles to simulate")
+	ramp := flags.Duration("ramp", 10*time.Second, "duration over which consoles are started")
+	think := flags.Duration("think", 500*time.Millisecond, "average pause between each console's requests")
+	region := flags.String("region", "USA", "region consoles register within")
+	country := flags.String("country", "US", "country consoles register within")
+	compression := flags.Bool("compress", false, "request compressed responses, for comparing transfer sizes")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap loadtest [-server url] [-n consoles] [-ramp duration] [-think duration] [-region region] [-country country] [-compress]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *consoles <= 0 || *ramp < 0 || *think < 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	// Device IDs begin at a random offset, so that repeated runs do not collide with consoles registered previously.
+	offset := make([]byte, 4)
+	random.Read(offset)
+	baseId := binary.BigEndian.Uint32(offset)
+
+	results := &loadtestResults{
+		latencies:   map[string][]time.Duration{},
+		failures:    map[string]int{},
+		transferred: map[string]int{},
+	}
+
+	var wg sync.WaitGroup
+	started := time.Now()
+	for i := 0; i < *consoles; i++ {
+		console, err := loadtestConsole(baseId+uint32(i), *region, *country)
+		checkError(err)
+
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			time.Sleep(delay)
+			simulateConsole(*server, console, *think, *compression, results)
+		}(*ramp * time.Duration(i) / time.Duration(*consoles))
+	}
+	wg.Wait()
+
+	fmt.Printf("Simulated %d consoles in %s.\n", *consoles, time.Since(started).Round(time.Millisecond))
+	results.report()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// DefaultLanguage is the language titles are presented in when unavailable in the console's own.
+const DefaultLanguage = "en"
+
+const (
+	// QueryTitleLocalization returns the name and description of a title in the given language,
+	// falling back to the given default language and then to the title's own metadata.
+	QueryTitleLocalization = `SELECT COALESCE(preferred.name, fallback.name, titles.name),
+			COALESCE(preferred.description, fallback.description, titles.description)
+		FROM (SELECT $1::varchar AS title_id) AS requested
+		LEFT JOIN title_localizations AS preferred ON preferred.title_id = requested.title_id AND preferred.language = $2
+		LEFT JOIN title_localizations AS fallback ON fallback.title_id = requested.title_id AND fallback.language = $3
+		LEFT JOIN titles ON titles.title_id = requested.title_id`
+
+	QueryTitleLocalizations = `SELECT language, name, description FROM title_localizations WHERE title_id = $1 ORDER BY language`
+
+	// UpsertTitleLocalizationStatement sets the name of a title in a language, retaining any existing description if none is given.
+	UpsertTitleLocalizationStatement = `INSERT INTO title_localizations (title_id, language, name, description)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (title_id, language) DO UPDATE SET
+			name = excluded.name,
+			description = COALESCE(excluded.description, title_localizations.description)`
+
+	DeleteTitleLocalizationStatement = `DELETE FROM title_localizations WHERE title_id = $1 AND language = $2`
+)
+
+// bannerLanguageCodes maps each of BannerLanguages to the language code consoles request the shop in.
+var bannerLanguageCodes = map[string]string{
+	"Japanese":           "ja",
+	"English":            "en",
+	"German":             "de",
+	"French":             "fr",
+	"Spanish":            "es",
+	"Italian":            "it",
+	"Dutch":              "nl",
+	"SimplifiedChinese":  "zh",
+	"TraditionalChinese": "zh-TW",
+	"Korean":             "ko",
+}
+
+// defaultLanguage is the configured fallback language.
+var defaultLanguage = DefaultLanguage
+
+// TitleLocalization describes the name and description of a title in a single language.
+type TitleLocalization struct {
+	TitleId     string  `json:"title_id"`
+	Language    string  `json:"language"`
+	Name        string  `json:"name"`
+	Description *string `json:"description"`
+}
+
+func init() {
+	registerAdminEndpoint("/titles/localizations", titleLocalizationsEndpoint)
+}
+
+// titleLocalization returns the name and description of the given title in this console's language.
+// Either is nil if unknown in this language, the default language, and the title's own metadata.
+func (e *Envelope) titleLocalization(titleId string) (*string, *string, error) {
+	var name, description *string
+	err := pool.QueryRow(e.ctx, QueryTitleLocalization, titleId, e.Language(), defaultLanguage).Scan(&name, &description)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return name, description, nil
+}
+
+// localizedAttributes returns attributes presenting the name and description of the given title, if known.
+func (e *Envelope) localizedAttributes(titleId string) ([]Attributes, error) {
+	name, description, err := e.titleLocalization(titleId)
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes []Attributes
+	if name != nil {
+		attributes = append(attributes, Attributes{Name: "TitleName", Value: *name})
+	}
+	if description != nil {
+		attributes = append(attributes, Attributes{Name: "TitleDescription", Value: *description})
+	}
+	return attributes, nil
+}
+
+// importBannerNames records the given banner names as localizations of a title.
+func importBannerNames(ctx context.Context, titleId string, names map[string]string) error {
+	for language, name := range names {
+		code, known := bannerLanguageCodes[language]
+		if !known {
+			continue
+		}
+
+		_, err := pool.Exec(ctx, UpsertTitleLocalizationStatement, titleId, code, name, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryTitleLocalizations returns every localization of the given title.
+func queryTitleLocalizations(ctx context.Context, titleId string) ([]TitleLocalization, error) {
+	rows, err := pool.Query(ctx, QueryTitleLocalizations, titleId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	localizations := []TitleLocalization{}
+	for rows.Next() {
+		localization := TitleLocalization{TitleId: titleId}
+		err = rows.Scan(&localization.Language, &localization.Name, &localization.Description)
+		if err != nil {
+			return nil, err
+		}
+		localizations = append(localizations, localization)
+	}
+
+	return localizations, rows.Err()
+}
+
+// titleLocalizationsEndpoint lists, sets or removes the localized names and descriptions of a title.
+func titleLocalizationsEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		titleId := r.URL.Query().Get("title_id")
+		if titleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id is required")
+			return
+		}
+
+		localizations, err := queryTitleLocalizations(r.Context(), titleId)
+		if err != nil {
+			log.Printf("error querying title localizations: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, localizations)
+	case "PUT":
+		var localization TitleLocalization
+		err := readJSON(r, &localization)
+		if err != nil || localization.TitleId == "" || localization.Language == "" || localization.Name == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id, language and name are required")
+			return
+		}
+
+		_, err = pool.Exec(r.Context(), UpsertTitleLocalizationStatement, localization.TitleId, localization.Language, localization.Name, localization.Description)
+		if err != nil {
+			log.Printf("error setting title localization: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, localization)
+	case "DELETE":
+		titleId, language := r.URL.Query().Get("title_id"), r.URL.Query().Get("language")
+		if titleId == "" || language == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id and language are required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), DeleteTitleLocalizationStatement, titleId, language)
+		if err != nil {
+			log.Printf("error removing title localization: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "title is not localized in this language")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
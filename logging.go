@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	logPath string
+	logFile *os.File
+	logLock sync.Mutex
+)
+
+func init() {
+	registerJob("rotate-logs", 24*time.Hour, rotateLogs)
+}
+
+// openLogFile directs all logging to the given path, appending to existing contents.
+func openLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	logPath = path
+	logFile = file
+	log.SetOutput(file)
+	return nil
+}
+
+// rotateLogs moves the current log file aside with a timestamp, and begins a new one.
+// It does nothing if logging is not directed to a file.
+func rotateLogs() error {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if logFile == nil {
+		return nil
+	}
+
+	rotatedPath := fmt.Sprintf("%s.%s", logPath, time.Now().UTC().Format("20060102-150405"))
+	err := os.Rename(logPath, rotatedPath)
+	if err != nil {
+		return err
+	}
+
+	previous := logFile
+	err = openLogFile(logPath)
+	if err != nil {
+		// Continue logging to the previous file, wherever it may now be.
+		return err
+	}
+
+	return previous.Close()
+}
@@ -19,30 +19,25 @@ package main
 
 import (
 	"context"
-	crypto "crypto/rand"
 	"encoding/xml"
 	"fmt"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"io/ioutil"
 	"log"
-	"math"
-	"math/big"
-	"math/rand"
-	"net/http"
+	"os"
+	"time"
 )
 
 const (
-	// SharedChallenge represents a static value to this nonsensical challenge response system.
+	// DefaultSharedChallenge represents a static value to this nonsensical challenge response system.
 	// The given challenge must be 11 characters or less. Contents do not matter.
-	SharedChallenge = "NintyWhyPls"
+	DefaultSharedChallenge = "NintyWhyPls"
 )
 
-var baseUrl string
-var pool *pgxpool.Pool
+var pool Database
+var sharedChallenge = DefaultSharedChallenge
 var ctx = context.Background()
 var isDebug = false
 var ignoreAuth = false
-var whitelistEnabled = false
 
 // checkError makes error handling not as ugly and inefficient.
 func checkError(err error) {
@@ -52,10 +47,23 @@ func checkError(err error) {
 }
 
 func main() {
-	// Seed our random number generator before anything else.
-	seed, err := crypto.Int(crypto.Reader, big.NewInt(math.MaxInt64))
-	checkError(err)
-	rand.Seed(seed.Int64())
+	// Handle subcommands, which do not require configuration.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			replayCommand(os.Args[2:])
+			return
+		case "actions":
+			actionsCommand()
+			return
+		case "golden":
+			goldenCommand(os.Args[2:])
+			return
+		case "loadtest":
+			loadtestCommand(os.Args[2:])
+			return
+		}
+	}
 
 	// Initial Start.
 	fmt.Println("WiiSOAP 0.2.6 Kawauso\n[i] Reading the Config...")
@@ -66,58 +74,127 @@ func main() {
 	readConfig := Config{}
 	err = xml.Unmarshal(ioconfig, &readConfig)
 	checkError(err)
+	checkError(loadSecrets(&readConfig))
 
 	fmt.Println("[i] Initializing core...")
 	isDebug = readConfig.Debug
 	if isDebug {
 		ignoreAuth = readConfig.NoAuth
+
+		if readConfig.CaptureDirectory != "" {
+			captureDirectory = readConfig.CaptureDirectory
+			checkError(os.MkdirAll(captureDirectory, 0755))
+		}
 	}
 
-	whitelistEnabled = readConfig.Whitelist
+	if readConfig.Whitelist {
+		log.Fatalln("Whitelist has been replaced by Allowlist. Import whitelist.txt via /allowlist/import on the admin API, then enable Allowlist instead.")
+	}
+	strictSerials = readConfig.StrictSerials
+	strictChallenge = readConfig.StrictChallenge
+	dolphinCompatibility = readConfig.DolphinCompatibility
+	checkError(loadDuplicateRegistrations(readConfig.DuplicateRegistrations))
+	parentalControls = readConfig.ParentalControls
+	bundleBaseTitles = readConfig.BundleBaseTitles
+	sandboxPurchases = readConfig.SandboxPurchases
+	strictCompatibility = readConfig.StrictCompatibility
+	if dolphinCompatibility {
+		log.Println("Dolphin compatibility is enabled. It should not be used on public instances.")
+	}
+	if readConfig.DefaultLanguage != "" {
+		defaultLanguage = readConfig.DefaultLanguage
+	}
+	loadPricing(readConfig.Pricing)
+	checkError(loadErrors(readConfig.Errors))
+	loadRequestLimits(readConfig.RequestLimits)
+	checkError(loadHTTP(readConfig.HTTP))
+	checkError(loadGeoIP(readConfig.GeoIP))
+	checkError(loadFraudRules(readConfig.Fraud))
+	loadAllowlist(readConfig.Allowlist)
+	checkError(loadAssets(readConfig.Assets))
+	checkError(loadFederation(readConfig.Federation))
+	checkError(loadTracing(readConfig.Tracing))
+	checkError(loadSystemUpdate(readConfig.SystemUpdate))
+
+	if readConfig.CacheTTL != "" {
+		cacheTTL, err := time.ParseDuration(readConfig.CacheTTL)
+		checkError(err)
+		configureCaches(cacheTTL)
+	}
+	checkError(loadSessions(readConfig.Sessions))
 
 	// Start SQL.
+	checkError(loadPoolConfig(readConfig.SQLPool))
+	checkError(loadReplicaConfig(readConfig.SQLReplica, readConfig.SQLUser, readConfig.SQLPass, readConfig.SQLDB))
 	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", readConfig.SQLUser, readConfig.SQLPass, readConfig.SQLAddress, readConfig.SQLDB)
-	dbConf, err := pgxpool.ParseConfig(dbString)
-	checkError(err)
-	pool, err = pgxpool.ConnectConfig(ctx, dbConf)
+	err = loadTenants(dbString, Tenant{
+		Name:    "default",
+		BaseURL: readConfig.BaseURL,
+		Shop:    readConfig.Shop,
+	}, readConfig.Tenants)
 	checkError(err)
+	defer closeTenants()
+
+	// Handle subcommands requiring configuration and the database.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-titles":
+			importTitlesCommand(os.Args[2:])
+			return
+		case "export":
+			exportCommand(os.Args[2:])
+			return
+		case "import":
+			importCommand(os.Args[2:])
+			return
+		case "gencodes":
+			genCodesCommand(os.Args[2:])
+			return
+		default:
+			log.Fatalf("Unknown subcommand %s.", os.Args[1])
+		}
+	}
 
-	// Ensure this PostgreSQL connection is valid.
-	defer pool.Close()
-	checkError(err)
+	if readConfig.LogFile != "" {
+		checkError(openLogFile(readConfig.LogFile))
+	}
 
-	baseUrl = readConfig.BaseURL
+	if readConfig.MetricsAddress != "" {
+		serveMetrics(readConfig.MetricsAddress)
+	}
 
-	// Start the HTTP server.
-	fmt.Printf("Starting HTTP connection (%s)...\nNot using the usual port for HTTP?\nBe sure to use a proxy, otherwise the Wii can't connect!\n", readConfig.Address)
+	if readConfig.Admin.Address != "" {
+		serveAdmin(readConfig.Admin)
+	}
 
-	r := NewRoute()
-	ecs := r.HandleGroup("ecs")
-	{
-		ecs.Authenticated("CheckDeviceStatus", checkDeviceStatus)
-		ecs.Authenticated("NotifyETicketsSynced", notifyETicketsSynced)
-		ecs.Authenticated("ListETickets", listETickets)
-		ecs.Authenticated("GetETickets", getETickets)
-		ecs.Authenticated("PurchaseTitle", purchaseTitle)
-		ecs.Unauthenticated("GetECConfig", getECConfig)
-		ecs.Authenticated("ListPurchaseHistory", listPurchaseHistory)
+	if readConfig.Portal.Address != "" {
+		servePortal(readConfig.Portal)
 	}
 
-	ias := r.HandleGroup("ias")
-	{
-		ias.Unauthenticated("CheckRegistration", checkRegistration)
-		ias.Unauthenticated("GetChallenge", getChallenge)
-		ias.Authenticated("GetRegistrationInfo", getRegistrationInfo)
-		ias.Unauthenticated("SyncRegistration", syncRegistration)
-		ias.Unauthenticated("Register", register)
-		ias.Authenticated("Unregister", unregister)
+	if readConfig.Companion.Address != "" {
+		serveCompanion(readConfig.Companion)
 	}
 
-	cas := r.HandleGroup("cas")
-	{
-		cas.Authenticated("ListItems", listItems)
+	// Monitor the database so that we can report outages to consoles.
+	superviseDatabase()
+
+	// Begin running housekeeping tasks.
+	startScheduler(readConfig.Jobs)
+	startTokenWorkers()
+	startWebhooks(readConfig.Webhooks)
+
+	// Start the HTTP server.
+	fmt.Printf("Starting HTTP connection (%s)...\nNot using the usual port for HTTP?\nBe sure to use a proxy, otherwise the Wii can't connect!\n", readConfig.Address)
+
+	r := newRouter()
+	for _, name := range readConfig.DisabledActions {
+		checkError(r.Disable(name))
 	}
-	log.Fatal(http.ListenAndServe(readConfig.Address, r.Handle()))
+	checkError(r.SetTimeouts(readConfig.Timeouts))
+	checkError(loadPlugins(readConfig.Plugins))
+	checkError(pluginHooks.validate(r))
+
+	log.Fatal(listen(readConfig, r.Handle()))
 
 	// From here on out, all special cool things should go into their respective handler function.
 }
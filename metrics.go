@@ -0,0 +1,26 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// metrics holds counters exported by WiiSOAP, available as JSON via the configured metrics address.
+var metrics = expvar.NewMap("wiisoap")
+
+// incrementMetric increases the named counter by one.
+func incrementMetric(name string) {
+	metrics.Add(name, 1)
+}
+
+// serveMetrics exposes all metrics at the given address in the background.
+func serveMetrics(address string) {
+	go func() {
+		log.Printf("Serving metrics at %s", address)
+		err := http.ListenAndServe(address, expvar.Handler())
+		if err != nil {
+			log.Printf("unable to serve metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// ExportFormatVersion is incremented whenever the export format changes incompatibly.
+	ExportFormatVersion = 1
+
+	QueryExportConsoles = `SELECT device_id, device_token, device_token_hashed, account_id, region, serial_number,
+			device_code, balance, console_model, manufacturing_region, parental_age_limit
+		FROM userbase
+		WHERE date_erased IS NULL
+		ORDER BY account_id`
+
+	QueryExportTickets = `SELECT account_id, title_id, version, item_id, date_purchased, date_expires
+		FROM owned_titles
+		WHERE account_id IN (SELECT account_id FROM userbase WHERE date_erased IS NULL)
+		ORDER BY account_id, date_purchased`
+
+	QueryAccountExists = `SELECT 1 FROM userbase WHERE account_id = $1`
+
+	ImportConsoleStatement = `INSERT INTO userbase (device_id, device_token, device_token_hashed, account_id, region, serial_number,
+			device_code, balance, console_model, manufacturing_region, parental_age_limit)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	ImportTicketStatement = `INSERT INTO owned_titles (account_id, title_id, version, item_id, date_purchased, date_expires)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+)
+
+// Export is the document produced by `wiisoap export` and consumed by `wiisoap import`.
+type Export struct {
+	// Version is the format version, currently ExportFormatVersion.
+	Version  int             `json:"version"`
+	Exported time.Time       `json:"exported"`
+	Consoles []ExportConsole `json:"consoles"`
+}
+
+// ExportConsole describes a registered console alongside its tickets.
+// Other shop implementations may omit DeviceTokenHashed, in which case it is derived from DeviceToken.
+type ExportConsole struct {
+	DeviceId            int64          `json:"device_id"`
+	DeviceToken         string         `json:"device_token"`
+	DeviceTokenHashed   string         `json:"device_token_hashed,omitempty"`
+	AccountId           int64          `json:"account_id"`
+	Region              *string        `json:"region"`
+	SerialNumber        *string        `json:"serial_number"`
+	DeviceCode          *string        `json:"device_code"`
+	Balance             int            `json:"balance"`
+	ConsoleModel        *string        `json:"console_model,omitempty"`
+	ManufacturingRegion *string        `json:"manufacturing_region,omitempty"`
+	ParentalAgeLimit    *int           `json:"parental_age_limit,omitempty"`
+	Tickets             []ExportTicket `json:"tickets"`
+}
+
+// ExportTicket describes a title owned by a console.
+type ExportTicket struct {
+	TitleId       string     `json:"title_id"`
+	Version       *int       `json:"version"`
+	ItemId        *int       `json:"item_id"`
+	DatePurchased time.Time  `json:"date_purchased"`
+	DateExpires   *time.Time `json:"date_expires,omitempty"`
+}
+
+// exportCommand writes all consoles, their balances and tickets as JSON.
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "file to write to instead of standard output")
+	tenant := flags.String("tenant", "", "tenant to export, rather than the default")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap export [-o file] [-tenant name]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	useTenant(*tenant)
+
+	export := Export{
+		Version:  ExportFormatVersion,
+		Exported: time.Now().UTC(),
+		Consoles: []ExportConsole{},
+	}
+
+	rows, err := pool.Query(ctx, QueryExportConsoles)
+	checkError(err)
+
+	indices := map[int64]int{}
+	for rows.Next() {
+		var console ExportConsole
+		err = rows.Scan(&console.DeviceId, &console.DeviceToken, &console.DeviceTokenHashed, &console.AccountId, &console.Region,
+			&console.SerialNumber, &console.DeviceCode, &console.Balance, &console.ConsoleModel, &console.ManufacturingRegion, &console.ParentalAgeLimit)
+		checkError(err)
+
+		console.Tickets = []ExportTicket{}
+		indices[console.AccountId] = len(export.Consoles)
+		export.Consoles = append(export.Consoles, console)
+	}
+	checkError(rows.Err())
+	rows.Close()
+
+	rows, err = pool.Query(ctx, QueryExportTickets)
+	checkError(err)
+
+	for rows.Next() {
+		var accountId int64
+		var ticket ExportTicket
+		err = rows.Scan(&accountId, &ticket.TitleId, &ticket.Version, &ticket.ItemId, &ticket.DatePurchased, &ticket.DateExpires)
+		checkError(err)
+
+		// Tickets of unregistered consoles have nowhere to go.
+		if index, exists := indices[accountId]; exists {
+			export.Consoles[index].Tickets = append(export.Consoles[index].Tickets, ticket)
+		}
+	}
+	checkError(rows.Err())
+	rows.Close()
+
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		checkError(err)
+		defer file.Close()
+		writer = file
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	checkError(encoder.Encode(export))
+
+	fmt.Fprintf(os.Stderr, "Exported %d consoles.\n", len(export.Consoles))
+}
+
+// importCommand loads consoles, their balances and tickets from an export within a single transaction.
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	skipExisting := flags.Bool("skip-existing", false, "skip consoles whose account ID is already registered, rather than aborting")
+	dryRun := flags.Bool("dry-run", false, "validate the export without modifying the database")
+	tenant := flags.String("tenant", "", "tenant to import into, rather than the default")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap import [-skip-existing] [-dry-run] [-tenant name] export.json")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	useTenant(*tenant)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	contents, err := os.ReadFile(flags.Arg(0))
+	checkError(err)
+
+	var export Export
+	checkError(json.Unmarshal(contents, &export))
+	if export.Version != ExportFormatVersion {
+		checkError(fmt.Errorf("unsupported export version %d", export.Version))
+	}
+
+	tx, err := pool.Begin(ctx)
+	checkError(err)
+	defer tx.Rollback(ctx)
+
+	imported, skipped, tickets := 0, 0, 0
+	for _, console := range export.Consoles {
+		if console.DeviceToken == "" {
+			checkError(fmt.Errorf("console %d is missing its device token", console.DeviceId))
+		}
+
+		var throwaway int
+		err = tx.QueryRow(ctx, QueryAccountExists, console.AccountId).Scan(&throwaway)
+		if err == nil {
+			if !*skipExisting {
+				checkError(fmt.Errorf("account %s is already registered", formatAccountId(console.AccountId)))
+			}
+			skipped++
+			continue
+		} else if err != pgx.ErrNoRows {
+			checkError(err)
+		}
+
+		hashed := console.DeviceTokenHashed
+		if hashed == "" {
+			hashed = hashDeviceToken(md5Token(console.DeviceToken))
+		}
+
+		_, err = tx.Exec(ctx, ImportConsoleStatement, console.DeviceId, console.DeviceToken, hashed, console.AccountId, console.Region,
+			console.SerialNumber, console.DeviceCode, console.Balance, console.ConsoleModel, console.ManufacturingRegion, console.ParentalAgeLimit)
+		checkError(err)
+
+		for _, ticket := range console.Tickets {
+			_, err = tx.Exec(ctx, ImportTicketStatement, console.AccountId, ticket.TitleId, ticket.Version, ticket.ItemId, ticket.DatePurchased, ticket.DateExpires)
+			checkError(err)
+			tickets++
+		}
+		imported++
+	}
+
+	if *dryRun {
+		fmt.Printf("Would import %d consoles with %d tickets, skipping %d.\n", imported, tickets, skipped)
+		return
+	}
+
+	checkError(tx.Commit(ctx))
+	fmt.Printf("Imported %d consoles with %d tickets, skipping %d.\n", imported, tickets, skipped)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+const (
+	// RequestIdHeader carries the ID of each request within its response, so that failures reported by users may be found within logs.
+	RequestIdHeader = "X-WiiSOAP-Request-Id"
+
+	// requestIdLength is the length of request IDs generated for untraced requests.
+	requestIdLength = 16
+)
+
+type requestIdContextKey struct{}
+
+// newRequestId returns the ID of the given request, being its trace ID should it be traced.
+func newRequestId(span trace.Span) string {
+	if traceId := span.SpanContext().TraceID(); traceId.IsValid() {
+		return traceId.String()
+	}
+	return RandString(requestIdLength)
+}
+
+// withRequestId returns a context identifying its request by the given ID.
+func withRequestId(parent context.Context, requestId string) context.Context {
+	return context.WithValue(parent, requestIdContextKey{}, requestId)
+}
+
+// requestIdFromContext returns the ID of the request the given context belongs to, or an empty string if none.
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+// logPanic records a recovered panic alongside the stack it occurred within.
+func logPanic(ctx context.Context, recovered interface{}) {
+	incrementMetric("panics")
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, "panic")
+	log.Printf("panic handling request %s: %v\n%s", requestIdFromContext(ctx), recovered, debug.Stack())
+}
+
+// invoke calls the given action, responding with an error should it panic rather than leaving the console without a response.
+// Panics within actions are most often nil dereferences upon requests lacking an expected node.
+func (e *Envelope) invoke(callback func(e *Envelope)) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		} else if recovered == http.ErrAbortHandler {
+			panic(recovered)
+		}
+
+		logPanic(e.ctx, recovered)
+		e.Error(ErrorCodeGenericFailure, "internal error", ErrPanic)
+	}()
+
+	callback(e)
+}
+
+// responseTracker records whether a response has begun, as a fault may not be written once it has.
+type responseTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (t *responseTracker) WriteHeader(status int) {
+	t.written = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *responseTracker) Write(b []byte) (int, error) {
+	t.written = true
+	return t.ResponseWriter.Write(b)
+}
+
+// recoverRequest responds with a SOAP fault should handling a request panic outside of its action, such as while parsing.
+// It must be deferred by the handler itself.
+func recoverRequest(ctx context.Context, w *responseTracker) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	} else if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+
+	logPanic(ctx, recovered)
+	if !w.written {
+		writeFault(w, http.StatusInternalServerError, FaultCodeServer, "WiiSOAP encountered an internal error.")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	QueryTitleRating = `SELECT rating_name, age FROM title_ratings WHERE title_id = $1`
+
+	UpsertTitleRatingStatement = `INSERT INTO title_ratings (title_id, rating_name, age)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (title_id) DO UPDATE SET rating_name = excluded.rating_name, age = excluded.age`
+
+	DeleteTitleRatingStatement = `DELETE FROM title_ratings WHERE title_id = $1`
+
+	QueryParentalAgeLimit = `SELECT parental_age_limit FROM userbase WHERE account_id = $1`
+
+	UpdateParentalAgeLimitStatement = `UPDATE userbase SET parental_age_limit = $2 WHERE account_id = $1`
+)
+
+// ErrParentalRestriction is returned when a title's rating exceeds what the console's parental controls permit.
+var ErrParentalRestriction = errors.New("title is restricted by parental controls")
+
+// parentalControls enables enforcement of age ratings against a console's parental restriction.
+var parentalControls = false
+
+// TitleRating describes the age rating of a title.
+type TitleRating struct {
+	TitleId string `json:"title_id"`
+	// Name is the rating as displayed by the shop, such as "E".
+	Name string `json:"name"`
+	// Age is the minimum age this title is suitable for.
+	Age int `json:"age"`
+}
+
+// ParentalRestriction describes the highest age rating a console may purchase.
+type ParentalRestriction struct {
+	AccountId int64 `json:"account_id"`
+	// AgeLimit is the highest permitted age rating, or nil if unrestricted.
+	AgeLimit *int `json:"age_limit"`
+}
+
+func init() {
+	registerAdminEndpoint("/titles/ratings", titleRatingsEndpoint)
+	registerAdminEndpoint("/consoles/parental", parentalRestrictionEndpoint)
+}
+
+// lookupTitleRating returns the rating of the given title, or nil if it is unrated.
+func lookupTitleRating(ctx context.Context, titleId string) (*TitleRating, error) {
+	rating := TitleRating{TitleId: titleId}
+	err := pool.QueryRow(ctx, QueryTitleRating, titleId).Scan(&rating.Name, &rating.Age)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &rating, nil
+}
+
+// titleRatings returns the ratings to present for the given title within the catalog.
+// Unrated titles are presented as suitable for everyone.
+func (e *Envelope) titleRatings(titleId string) (Ratings, error) {
+	ratings := Ratings{
+		Name:   "E",
+		Rating: 1,
+		Age:    9,
+	}
+
+	rating, err := lookupTitleRating(e.ctx, titleId)
+	if err != nil {
+		return Ratings{}, err
+	} else if rating != nil {
+		ratings.Name = rating.Name
+		ratings.Age = rating.Age
+	}
+
+	return ratings, nil
+}
+
+// parentalAgeLimit returns the highest age rating this console may access, or nil if it is unrestricted.
+// Consoles may additionally send their own ParentalAgeLimit, in which case the stricter limit applies.
+func (e *Envelope) parentalAgeLimit() (*int, error) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		return nil, err
+	}
+
+	var limit *int
+	err = pool.QueryRow(e.ctx, QueryParentalAgeLimit, accountId).Scan(&limit)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, err := e.getKey("ParentalAgeLimit"); err == nil {
+		sent, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		if limit == nil || sent < *limit {
+			limit = &sent
+		}
+	}
+
+	return limit, nil
+}
+
+// isRatingPermitted returns whether the given title may be accessed under this console's parental restriction.
+// Unrated titles are always permitted, as is everything when parental controls are not enforced.
+func (e *Envelope) isRatingPermitted(titleId string) (bool, error) {
+	if !parentalControls {
+		return true, nil
+	}
+
+	rating, err := lookupTitleRating(e.ctx, titleId)
+	if err != nil || rating == nil {
+		return true, err
+	}
+
+	limit, err := e.parentalAgeLimit()
+	if err != nil || limit == nil {
+		return true, err
+	}
+
+	return rating.Age <= *limit, nil
+}
+
+// enforceRating reports an error to the console if the given title is restricted, returning whether it may proceed.
+func (e *Envelope) enforceRating(titleId string) bool {
+	permitted, err := e.isRatingPermitted(titleId)
+	if err != nil {
+		log.Printf("error checking parental restriction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return false
+	}
+
+	if !permitted {
+		e.Error(ErrorCodeParentalRestriction, "unable to access title", ErrParentalRestriction)
+		return false
+	}
+
+	return true
+}
+
+// titleRatingsEndpoint returns, sets or removes the rating of a title.
+func titleRatingsEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		titleId := r.URL.Query().Get("title_id")
+		if titleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id is required")
+			return
+		}
+
+		rating, err := lookupTitleRating(r.Context(), titleId)
+		if err != nil {
+			log.Printf("error querying title rating: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if rating == nil {
+			writeAdminError(w, http.StatusNotFound, "title is unrated")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rating)
+	case "PUT":
+		var rating TitleRating
+		err := readJSON(r, &rating)
+		if err != nil || rating.TitleId == "" || rating.Name == "" || rating.Age < 0 {
+			writeAdminError(w, http.StatusBadRequest, "title_id, name and age are required")
+			return
+		}
+
+		_, err = pool.Exec(r.Context(), UpsertTitleRatingStatement, rating.TitleId, rating.Name, rating.Age)
+		if err != nil {
+			log.Printf("error setting title rating: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rating)
+	case "DELETE":
+		titleId := r.URL.Query().Get("title_id")
+		if titleId == "" {
+			writeAdminError(w, http.StatusBadRequest, "title_id is required")
+			return
+		}
+
+		_, err := pool.Exec(r.Context(), DeleteTitleRatingStatement, titleId)
+		if err != nil {
+			log.Printf("error removing title rating: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// parentalRestrictionEndpoint returns or sets the parental restriction of an account.
+func parentalRestrictionEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		accountId, err := strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "account_id is required")
+			return
+		}
+
+		restriction := ParentalRestriction{AccountId: accountId}
+		err = pool.QueryRow(r.Context(), QueryParentalAgeLimit, accountId).Scan(&restriction.AgeLimit)
+		if err == pgx.ErrNoRows {
+			writeAdminError(w, http.StatusNotFound, "account does not exist")
+			return
+		} else if err != nil {
+			log.Printf("error querying parental restriction: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, restriction)
+	case "PUT":
+		var restriction ParentalRestriction
+		err := readJSON(r, &restriction)
+		if err != nil || restriction.AccountId == 0 {
+			writeAdminError(w, http.StatusBadRequest, "account_id is required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), UpdateParentalAgeLimitStatement, restriction.AccountId, restriction.AgeLimit)
+		if err != nil {
+			log.Printf("error setting parental restriction: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "account does not exist")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, restriction)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
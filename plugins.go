@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/OpenShopChannel/WiiSOAP/hooks"
+	"github.com/antchfx/xmlquery"
+	"log"
+	"plugin"
+	"strings"
+)
+
+// PluginRegisterSymbol is the function every plugin must export, of type hooks.RegisterFunc.
+const PluginRegisterSymbol = "Register"
+
+// hookRegistry holds the hooks registered by plugins, keyed by action in the form of service/Action.
+type hookRegistry struct {
+	before map[string][]hooks.Hook
+	after  map[string][]hooks.Hook
+}
+
+// pluginHooks holds every hook registered by loaded plugins.
+var pluginHooks = &hookRegistry{
+	before: map[string][]hooks.Hook{},
+	after:  map[string][]hooks.Hook{},
+}
+
+func (r *hookRegistry) Before(action string, hook hooks.Hook) {
+	r.before[action] = append(r.before[action], hook)
+}
+
+func (r *hookRegistry) After(action string, hook hooks.Hook) {
+	r.after[action] = append(r.after[action], hook)
+}
+
+// validate ensures every hook is registered against a known action, as a misspelt action would otherwise never be hooked.
+func (r *hookRegistry) validate(route Route) error {
+	for _, registered := range []map[string][]hooks.Hook{r.before, r.after} {
+		for name := range registered {
+			if name == hooks.AllActions {
+				continue
+			}
+
+			service, actionName, found := strings.Cut(name, "/")
+			if !found {
+				return errors.New("hooked action " + name + " is not in the form service/Action")
+			}
+			if _, exists := route.Lookup(service, actionName); !exists {
+				return errors.New("hooked action " + name + " is not registered")
+			}
+		}
+	}
+	return nil
+}
+
+// loadPlugins opens each plugin at the given paths, registering their hooks.
+func loadPlugins(paths []string) error {
+	for _, path := range paths {
+		opened, err := plugin.Open(path)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", path, err)
+		}
+
+		symbol, err := opened.Lookup(PluginRegisterSymbol)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", path, err)
+		}
+		register, ok := symbol.(hooks.RegisterFunc)
+		if !ok {
+			return fmt.Errorf("plugin %s: %s is not a hooks.RegisterFunc", path, PluginRegisterSymbol)
+		}
+
+		err = register(pluginHooks)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", path, err)
+		}
+		log.Printf("loaded plugin %s", path)
+	}
+	return nil
+}
+
+// runHooks runs the given hooks registered against this envelope's action, followed by those registered against every action.
+func (e *Envelope) runHooks(registered map[string][]hooks.Hook) {
+	for _, name := range []string{e.service + "/" + e.action, hooks.AllActions} {
+		for _, hook := range registered[name] {
+			hook(hookEnvelope{e})
+		}
+	}
+}
+
+// hookEnvelope exposes an envelope to hooks.
+type hookEnvelope struct {
+	e *Envelope
+}
+
+func (h hookEnvelope) Context() context.Context {
+	return h.e.ctx
+}
+
+func (h hookEnvelope) Service() string {
+	return h.e.service
+}
+
+func (h hookEnvelope) Action() string {
+	return h.e.action
+}
+
+func (h hookEnvelope) Tenant() string {
+	return tenantFromContext(h.e.ctx).Name
+}
+
+func (h hookEnvelope) DeviceId() int {
+	return h.e.DeviceId()
+}
+
+func (h hookEnvelope) Region() string {
+	return h.e.Region()
+}
+
+func (h hookEnvelope) Country() string {
+	return h.e.Country()
+}
+
+func (h hookEnvelope) Language() string {
+	return h.e.Language()
+}
+
+func (h hookEnvelope) AccountId() (int64, bool) {
+	accountId, err := h.e.AccountId()
+	return accountId, err == nil && accountId != 0
+}
+
+func (h hookEnvelope) Value(key string) (string, bool) {
+	value, err := h.e.getKey(key)
+	return value, err == nil
+}
+
+func (h hookEnvelope) SetValue(key string, value string) bool {
+	node := xmlquery.FindOne(h.e.doc, "//"+key)
+	if node == nil {
+		return false
+	}
+
+	for child := node.FirstChild; child != nil; child = node.FirstChild {
+		xmlquery.RemoveFromTree(child)
+	}
+	xmlquery.AddChild(node, &xmlquery.Node{Type: xmlquery.TextNode, Data: value})
+	return true
+}
+
+func (h hookEnvelope) ErrorCode() int {
+	return int(h.e.Body.Response.ErrorCode)
+}
+
+func (h hookEnvelope) Fail(code int, message string) {
+	h.e.Error(ErrorCode(code), message, nil)
+}
+
+func (h hookEnvelope) Field(key string) (string, bool) {
+	for _, field := range h.e.Body.Response.CustomFields {
+		if kv, ok := field.(KVField); ok && kv.XMLName.Local == key {
+			return kv.Value, true
+		}
+	}
+	return "", false
+}
+
+func (h hookEnvelope) SetField(key string, value string) {
+	for i, field := range h.e.Body.Response.CustomFields {
+		if kv, ok := field.(KVField); ok && kv.XMLName.Local == key {
+			h.e.Body.Response.CustomFields[i] = KVField{XMLName: xml.Name{Local: key}, Value: value}
+			return
+		}
+	}
+	h.e.AddKVNode(key, value)
+}
+
+func (h hookEnvelope) RemoveField(key string) {
+	var fields []interface{}
+	for _, field := range h.e.Body.Response.CustomFields {
+		if kv, ok := field.(KVField); ok && kv.XMLName.Local == key {
+			continue
+		}
+		fields = append(fields, field)
+	}
+	h.e.Body.Response.CustomFields = fields
+}
+
+func (h hookEnvelope) RewriteItems(rewrite func(item *hooks.Item) bool) {
+	var fields []interface{}
+	for _, field := range h.e.Body.Response.CustomFields {
+		listed, ok := field.(Items)
+		if !ok {
+			fields = append(fields, field)
+			continue
+		}
+
+		item := &hooks.Item{TitleId: listed.TitleId, ItemId: listed.Prices.ItemId, Price: listed.Prices.Price.Amount}
+		for _, attribute := range listed.Attributes {
+			item.Attributes = append(item.Attributes, hooks.Attribute{Name: attribute.Name, Value: attribute.Value})
+		}
+		if !rewrite(item) {
+			continue
+		}
+
+		listed.TitleId = item.TitleId
+		listed.Prices.ItemId = item.ItemId
+		listed.Prices.Price.Amount = item.Price
+		listed.Attributes = nil
+		for _, attribute := range item.Attributes {
+			listed.Attributes = append(listed.Attributes, Attributes{Name: attribute.Name, Value: attribute.Value})
+		}
+		fields = append(fields, listed)
+	}
+	h.e.Body.Response.CustomFields = fields
+}
+
+func (h hookEnvelope) AdjustBalance(accountId int64, amount int) (int, error) {
+	return adjustBalance(h.e.ctx, BalanceAdjustment{AccountId: accountId, Amount: amount})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Points card code formats.
+const (
+	// PointCardFormatDigits is sixteen digits, as printed on retail Wii Points Cards.
+	PointCardFormatDigits = "digits"
+	// PointCardFormatAlphanumeric is sixteen characters omitting those easily confused with one another.
+	PointCardFormatAlphanumeric = "alphanumeric"
+)
+
+const (
+	// PointCardLength is the length of every points card code, excluding separators.
+	PointCardLength = 16
+	// pointCardGroup is how many characters are printed between dashes.
+	pointCardGroup = 4
+
+	pointCardDigits = "0123456789"
+
+	// TransactionPointsCard is the transaction type recorded when redeeming a points card.
+	TransactionPointsCard = "PURCHPOINTS"
+
+	InsertPointCardStatement = `INSERT INTO point_cards (code_hash, points, campaign, date_expires)
+		VALUES ($1, $2, $3, $4)`
+
+	// RedeemPointCardStatement marks an unredeemed, unexpired card as redeemed by an account, returning its value.
+	RedeemPointCardStatement = `UPDATE point_cards SET account_id = $2, date_redeemed = $3
+		WHERE code_hash = $1 AND date_redeemed IS NULL AND (date_expires IS NULL OR date_expires > $3)
+		RETURNING points, campaign`
+
+	// QueryPointCardCampaigns summarizes cards by campaign. Cards without a campaign are grouped under an empty one.
+	QueryPointCardCampaigns = `SELECT COALESCE(campaign, ''), count(*), count(date_redeemed),
+			count(*) FILTER (WHERE date_redeemed IS NULL AND date_expires <= $1),
+			COALESCE(sum(points) FILTER (WHERE date_redeemed IS NOT NULL), 0)
+		FROM point_cards
+		GROUP BY COALESCE(campaign, '')
+		ORDER BY COALESCE(campaign, '')`
+)
+
+// ErrInvalidPointCard is returned when a points card does not exist, has expired or has already been redeemed.
+var ErrInvalidPointCard = errors.New("points card is invalid, expired or already redeemed")
+
+// PointCardCampaign summarizes the cards generated for a campaign and their redemptions.
+type PointCardCampaign struct {
+	Campaign  string `json:"campaign"`
+	Generated int    `json:"generated"`
+	Redeemed  int    `json:"redeemed"`
+	// Expired counts cards which lapsed without being redeemed.
+	Expired        int   `json:"expired"`
+	PointsRedeemed int64 `json:"points_redeemed"`
+}
+
+func init() {
+	registerAdminEndpoint("/pointcards/campaigns", pointCardCampaignsEndpoint)
+}
+
+// newPointCard generates a points card code in the given format, grouped with dashes.
+func newPointCard(format string) string {
+	alphabet := pointCardDigits
+	if format == PointCardFormatAlphanumeric {
+		alphabet = linkCodeBytes
+	}
+
+	code := randomString(alphabet, PointCardLength)
+	groups := make([]string, 0, PointCardLength/pointCardGroup)
+	for i := 0; i < len(code); i += pointCardGroup {
+		groups = append(groups, code[i:i+pointCardGroup])
+	}
+	return strings.Join(groups, "-")
+}
+
+// purchasePoints credits the account with the value of a points card.
+func purchasePoints(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	if !tenantFromContext(e.ctx).Shop.PointCards {
+		e.Error(ErrorCodeInvalidRequest, "points cards are not offered", nil)
+		return
+	}
+
+	cardNumber, err := e.getKey("ECardNumber")
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "missing points card", err)
+		return
+	}
+
+	// Attempts count towards redemption velocity whether or not the code is valid, as guessing codes is itself suspicious.
+	redemptionRule, ok := e.enforceFraud(ErrorCodeInvalidRequest, FraudEventRedemption, formatAccountId(accountId), 1)
+	if !ok {
+		return
+	}
+
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	var points int
+	var campaign *string
+	err = tx.QueryRow(e.ctx, RedeemPointCardStatement, hashUserCode(cardNumber), accountId, time.Now().UTC()).Scan(&points, &campaign)
+	if err == pgx.ErrNoRows {
+		e.Error(ErrorCodeInvalidRequest, "invalid points card", ErrInvalidPointCard)
+		return
+	} else if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	pointsRule, ok := e.enforceFraud(ErrorCodeInvalidRequest, FraudEventPoints, formatAccountId(accountId), points)
+	if !ok {
+		return
+	}
+
+	// Held redemptions consume the card, but their points are only credited once approved.
+	held := redemptionRule.holds() || pointsRule.holds()
+	var transactionId int
+	if held {
+		rule := redemptionRule
+		if pointsRule.holds() {
+			rule = pointsRule
+		}
+		_, err = tx.Exec(e.ctx, InsertFraudHoldStatement, accountId, rule.name, points)
+	} else {
+		err = creditPoints(e.ctx, tx, accountId, points)
+		if err == nil {
+			transactionId, err = recordTransaction(e.ctx, tx, Transaction{
+				AccountId: accountId,
+				Type:      TransactionPointsCard,
+				TotalPaid: 0,
+			})
+		}
+	}
+	if err != nil {
+		log.Printf("error crediting points: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("error committing redemption: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	incrementMetric("point_cards_redeemed")
+	if campaign != nil {
+		incrementMetric("point_cards_redeemed_" + *campaign)
+	}
+	if held {
+		incrementMetric("fraud_holds")
+		e.Error(ErrorCodeGenericFailure, "redemption is held for review", ErrRedemptionHeld)
+		return
+	}
+
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
+	e.AddKVNode("TransactionId", formatTransactionId(transactionId))
+	e.AddKVNode("Points", strconv.Itoa(points))
+}
+
+// pointCardCampaignsEndpoint summarizes points cards and their redemptions per campaign.
+func pointCardCampaignsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rows, err := pool.Query(r.Context(), QueryPointCardCampaigns, time.Now().UTC())
+	if err != nil {
+		log.Printf("error querying points cards: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	campaigns := []PointCardCampaign{}
+	for rows.Next() {
+		var campaign PointCardCampaign
+		err = rows.Scan(&campaign.Campaign, &campaign.Generated, &campaign.Redeemed, &campaign.Expired, &campaign.PointsRedeemed)
+		if err != nil {
+			log.Printf("error querying points cards: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		campaigns = append(campaigns, campaign)
+	}
+
+	writeJSON(w, http.StatusOK, campaigns)
+}
+
+// genCodesCommand generates points cards, storing them hashed and writing them as CSV for distribution.
+// Codes are only committed once written in full, as they cannot be recovered afterwards.
+func genCodesCommand(args []string) {
+	flags := flag.NewFlagSet("gencodes", flag.ExitOnError)
+	count := flags.Int("n", 0, "number of codes to generate")
+	points := flags.Int("points", 0, "points each code is worth")
+	format := flags.String("format", PointCardFormatDigits, "code format, either digits or alphanumeric")
+	expires := flags.String("expires", "", "date codes expire upon as YYYY-MM-DD, rather than never")
+	campaign := flags.String("campaign", "", "campaign to tag codes with, for redemption metrics")
+	output := flags.String("o", "", "file to write CSV to instead of standard output")
+	tenant := flags.String("tenant", "", "tenant to generate codes for, rather than the default")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap gencodes -n count -points amount [-format digits|alphanumeric] [-expires YYYY-MM-DD] [-campaign tag] [-o file] [-tenant name]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	useTenant(*tenant)
+
+	if *count <= 0 || *points <= 0 || (*format != PointCardFormatDigits && *format != PointCardFormatAlphanumeric) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var dateExpires *time.Time
+	if *expires != "" {
+		parsed, err := time.Parse(StatsDateFormat, *expires)
+		checkError(err)
+		if !parsed.After(time.Now()) {
+			checkError(errors.New("expiry must be in the future"))
+		}
+		dateExpires = &parsed
+	}
+	var tag *string
+	if *campaign != "" {
+		tag = campaign
+	}
+
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		checkError(err)
+		defer file.Close()
+		writer = file
+	}
+
+	tx, err := pool.Begin(ctx)
+	checkError(err)
+	defer tx.Rollback(ctx)
+
+	csvWriter := csv.NewWriter(writer)
+	checkError(csvWriter.Write([]string{"code", "points", "campaign", "expires"}))
+	for i := 0; i < *count; i++ {
+		code := newPointCard(*format)
+		_, err = tx.Exec(ctx, InsertPointCardStatement, hashUserCode(code), *points, tag, dateExpires)
+		checkError(err)
+
+		checkError(csvWriter.Write([]string{code, strconv.Itoa(*points), *campaign, *expires}))
+	}
+	csvWriter.Flush()
+	checkError(csvWriter.Error())
+
+	checkError(tx.Commit(ctx))
+	fmt.Fprintf(os.Stderr, "Generated %d codes worth %d points each.\n", *count, *points)
+}
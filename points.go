@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	QueryAccountBalance = `SELECT balance FROM userbase WHERE account_id = $1`
+
+	// DebitPointsStatement only succeeds if the account has enough points available.
+	DebitPointsStatement = `UPDATE userbase SET balance = balance - $2
+		WHERE account_id = $1 AND balance >= $2`
+
+	CreditPointsStatement = `UPDATE userbase SET balance = balance + $2 WHERE account_id = $1`
+)
+
+var (
+	// ErrInsufficientPoints is returned when an account cannot afford a debit.
+	ErrInsufficientPoints = errors.New("insufficient points")
+	// ErrUnknownAccount is returned when crediting an account which does not exist.
+	ErrUnknownAccount = errors.New("account does not exist")
+)
+
+// getBalance returns the current points balance for the given account.
+func getBalance(ctx context.Context, accountId int64) (Balance, error) {
+	var amount int
+	err := pool.QueryRow(ctx, QueryAccountBalance, accountId).Scan(&amount)
+	if err != nil {
+		return Balance{}, err
+	}
+
+	return Balance{
+		Amount:   amount,
+		Currency: DefaultCurrency,
+	}, nil
+}
+
+// debitPoints removes the given amount of points from an account within a transaction.
+// If the account lacks enough points, ErrInsufficientPoints is returned.
+func debitPoints(ctx context.Context, tx pgx.Tx, accountId int64, amount int) error {
+	result, err := tx.Exec(ctx, DebitPointsStatement, accountId, amount)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() != 1 {
+		return ErrInsufficientPoints
+	}
+
+	return recordAudit(ctx, tx, AuditEntry{
+		AccountId:      &accountId,
+		Action:         "points/Debit",
+		ParametersHash: hashParameters(accountId, amount),
+	})
+}
+
+// creditPoints adds the given amount of points to an account within a transaction.
+func creditPoints(ctx context.Context, tx pgx.Tx, accountId int64, amount int) error {
+	result, err := tx.Exec(ctx, CreditPointsStatement, accountId, amount)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() != 1 {
+		return ErrUnknownAccount
+	}
+
+	return recordAudit(ctx, tx, AuditEntry{
+		AccountId:      &accountId,
+		Action:         "points/Credit",
+		ParametersHash: hashParameters(accountId, amount),
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
+)
+
+// Statement cache modes.
+const (
+	// StatementCachePrepare prepares every statement upon first use, alongside those within preparedStatements upon connecting.
+	StatementCachePrepare = "prepare"
+	// StatementCacheDescribe only caches statement descriptions, as is necessary behind PgBouncer's transaction pooling.
+	StatementCacheDescribe = "describe"
+	// StatementCacheNone disables caching entirely.
+	StatementCacheNone = "none"
+)
+
+// PoolConfig tunes the connections held to the database by every tenant.
+// Unset values retain pgx's defaults.
+type PoolConfig struct {
+	MaxConns          int32  `xml:"MaxConns,attr"`
+	MinConns          int32  `xml:"MinConns,attr"`
+	HealthCheckPeriod string `xml:"HealthCheckPeriod,attr"`
+	MaxConnLifetime   string `xml:"MaxConnLifetime,attr"`
+	MaxConnIdleTime   string `xml:"MaxConnIdleTime,attr"`
+	// StatementCache is one of prepare, describe or none, defaulting to prepare.
+	StatementCache         string `xml:"StatementCache,attr"`
+	StatementCacheCapacity int    `xml:"StatementCacheCapacity,attr"`
+}
+
+// poolSettings holds parsed pool configuration.
+type poolSettings struct {
+	maxConns, minConns                                  int32
+	healthCheckPeriod, maxConnLifetime, maxConnIdleTime time.Duration
+	statementCache                                      string
+	statementCacheCapacity                              int
+}
+
+// poolTuning is the configured pool tuning, applied when connecting each tenant.
+var poolTuning = poolSettings{statementCache: StatementCachePrepare}
+
+// preparedStatements are prepared by name upon connecting, as they are executed by consoles on most requests.
+// Statements not listed are prepared upon first use by the statement cache.
+var preparedStatements = map[string]string{
+	"RouteVerifyUnhashedStatement":  RouteVerifyUnhashedStatement,
+	"QueryDeviceTokenHash":          QueryDeviceTokenHash,
+	"QueryDeviceToken":              QueryDeviceToken,
+	"SyncUserStatement":             SyncUserStatement,
+	"CheckUserStatement":            CheckUserStatement,
+	"QueryAccountBalance":           QueryAccountBalance,
+	"QueryOwnedServiceTitles":       QueryOwnedServiceTitles,
+	"QuerySyncVersion":              QuerySyncVersion,
+	"QuerySyncedTitles":             QuerySyncedTitles,
+	"QueryRegionalTitleByPriceCode": QueryRegionalTitleByPriceCode,
+	"QueryRegionalItemAvailability": QueryRegionalItemAvailability,
+	"QueryCategories":               QueryCategories,
+	"QueryCategoryTitles":           QueryCategoryTitles,
+	"QuerySearchTitles":             QuerySearchTitles,
+	"QueryDiscountedPrice":          QueryDiscountedPrice,
+	"QueryTitleVersion":             QueryTitleVersion,
+	"QueryTitleRating":              QueryTitleRating,
+	"QueryTitleLocalization":        QueryTitleLocalization,
+	"QueryParentalAgeLimit":         QueryParentalAgeLimit,
+	"QueryContentRights":            QueryContentRights,
+	"QueryPurchaseHistory":          QueryPurchaseHistory,
+	"QueryPendingGifts":             QueryPendingGifts,
+	"InsertAuditStatement":          InsertAuditStatement,
+	"RecordActivityStatement":       RecordActivityStatement,
+	"QueryActiveBan":                QueryActiveBan,
+}
+
+// statementNames maps the SQL of each prepared statement to its name.
+var statementNames = map[string]string{}
+
+func init() {
+	for name, sql := range preparedStatements {
+		statementNames[sql] = name
+	}
+}
+
+// loadPoolConfig validates and applies the given pool configuration.
+func loadPoolConfig(config PoolConfig) error {
+	settings := poolSettings{
+		maxConns:               config.MaxConns,
+		minConns:               config.MinConns,
+		statementCache:         config.StatementCache,
+		statementCacheCapacity: config.StatementCacheCapacity,
+	}
+	if settings.statementCache == "" {
+		settings.statementCache = StatementCachePrepare
+	}
+
+	switch settings.statementCache {
+	case StatementCachePrepare, StatementCacheDescribe, StatementCacheNone:
+	default:
+		return fmt.Errorf("StatementCache must be %s, %s or %s", StatementCachePrepare, StatementCacheDescribe, StatementCacheNone)
+	}
+	if settings.minConns < 0 || settings.maxConns < 0 || (settings.maxConns != 0 && settings.minConns > settings.maxConns) {
+		return fmt.Errorf("MinConns must be no greater than MaxConns")
+	}
+
+	for _, duration := range []struct {
+		value  string
+		parsed *time.Duration
+	}{
+		{config.HealthCheckPeriod, &settings.healthCheckPeriod},
+		{config.MaxConnLifetime, &settings.maxConnLifetime},
+		{config.MaxConnIdleTime, &settings.maxConnIdleTime},
+	} {
+		if duration.value == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil {
+			return err
+		}
+		*duration.parsed = parsed
+	}
+
+	poolTuning = settings
+	return nil
+}
+
+// namedStatements returns whether statements are prepared by name, which is only possible with the prepare cache mode.
+func namedStatements() bool {
+	return poolTuning.statementCache == StatementCachePrepare
+}
+
+// apply tunes the given pool configuration.
+func (s poolSettings) apply(config *pgxpool.Config) {
+	if s.maxConns != 0 {
+		config.MaxConns = s.maxConns
+	}
+	if s.minConns != 0 {
+		config.MinConns = s.minConns
+	}
+	if s.healthCheckPeriod != 0 {
+		config.HealthCheckPeriod = s.healthCheckPeriod
+	}
+	if s.maxConnLifetime != 0 {
+		config.MaxConnLifetime = s.maxConnLifetime
+	}
+	if s.maxConnIdleTime != 0 {
+		config.MaxConnIdleTime = s.maxConnIdleTime
+	}
+
+	capacity := s.statementCacheCapacity
+	if capacity == 0 {
+		// pgx's default capacity.
+		capacity = 512
+	}
+	switch s.statementCache {
+	case StatementCacheNone:
+		config.ConnConfig.BuildStatementCache = nil
+	case StatementCacheDescribe:
+		config.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, stmtcache.ModeDescribe, capacity)
+		}
+	default:
+		config.ConnConfig.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+			return stmtcache.New(conn, stmtcache.ModePrepare, capacity)
+		}
+		config.AfterConnect = prepareStatements
+	}
+}
+
+// prepareStatements prepares every statement within preparedStatements upon a new connection.
+// Failures prevent connecting, as they indicate the schema does not match what WiiSOAP expects.
+func prepareStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, sql := range preparedStatements {
+		_, err := conn.Prepare(ctx, name, sql)
+		if err != nil {
+			return fmt.Errorf("unable to prepare %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// prepared returns the name the given SQL is prepared under, or the SQL itself if it is not.
+func prepared(sql string) string {
+	if !namedStatements() {
+		return sql
+	}
+
+	if name, exists := statementNames[sql]; exists {
+		return name
+	}
+	return sql
+}
+
+// preparedTx directs statements within a transaction to their prepared equivalents, tracing each.
+type preparedTx struct {
+	pgx.Tx
+}
+
+func (t preparedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startQuerySpan(ctx, "query", sql)
+	rows, err := t.Tx.Query(ctx, prepared(sql), args...)
+	if err != nil {
+		endSpan(span, err)
+		return rows, err
+	}
+	return tracedRows{rows, span}, nil
+}
+
+func (t preparedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startQuerySpan(ctx, "query", sql)
+	return tracedRow{t.Tx.QueryRow(ctx, prepared(sql), args...), span}
+}
+
+func (t preparedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startQuerySpan(ctx, "exec", sql)
+	tag, err := t.Tx.Exec(ctx, prepared(sql), args...)
+	endSpan(span, err)
+	return tag, err
+}
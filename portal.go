@@ -0,0 +1,266 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// PortalSessionLifetime is how long a portal session remains valid after signing in.
+	PortalSessionLifetime = 30 * time.Minute
+
+	QueryAccountSerialNumber = `SELECT serial_number FROM userbase WHERE account_id = $1`
+
+	QueryPortalOwnedTitles = `SELECT title_id, version, item_id, date_purchased
+		FROM owned_titles WHERE account_id = $1
+		ORDER BY date_purchased DESC`
+
+	QueryPortalPurchases = `SELECT owned_titles.title_id, owned_titles.item_id, COALESCE(service_titles.price, 0), owned_titles.date_purchased
+		FROM owned_titles
+		LEFT JOIN service_titles ON service_titles.item_id = owned_titles.item_id
+		WHERE owned_titles.account_id = $1
+		ORDER BY owned_titles.date_purchased DESC`
+
+	ResetDeviceTokenStatement = `UPDATE userbase SET device_token = $2, device_token_hashed = $3
+		WHERE account_id = $1
+		RETURNING region, device_id`
+)
+
+// PortalConfig configures the self-service portal.
+type PortalConfig struct {
+	Address string `xml:"Address"`
+}
+
+// PortalLoginRequest is sent to sign in with a code displayed on-console.
+type PortalLoginRequest struct {
+	SerialNumber string `json:"serial_number"`
+	Code         string `json:"code"`
+}
+
+// PortalSession is returned upon signing in.
+type PortalSession struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// PortalTitle describes a title owned by an account.
+type PortalTitle struct {
+	TitleId       string    `json:"title_id"`
+	Version       *int      `json:"version"`
+	ItemId        *int      `json:"item_id"`
+	DatePurchased time.Time `json:"date_purchased"`
+}
+
+// PortalTransaction describes a purchase made by the account.
+type PortalTransaction struct {
+	TitleId string    `json:"title_id"`
+	ItemId  *int      `json:"item_id"`
+	Price   int       `json:"price"`
+	Date    time.Time `json:"date"`
+}
+
+// PortalAccount summarizes an account.
+type PortalAccount struct {
+	AccountId int64 `json:"account_id"`
+	Balance   int   `json:"balance"`
+}
+
+// portalIdentity is the account a session is signed in as, within its tenant.
+type portalIdentity struct {
+	tenant    *Tenant
+	accountId int64
+}
+
+// portalSessions maps a session token to its identity.
+var portalSessions = newTTLCache[string, portalIdentity]()
+
+// portalMux routes all portal endpoints.
+var portalMux = http.NewServeMux()
+
+func init() {
+	portalSessions.SetTTL(PortalSessionLifetime)
+
+	portalMux.HandleFunc("/portal/login", portalLoginEndpoint)
+	portalMux.HandleFunc("/portal/account", portalAuthenticated(portalAccountEndpoint))
+	portalMux.HandleFunc("/portal/titles", portalAuthenticated(portalTitlesEndpoint))
+	portalMux.HandleFunc("/portal/transactions", portalAuthenticated(portalTransactionsEndpoint))
+	portalMux.HandleFunc("/portal/reset-token", portalAuthenticated(portalResetTokenEndpoint))
+
+	registerJob("prune-portal-sessions", time.Minute, func() error {
+		portalSessions.Prune()
+		return nil
+	})
+}
+
+// servePortal exposes the self-service portal at the configured address in the background.
+func servePortal(config PortalConfig) {
+	go func() {
+		log.Printf("Serving portal at %s", config.Address)
+		// Tenants are resolved as they are for consoles.
+		err := http.ListenAndServe(config.Address, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, r = resolveTenant(r)
+			portalMux.ServeHTTP(w, r)
+		}))
+		if err != nil {
+			log.Printf("unable to serve portal: %v", err)
+		}
+	}()
+}
+
+// portalAuthenticated wraps an endpoint requiring a valid session, passing along its account ID.
+func portalAuthenticated(handler func(w http.ResponseWriter, r *http.Request, accountId int64)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		identity, valid := portalSessions.Get(token)
+		if token == "" || !valid || identity.tenant != tenantFromContext(r.Context()) {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		handler(w, r, identity.accountId)
+	}
+}
+
+// portalLoginEndpoint exchanges a serial number and code displayed on-console for a session.
+func portalLoginEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request PortalLoginRequest
+	err := readJSON(r, &request)
+	if err != nil || request.SerialNumber == "" || request.Code == "" {
+		writeAdminError(w, http.StatusBadRequest, "serial_number and code are required")
+		return
+	}
+
+	var accountId int64
+	err = pool.QueryRow(r.Context(), RedeemLinkCodeStatement, request.Code, time.Now().UTC(), LinkCodePurposePortal).Scan(&accountId)
+	if err == pgx.ErrNoRows {
+		writeAdminError(w, http.StatusUnauthorized, "invalid or expired code")
+		return
+	} else if err != nil {
+		log.Printf("error redeeming portal code: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	// The code is consumed regardless, so that it cannot be guessed against many serial numbers.
+	var serialNumber string
+	err = pool.QueryRow(r.Context(), QueryAccountSerialNumber, accountId).Scan(&serialNumber)
+	if err != nil || serialNumber != request.SerialNumber {
+		writeAdminError(w, http.StatusUnauthorized, "invalid or expired code")
+		return
+	}
+
+	session := PortalSession{
+		Token:   RandString(32),
+		Expires: time.Now().UTC().Add(PortalSessionLifetime),
+	}
+	portalSessions.Set(session.Token, portalIdentity{tenant: tenantFromContext(r.Context()), accountId: accountId})
+	writeJSON(w, http.StatusOK, session)
+}
+
+// portalAccountEndpoint returns an overview of the signed in account.
+func portalAccountEndpoint(w http.ResponseWriter, r *http.Request, accountId int64) {
+	balance, err := getBalance(r.Context(), accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PortalAccount{
+		AccountId: accountId,
+		Balance:   balance.Amount,
+	})
+}
+
+// portalTitlesEndpoint lists all titles owned by the signed in account.
+func portalTitlesEndpoint(w http.ResponseWriter, r *http.Request, accountId int64) {
+	rows, err := pool.Query(r.Context(), QueryPortalOwnedTitles, accountId)
+	if err != nil {
+		log.Printf("error querying owned titles: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	titles := []PortalTitle{}
+	for rows.Next() {
+		var title PortalTitle
+		err = rows.Scan(&title.TitleId, &title.Version, &title.ItemId, &title.DatePurchased)
+		if err != nil {
+			log.Printf("error querying owned titles: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		titles = append(titles, title)
+	}
+
+	writeJSON(w, http.StatusOK, titles)
+}
+
+// portalTransactionsEndpoint lists all purchases made by the signed in account.
+func portalTransactionsEndpoint(w http.ResponseWriter, r *http.Request, accountId int64) {
+	rows, err := pool.Query(r.Context(), QueryPortalPurchases, accountId)
+	if err != nil {
+		log.Printf("error querying purchases: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	transactions := []PortalTransaction{}
+	for rows.Next() {
+		var transaction PortalTransaction
+		err = rows.Scan(&transaction.TitleId, &transaction.ItemId, &transaction.Price, &transaction.Date)
+		if err != nil {
+			log.Printf("error querying purchases: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	writeJSON(w, http.StatusOK, transactions)
+}
+
+// portalResetTokenEndpoint issues a new device token for the signed in account.
+// The console will obtain its new token upon its next SyncRegistration.
+func portalResetTokenEndpoint(w http.ResponseWriter, r *http.Request, accountId int64) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	deviceToken, md5DeviceToken := newDeviceToken()
+
+	var region string
+	var deviceId int
+	err := pool.QueryRow(r.Context(), ResetDeviceTokenStatement, accountId, deviceToken, md5DeviceToken).Scan(&region, &deviceId)
+	if err != nil {
+		log.Printf("error resetting device token: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	invalidateRegistration(r.Context(), region, deviceId)
+
+	auditedDeviceId := int64(deviceId)
+	err = recordAudit(r.Context(), pool, AuditEntry{
+		DeviceId:       &auditedDeviceId,
+		AccountId:      &accountId,
+		Action:         "portal/ResetToken",
+		ParametersHash: hashParameters(accountId),
+	})
+	if err != nil {
+		log.Printf("error recording audit entry for portal request: %v\n", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// DefaultCurrency is the currency used by the Wii Shop Channel for all transactions.
+const DefaultCurrency = "POINTS"
+
+// CountryPricing describes how prices should be presented for a given country.
+type CountryPricing struct {
+	// Code is the two-letter country code, as sent by the console.
+	Code string `xml:"Code,attr"`
+	// Currency is the currency prices are displayed in. It defaults to POINTS.
+	Currency string `xml:"Currency,attr"`
+	// Rate is the amount of the configured currency a single point is worth.
+	// It is unused when the currency is POINTS.
+	Rate float64 `xml:"Rate,attr"`
+	// TaxRate is the percentage of tax applied to prices.
+	TaxRate float64 `xml:"TaxRate,attr"`
+	// TaxIncluded specifies whether tax should be included within displayed prices.
+	TaxIncluded bool `xml:"TaxIncluded,attr"`
+	// LimitKind optionally overrides the limit kind sent alongside prices, such as "TR".
+	LimitKind string `xml:"LimitKind,attr"`
+	// Subdivisions override TaxRate within regions of this country, such as states.
+	Subdivisions []SubdivisionTax `xml:"Subdivision"`
+}
+
+// SubdivisionTax describes the tax applied within a subdivision of a country.
+type SubdivisionTax struct {
+	// Code identifies the subdivision, such as "CA" for California within the US.
+	Code    string  `xml:"Code,attr"`
+	TaxRate float64 `xml:"TaxRate,attr"`
+}
+
+// PricingConfig holds all configured countries.
+type PricingConfig struct {
+	Countries []CountryPricing `xml:"Country"`
+}
+
+// pricingRules maps an uppercase country code to its pricing rules.
+var pricingRules = map[string]CountryPricing{}
+
+// loadPricing prepares the given configuration for usage.
+func loadPricing(config PricingConfig) {
+	for _, country := range config.Countries {
+		if country.Currency == "" {
+			country.Currency = DefaultCurrency
+		}
+
+		pricingRules[strings.ToUpper(country.Code)] = country
+	}
+}
+
+// countryPricing returns the pricing rules for the given country.
+// Countries without rules have prices displayed as-is in points.
+func countryPricing(country string) CountryPricing {
+	if rules, exists := pricingRules[strings.ToUpper(country)]; exists {
+		return rules
+	}
+
+	return CountryPricing{
+		Code:     country,
+		Currency: DefaultCurrency,
+	}
+}
+
+// limitKindByName returns the LimitKinds value for a name such as "PR".
+func limitKindByName(name string) (LimitKinds, bool) {
+	kinds := map[string]LimitKinds{
+		"PR": PR,
+		"TR": TR,
+		"DR": DR,
+		"SR": SR,
+		"LR": LR,
+		"AT": AT,
+	}
+
+	kind, exists := kinds[strings.ToUpper(name)]
+	return kind, exists
+}
+
+// Convert returns the given amount of points within this country's currency, applying tax if necessary.
+func (c CountryPricing) Convert(points int) int {
+	amount := float64(points)
+	if c.Currency != DefaultCurrency && c.Rate != 0 {
+		amount *= c.Rate
+	}
+
+	if c.TaxIncluded {
+		amount *= 1 + c.TaxRate/100
+	}
+
+	return int(math.Round(amount))
+}
+
+// Tax returns the tax owed on the given amount of points within this country's currency.
+func (c CountryPricing) Tax(points int) int {
+	if c.TaxIncluded {
+		// Tax has already been factored into the price.
+		return 0
+	}
+
+	amount := float64(points)
+	if c.Currency != DefaultCurrency && c.Rate != 0 {
+		amount *= c.Rate
+	}
+
+	return int(math.Round(amount * c.TaxRate / 100))
+}
+
+// ForSubdivision returns the pricing rules applicable within the given subdivision, and whether it is configured.
+// Unknown subdivisions use the rules of the country as a whole.
+func (c CountryPricing) ForSubdivision(code string) (CountryPricing, bool) {
+	for _, subdivision := range c.Subdivisions {
+		if strings.EqualFold(subdivision.Code, code) {
+			c.TaxRate = subdivision.TaxRate
+			return c, true
+		}
+	}
+
+	return c, false
+}
+
+// ItemPrice returns the pricing structure for an item as is appropriate for this request's country.
+// The passed limit kind is used unless the country specifies its own.
+func (e *Envelope) ItemPrice(itemId int, points int, limit LimitKinds, licence LicenceKinds) Prices {
+	rules := countryPricing(e.Country())
+	if override, exists := limitKindByName(rules.LimitKind); exists {
+		limit = override
+	}
+
+	return Prices{
+		ItemId: itemId,
+		Price: Price{
+			Amount:   rules.Convert(points),
+			Currency: rules.Currency,
+		},
+		Limits:      LimitStruct(limit),
+		LicenseKind: licence,
+	}
+}
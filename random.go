@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+const (
+	// randomBufferSize is how many bytes are read from the system's secure source at once.
+	randomBufferSize = 4096
+
+	// TokenWorkers is how many goroutines pre-generate device tokens.
+	TokenWorkers = 2
+	// TokenPoolSize is how many pre-generated device tokens are held ready for registrations.
+	TokenPoolSize = 64
+)
+
+// secureSource is a buffered reader over the system's secure source, shared by all goroutines.
+// Buffering avoids a system call per character, which otherwise becomes a contention point under many concurrent registrations.
+type secureSource struct {
+	lock   sync.Mutex
+	reader *bufio.Reader
+}
+
+// pregeneratedToken is a device token alongside its hashed form.
+type pregeneratedToken struct {
+	token  string
+	hashed string
+}
+
+var (
+	// random is the source all tokens, codes and challenges are drawn from.
+	random = &secureSource{reader: bufio.NewReaderSize(rand.Reader, randomBufferSize)}
+
+	// deviceTokens holds device tokens pre-generated by startTokenWorkers.
+	deviceTokens = make(chan pregeneratedToken, TokenPoolSize)
+)
+
+// Read fills b with random bytes.
+func (s *secureSource) Read(b []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := io.ReadFull(s.reader, b)
+	if err != nil {
+		// The system's secure source being unavailable is not something we can recover from.
+		panic(err)
+	}
+}
+
+// randomString generates a random string of length n from the given alphabet using a secure source.
+// Bytes which would bias the result towards the start of the alphabet are discarded.
+func randomString(alphabet string, n int) string {
+	limit := 256 - 256%len(alphabet)
+	b := make([]byte, n)
+	buffer := make([]byte, n)
+	for filled := 0; filled < n; {
+		random.Read(buffer)
+		for _, value := range buffer {
+			if int(value) >= limit || filled == n {
+				continue
+			}
+			b[filled] = alphabet[int(value)%len(alphabet)]
+			filled++
+		}
+	}
+	return string(b)
+}
+
+// startTokenWorkers begins pre-generating device tokens, so that registrations need not hash their own.
+func startTokenWorkers() {
+	for i := 0; i < TokenWorkers; i++ {
+		go func() {
+			for {
+				token, hashed := generateDeviceToken()
+				deviceTokens <- pregeneratedToken{token: token, hashed: hashed}
+			}
+		}()
+	}
+}
+
+// newDeviceToken returns a device token alongside its hashed form,
+// preferring those pre-generated and generating one itself should none be ready.
+func newDeviceToken() (string, string) {
+	select {
+	case pregenerated := <-deviceTokens:
+		return pregenerated.token, pregenerated.hashed
+	default:
+		return generateDeviceToken()
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RecoveryCodeCount is how many recovery codes are issued to an account at once.
+	RecoveryCodeCount = 8
+	// RecoveryCodeLength is the length of each recovery code, drawn from the same characters as link codes.
+	RecoveryCodeLength = 10
+	// PendingRecoveryCodesLifetime is how long newly issued codes may be retrieved for, after which only their hashes remain.
+	PendingRecoveryCodesLifetime = 24 * time.Hour
+
+	DeleteRecoveryCodesStatement = `DELETE FROM recovery_codes WHERE account_id = $1`
+
+	InsertRecoveryCodeStatement = `INSERT INTO recovery_codes (account_id, code_hash, date_created)
+		VALUES ($1, $2, $3)`
+
+	QueryRemainingRecoveryCodes = `SELECT COUNT(*) FROM recovery_codes WHERE account_id = $1 AND date_used IS NULL`
+
+	// RedeemRecoveryCodeStatement marks an unused code as used, returning its account.
+	RedeemRecoveryCodeStatement = `UPDATE recovery_codes SET date_used = $2
+		WHERE code_hash = $1 AND date_used IS NULL
+		RETURNING account_id`
+
+	QueryRecoverableAccount = `SELECT device_id, region FROM userbase
+		WHERE account_id = $1 AND date_erased IS NULL
+		FOR UPDATE`
+
+	// RecoverAccountStatement moves an account onto a new console, issuing it a new device token.
+	RecoverAccountStatement = `UPDATE userbase SET device_id = $2, device_token = $3, device_token_hashed = $4, region = $5,
+			serial_number = $6, device_code = $7, console_model = $8, manufacturing_region = $9
+		WHERE account_id = $1`
+)
+
+// ErrInvalidRecoveryCode is returned when a recovery code does not exist or has already been used.
+var ErrInvalidRecoveryCode = errors.New("recovery code is invalid or has been used")
+
+// pendingRecoveryKey identifies newly issued recovery codes for an account within a tenant.
+type pendingRecoveryKey struct {
+	tenant    string
+	accountId int64
+}
+
+// pendingRecoveryCodes holds recovery codes which have been issued but not yet retrieved.
+// Codes are only stored hashed within the database, so they may be retrieved once before they are lost.
+var pendingRecoveryCodes = newTTLCache[pendingRecoveryKey, []string]()
+
+// RecoveryCodes describes an account's recovery codes.
+type RecoveryCodes struct {
+	AccountId int64 `json:"account_id"`
+	// Remaining is how many codes have yet to be used.
+	Remaining int `json:"remaining"`
+	// Codes are those issued but not yet retrieved, and are returned once only.
+	Codes []string `json:"codes"`
+}
+
+func init() {
+	pendingRecoveryCodes.SetTTL(PendingRecoveryCodesLifetime)
+	registerJob("prune-pending-recovery-codes", time.Hour, func() error {
+		pendingRecoveryCodes.Prune()
+		return nil
+	})
+	registerAdminEndpoint("/accounts/recovery-codes", recoveryCodesEndpoint)
+	portalMux.HandleFunc("/portal/recovery-codes", portalAuthenticated(portalRecoveryCodesEndpoint))
+}
+
+// hashUserCode returns the form codes typed by users, such as recovery codes and points cards, are stored as.
+// Codes are compared case-insensitively, and may be entered with spaces or dashes between groups.
+func hashUserCode(code string) string {
+	normalized := strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRecoveryCodes replaces all recovery codes for the given account, holding the new codes until retrieved.
+func issueRecoveryCodes(ctx context.Context, accountId int64) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, DeleteRecoveryCodesStatement, accountId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		codes[i] = randomString(linkCodeBytes, RecoveryCodeLength)
+		_, err = tx.Exec(ctx, InsertRecoveryCodeStatement, accountId, hashUserCode(codes[i]), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	pendingRecoveryCodes.Set(pendingRecoveryKey{tenant: tenantFromContext(ctx).Name, accountId: accountId}, codes)
+	return nil
+}
+
+// queryRecoveryCodes returns how many recovery codes the given account has remaining,
+// alongside any pending retrieval. Pending codes are no longer held once returned.
+func queryRecoveryCodes(ctx context.Context, accountId int64) (RecoveryCodes, error) {
+	result := RecoveryCodes{AccountId: accountId, Codes: []string{}}
+	err := pool.QueryRow(ctx, QueryRemainingRecoveryCodes, accountId).Scan(&result.Remaining)
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+
+	key := pendingRecoveryKey{tenant: tenantFromContext(ctx).Name, accountId: accountId}
+	if codes, pending := pendingRecoveryCodes.Get(key); pending {
+		pendingRecoveryCodes.Delete(key)
+		result.Codes = codes
+	}
+	return result, nil
+}
+
+// recoverAccount moves the account a recovery code was issued for onto the requesting console,
+// such as after the original console was lost. The requesting console must not already be registered.
+func recoverAccount(e *Envelope) {
+	deviceCode, err := e.getKey("DeviceCode")
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "missing device code", err)
+		return
+	}
+
+	recoveryCode, err := e.getKey("RecoveryCode")
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "missing recovery code", err)
+		return
+	}
+
+	registerRegion, err := e.getKey("RegisterRegion")
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "missing registration region", err)
+		return
+	}
+	if registerRegion != e.Region() && !dolphinCompatibility {
+		e.Error(ErrorCodeRegistrationFailure, "mismatched region", errors.New("region does not match registration region"))
+		return
+	}
+
+	serialNo, err := e.SerialNumber()
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "missing serial number", err)
+		return
+	}
+
+	serial, err := checkSerialNumber(serialNo)
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "invalid serial number", err)
+		return
+	}
+
+	if !e.enforceBan() {
+		return
+	}
+
+	// Recovery registers the console anew, and so is gated alongside registrations.
+	if !e.enforceAllowlist(serialNo) {
+		return
+	}
+
+	friendCode, err := parseFriendCode(deviceCode)
+	if err != nil {
+		e.Error(ErrorCodeRegistrationFailure, "invalid friend code", err)
+		return
+	}
+
+	// Accounts may only be recovered onto consoles without one of their own.
+	reregistering, err := checkDuplicateRegistration(e.ctx, e.DeviceId(), serialNo, e.Region())
+	if err == nil && reregistering {
+		err = ErrAlreadyRegistered
+	}
+	if err == ErrDeviceRegistered || err == ErrSerialRegistered || err == ErrAlreadyRegistered {
+		e.Error(ErrorCodeDeviceConflict, "console is already registered", err)
+		return
+	} else if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeRegistrationFailure, "database error", ErrDatabase)
+		return
+	}
+
+	tx, err := pool.Begin(e.ctx)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	var accountId int64
+	err = tx.QueryRow(e.ctx, RedeemRecoveryCodeStatement, hashUserCode(recoveryCode), time.Now().UTC()).Scan(&accountId)
+	if err == pgx.ErrNoRows {
+		e.Error(ErrorCodeRegistrationFailure, "invalid recovery code", ErrInvalidRecoveryCode)
+		return
+	} else if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	var previousDeviceId int
+	var previousRegion *string
+	err = tx.QueryRow(e.ctx, QueryRecoverableAccount, accountId).Scan(&previousDeviceId, &previousRegion)
+	if err == pgx.ErrNoRows {
+		// Erased accounts retain no registration to recover.
+		e.Error(ErrorCodeRegistrationFailure, "invalid recovery code", ErrInvalidRecoveryCode)
+		return
+	} else if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	deviceToken, md5DeviceToken := newDeviceToken()
+	_, err = tx.Exec(e.ctx, RecoverAccountStatement, accountId, e.DeviceId(), deviceToken, md5DeviceToken, e.Region(),
+		serialNo, friendCode.String(), nullableString(serial.Model), nullableString(serial.Region))
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("error committing transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	// Neither the previous console nor any earlier lookup for this one may be reused.
+	if previousRegion != nil {
+		invalidateRegistration(e.ctx, *previousRegion, previousDeviceId)
+	}
+	invalidateRegistration(e.ctx, e.Region(), e.DeviceId())
+
+	e.AddKVNode("AccountId", formatAccountId(accountId))
+	e.AddKVNode("DeviceToken", deviceToken)
+	e.AddKVNode("DeviceTokenExpired", "false")
+	e.AddKVNode("Country", e.Country())
+	e.AddKVNode("ExtAccountId", "")
+	e.AddKVNode("DeviceCode", deviceCode)
+}
+
+// recoveryCodesEndpoint returns or regenerates an account's recovery codes, such as for support staff to pass on.
+func recoveryCodesEndpoint(w http.ResponseWriter, r *http.Request) {
+	accountId, err := strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "account_id is required")
+		return
+	}
+
+	serveRecoveryCodes(w, r, accountId)
+}
+
+// portalRecoveryCodesEndpoint returns or regenerates the signed in account's recovery codes.
+func portalRecoveryCodesEndpoint(w http.ResponseWriter, r *http.Request, accountId int64) {
+	serveRecoveryCodes(w, r, accountId)
+}
+
+// serveRecoveryCodes responds with the given account's recovery codes, regenerating them upon POST.
+func serveRecoveryCodes(w http.ResponseWriter, r *http.Request, accountId int64) {
+	if r.Method != "GET" && r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var throwaway int
+	err := pool.QueryRow(r.Context(), QueryAccountExists, accountId).Scan(&throwaway)
+	if err == pgx.ErrNoRows {
+		writeAdminError(w, http.StatusNotFound, "account does not exist")
+		return
+	} else if err != nil {
+		log.Printf("error querying recovery codes: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		err = issueRecoveryCodes(r.Context(), accountId)
+		if err != nil {
+			log.Printf("error issuing recovery codes: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	codes, err := queryRecoveryCodes(r.Context(), accountId)
+	if err != nil {
+		log.Printf("error querying recovery codes: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, status, codes)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// QueryRefundableTransaction locks a transaction so that it cannot be refunded twice concurrently.
+	QueryRefundableTransaction = `SELECT account_id, type, title_id, item_id, total_paid, date_refunded, sandbox
+		FROM transactions
+		WHERE transaction_id = $1
+		FOR UPDATE`
+
+	MarkTransactionRefundedStatement = `UPDATE transactions SET date_refunded = $2, refund_reason = $3
+		WHERE transaction_id = $1`
+
+	RevokeTicketStatement = `DELETE FROM owned_titles WHERE account_id = $1 AND title_id = $2`
+
+	// EndSubscriptionStatement lapses any active subscription to the given title immediately.
+	EndSubscriptionStatement = `UPDATE subscriptions SET date_end = $3
+		WHERE account_id = $1 AND title_id = $2 AND date_end > $3`
+)
+
+// RefundRequest identifies a transaction to reverse.
+type RefundRequest struct {
+	TransactionId int    `json:"transaction_id"`
+	Reason        string `json:"reason"`
+}
+
+// Refund describes a reversed transaction.
+type Refund struct {
+	TransactionId int       `json:"transaction_id"`
+	AccountId     int64     `json:"account_id"`
+	TitleId       string    `json:"title_id"`
+	Credited      int       `json:"credited"`
+	DateRefunded  time.Time `json:"date_refunded"`
+}
+
+// refundableTransactions lists the transaction types which may be refunded.
+// Gifts are excluded, as their ticket belongs to a different account than the points spent.
+var refundableTransactions = map[string]bool{
+	TransactionPurchase:     true,
+	TransactionRental:       true,
+	TransactionSubscription: true,
+}
+
+func init() {
+	registerAdminEndpoint("/transactions/refund", refundEndpoint)
+}
+
+// refundEndpoint reverses a transaction: its points are credited back, its ticket is revoked,
+// and it is marked as refunded. All steps occur within a single database transaction.
+func refundEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var request RefundRequest
+	err := readJSON(r, &request)
+	if err != nil || request.TransactionId == 0 {
+		writeAdminError(w, http.StatusBadRequest, "transaction_id is required")
+		return
+	}
+
+	tx, err := pool.Begin(r.Context())
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer tx.Rollback(r.Context())
+
+	var kind string
+	var itemId int
+	var accountId *int64
+	var dateRefunded *time.Time
+	var sandboxed bool
+	refund := Refund{TransactionId: request.TransactionId}
+	err = tx.QueryRow(r.Context(), QueryRefundableTransaction, request.TransactionId).Scan(&accountId, &kind, &refund.TitleId, &itemId, &refund.Credited, &dateRefunded, &sandboxed)
+	if err == pgx.ErrNoRows {
+		writeAdminError(w, http.StatusNotFound, "transaction does not exist")
+		return
+	} else if err != nil {
+		log.Printf("error querying transaction: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	if accountId == nil {
+		writeAdminError(w, http.StatusGone, "the account for this transaction has been erased")
+		return
+	}
+	refund.AccountId = *accountId
+
+	if dateRefunded != nil {
+		writeAdminError(w, http.StatusConflict, "transaction has already been refunded")
+		return
+	}
+	if sandboxed {
+		writeAdminError(w, http.StatusUnprocessableEntity, "sandboxed transactions cannot be refunded")
+		return
+	}
+	if !refundableTransactions[kind] {
+		writeAdminError(w, http.StatusUnprocessableEntity, "transactions of type "+kind+" cannot be refunded")
+		return
+	}
+
+	refund.DateRefunded = time.Now().UTC()
+	if refund.Credited != 0 {
+		err = creditPoints(r.Context(), tx, refund.AccountId, refund.Credited)
+		if err != nil {
+			log.Printf("error crediting points: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+	}
+
+	// The ticket is removed so that it is no longer listed to the console.
+	_, err = tx.Exec(r.Context(), RevokeTicketStatement, refund.AccountId, refund.TitleId)
+	if err == nil && kind == TransactionSubscription {
+		_, err = tx.Exec(r.Context(), EndSubscriptionStatement, refund.AccountId, refund.TitleId, refund.DateRefunded)
+	}
+	if err == nil {
+		err = releaseItem(r.Context(), tx, itemId)
+	}
+	if err != nil {
+		log.Printf("error revoking ticket: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	_, err = tx.Exec(r.Context(), MarkTransactionRefundedStatement, request.TransactionId, refund.DateRefunded, nullableString(request.Reason))
+	if err != nil {
+		log.Printf("error marking transaction refunded: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	err = recordAudit(r.Context(), tx, AuditEntry{
+		AccountId:      &refund.AccountId,
+		Action:         "admin/RefundTransaction",
+		ParametersHash: hashParameters(request.TransactionId, refund.Credited, request.Reason),
+	})
+	if err != nil {
+		log.Printf("error recording audit entry for refund: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	err = tx.Commit(r.Context())
+	if err != nil {
+		log.Printf("error committing refund: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	invalidateItem(r.Context(), itemId)
+
+	writeJSON(w, http.StatusOK, refund)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"github.com/wii-tools/wadlib"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// QueryRentalTerms returns the rental price tier for an item. Items without one cannot be rented.
+	QueryRentalTerms = `SELECT rental_price, rental_days FROM service_titles
+		WHERE item_id = $1 AND rental_price IS NOT NULL`
+
+	QueryPermanentTicket = `SELECT 1 FROM owned_titles
+		WHERE account_id = $1 AND title_id = $2 AND date_expires IS NULL`
+)
+
+// ErrNotRentable is returned for items without a rental price tier.
+var ErrNotRentable = errors.New("item is not available for rental")
+
+// RentalTerms describes the price and length of renting an item.
+type RentalTerms struct {
+	Price  int
+	Period time.Duration
+}
+
+// lookupRentalTerms returns the rental terms for the given item, or ErrNotRentable.
+func lookupRentalTerms(ctx context.Context, itemId int) (RentalTerms, error) {
+	var price, days int
+	err := pool.QueryRow(ctx, QueryRentalTerms, itemId).Scan(&price, &days)
+	if err == pgx.ErrNoRows {
+		return RentalTerms{}, ErrNotRentable
+	} else if err != nil {
+		return RentalTerms{}, err
+	}
+
+	return RentalTerms{
+		Price:  price,
+		Period: time.Duration(days) * 24 * time.Hour,
+	}, nil
+}
+
+// rentalLimits returns the LR limit for a rental of the given length.
+// Its value is the length of the rental in seconds, as is enforced by the console.
+func rentalLimits(period time.Duration) Limits {
+	limits := LimitStruct(LR)
+	limits.Limits = int(period.Seconds())
+	return limits
+}
+
+// RentalPrice returns the pricing structure for renting an item.
+// Unlike ItemPrice, the limit kind is never overridden by the country, as the console relies on it to end the rental.
+func (e *Envelope) RentalPrice(itemId int, terms RentalTerms) Prices {
+	prices := e.ItemPrice(itemId, terms.Price, LR, RENTAL)
+	prices.Limits = rentalLimits(terms.Period)
+	return prices
+}
+
+// newRentalTicket formulates a ticket which the console will stop permitting usage of after the given period.
+func newRentalTicket(ctx context.Context, titleId string, period time.Duration) (*wadlib.Ticket, error) {
+	ticket, err := newTitleTicket(ctx, titleId)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket.TimeLimits[0] = wadlib.TimeLimitEntry{
+		Code:  uint32(LR),
+		Limit: uint32(period.Seconds()),
+	}
+	return ticket, nil
+}
+
+// purchaseRental issues a RENTAL ticket for the given title at the item's rental price.
+// Renting again while a rental is active extends it from the current time.
+func purchaseRental(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	tempItemId, err := e.getKey("ItemId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing item ID", err)
+		return
+	}
+
+	itemId, err := strconv.Atoi(tempItemId)
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "invalid item ID", err)
+		return
+	}
+
+	titleId, err := e.getKey("TitleId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing title ID", err)
+		return
+	}
+
+	if !e.enforceRating(titleId) {
+		return
+	}
+
+	app, err := lookupTitle(e.ctx, titleId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+		return
+	}
+
+	if app == nil {
+		e.Error(ErrorCodeTitleUnavailable, "title does not exist", nil)
+		return
+	}
+
+	available, err := e.isItemAvailable(itemId)
+	if err != nil {
+		log.Printf("unexpected error checking item availability: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+	if !available {
+		e.Error(ErrorCodeGenericFailure, "item is not available in this region", nil)
+		return
+	}
+
+	terms, err := lookupRentalTerms(e.ctx, itemId)
+	if err == ErrNotRentable {
+		e.Error(ErrorCodeTitleUnavailable, "title is not available for rental", err)
+		return
+	} else if err != nil {
+		log.Printf("error querying rental terms: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	terms.Price, err = e.chargedPrice(titleId, itemId, terms.Price, RENTAL)
+	if err != nil {
+		log.Printf("error querying discounts: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	ticketStruct, err := newRentalTicket(e.ctx, titleId, terms.Period)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+		return
+	}
+
+	ticket := new(bytes.Buffer)
+	err = writeTicket(e.ctx, ticket, ticketStruct)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
+		return
+	}
+
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	// There is no reason to rent a title which is already owned outright.
+	var throwaway int
+	err = tx.QueryRow(e.ctx, QueryPermanentTicket, accountId, titleId).Scan(&throwaway)
+	if err == nil {
+		e.Error(ErrorCodeGenericFailure, "title is already owned", nil)
+		return
+	} else if err != pgx.ErrNoRows {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = claimItem(e.ctx, tx, itemId)
+	if err == ErrItemUnavailable {
+		e.Error(ErrorCodeTitleUnavailable, "unable to rent title", err)
+		return
+	} else if err != nil {
+		log.Printf("unexpected error claiming item: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	err = debitPoints(e.ctx, tx, accountId, terms.Price)
+	if err == ErrInsufficientPoints {
+		e.Error(ErrorCodeGenericFailure, "unable to rent title", err)
+		return
+	} else if err != nil {
+		log.Printf("error debiting points: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	// Rental tickets are removed by the purge-expired-tickets job once the window ends.
+	expires := time.Now().UTC().Add(terms.Period)
+	err = associateExpiringTicket(e.ctx, tx, accountId, titleId, app.Shop.Version, itemId, expires)
+	if err != nil {
+		log.Printf("unexpected error renting title: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	transactionId, err := recordTransaction(e.ctx, tx, Transaction{
+		AccountId: accountId,
+		Type:      TransactionRental,
+		TitleId:   titleId,
+		ItemId:    itemId,
+		TotalPaid: terms.Price,
+	})
+	if err != nil {
+		log.Printf("error recording transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("unexpected error renting title: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+	invalidateItem(e.ctx, itemId)
+
+	emitEvent(e.ctx, EventPointsRedeemed, PointsRedeemedEvent{
+		AccountId: formatAccountId(accountId),
+		Amount:    terms.Price,
+		Reason:    "rental",
+	})
+	emitEvent(e.ctx, EventTitlePurchased, TitlePurchasedEvent{
+		AccountId:   formatAccountId(accountId),
+		TitleId:     titleId,
+		ItemId:      itemId,
+		LicenseKind: RENTAL,
+	})
+
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
+	e.AddCustomType(Transactions{
+		TransactionId: formatTransactionId(transactionId),
+		Date:          e.Timestamp(),
+		Type:          TransactionRental,
+		TotalPaid:     terms.Price,
+		Currency:      "POINTS",
+		ItemId:        itemId,
+		ItemPricing:   e.RentalPrice(itemId, terms),
+	})
+	e.AddKVNode("SyncTime", e.Timestamp())
+	e.AddKVNode("ExpirationDate", strconv.FormatInt(expires.UnixMilli(), 10))
+
+	e.AddKVNode("ETickets", b64(append(ticket.Bytes(), wadlib.CertChainTemplate...)))
+	// Two cert types must be present.
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("TitleId", titleId)
+}
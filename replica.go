@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReplicaFailureThreshold is how many consecutive failures open the circuit to a replica.
+	DefaultReplicaFailureThreshold = 5
+	// DefaultReplicaCooldown is how long reads are directed to the primary once the circuit has opened.
+	DefaultReplicaCooldown = 30 * time.Second
+)
+
+// ReplicaConfig configures a read-only replica of the database, sharing the primary's credentials and database name.
+// Read-only queries executed on most console requests are directed to it, falling back to the primary if it fails.
+type ReplicaConfig struct {
+	// Address is the replica's host and port, such as 10.0.0.2:5432. No replica is used unless one is given.
+	Address string `xml:"Address,attr"`
+	// FailureThreshold is how many consecutive failures direct reads to the primary, defaulting to 5.
+	FailureThreshold int `xml:"FailureThreshold,attr"`
+	// Cooldown is how long reads are directed to the primary before the replica is tried again, defaulting to 30s.
+	Cooldown string `xml:"Cooldown,attr"`
+}
+
+// replicaSettings holds parsed replica configuration.
+type replicaSettings struct {
+	dbString         string
+	failureThreshold int
+	cooldown         time.Duration
+}
+
+// replicaTuning is the configured replica, applied when connecting each tenant.
+var replicaTuning replicaSettings
+
+// replica directs read-only queries to the replica of the tenant within their context.
+var replica ReadReplica
+
+// loadReplicaConfig validates and applies the given replica configuration.
+func loadReplicaConfig(config ReplicaConfig, user string, pass string, database string) error {
+	settings := replicaSettings{
+		failureThreshold: config.FailureThreshold,
+		cooldown:         DefaultReplicaCooldown,
+	}
+	if config.Address != "" {
+		settings.dbString = fmt.Sprintf("postgres://%s:%s@%s/%s", user, pass, config.Address, database)
+	}
+	if settings.failureThreshold == 0 {
+		settings.failureThreshold = DefaultReplicaFailureThreshold
+	}
+	if settings.failureThreshold < 0 {
+		return errors.New("FailureThreshold must be positive")
+	}
+
+	if config.Cooldown != "" {
+		cooldown, err := time.ParseDuration(config.Cooldown)
+		if err != nil {
+			return err
+		}
+		settings.cooldown = cooldown
+	}
+
+	replicaTuning = settings
+	return nil
+}
+
+// connectReplica connects to the configured replica for a tenant, returning nil if none is configured.
+// Connections are established lazily, so that an unavailable replica does not prevent starting.
+func connectReplica(schema string) (*pgxpool.Pool, error) {
+	if replicaTuning.dbString == "" {
+		return nil, nil
+	}
+
+	dbConf, err := tenantPoolConfig(replicaTuning.dbString, schema)
+	if err != nil {
+		return nil, err
+	}
+	dbConf.LazyConnect = true
+	return pgxpool.ConnectConfig(ctx, dbConf)
+}
+
+// circuitBreaker tracks consecutive failures of a replica.
+// Once enough occur, the circuit opens and reads are directed to the primary until the cooldown elapses.
+// The next failure afterwards reopens it immediately, whereas a success closes it.
+type circuitBreaker struct {
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns whether the replica should be attempted.
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// record notes the outcome of a query against the replica, returning whether it failed.
+// Missing rows and cancelled requests are not failures of the replica itself.
+func (b *circuitBreaker) record(tenant *Tenant, err error) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err == nil || err == pgx.ErrNoRows || errors.Is(err, context.Canceled) {
+		if b.failures >= replicaTuning.failureThreshold {
+			log.Printf("replica for tenant %s is available again", tenant.Name)
+		}
+		b.failures = 0
+		return false
+	}
+
+	b.failures++
+	incrementMetric("replica_failures")
+	if b.failures >= replicaTuning.failureThreshold {
+		if !time.Now().Before(b.openUntil) {
+			incrementMetric("replica_circuit_opened")
+			log.Printf("replica for tenant %s is unavailable, reading from primary: %v", tenant.Name, err)
+		}
+		b.openUntil = time.Now().Add(replicaTuning.cooldown)
+	}
+	return true
+}
+
+// ReadReplica directs read-only queries to the replica of the tenant within their context,
+// falling back to the primary if none is configured, its circuit is open or the query fails.
+// As replicas may lag behind the primary, it must only be used where slightly stale results are acceptable.
+type ReadReplica struct{}
+
+// conn returns the tenant within the given context, alongside its replica if it should be attempted.
+func (ReadReplica) conn(ctx context.Context) (*Tenant, *pgxpool.Pool) {
+	tenant := tenantFromContext(ctx)
+	if tenant.replica == nil || !tenant.breaker.allow() {
+		return tenant, nil
+	}
+	return tenant, tenant.replica
+}
+
+func (r ReadReplica) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	tenant, db := r.conn(ctx)
+	if db == nil {
+		return pool.Query(ctx, sql, args...)
+	}
+
+	spanCtx, span := startQuerySpan(ctx, "replica.query", sql)
+	rows, err := db.Query(spanCtx, prepared(sql), args...)
+	if err != nil {
+		endSpan(span, err)
+		if tenant.breaker.record(tenant, err) {
+			incrementMetric("replica_fallbacks")
+			return pool.Query(ctx, sql, args...)
+		}
+		return rows, err
+	}
+	return replicaRows{tracedRows{rows, span}, tenant}, nil
+}
+
+func (r ReadReplica) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	tenant, db := r.conn(ctx)
+	if db == nil {
+		return pool.QueryRow(ctx, sql, args...)
+	}
+
+	spanCtx, span := startQuerySpan(ctx, "replica.query", sql)
+	return replicaRow{
+		row:    tracedRow{db.QueryRow(spanCtx, prepared(sql), args...), span},
+		tenant: tenant,
+		ctx:    ctx,
+		sql:    sql,
+		args:   args,
+	}
+}
+
+// replicaRow repeats its query against the primary should scanning from the replica fail.
+// Queries matching no rows are also repeated, as the row may have been written to the primary moments beforehand,
+// such as when a console syncs immediately after registering.
+type replicaRow struct {
+	row    pgx.Row
+	tenant *Tenant
+	ctx    context.Context
+	sql    string
+	args   []interface{}
+}
+
+func (r replicaRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if r.tenant.breaker.record(r.tenant, err) {
+		incrementMetric("replica_fallbacks")
+		return pool.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	} else if err == pgx.ErrNoRows {
+		return pool.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	}
+	return err
+}
+
+// replicaRows records the outcome of reading rows from the replica once closed.
+// Rows may have been partially consumed by then, so failures are not repeated against the primary.
+type replicaRows struct {
+	tracedRows
+	tenant *Tenant
+}
+
+func (r replicaRows) Close() {
+	r.tracedRows.Close()
+	r.tenant.breaker.record(r.tenant, r.Err())
+}
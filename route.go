@@ -1,18 +1,39 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v4"
 	"github.com/logrusorgru/aurora/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
-// Route defines a header to be checked for actions, and an array of actions to handle.
+// Route defines a header to be checked for actions, and a registry of actions to handle.
 type Route struct {
 	HeaderName string
-	Actions    []Action
+
+	// Actions holds all registered actions in order of registration.
+	Actions []*Action
+	// registry maps a service type and action name to its registered action.
+	registry map[actionKey]*Action
+}
+
+// actionKey uniquely identifies an action within a service.
+type actionKey struct {
+	service string
+	action  string
 }
 
 // Action contains information about how a specified action should be handled.
@@ -21,12 +42,29 @@ type Action struct {
 	Callback            func(e *Envelope)
 	NeedsAuthentication bool
 	ServiceType         string
+
+	// Parameters lists the request keys this action reads beyond the common envelope fields.
+	// It is used to describe the action within generated WSDL documents.
+	Parameters []string
+
+	// Methods lists the HTTP methods this action may be requested with.
+	Methods []string
+
+	// Disabled actions are neither routed to nor described.
+	Disabled bool
+
+	// Timeout is how long this action may take before its request is abandoned.
+	Timeout time.Duration
+
+	// Audit determines whether successful requests are recorded within the audit log.
+	Audit bool
 }
 
 // NewRoute produces a new route struct with appropriate header defaults.
 func NewRoute() Route {
 	return Route{
 		HeaderName: "SOAPAction",
+		registry:   map[actionKey]*Action{},
 	}
 }
 
@@ -44,108 +82,360 @@ func (r *Route) HandleGroup(serviceType string) RoutingGroup {
 	}
 }
 
+// register adds an action to the registry, replacing any previously registered under the same name.
+func (r *Route) register(action *Action) *Action {
+	key := actionKey{service: action.ServiceType, action: action.ActionName}
+	if previous, exists := r.registry[key]; exists {
+		*previous = *action
+		return previous
+	}
+
+	r.registry[key] = action
+	r.Actions = append(r.Actions, action)
+	return action
+}
+
+// Lookup returns the enabled action registered for the given service type and name.
+func (r *Route) Lookup(service string, actionName string) (*Action, bool) {
+	action, exists := r.registry[actionKey{service: service, action: actionName}]
+	if !exists || action.Disabled {
+		return nil, false
+	}
+
+	return action, true
+}
+
+// HasService returns whether any actions are registered for the given service type.
+func (r *Route) HasService(service string) bool {
+	for _, action := range r.Actions {
+		if action.ServiceType == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Disable prevents the given action, in the form of "service/Action", from being handled.
+func (r *Route) Disable(name string) error {
+	service, actionName, found := strings.Cut(name, "/")
+	if !found {
+		return errors.New("action " + name + " is not in the form service/Action")
+	}
+
+	action, exists := r.registry[actionKey{service: service, action: actionName}]
+	if !exists {
+		return errors.New("action " + name + " is not registered")
+	}
+
+	action.Disabled = true
+	return nil
+}
+
 // Unauthenticated associates an action to a function to be handled without authentication.
-func (r *RoutingGroup) Unauthenticated(action string, function func(e *Envelope)) {
-	r.Route.Actions = append(r.Route.Actions, Action{
+// Any additional request parameters the action reads may be listed for self-description.
+func (r *RoutingGroup) Unauthenticated(action string, function func(e *Envelope), parameters ...string) *Action {
+	return r.Route.register(&Action{
 		ActionName:          action,
 		Callback:            function,
 		NeedsAuthentication: false,
 		ServiceType:         r.ServiceType,
+		Parameters:          parameters,
+		Methods:             []string{"POST"},
+		Timeout:             DefaultRequestTimeout,
 	})
 }
 
 // Authenticated associates an action to a function to be handled with authentication.
-func (r *RoutingGroup) Authenticated(action string, function func(e *Envelope)) {
-	r.Route.Actions = append(r.Route.Actions, Action{
+// Any additional request parameters the action reads may be listed for self-description.
+func (r *RoutingGroup) Authenticated(action string, function func(e *Envelope), parameters ...string) *Action {
+	return r.Route.register(&Action{
 		ActionName:          action,
 		Callback:            function,
 		NeedsAuthentication: true,
 		ServiceType:         r.ServiceType,
+		Parameters:          parameters,
+		Methods:             []string{"POST"},
+		Timeout:             DefaultRequestTimeout,
 	})
 }
 
+// AllowMethods replaces the HTTP methods this action may be requested with.
+func (a *Action) AllowMethods(methods ...string) *Action {
+	a.Methods = methods
+	return a
+}
+
+// AllowsMethod returns whether this action may be requested with the given HTTP method.
+func (a *Action) AllowsMethod(method string) bool {
+	for _, allowed := range a.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRouter returns a route with the actions of every service registered.
+func newRouter() Route {
+	r := NewRoute()
+	registerECS(&r)
+	registerIAS(&r)
+	registerCAS(&r)
+	registerNUS(&r)
+	return r
+}
+
+// actionsCommand prints a description of every registered action.
+func actionsCommand() {
+	r := newRouter()
+	for _, action := range r.Actions {
+		authentication := "unauthenticated"
+		if action.NeedsAuthentication {
+			authentication = "authenticated"
+		}
+
+		fmt.Printf("%s/%s (%s, %s)\n", action.ServiceType, action.ActionName, authentication, strings.Join(action.Methods, ", "))
+		if len(action.Parameters) != 0 {
+			fmt.Printf("\tParameters: %s\n", strings.Join(action.Parameters, ", "))
+		}
+	}
+}
+
 func (route *Route) Handle() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Health checks are frequent enough that we do not log them.
+		if r.Method == "GET" && serveHealth(w, r) {
+			return
+		}
+
 		log.Printf("%s %s via %s", aurora.Yellow(r.Method), aurora.Cyan(r.URL), aurora.Cyan(r.Host))
 
-		// Check if there's a header of the type we need.
-		service, actionName := parseAction(r.Header.Get("SOAPAction"))
-		if service == "" || actionName == "" || r.Method != "POST" {
-			printError(w, "WiiSOAP can't handle this. Try again later.")
+		// Shop pages, scripts and artwork are served alongside SOAP when configured.
+		if serveAssets(w, r) {
 			return
 		}
 
-		// Verify this is a service type we know.
-		switch service {
-		case "ecs":
-		case "ias":
-		case "cas":
-			break
-		default:
-			printError(w, "Unsupported service type...")
+		// Requests are traced from here, continuing any trace the client propagated.
+		spanCtx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		spanCtx, span := tracer.Start(spanCtx, "HTTP "+r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.RequestURI())))
+		defer span.End()
+
+		// Each request is identified within logs, and recovered from should it panic.
+		requestId := newRequestId(span)
+		w.Header().Set(RequestIdHeader, requestId)
+		r = r.WithContext(withRequestId(spanCtx, requestId))
+		tracker := &responseTracker{ResponseWriter: w}
+		w = tracker
+		defer recoverRequest(r.Context(), tracker)
+
+		// All further work is performed on behalf of the tenant this request is for.
+		tenant, r := resolveTenant(r)
+		tenant.metrics.Add("requests", 1)
+
+		// WSDL documents may be requested via GET, similar to most SOAP servers.
+		if r.Method == "GET" && r.URL.Query().Has("wsdl") {
+			route.serveWSDL(w, r)
 			return
 		}
 
-		debugPrint("[!] Incoming ", aurora.Yellow(strings.ToUpper(service)), " request - handling request ", aurora.Yellow(actionName))
-		body, err := ioutil.ReadAll(r.Body)
+		// Reading a byte past our limit tells us whether the body exceeds it.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, requestLimits.MaxBodySize+1))
 		if err != nil {
-			printError(w, "Error reading request body...")
+			writeFault(w, http.StatusBadRequest, FaultCodeClient, "Error reading request body...")
+			return
+		}
+		if int64(len(body)) > requestLimits.MaxBodySize {
+			rejectPayload("size")
+			writeFault(w, http.StatusRequestEntityTooLarge, FaultCodeClient, "Request body is too large.")
 			return
 		}
 
-		// Ensure we can route to this action before processing.
-		// Search all registered actions and find a matching action.
-		var action Action
-		for _, routeAction := range route.Actions {
-			if routeAction.ActionName == actionName && routeAction.ServiceType == service {
-				action = routeAction
+		// Bodies must be vetted before any attempt to parse them, including for routing.
+		if len(body) != 0 {
+			err = checkXMLDocument(body)
+			if err != nil {
+				rejectPayload(rejectionReason(err))
+				writeFault(w, http.StatusBadRequest, FaultCodeClient, "Error interpreting request body: "+err.Error())
+				return
 			}
 		}
 
-		// Action is only properly populated if we found it previously.
-		if action.ActionName == "" && action.ServiceType == "" {
-			printError(w, "WiiSOAP can't handle this. Try again later.")
+		// Prefer the action within our header, falling back to the element within the SOAP body.
+		service, actionName := parseAction(r.Header.Get(route.HeaderName))
+		if service == "" || actionName == "" {
+			service, actionName = actionFromBody(body)
+		}
+		if service == "" || actionName == "" {
+			if r.Method != "POST" {
+				w.Header().Set("Allow", "POST")
+				writeFault(w, http.StatusMethodNotAllowed, FaultCodeClient, "SOAP requests must be sent via POST.")
+				return
+			}
+
+			writeFault(w, http.StatusBadRequest, FaultCodeClient, "WiiSOAP can't handle this. Try again later.")
+			return
+		}
+
+		// Verify this is a service type we know.
+		if !route.HasService(service) {
+			writeFault(w, http.StatusNotFound, FaultCodeClient, "Unsupported service type...")
+			return
+		}
+
+		debugPrint("[!] Incoming ", aurora.Yellow(strings.ToUpper(service)), " request - handling request ", aurora.Yellow(actionName))
+		span.SetName(service + "/" + actionName)
+		span.SetAttributes(attribute.String("wiisoap.tenant", tenant.Name))
+
+		// Ensure we can route to this action before processing.
+		action, found := route.Lookup(service, actionName)
+		if !found {
+			writeFault(w, http.StatusNotFound, FaultCodeClient, "WiiSOAP can't handle this. Try again later.")
+			return
+		}
+		if !action.AllowsMethod(r.Method) {
+			w.Header().Set("Allow", strings.Join(action.Methods, ", "))
+			writeFault(w, http.StatusMethodNotAllowed, FaultCodeClient, "Method not allowed for this action.")
 			return
 		}
 
 		debugPrint("Client sent:\n", aurora.BrightGreen(string(body)))
 
 		// Insert the current action being performed.
+		_, parseSpan := tracer.Start(r.Context(), "envelope.parse")
 		e, err := NewEnvelope(service, actionName, body)
+		endSpan(parseSpan, err)
 		if err != nil {
-			printError(w, "Error interpreting request body: "+err.Error())
+			writeFault(w, http.StatusBadRequest, FaultCodeClient, "Error interpreting request body: "+err.Error())
+			return
+		}
+
+		// All work for this request must complete within the action's deadline.
+		requestCtx, cancel := context.WithTimeout(r.Context(), action.Timeout)
+		defer cancel()
+		e.ctx = requestCtx
+		e.clientIP = clientAddress(r)
+		e.session = r.Header.Get(SessionHeader)
+
+		// Consoles are shown maintenance rather than an error while the database is unreachable.
+		if !databaseAvailable() {
+			e.Unavailable()
+			respond(w, r, body, e)
 			return
 		}
 
 		// Check for authentication.
 		if action.NeedsAuthentication {
 			success, err := checkAuthentication(e)
+			if errors.Is(err, context.DeadlineExceeded) {
+				incrementMetric("request_timeouts")
+				writeFault(w, http.StatusGatewayTimeout, FaultCodeServer, "Request timed out.")
+				return
+			}
+
 			// Catch-all in case of invalid formatting or true invalidity.
 			if !success || (err != nil) {
-				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				// Operators may have authentication failures responded to as errors, as some client patches expect.
+				if override, exists := e.failureOverride(FailureAuthentication); exists && override.behavior != FailureBehaviorFault {
+					e.Error(ErrorCodeGenericFailure, "unauthorized", ErrUnauthorized)
+					respond(w, r, body, e)
+					return
+				}
+
+				writeFault(w, http.StatusUnauthorized, FaultCodeClient, "Unauthorized.")
 				return
 			}
+
+			if e.session != "" {
+				w.Header().Set(SessionHeader, e.session)
+			}
+
+			if !e.enforceBan() {
+				respond(w, r, body, e)
+				return
+			}
+
+			e.recordActivity()
 		}
 
-		// Call this action.
-		action.Callback(e)
+		// Operators may announce downtime or other news in place of a response.
+		if e.showBroadcast() {
+			respond(w, r, body, e)
+			return
+		}
+
+		// Call this action, alongside any hooks plugins registered against it.
+		handlerCtx, handlerSpan := tracer.Start(e.ctx, "handler "+service+"/"+actionName)
+		e.ctx = handlerCtx
+		e.invoke(func(e *Envelope) {
+			e.runHooks(pluginHooks.before)
+		})
+		if e.Body.Response.ErrorCode == ErrorCodeSuccess {
+			e.invoke(action.Callback)
+		}
+		e.invoke(func(e *Envelope) {
+			e.runHooks(pluginHooks.after)
+		})
+		// Work following the action, such as auditing, is traced alongside rather than within it.
+		e.ctx = requestCtx
+		if e.Body.Response.ErrorCode != ErrorCodeSuccess {
+			handlerSpan.SetStatus(codes.Error, e.Body.Response.ErrorCode.String())
+		}
+		handlerSpan.End()
+
+		// Any failures as a result of our deadline should be reported as such, rather than as database errors.
+		if errors.Is(requestCtx.Err(), context.DeadlineExceeded) {
+			incrementMetric("request_timeouts")
+			tenant.metrics.Add("request_timeouts", 1)
+			log.Printf("%s/%s exceeded its timeout of %s", service, actionName, action.Timeout)
+			e.Error(ErrorCodeRequestTimeout, "request timed out", requestCtx.Err())
+		}
 
-		// The action has now finished its task, and we can serialize.
-		// Output may or may not truly be XML depending on where things failed.
-		// We'll expect the best, however.
-		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-		success, contents := e.becomeXML()
-		if !success {
-			// This is not what we wanted, and we need to reflect that.
-			w.WriteHeader(http.StatusInternalServerError)
+		if action.Audit && e.Body.Response.ErrorCode == ErrorCodeSuccess {
+			e.audit(service + "/" + actionName)
 		}
-		w.Write([]byte(contents))
-		debugPrint("Writing response:\n", aurora.BrightCyan(contents))
+
+		if e.Body.Response.ErrorCode != ErrorCodeSuccess {
+			tenant.metrics.Add("errors", 1)
+		}
+		span.SetAttributes(attribute.Int("wiisoap.error_code", int(e.Body.Response.ErrorCode)))
+
+		// Failures while the database is unreachable are reported as such, rather than as generic errors.
+		if e.Body.Response.ErrorCode != ErrorCodeSuccess && pingDatabase() != nil {
+			e.Unavailable()
+		}
+
+		respond(w, r, body, e)
 	})
 }
 
+// respond serializes the given envelope as the response to a request.
+func respond(w http.ResponseWriter, r *http.Request, body []byte, e *Envelope) {
+	if e.fault != "" {
+		writeFault(w, http.StatusInternalServerError, FaultCodeServer, e.fault)
+		captureExchange(r, body, http.StatusInternalServerError, e.fault)
+		return
+	}
+
+	// The action has now finished its task, and we can serialize.
+	// Output may or may not truly be XML depending on where things failed.
+	// We'll expect the best, however.
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	success, contents := e.becomeXML()
+	status := http.StatusOK
+	if !success {
+		// This is not what we wanted, and we need to reflect that.
+		status = http.StatusInternalServerError
+		w.WriteHeader(status)
+	}
+	w.Write([]byte(contents))
+	debugPrint("Writing response:\n", aurora.BrightCyan(contents))
+	captureExchange(r, body, status, contents)
+}
+
 const (
-	RouteVerifyHashedStatement   = `SELECT 1 FROM userbase WHERE device_token_hashed=$1 AND account_id=$2 AND device_id=$3`
 	RouteVerifyUnhashedStatement = `SELECT 1 FROM userbase WHERE device_token=$1 AND account_id=$2 AND device_id=$3`
 )
 
@@ -155,6 +445,20 @@ func checkAuthentication(e *Envelope) (bool, error) {
 		return true, nil
 	}
 
+	valid, err := checkDeviceToken(e)
+	if !valid || err != nil {
+		return valid, err
+	}
+
+	// Strict challenge mode additionally requires a response to the console's challenge.
+	response, _ := e.getKey("ChallengeResponse")
+	accountId, _ := e.AccountId()
+	err = verifyChallenge(e.ctx, accountId, e.DeviceId(), response)
+	return err == nil, err
+}
+
+// checkDeviceToken validates the device token and account ID given within a request.
+func checkDeviceToken(e *Envelope) (bool, error) {
 	// Get necessary authentication identifiers.
 	deviceToken, err := e.getKey("DeviceToken")
 	if err != nil {
@@ -170,15 +474,25 @@ func checkAuthentication(e *Envelope) (bool, error) {
 		return false, nil
 	}
 
-	var statement string
+	// Consoles which authenticated recently with the same credentials need not be looked up again.
+	if e.resumeSession(accountId, deviceToken) {
+		return true, nil
+	}
+
+	// Hashed tokens are verified against our stored hash, which may need upgrading.
 	if tokenType == TokenTypeHashed {
-		statement = RouteVerifyHashedStatement
-	} else if tokenType == TokenTypeUnhashed {
-		statement = RouteVerifyUnhashedStatement
+		valid, err := checkTokenHash(e.ctx, accountId, e.DeviceId(), hash)
+		if err != nil && err != pgx.ErrNoRows {
+			debugPrint("error occurred while checking authentication: ", err)
+		}
+		if valid {
+			e.startSession(accountId, deviceToken)
+		}
+		return valid, err
 	}
 
 	// Check using various input given.
-	row := pool.QueryRow(ctx, statement, hash, accountId, e.DeviceId())
+	row := pool.QueryRow(e.ctx, RouteVerifyUnhashedStatement, hash, accountId, e.DeviceId())
 
 	var throwaway int
 	err = row.Scan(&throwaway)
@@ -186,9 +500,10 @@ func checkAuthentication(e *Envelope) (bool, error) {
 		return false, err
 	} else if err != nil {
 		// We shouldn't encounter other errors.
-		debugPrint("error occurred while checking authentication: %v\n", err)
+		debugPrint("error occurred while checking authentication: ", err)
 		return false, err
 	} else {
+		e.startSession(accountId, deviceToken)
 		return true, nil
 	}
 }
@@ -218,8 +533,3 @@ func determineTokenFormat(token string) (string, TokenType) {
 
 	return "", TokenTypeInvalid
 }
-
-func printError(w http.ResponseWriter, reason string) {
-	http.Error(w, reason, http.StatusInternalServerError)
-	debugPrint("Failed to handle request: ", aurora.Red(reason))
-}
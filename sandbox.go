@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	QueryAccountSandbox = `SELECT sandbox FROM userbase WHERE account_id = $1`
+
+	UpdateAccountSandboxStatement = `UPDATE userbase SET sandbox = $2 WHERE account_id = $1`
+
+	// QueryNextTransactionId allocates a transaction ID, as sequences are unaffected by rollbacks.
+	// The table is unqualified so that it resolves within the tenant's schema.
+	QueryNextTransactionId = `SELECT nextval(pg_get_serial_sequence('transactions', 'transaction_id'))`
+
+	InsertSandboxTransactionStatement = `INSERT INTO transactions (transaction_id, account_id, type, title_id, item_id, total_paid, reference_id, date, sandbox)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, true)`
+)
+
+// sandboxPurchases places every account within the sandbox.
+var sandboxPurchases = false
+
+// sandboxKey marks a context as handling a sandboxed purchase.
+type sandboxKey struct{}
+
+// SandboxSetting describes whether an account's purchases are sandboxed.
+type SandboxSetting struct {
+	AccountId int64 `json:"account_id"`
+	Sandbox   bool  `json:"sandbox"`
+}
+
+func init() {
+	registerAdminEndpoint("/consoles/sandbox", sandboxEndpoint)
+}
+
+// sandboxTx performs a purchase in full, but discards its effects in place of committing them.
+// Transactions recorded within are kept, marked as sandboxed.
+type sandboxTx struct {
+	pgx.Tx
+	transactions []sandboxTransaction
+}
+
+// sandboxTransaction is a transaction recorded within a sandboxed purchase, alongside its allocated ID.
+type sandboxTransaction struct {
+	id int
+	Transaction
+}
+
+// Commit discards all changes made within this purchase, such as debits and issued tickets, and records its transactions.
+func (t *sandboxTx) Commit(ctx context.Context) error {
+	err := t.Tx.Rollback(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range t.transactions {
+		_, err = pool.Exec(ctx, InsertSandboxTransactionStatement, transaction.id, transaction.AccountId, transaction.Type,
+			transaction.TitleId, transaction.ItemId, transaction.TotalPaid, transaction.ReferenceId, transaction.Date)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSandboxed returns whether the given context is handling a sandboxed purchase.
+func isSandboxed(ctx context.Context) bool {
+	sandboxed, _ := ctx.Value(sandboxKey{}).(bool)
+	return sandboxed
+}
+
+// beginPurchase begins the transaction a purchase by the given account is made within.
+// Purchases by sandboxed accounts are validated and responded to as usual, but leave balances and tickets untouched.
+func (e *Envelope) beginPurchase(accountId int64) (pgx.Tx, error) {
+	sandboxed := sandboxPurchases
+	if !sandboxed {
+		err := pool.QueryRow(e.ctx, QueryAccountSandbox, accountId).Scan(&sandboxed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := pool.Begin(e.ctx)
+	if err != nil || !sandboxed {
+		return tx, err
+	}
+
+	e.ctx = context.WithValue(e.ctx, sandboxKey{}, true)
+	return &sandboxTx{Tx: tx}, nil
+}
+
+// sandboxEndpoint returns or sets whether an account's purchases are sandboxed.
+func sandboxEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		accountId, err := strconv.ParseInt(r.URL.Query().Get("account_id"), 10, 64)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "account_id is required")
+			return
+		}
+
+		setting := SandboxSetting{AccountId: accountId}
+		err = pool.QueryRow(r.Context(), QueryAccountSandbox, accountId).Scan(&setting.Sandbox)
+		if err == pgx.ErrNoRows {
+			writeAdminError(w, http.StatusNotFound, "account does not exist")
+			return
+		} else if err != nil {
+			log.Printf("error querying sandbox: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, setting)
+	case "PUT":
+		var setting SandboxSetting
+		err := readJSON(r, &setting)
+		if err != nil || setting.AccountId == 0 {
+			writeAdminError(w, http.StatusBadRequest, "account_id is required")
+			return
+		}
+
+		result, err := pool.Exec(r.Context(), UpdateAccountSandboxStatement, setting.AccountId, setting.Sandbox)
+		if err != nil {
+			log.Printf("error setting sandbox: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		} else if result.RowsAffected() == 0 {
+			writeAdminError(w, http.StatusNotFound, "account does not exist")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, setting)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
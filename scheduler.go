@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Job describes a task run periodically in the background.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+
+	// PerTenant jobs are run once for every tenant, with that tenant's context.
+	PerTenant bool
+
+	// Used to report the status of this job.
+	status *expvar.Map
+}
+
+// JobConfig allows overriding the interval of a job, or disabling it entirely.
+type JobConfig struct {
+	Name     string `xml:"Name,attr"`
+	Interval string `xml:"Interval,attr"`
+	Disabled bool   `xml:"Disabled,attr"`
+}
+
+// jobs contains all registered jobs.
+var jobs []*Job
+
+// jobMetrics holds the status of every job, keyed by name.
+var jobMetrics = expvar.NewMap("jobs")
+
+// registerJob adds a job to be run at the given interval once the scheduler starts.
+// It is intended to be called from init functions within any module.
+func registerJob(name string, interval time.Duration, run func() error) {
+	jobs = append(jobs, &Job{
+		Name:     name,
+		Interval: interval,
+		Run: func(context.Context) error {
+			return run()
+		},
+	})
+}
+
+// registerTenantJob adds a job to be run for every tenant at the given interval once the scheduler starts,
+// such as those operating upon the database.
+func registerTenantJob(name string, interval time.Duration, run func(ctx context.Context) error) {
+	jobs = append(jobs, &Job{
+		Name:      name,
+		Interval:  interval,
+		Run:       run,
+		PerTenant: true,
+	})
+}
+
+// startScheduler applies configuration to all registered jobs, and begins running them in the background.
+func startScheduler(config []JobConfig) {
+	overrides := map[string]JobConfig{}
+	for _, job := range config {
+		overrides[job.Name] = job
+	}
+
+	for _, job := range jobs {
+		if override, exists := overrides[job.Name]; exists {
+			if override.Disabled {
+				continue
+			}
+
+			if override.Interval != "" {
+				interval, err := time.ParseDuration(override.Interval)
+				checkError(err)
+				job.Interval = interval
+			}
+		}
+
+		job.status = new(expvar.Map).Init()
+		jobMetrics.Set(job.Name, job.status)
+
+		go job.schedule()
+	}
+}
+
+// schedule runs the job at its interval indefinitely.
+func (j *Job) schedule() {
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		j.execute()
+	}
+}
+
+// execute runs the job once, recording its status.
+func (j *Job) execute() {
+	start := time.Now()
+	err := j.safeRun()
+
+	j.status.Add("runs", 1)
+	lastRun := new(expvar.String)
+	lastRun.Set(start.UTC().Format(time.RFC3339))
+	j.status.Set("last_run", lastRun)
+	duration := new(expvar.Int)
+	duration.Set(time.Since(start).Milliseconds())
+	j.status.Set("last_duration_ms", duration)
+
+	lastError := new(expvar.String)
+	if err != nil {
+		log.Printf("job %s failed: %v", j.Name, err)
+		j.status.Add("failures", 1)
+		lastError.Set(err.Error())
+	}
+	j.status.Set("last_error", lastError)
+}
+
+// safeRun runs the job, for every tenant if necessary.
+// A failure for one tenant does not prevent running for the rest.
+func (j *Job) safeRun() error {
+	if !j.PerTenant {
+		return j.recoverRun(ctx)
+	}
+
+	var failure error
+	for _, tenant := range tenants {
+		err := j.recoverRun(withTenant(ctx, tenant))
+		if err != nil {
+			failure = fmt.Errorf("tenant %s: %w", tenant.Name, err)
+			log.Printf("job %s failed for %v", j.Name, failure)
+		}
+	}
+	return failure
+}
+
+// recoverRun runs the job with the given context, ensuring a panicking job cannot take down the server.
+func (j *Job) recoverRun(ctx context.Context) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("job panicked: %v", recovered)
+		}
+	}()
+
+	return j.Run(ctx)
+}
@@ -0,0 +1,53 @@
+package main
+
+import "strings"
+
+const (
+	// DefaultSearchLimit is how many results are returned unless the client requests otherwise.
+	DefaultSearchLimit = 20
+	// MaxSearchLimit is the most results returned at once.
+	MaxSearchLimit = 100
+	// MaxSearchLength is the longest search string accepted, in characters.
+	MaxSearchLength = 64
+
+	// QuerySearchTitles matches titles by name and description using titles_search_index,
+	// listing each matching item available within the given region and country, best matches first.
+	// Each row additionally includes the total number of matches, prior to pagination.
+	QuerySearchTitles = `SELECT item_id, title_id, version, price, count(*) OVER ()
+		FROM (
+			SELECT DISTINCT ON (service_titles.item_id) service_titles.item_id, titles.title_id, titles.version, titles.name,
+				COALESCE(service_title_regions.price, service_titles.price) AS price,
+				ts_rank(to_tsvector('simple', COALESCE(titles.name, '') || ' ' || COALESCE(titles.description, '')), plainto_tsquery('simple', $1)) AS rank
+			FROM service_titles
+			JOIN titles ON titles.title_id = service_titles.title_id
+			LEFT JOIN service_title_regions
+				ON service_title_regions.item_id = service_titles.item_id
+				AND service_title_regions.region = $2
+				AND (service_title_regions.country IS NULL OR service_title_regions.country = $3)
+			WHERE to_tsvector('simple', COALESCE(titles.name, '') || ' ' || COALESCE(titles.description, '')) @@ plainto_tsquery('simple', $1)
+			AND (service_titles.available_from IS NULL OR service_titles.available_from <= now())
+			AND (service_titles.available_until IS NULL OR service_titles.available_until > now())
+			AND (service_titles.purchase_limit IS NULL OR service_titles.purchase_count < service_titles.purchase_limit)
+			AND (service_title_regions.item_id IS NOT NULL
+				OR NOT EXISTS (SELECT 1 FROM service_title_regions WHERE service_title_regions.item_id = service_titles.item_id))
+			ORDER BY service_titles.item_id, service_title_regions.country NULLS LAST
+		) AS matches
+		ORDER BY rank DESC, name, item_id
+		LIMIT $4 OFFSET $5`
+)
+
+// searchItems lists items whose title name or description matches the client's search string.
+func searchItems(e *Envelope) {
+	searchString, err := e.getKey("SearchString")
+	searchString = strings.TrimSpace(searchString)
+	if err != nil || searchString == "" {
+		e.Error(ErrorCodeInvalidRequest, "missing search string", err)
+		return
+	}
+	if len([]rune(searchString)) > MaxSearchLength {
+		searchString = string([]rune(searchString)[:MaxSearchLength])
+	}
+
+	offset, limit := e.listPagination(DefaultSearchLimit, MaxSearchLimit)
+	e.listCatalogItems(offset, limit, QuerySearchTitles, searchString, e.Region(), e.Country())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/wii-tools/wadlib"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ErrMissingSecret is returned when a secret is referenced or required, but not provided.
+var ErrMissingSecret = errors.New("required secret is missing")
+
+// secretReference matches ${NAME} within configured values.
+var secretReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// SecretsConfig holds values which differ per deployment and should not be stored alongside the rest of configuration.
+// Any value may reference environment variables as ${NAME}, as may SQLPass, webhook secrets and companion API keys.
+type SecretsConfig struct {
+	// Directory enables the file-based provider, resolving ${NAME} from the file NAME within it
+	// when not set within the environment, such as with Docker or Kubernetes secrets.
+	Directory string `xml:"Directory,attr"`
+
+	// SharedChallenge is the challenge given to consoles unless StrictChallenge is enabled, of at most 11 characters.
+	SharedChallenge string `xml:"SharedChallenge"`
+	// CommonKey and KoreanKey are the hex-encoded common keys title keys are encrypted with.
+	CommonKey string `xml:"CommonKey"`
+	KoreanKey string `xml:"KoreanKey"`
+	// TitleKey is the hex-encoded key title contents are encrypted with.
+	TitleKey string `xml:"TitleKey"`
+	// AdminToken is required to serve the admin API.
+	AdminToken string `xml:"AdminToken"`
+}
+
+// secretResolver interpolates secret references, retaining the first failure.
+type secretResolver struct {
+	directory string
+	err       error
+}
+
+// resolve returns the given value with all references replaced.
+func (s *secretResolver) resolve(value string) string {
+	return secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := secretReference.FindStringSubmatch(reference)[1]
+		if value, exists := os.LookupEnv(name); exists {
+			return value
+		}
+
+		if s.directory != "" {
+			contents, err := os.ReadFile(filepath.Join(s.directory, name))
+			if err == nil {
+				// Files commonly end with a newline which is not part of the secret.
+				return strings.TrimRight(string(contents), "\r\n")
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				s.fail(err)
+				return ""
+			}
+		}
+
+		s.fail(fmt.Errorf("%w: %s is not set", ErrMissingSecret, name))
+		return ""
+	})
+}
+
+func (s *secretResolver) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// loadSecrets resolves all secrets within the given configuration and applies them.
+// It fails if any reference cannot be resolved, or if a secret required by an enabled feature is missing.
+func loadSecrets(config *Config) error {
+	resolver := &secretResolver{directory: config.Secrets.Directory}
+	secrets := &config.Secrets
+	for _, value := range []*string{&secrets.SharedChallenge, &secrets.CommonKey, &secrets.KoreanKey, &secrets.TitleKey, &secrets.AdminToken, &config.SQLPass, &config.Admin.Token} {
+		*value = resolver.resolve(*value)
+	}
+	for i := range config.Webhooks {
+		config.Webhooks[i].Secret = resolver.resolve(config.Webhooks[i].Secret)
+	}
+	for i := range config.Federation.Upstreams {
+		config.Federation.Upstreams[i].Token = resolver.resolve(config.Federation.Upstreams[i].Token)
+	}
+	for i := range config.Companion.APIKeys {
+		config.Companion.APIKeys[i] = resolver.resolve(config.Companion.APIKeys[i])
+	}
+	if resolver.err != nil {
+		return resolver.err
+	}
+
+	if secrets.AdminToken != "" {
+		config.Admin.Token = secrets.AdminToken
+	} else if config.Admin.Token != "" {
+		log.Println("Admin>Token is deprecated. Please move it to Secrets>AdminToken.")
+	}
+	if config.Admin.Address != "" && config.Admin.Token == "" {
+		return fmt.Errorf("%w: AdminToken must be set to serve the admin API", ErrMissingSecret)
+	}
+
+	if secrets.SharedChallenge != "" {
+		if len(secrets.SharedChallenge) > 11 {
+			return errors.New("SharedChallenge must be 11 characters or less")
+		}
+		sharedChallenge = secrets.SharedChallenge
+	}
+
+	for _, key := range []struct {
+		name  string
+		value string
+		key   *[16]byte
+	}{
+		{"CommonKey", secrets.CommonKey, &wadlib.CommonKey},
+		{"KoreanKey", secrets.KoreanKey, &wadlib.KoreanKey},
+		{"TitleKey", secrets.TitleKey, &contentAesKey},
+	} {
+		if key.value == "" {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(key.value)
+		if err != nil || len(decoded) != len(key.key) {
+			return fmt.Errorf("%s must be 16 hex-encoded bytes", key.name)
+		}
+		copy(key.key[:], decoded)
+	}
+
+	return nil
+}
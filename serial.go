@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	QueryConsoleModels = `SELECT COALESCE(console_model, 'Unknown'), COALESCE(manufacturing_region, 'Unknown'), COUNT(*)
+		FROM userbase
+		GROUP BY 1, 2
+		ORDER BY 3 DESC`
+)
+
+// serialFormat matches serial numbers such as LU123456789 or LEH123456789:
+// a model letter, a region letter, an optional suffix, and the serial itself.
+var serialFormat = regexp.MustCompile(`^([A-Z])([A-Z])([A-Z]?)(\d{8,9})$`)
+
+// consoleModels maps the first letter of a serial number to the console it was assigned to.
+var consoleModels = map[string]string{
+	"L": "RVL-001",
+	"K": "RVL-101",
+	"N": "RVL-201",
+}
+
+// manufacturingRegions maps the second letter of a serial number to the region it was manufactured for.
+var manufacturingRegions = map[string]string{
+	"J": "Japan",
+	"U": "Americas",
+	"E": "Europe",
+	"A": "Australia",
+	"K": "Korea",
+	"W": "Taiwan",
+	"C": "China",
+}
+
+// strictSerials rejects registrations with serial numbers we are unable to parse.
+var strictSerials = false
+
+// SerialNumber describes the fields within a console's serial number.
+type SerialNumber struct {
+	Original string
+	// Model is the console's model number, such as RVL-001.
+	Model string
+	// Region is the region the console was manufactured for.
+	Region string
+	// Serial is the numeric portion of the serial number.
+	Serial string
+}
+
+var (
+	ErrInvalidSerialFormat = errors.New("serial number is not in a known format")
+	ErrUnknownConsoleModel = errors.New("serial number has an unknown console model")
+	ErrUnknownSerialRegion = errors.New("serial number has an unknown manufacturing region")
+	ErrBogusSerial         = errors.New("serial number is a placeholder")
+)
+
+func init() {
+	registerAdminEndpoint("/consoles/models", consoleModelsEndpoint)
+}
+
+// parseSerialNumber validates and interprets the given serial number.
+func parseSerialNumber(serialNo string) (SerialNumber, error) {
+	matches := serialFormat.FindStringSubmatch(strings.ToUpper(serialNo))
+	if matches == nil {
+		return SerialNumber{}, ErrInvalidSerialFormat
+	}
+
+	serial := SerialNumber{
+		Original: serialNo,
+		Model:    consoleModels[matches[1]],
+		Region:   manufacturingRegions[matches[2]],
+		Serial:   matches[4],
+	}
+
+	if serial.Model == "" {
+		return serial, ErrUnknownConsoleModel
+	}
+	if serial.Region == "" {
+		return serial, ErrUnknownSerialRegion
+	}
+
+	// Serials repeating a single digit, such as 00000000, are not assigned to any console.
+	if strings.Count(serial.Serial, serial.Serial[:1]) == len(serial.Serial) {
+		return serial, ErrBogusSerial
+	}
+
+	return serial, nil
+}
+
+// checkSerialNumber validates the given serial number, returning an error only if strict mode is enabled.
+// Emulated consoles are never rejected under Dolphin compatibility.
+func checkSerialNumber(serialNo string) (SerialNumber, error) {
+	serial, err := parseSerialNumber(serialNo)
+	if err != nil && strictSerials && !dolphinCompatibility {
+		return serial, err
+	}
+
+	return serial, nil
+}
+
+// nullableString returns nil for empty strings, so that they are stored as NULL.
+func nullableString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// ConsoleModelCount describes how many registered consoles share a model and manufacturing region.
+type ConsoleModelCount struct {
+	Model  string `json:"model"`
+	Region string `json:"region"`
+	Count  int    `json:"count"`
+}
+
+// consoleModelsEndpoint summarizes registered consoles by model and manufacturing region.
+func consoleModelsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rows, err := pool.Query(r.Context(), QueryConsoleModels)
+	if err != nil {
+		log.Printf("error querying console models: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	counts := []ConsoleModelCount{}
+	for rows.Next() {
+		var count ConsoleModelCount
+		err = rows.Scan(&count.Model, &count.Region, &count.Count)
+		if err != nil {
+			log.Printf("error querying console models: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		counts = append(counts, count)
+	}
+
+	writeJSON(w, http.StatusOK, counts)
+}
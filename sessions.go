@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"time"
+)
+
+const (
+	// DefaultSessionTTL is how long a session lasts after its last request unless otherwise configured.
+	DefaultSessionTTL = 5 * time.Minute
+
+	// SessionHeader carries a console's session token, both within responses and within requests resuming a session.
+	SessionHeader = "X-WiiSOAP-Session"
+
+	// sessionTokenLength is the length of issued session tokens.
+	sessionTokenLength = 32
+)
+
+// SessionsConfig configures sessions, sparing authenticated requests within a browsing session from looking up the console's registration.
+type SessionsConfig struct {
+	Enabled bool `xml:"Enabled,attr"`
+	// TTL is how long a session lasts after its last request, such as 5m.
+	TTL string `xml:"TTL,attr"`
+}
+
+// sessionKey identifies a session by its token within a tenant.
+type sessionKey struct {
+	tenant string
+	token  string
+}
+
+// credentialsKey identifies a session by the credentials it was started with, as consoles do not return session tokens.
+type credentialsKey struct {
+	tenant    string
+	accountId int64
+	deviceId  int
+	digest    [sha256.Size]byte
+}
+
+// session is an authenticated console, alongside a digest of the device token it authenticated with.
+type session struct {
+	accountId int64
+	deviceId  int
+	digest    [sha256.Size]byte
+}
+
+var (
+	// sessionsEnabled indicates whether sessions are started upon authenticating.
+	sessionsEnabled = false
+
+	sessions              = newTTLCache[sessionKey, session]()
+	sessionsByCredentials = newTTLCache[credentialsKey, string]()
+)
+
+// loadSessions applies the given session configuration.
+func loadSessions(config SessionsConfig) error {
+	sessionsEnabled = config.Enabled
+
+	ttl := DefaultSessionTTL
+	if config.TTL != "" {
+		parsed, err := time.ParseDuration(config.TTL)
+		if err != nil {
+			return err
+		}
+		ttl = parsed
+	}
+
+	sessions.SetTTL(ttl)
+	sessionsByCredentials.SetTTL(ttl)
+	return nil
+}
+
+// resumeSession returns whether this request belongs to a session started with the same credentials, extending it if so.
+// The session token sent via SessionHeader is preferred, falling back to the credentials themselves.
+func (e *Envelope) resumeSession(accountId int64, deviceToken string) bool {
+	if !sessionsEnabled {
+		return false
+	}
+
+	tenant := tenantFromContext(e.ctx).Name
+	credentials := credentialsKey{tenant: tenant, accountId: accountId, deviceId: e.DeviceId(), digest: sha256.Sum256([]byte(deviceToken))}
+
+	token := e.session
+	if token == "" {
+		token, _ = sessionsByCredentials.Get(credentials)
+	}
+
+	current, exists := sessions.Get(sessionKey{tenant: tenant, token: token})
+	if !exists || current.accountId != accountId || current.deviceId != e.DeviceId() ||
+		subtle.ConstantTimeCompare(current.digest[:], credentials.digest[:]) != 1 {
+		e.session = ""
+		return false
+	}
+
+	sessions.Set(sessionKey{tenant: tenant, token: token}, current)
+	sessionsByCredentials.Set(credentials, token)
+	e.session = token
+	incrementMetric("sessions_resumed")
+	return true
+}
+
+// startSession begins a session for this request's console once it has authenticated with the given credentials.
+func (e *Envelope) startSession(accountId int64, deviceToken string) {
+	if !sessionsEnabled {
+		return
+	}
+
+	tenant := tenantFromContext(e.ctx).Name
+	digest := sha256.Sum256([]byte(deviceToken))
+	token := RandString(sessionTokenLength)
+
+	sessions.Set(sessionKey{tenant: tenant, token: token}, session{accountId: accountId, deviceId: e.DeviceId(), digest: digest})
+	sessionsByCredentials.Set(credentialsKey{tenant: tenant, accountId: accountId, deviceId: e.DeviceId(), digest: digest}, token)
+	e.session = token
+	incrementMetric("sessions_started")
+}
+
+// endSessions ends every session of the given console, such as once its registration changes.
+func endSessions(ctx context.Context, deviceId int) {
+	tenant := tenantFromContext(ctx).Name
+	sessions.DeleteMatching(func(key sessionKey, value session) bool {
+		return key.tenant == tenant && value.deviceId == deviceId
+	})
+	sessionsByCredentials.DeleteMatching(func(key credentialsKey, _ string) bool {
+		return key.tenant == tenant && key.deviceId == deviceId
+	})
+}
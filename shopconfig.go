@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+)
+
+// ShopConfig holds values sent to the shop via GetECConfig, allowing features to be toggled without patching the channel.
+type ShopConfig struct {
+	// ContentPrefixURL overrides where title contents are downloaded from.
+	// It defaults to the CCS service at the base URL.
+	ContentPrefixURL string `xml:"ContentPrefixURL"`
+	// UncachedContentPrefixURL overrides where uncached contents are downloaded from, defaulting to ContentPrefixURL.
+	UncachedContentPrefixURL string `xml:"UncachedContentPrefixURL"`
+	// SystemContentPrefixURL overrides where system titles are downloaded from, defaulting to ContentPrefixURL.
+	SystemContentPrefixURL string `xml:"SystemContentPrefixURL"`
+	// SystemUncachedContentPrefixURL overrides where uncached system titles are downloaded from, defaulting to SystemContentPrefixURL.
+	SystemUncachedContentPrefixURL string `xml:"SystemUncachedContentPrefixURL"`
+	// PointCards specifies whether the shop offers redeeming Wii Points Cards.
+	PointCards bool `xml:"PointCards"`
+	// Features are arbitrary toggles exposed to the shop's scripts.
+	Features []ShopFeature `xml:"Feature"`
+}
+
+// ShopFeature is a single named toggle.
+type ShopFeature struct {
+	Name    string `xml:"Name,attr"`
+	Enabled bool   `xml:"Enabled,attr"`
+}
+
+// ConfigParameters represents a single configuration value within GetECConfig.
+type ConfigParameters struct {
+	XMLName xml.Name `xml:"Parameters"`
+	Name    string   `xml:"Name"`
+	Value   string   `xml:"Value"`
+}
+
+// resolveShopConfig applies defaults to the given configuration for a tenant at the given base URL.
+func resolveShopConfig(baseUrl string, config ShopConfig) ShopConfig {
+	if config.ContentPrefixURL == "" {
+		config.ContentPrefixURL = fmt.Sprintf("http://ccs.%s/ccs/download", baseUrl)
+	}
+	if config.UncachedContentPrefixURL == "" {
+		config.UncachedContentPrefixURL = config.ContentPrefixURL
+	}
+	if config.SystemContentPrefixURL == "" {
+		config.SystemContentPrefixURL = config.ContentPrefixURL
+	}
+	if config.SystemUncachedContentPrefixURL == "" {
+		config.SystemUncachedContentPrefixURL = config.SystemContentPrefixURL
+	}
+
+	return config
+}
+
+func getECConfig(e *Envelope) {
+	shopConfig := tenantFromContext(e.ctx).Shop
+	e.AddKVNode("ContentPrefixURL", shopConfig.ContentPrefixURL)
+	e.AddKVNode("UncachedContentPrefixURL", shopConfig.UncachedContentPrefixURL)
+	e.AddKVNode("SystemContentPrefixURL", shopConfig.SystemContentPrefixURL)
+	e.AddKVNode("SystemUncachedContentPrefixURL", shopConfig.SystemUncachedContentPrefixURL)
+
+	e.AddKVNode("EcsURL", genServiceUrl(e.ctx, "ecs", serviceEndpoints["ecs"]))
+	e.AddKVNode("IasURL", genServiceUrl(e.ctx, "ias", serviceEndpoints["ias"]))
+	e.AddKVNode("CasURL", genServiceUrl(e.ctx, "cas", serviceEndpoints["cas"]))
+	e.AddKVNode("NusURL", genServiceUrl(e.ctx, "nus", serviceEndpoints["nus"]))
+
+	e.AddCustomType(ConfigParameters{
+		Name:  "PointCards",
+		Value: strconv.FormatBool(shopConfig.PointCards),
+	})
+	for _, feature := range shopConfig.Features {
+		e.AddCustomType(ConfigParameters{
+			Name:  feature.Name,
+			Value: strconv.FormatBool(feature.Enabled),
+		})
+	}
+}
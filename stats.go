@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultStatsDays is how many days of statistics are returned unless a range is requested.
+	DefaultStatsDays = 30
+	// DefaultTitleStatsLimit is how many titles are returned unless the client requests otherwise.
+	DefaultTitleStatsLimit = 50
+	// MaxTitleStatsLimit is the most titles returned at once.
+	MaxTitleStatsLimit = 500
+
+	// StatsDateFormat is the format days are given and returned in.
+	StatsDateFormat = "2006-01-02"
+)
+
+const (
+	RecordActivityStatement = `INSERT INTO device_activity (day, account_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+
+	// QueryRollupStart returns the most recent day rolled up, or otherwise the earliest day with any data.
+	QueryRollupStart = `SELECT COALESCE((SELECT max(day) FROM daily_stats),
+			LEAST((SELECT min(date_registered) FROM userbase)::date, (SELECT min(date) FROM transactions)::date))`
+
+	DeleteDailyStatsStatement = `DELETE FROM daily_stats WHERE day BETWEEN $1 AND $2`
+
+	DeleteDailyTitleStatsStatement = `DELETE FROM daily_title_stats WHERE day BETWEEN $1 AND $2`
+
+	// RollupDailyStatsStatement aggregates every day within the given range.
+	// Received gifts are excluded from purchases as they are counted when sent, as are points cards, refunded and sandboxed transactions.
+	RollupDailyStatsStatement = `INSERT INTO daily_stats (day, registrations, active_devices, purchases, points_redeemed)
+		SELECT days.day,
+			(SELECT count(*) FROM userbase WHERE date_registered >= days.day AND date_registered < days.day + 1),
+			(SELECT count(*) FROM device_activity WHERE device_activity.day = days.day),
+			count(transactions.transaction_id),
+			COALESCE(sum(transactions.total_paid), 0)
+		FROM (SELECT generate_series($1::date, $2::date, interval '1 day')::date AS day) AS days
+		LEFT JOIN transactions ON transactions.date >= days.day AND transactions.date < days.day + 1
+			AND transactions.type NOT IN ('RECVGIFT', 'PURCHPOINTS') AND transactions.date_refunded IS NULL AND NOT transactions.sandbox
+		GROUP BY days.day`
+
+	RollupDailyTitleStatsStatement = `INSERT INTO daily_title_stats (day, title_id, purchases, points_redeemed)
+		SELECT date::date, title_id, count(*), sum(total_paid)
+		FROM transactions
+		WHERE date >= $1::date AND date < $2::date + 1
+		AND type NOT IN ('RECVGIFT', 'PURCHPOINTS') AND date_refunded IS NULL AND NOT sandbox
+		GROUP BY date::date, title_id`
+
+	// PurgeActivityStatement removes activity for days which will no longer be rolled up.
+	PurgeActivityStatement = `DELETE FROM device_activity WHERE day < $1`
+
+	QueryDailyStats = `SELECT day, registrations, active_devices, purchases, points_redeemed
+		FROM daily_stats
+		WHERE day BETWEEN $1 AND $2
+		ORDER BY day`
+
+	// QueryTitleStats totals purchases per title across the given range, most purchased first.
+	QueryTitleStats = `SELECT daily_title_stats.title_id, titles.name, sum(daily_title_stats.purchases), sum(daily_title_stats.points_redeemed)
+		FROM daily_title_stats
+		LEFT JOIN (SELECT DISTINCT ON (title_id) title_id, name FROM titles ORDER BY title_id, version DESC) AS titles
+			ON titles.title_id = daily_title_stats.title_id
+		WHERE daily_title_stats.day BETWEEN $1 AND $2
+		GROUP BY daily_title_stats.title_id, titles.name
+		ORDER BY sum(daily_title_stats.purchases) DESC, daily_title_stats.title_id
+		LIMIT $3`
+)
+
+// DailyStats summarises activity across the shop for a single day.
+type DailyStats struct {
+	Day            string `json:"day"`
+	Registrations  int    `json:"registrations"`
+	ActiveDevices  int    `json:"active_devices"`
+	Purchases      int    `json:"purchases"`
+	PointsRedeemed int64  `json:"points_redeemed"`
+}
+
+// TitleStats summarises purchases of a single title.
+type TitleStats struct {
+	TitleId        string  `json:"title_id"`
+	Name           *string `json:"name"`
+	Purchases      int     `json:"purchases"`
+	PointsRedeemed int64   `json:"points_redeemed"`
+}
+
+// activityKey identifies a console's activity.
+type activityKey struct {
+	tenant    string
+	accountId int64
+}
+
+// recordedActivity holds the day each console's activity was last recorded, so that it is only written once per console each day.
+// Keying by console alone retains at most one entry for each, regardless of how many days it is active.
+var recordedActivity = newTTLCache[activityKey, string]()
+
+func init() {
+	recordedActivity.SetTTL(24 * time.Hour)
+	registerTenantJob("rollup-stats", time.Hour, rollupStats)
+	registerAdminEndpoint("/stats", statsEndpoint)
+	registerAdminEndpoint("/stats/titles", titleStatsEndpoint)
+}
+
+// recordActivity marks this request's console as active today.
+// Failures are logged rather than returned, as they should not affect the request.
+func (e *Envelope) recordActivity() {
+	accountId, err := e.AccountId()
+	if err != nil || accountId == 0 {
+		return
+	}
+
+	day := time.Now().UTC().Format(StatsDateFormat)
+	key := activityKey{tenant: tenantFromContext(e.ctx).Name, accountId: accountId}
+	if recorded, exists := recordedActivity.Get(key); exists && recorded == day {
+		return
+	}
+
+	_, err = pool.Exec(e.ctx, RecordActivityStatement, day, accountId)
+	if err != nil {
+		log.Printf("error recording activity: %v\n", err)
+		return
+	}
+	recordedActivity.Set(key, day)
+}
+
+// rollupStats aggregates statistics for every day since the last rollup, including today.
+// The most recent day is always recomputed, as it may have been rolled up partway through.
+func rollupStats(ctx context.Context) error {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	var start *time.Time
+	err := pool.QueryRow(ctx, QueryRollupStart).Scan(&start)
+	if err != nil {
+		return err
+	}
+	if start == nil || start.After(today) {
+		start = &today
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, statement := range []string{DeleteDailyStatsStatement, DeleteDailyTitleStatsStatement, RollupDailyStatsStatement, RollupDailyTitleStatsStatement} {
+		_, err = tx.Exec(ctx, statement, *start, today)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, PurgeActivityStatement, *start)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// statsRange returns the days requested via the from and to query parameters,
+// defaulting to the most recent DefaultStatsDays days.
+func statsRange(r *http.Request) (time.Time, time.Time, bool) {
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(StatsDateFormat, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, 1-DefaultStatsDays)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(StatsDateFormat, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+
+	return from, to, !from.After(to)
+}
+
+// statsEndpoint lists daily statistics within the requested range.
+func statsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	from, to, valid := statsRange(r)
+	if !valid {
+		writeAdminError(w, http.StatusBadRequest, "from and to must be dates, from no later than to")
+		return
+	}
+
+	rows, err := pool.Query(r.Context(), QueryDailyStats, from, to)
+	if err != nil {
+		log.Printf("error querying statistics: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	stats := []DailyStats{}
+	for rows.Next() {
+		var day time.Time
+		var daily DailyStats
+		err = rows.Scan(&day, &daily.Registrations, &daily.ActiveDevices, &daily.Purchases, &daily.PointsRedeemed)
+		if err != nil {
+			log.Printf("error querying statistics: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		daily.Day = day.Format(StatsDateFormat)
+		stats = append(stats, daily)
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// titleStatsEndpoint lists the most purchased titles within the requested range.
+func titleStatsEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	from, to, valid := statsRange(r)
+	if !valid {
+		writeAdminError(w, http.StatusBadRequest, "from and to must be dates, from no later than to")
+		return
+	}
+
+	limit := DefaultTitleStatsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeAdminError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = parsed
+	}
+	if limit > MaxTitleStatsLimit {
+		limit = MaxTitleStatsLimit
+	}
+
+	rows, err := pool.Query(r.Context(), QueryTitleStats, from, to, limit)
+	if err != nil {
+		log.Printf("error querying title statistics: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	stats := []TitleStats{}
+	for rows.Next() {
+		var title TitleStats
+		err = rows.Scan(&title.TitleId, &title.Name, &title.Purchases, &title.PointsRedeemed)
+		if err != nil {
+			log.Printf("error querying title statistics: %v\n", err)
+			writeAdminError(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		stats = append(stats, title)
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -18,8 +18,10 @@
 package main
 
 import (
+	"context"
 	"encoding/xml"
 	"github.com/antchfx/xmlquery"
+	"net"
 )
 
 /////////////////////
@@ -31,17 +33,94 @@ import (
 type Config struct {
 	XMLName xml.Name `xml:"Config"`
 
-	Address string `xml:"Address"`
-	BaseURL string `xml:"BaseURL"`
+	Address string    `xml:"Address"`
+	BaseURL string    `xml:"BaseURL"`
+	TLS     TLSConfig `xml:"TLS"`
 
 	SQLAddress string `xml:"SQLAddress"`
 	SQLUser    string `xml:"SQLUser"`
 	SQLPass    string `xml:"SQLPass"`
 	SQLDB      string `xml:"SQLDB"`
+	// SQLPool tunes connections to the database.
+	SQLPool PoolConfig `xml:"SQLPool"`
+	// SQLReplica directs read-only queries to a replica of the database.
+	SQLReplica ReplicaConfig `xml:"SQLReplica"`
 
-	Debug     bool `xml:"Debug"`
-	NoAuth    bool `xml:"NoAuth"`
+	Secrets SecretsConfig `xml:"Secrets"`
+
+	Debug  bool `xml:"Debug"`
+	NoAuth bool `xml:"NoAuth"`
+	// Whitelist is no longer supported, and is only read to refuse starting with it enabled.
 	Whitelist bool `xml:"Whitelist"`
+	// StrictSerials rejects registrations from consoles with malformed serial numbers.
+	StrictSerials bool `xml:"StrictSerials"`
+	// StrictChallenge requires authenticated requests to respond to a challenge from GetChallenge.
+	StrictChallenge bool `xml:"StrictChallenge"`
+	// DolphinCompatibility relaxes checks emulated consoles are unable to pass.
+	DolphinCompatibility bool `xml:"DolphinCompatibility"`
+	// DuplicateRegistrations selects how registrations for an already registered device ID or serial number are handled.
+	DuplicateRegistrations string `xml:"DuplicateRegistrations"`
+	// StrictCompatibility emits responses in the exact element order and formatting of Nintendo's servers.
+	StrictCompatibility bool `xml:"StrictCompatibility"`
+	// ParentalControls refuses titles rated above an account's parental restriction.
+	ParentalControls bool `xml:"ParentalControls"`
+	// BundleBaseTitles purchases base titles alongside add-ons requiring them, rather than refusing the purchase.
+	BundleBaseTitles bool `xml:"BundleBaseTitles"`
+	// SandboxPurchases sandboxes purchases by every account, rather than only those sandboxed individually.
+	SandboxPurchases bool `xml:"SandboxPurchases"`
+
+	CaptureDirectory string `xml:"CaptureDirectory"`
+
+	// DefaultLanguage is the language titles are presented in when not localized in the console's own.
+	DefaultLanguage string `xml:"DefaultLanguage"`
+
+	Pricing PricingConfig `xml:"Pricing"`
+	Assets  AssetsConfig  `xml:"Assets"`
+	Shop    ShopConfig    `xml:"Shop"`
+
+	Tenants []TenantConfig `xml:"Tenants>Tenant"`
+
+	GeoIP GeoIPConfig `xml:"GeoIP"`
+
+	// Allowlist limits registrations to allowlisted consoles, such as during a beta.
+	Allowlist AllowlistConfig `xml:"Allowlist"`
+
+	// Fraud flags, holds or blocks suspicious registrations, purchases and redemptions.
+	Fraud FraudConfig `xml:"Fraud"`
+
+	// Federation supplements the local catalog with titles from trusted upstreams.
+	Federation FederationConfig `xml:"Federation"`
+
+	Webhooks []WebhookConfig `xml:"Webhooks>Webhook"`
+
+	// Tracing exports OpenTelemetry spans for every request.
+	Tracing TracingConfig `xml:"Tracing"`
+
+	// SystemUpdate lists the system titles offered to consoles checking for updates via NUS.
+	SystemUpdate SystemUpdateConfig `xml:"SystemUpdate"`
+
+	LogFile        string      `xml:"LogFile"`
+	MetricsAddress string      `xml:"MetricsAddress"`
+	Jobs           []JobConfig `xml:"Jobs>Job"`
+	CacheTTL       string      `xml:"CacheTTL"`
+
+	// Sessions spares consoles from being looked up upon every authenticated request within a browsing session.
+	Sessions SessionsConfig `xml:"Sessions"`
+
+	// HTTP tunes connections with consoles and compresses responses.
+	HTTP HTTPConfig `xml:"HTTP"`
+
+	RequestLimits   RequestLimitsConfig `xml:"RequestLimits"`
+	Timeouts        TimeoutsConfig      `xml:"Timeouts"`
+	DisabledActions []string            `xml:"DisabledActions>Action"`
+
+	// Plugins lists the paths of plugins to load, which register hooks run alongside actions.
+	Plugins []string `xml:"Plugins>Plugin"`
+
+	Errors    ErrorsConfig    `xml:"Errors"`
+	Admin     AdminConfig     `xml:"Admin"`
+	Portal    PortalConfig    `xml:"Portal"`
+	Companion CompanionConfig `xml:"Companion"`
 }
 
 // Envelope represents the root element of any response, soapenv:Envelope.
@@ -57,6 +136,23 @@ type Envelope struct {
 	// Used for internal state tracking.
 	doc *xmlquery.Node
 
+	// ctx is cancelled once this request's deadline passes.
+	// It should be used for all database operations made while handling this request.
+	ctx context.Context
+
+	// The service and action this envelope responds to, such as ecs and GetECConfig.
+	service string
+	action  string
+
+	// clientIP is the address this request originated from.
+	clientIP net.IP
+
+	// session is the token of the session this request authenticated within, or that the client sent to resume.
+	session string
+
+	// fault is the reason sent within a SOAP fault in place of this envelope, if a failure was overridden to do so.
+	fault string
+
 	// Common IAS values.
 	region   string
 	country  string
@@ -82,7 +178,7 @@ type Response struct {
 	DeviceId           int    `xml:"DeviceId"`
 	MessageId          string `xml:"MessageId"`
 	TimeStamp          string `xml:"TimeStamp"`
-	ErrorCode          int
+	ErrorCode          ErrorCode
 	ServiceStandbyMode bool `xml:"ServiceStandbyMode"`
 
 	// Allows for <name>[dynamic content]</name> situations.
@@ -95,6 +191,13 @@ type KVField struct {
 	Value   string `xml:",chardata"`
 }
 
+// Node represents an element holding other elements, for structures built while responding
+// rather than declared ahead of time. Children may be KVFields, structures, slices or further nodes.
+type Node struct {
+	XMLName  xml.Name
+	Children []interface{}
+}
+
 // Balance represents a common XML structure.
 type Balance struct {
 	XMLName  xml.Name `xml:"Balance"`
@@ -104,9 +207,11 @@ type Balance struct {
 
 // Limits represents a common XML structure for transaction information.
 type Limits struct {
-	XMLName   xml.Name   `xml:"Limits"`
-	Limits    LimitKinds `xml:"Limits"`
-	LimitKind string     `xml:"LimitKind,omitempty"`
+	XMLName xml.Name `xml:"Limits"`
+	// Limits is the value of the limit, such as the length of a rental in seconds.
+	// Kinds without a value repeat the kind itself.
+	Limits    int    `xml:"Limits"`
+	LimitKind string `xml:"LimitKind,omitempty"`
 }
 
 // Transactions represents a common XML structure.
@@ -123,6 +228,7 @@ type Transactions struct {
 	ItemCode       int      `xml:"ItemCode,omitempty"`
 	ReferenceId    string   `xml:"ReferenceId,omitempty"`
 	ReferenceValue int      `xml:"ReferenceValue,omitempty"`
+	TitleName      string   `xml:"TitleName,omitempty"`
 }
 
 // Tickets represents the format to inform a console of available titles for its consumption.
@@ -136,6 +242,24 @@ type Tickets struct {
 	MigrateLimit int      `xml:"MigrateLimit"`
 }
 
+// UpdatedTitles represents a title owned by the console with a newer version available.
+type UpdatedTitles struct {
+	XMLName        xml.Name `xml:"Titles"`
+	TitleId        string   `xml:"TitleId"`
+	Version        int      `xml:"Version"`
+	CurrentVersion int      `xml:"CurrentVersion"`
+}
+
+// Gifts represents a gift pending acceptance by the recipient.
+type Gifts struct {
+	XMLName         xml.Name `xml:"Gifts"`
+	GiftId          int      `xml:"GiftId"`
+	SenderAccountId int64    `xml:"SenderAccountId"`
+	TitleId         string   `xml:"TitleId"`
+	ItemId          int      `xml:"ItemId"`
+	Date            string   `xml:"Date"`
+}
+
 // Attributes represents a common structure of the same name.
 type Attributes struct {
 	XMLName xml.Name `xml:"Attributes"`
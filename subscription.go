@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/jackc/pgx/v4"
+	"github.com/wii-tools/wadlib"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// SubscriptionLength is how long a single purchase of a subscription lasts.
+	SubscriptionLength = 30 * 24 * time.Hour
+
+	// QueryActiveSubscription locks the subscription for a title so that concurrent renewals are serialized.
+	QueryActiveSubscription = `SELECT subscription_id, date_end
+		FROM subscriptions
+		WHERE account_id = $1 AND title_id = $2 AND date_end > $3
+		FOR UPDATE`
+
+	InsertSubscriptionStatement = `INSERT INTO subscriptions (account_id, title_id, item_id, date_start, date_end)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	RenewSubscriptionStatement = `UPDATE subscriptions SET date_end = $2, date_renewed = $3
+		WHERE subscription_id = $1`
+
+	// QueryContentRights returns the unexpired ticket for a title, and whether it is granted by a subscription.
+	QueryContentRights = `SELECT owned_titles.date_expires, EXISTS(
+			SELECT 1 FROM subscriptions
+			WHERE subscriptions.account_id = $1 AND subscriptions.title_id = $2 AND subscriptions.date_end > $3
+		)
+		FROM owned_titles
+		WHERE owned_titles.account_id = $1 AND owned_titles.title_id = $2
+		AND (owned_titles.date_expires IS NULL OR owned_titles.date_expires > $3)
+		ORDER BY owned_titles.date_expires DESC NULLS FIRST
+		LIMIT 1`
+
+	// UpdateTicketExpiryStatement never alters permanent tickets, which remain alongside any time-limited one.
+	UpdateTicketExpiryStatement = `UPDATE owned_titles SET date_expires = $3
+		WHERE account_id = $1 AND title_id = $2 AND date_expires IS NOT NULL`
+
+	AssociateExpiringTicketStatement = `INSERT INTO owned_titles (account_id, title_id, version, item_id, date_purchased, date_expires)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+)
+
+// associateExpiringTicket grants the account a ticket lasting until the given time,
+// extending any ticket it already has for the title.
+func associateExpiringTicket(ctx context.Context, tx pgx.Tx, accountId int64, titleId string, version int, itemId int, expires time.Time) error {
+	result, err := tx.Exec(ctx, UpdateTicketExpiryStatement, accountId, titleId, expires)
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() != 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(ctx, AssociateExpiringTicketStatement, accountId, titleId, version, itemId, time.Now().UTC(), expires)
+	return err
+}
+
+// purchaseSubscription issues a SUBSCRIPT ticket for the given title, or renews an active subscription.
+// Renewals extend from the current end date, so that no paid time is lost.
+func purchaseSubscription(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	tempItemId, err := e.getKey("ItemId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing item ID", err)
+		return
+	}
+
+	itemId, err := strconv.Atoi(tempItemId)
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "invalid item ID", err)
+		return
+	}
+
+	titleId, err := e.getKey("TitleId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing title ID", err)
+		return
+	}
+
+	if !e.enforceRating(titleId) {
+		return
+	}
+
+	// Hosted services may not be listed, in which case there is no version to track.
+	version := 0
+	app, err := lookupTitle(e.ctx, titleId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "an error has occurred retrieving app metadata", err)
+		return
+	}
+	if app != nil {
+		version = app.Shop.Version
+	}
+
+	price, err := itemPrice(e.ctx, itemId)
+	if err == nil {
+		price, err = e.chargedPrice(titleId, itemId, price, SUBSCRIPT)
+	}
+	if err != nil {
+		log.Printf("error querying item price: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	ticketStruct, err := newTitleTicket(e.ctx, titleId)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "error creating ticket", err)
+		return
+	}
+
+	ticket := new(bytes.Buffer)
+	err = writeTicket(e.ctx, ticket, ticketStruct)
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "failed to create ticket", err)
+		return
+	}
+
+	tx, err := e.beginPurchase(accountId)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	now := time.Now().UTC()
+	var subscriptionId int
+	var currentEnd time.Time
+	err = tx.QueryRow(e.ctx, QueryActiveSubscription, accountId, titleId, now).Scan(&subscriptionId, &currentEnd)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("error querying subscription: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	renewing := err == nil
+
+	err = claimItem(e.ctx, tx, itemId)
+	if err == ErrItemUnavailable {
+		e.Error(ErrorCodeTitleUnavailable, "unable to purchase subscription", err)
+		return
+	} else if err != nil {
+		log.Printf("unexpected error claiming item: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	err = debitPoints(e.ctx, tx, accountId, price)
+	if err == ErrInsufficientPoints {
+		e.Error(ErrorCodeGenericFailure, "unable to purchase subscription", err)
+		return
+	} else if err != nil {
+		log.Printf("error debiting points: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	var end time.Time
+	if renewing {
+		end = currentEnd.Add(SubscriptionLength)
+		_, err = tx.Exec(e.ctx, RenewSubscriptionStatement, subscriptionId, end, now)
+	} else {
+		end = now.Add(SubscriptionLength)
+		_, err = tx.Exec(e.ctx, InsertSubscriptionStatement, accountId, titleId, itemId, now, end)
+	}
+	if err != nil {
+		log.Printf("error recording subscription: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	// Tickets for subscriptions are removed by the purge-expired-tickets job once they lapse.
+	err = associateExpiringTicket(e.ctx, tx, accountId, titleId, version, itemId, end)
+	if err != nil {
+		log.Printf("unexpected error purchasing subscription: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	transactionId, err := recordTransaction(e.ctx, tx, Transaction{
+		AccountId: accountId,
+		Type:      TransactionSubscription,
+		TitleId:   titleId,
+		ItemId:    itemId,
+		TotalPaid: price,
+	})
+	if err != nil {
+		log.Printf("error recording transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("unexpected error purchasing subscription: %v", err)
+		e.Error(ErrorCodeGenericFailure, "error purchasing", nil)
+		return
+	}
+	invalidateItem(e.ctx, itemId)
+
+	emitEvent(e.ctx, EventPointsRedeemed, PointsRedeemedEvent{
+		AccountId: formatAccountId(accountId),
+		Amount:    price,
+		Reason:    "subscription",
+	})
+	emitEvent(e.ctx, EventTitlePurchased, TitlePurchasedEvent{
+		AccountId:   formatAccountId(accountId),
+		TitleId:     titleId,
+		ItemId:      itemId,
+		LicenseKind: SUBSCRIPT,
+	})
+
+	balance, err := getBalance(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying balance: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddCustomType(balance)
+	e.AddCustomType(Transactions{
+		TransactionId: formatTransactionId(transactionId),
+		Date:          e.Timestamp(),
+		Type:          TransactionSubscription,
+		TotalPaid:     price,
+		Currency:      "POINTS",
+		ItemId:        itemId,
+		ItemPricing:   e.ItemPrice(itemId, price, SR, SUBSCRIPT),
+	})
+	e.AddKVNode("SyncTime", e.Timestamp())
+	e.AddKVNode("ExpirationDate", strconv.FormatInt(end.UnixMilli(), 10))
+
+	e.AddKVNode("ETickets", b64(append(ticket.Bytes(), wadlib.CertChainTemplate...)))
+	// Two cert types must be present.
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("Certs", b64(wadlib.CertChainTemplate))
+	e.AddKVNode("TitleId", titleId)
+}
+
+// checkContentRights reports whether the account may currently use the given title.
+// Titles with time-limited tickets, such as subscriptions, are only usable until they lapse.
+func checkContentRights(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	titleId, err := e.getKey("TitleId")
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing title ID", err)
+		return
+	}
+
+	var expires *time.Time
+	var subscribed bool
+	err = pool.QueryRow(e.ctx, QueryContentRights, accountId, titleId, time.Now().UTC()).Scan(&expires, &subscribed)
+	if err == pgx.ErrNoRows {
+		e.AddKVNode("HasRights", "false")
+		return
+	} else if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	e.AddKVNode("HasRights", "true")
+	if expires == nil {
+		e.AddKVNode("LicenseKind", string(PERMANENT))
+		return
+	}
+
+	if subscribed {
+		e.AddKVNode("LicenseKind", string(SUBSCRIPT))
+	} else {
+		e.AddKVNode("LicenseKind", string(RENTAL))
+	}
+	e.AddKVNode("ExpirationDate", strconv.FormatInt(expires.UnixMilli(), 10))
+}
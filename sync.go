@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	QuerySyncVersion = `SELECT sync_version FROM userbase WHERE account_id = $1`
+
+	// UpdateSyncVersionStatement records an acknowledged sync, never moving backwards.
+	UpdateSyncVersionStatement = `UPDATE userbase SET sync_version = GREATEST(sync_version, $2)
+		WHERE account_id = $1`
+
+	ResetSyncVersionStatement = `UPDATE userbase SET sync_version = 0
+		WHERE region = $1 AND device_id = $2`
+
+	// QuerySyncedTitles omits tickets which have lapsed but are yet to be purged.
+	QuerySyncedTitles = `SELECT title_id, version, date_purchased, date_expires, date_reissued, key_id
+		FROM owned_titles
+		WHERE account_id = $1
+		AND (date_expires IS NULL OR date_expires > now())
+		ORDER BY title_id`
+
+	UpdateSyncedTitleVersionStatement = `UPDATE owned_titles SET version = $3
+		WHERE account_id = $1 AND title_id = $2`
+)
+
+// SyncedTitle describes a title owned by an account alongside the state last delivered to its console.
+type SyncedTitle struct {
+	TitleId string
+	// Version is the version of the title last acknowledged by the console.
+	Version int
+	// CurrentVersion is the latest version of this title available.
+	CurrentVersion int
+	DatePurchased  time.Time
+	// DateExpires is when a time-limited ticket, such as a rental, is revoked.
+	DateExpires *time.Time
+	// DateReissued is when this ticket was last re-issued under KeyId, such as after rotating keys.
+	DateReissued *time.Time
+	KeyId        *int
+}
+
+// needsSync determines whether a ticket must be sent to a console which last synced at the given version.
+// Tickets are resent when purchased or re-issued after the last sync, or if a newer version of their title is available.
+func (t SyncedTitle) needsSync(syncVersion int64) bool {
+	if t.DateReissued != nil && t.DateReissued.UnixMilli() > syncVersion {
+		return true
+	}
+	return t.DatePurchased.UnixMilli() > syncVersion || t.CurrentVersion > t.Version
+}
+
+// revokeDate returns when the console should revoke this ticket, or 0 for permanent tickets.
+func (t SyncedTitle) revokeDate() int {
+	if t.DateExpires == nil {
+		return 0
+	}
+	return int(t.DateExpires.UnixMilli())
+}
+
+// syncedTitles returns all titles owned by the given account, alongside their current metadata.
+func syncedTitles(ctx context.Context, accountId int64) ([]SyncedTitle, error) {
+	rows, err := pool.Query(ctx, QuerySyncedTitles, accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var titles []SyncedTitle
+	for rows.Next() {
+		var title SyncedTitle
+		var version *int
+		err = rows.Scan(&title.TitleId, &version, &title.DatePurchased, &title.DateExpires, &title.DateReissued, &title.KeyId)
+		if err != nil {
+			return nil, err
+		}
+		if version != nil {
+			title.Version = *version
+		}
+		titles = append(titles, title)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	for i, title := range titles {
+		app, err := lookupTitle(ctx, title.TitleId)
+		if err != nil {
+			return nil, err
+		}
+
+		// Titles no longer listed stay at the version last delivered.
+		title.CurrentVersion = title.Version
+		if app != nil {
+			title.CurrentVersion = app.Shop.Version
+		}
+		titles[i] = title
+	}
+
+	return titles, nil
+}
+
+// getSyncVersion returns the timestamp, in milliseconds, of the last sync acknowledged by the given account's console.
+func getSyncVersion(ctx context.Context, accountId int64) (int64, error) {
+	var syncVersion int64
+	err := pool.QueryRow(ctx, QuerySyncVersion, accountId).Scan(&syncVersion)
+	return syncVersion, err
+}
+
+// resetSyncVersion causes all tickets to be resent to the given console, such as after its NAND was restored.
+func resetSyncVersion(ctx context.Context, region string, deviceId int) error {
+	_, err := pool.Exec(ctx, ResetSyncVersionStatement, region, deviceId)
+	return err
+}
+
+// notifyETicketsSynced is sent by the console once it has installed the tickets it was given.
+func notifyETicketsSynced(e *Envelope) {
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(ErrorCodeGenericFailure, "missing account ID", err)
+		return
+	}
+
+	// The console echoes the SyncTime given within ListETickets.
+	// Older clients omit it, so we assume it synchronized as of now.
+	syncVersion := time.Now().UnixMilli()
+	if syncTime, err := e.getKey("SyncTime"); err == nil {
+		syncVersion, err = strconv.ParseInt(syncTime, 10, 64)
+		if err != nil {
+			e.Error(ErrorCodeInvalidRequest, "invalid sync time", err)
+			return
+		}
+	}
+
+	titles, err := syncedTitles(e.ctx, accountId)
+	if err != nil {
+		log.Printf("error querying synced titles: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	tx, err := pool.Begin(e.ctx)
+	if err != nil {
+		log.Printf("error beginning transaction: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+	defer tx.Rollback(e.ctx)
+
+	// Record the versions delivered for all titles available by the time of this sync.
+	for _, title := range titles {
+		if title.DatePurchased.UnixMilli() > syncVersion || title.CurrentVersion == title.Version {
+			continue
+		}
+
+		_, err = tx.Exec(e.ctx, UpdateSyncedTitleVersionStatement, accountId, title.TitleId, title.CurrentVersion)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+			return
+		}
+	}
+
+	_, err = tx.Exec(e.ctx, UpdateSyncVersionStatement, accountId, syncVersion)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+
+	err = tx.Commit(e.ctx)
+	if err != nil {
+		log.Printf("error committing sync: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", ErrDatabase)
+		return
+	}
+}
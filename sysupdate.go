@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SystemUpdateConfig configures the titles offered to consoles checking for system updates.
+type SystemUpdateConfig struct {
+	// Manifest is an XML file listing system titles and their versions, optionally per region.
+	// Consoles are told no update is available unless one is given.
+	Manifest string `xml:"Manifest"`
+}
+
+// SystemUpdateManifest is the root element of a system update manifest.
+// Titles at its root are offered to every region, and those within a Region replace them by title ID.
+type SystemUpdateManifest struct {
+	Titles  []SystemTitle        `xml:"Title"`
+	Regions []SystemUpdateRegion `xml:"Region"`
+}
+
+// SystemUpdateRegion lists titles offered to consoles of a region, such as USA.
+type SystemUpdateRegion struct {
+	Name   string        `xml:"Name,attr"`
+	Titles []SystemTitle `xml:"Title"`
+}
+
+// SystemTitle describes the version of a system title, such as an IOS or the System Menu, consoles should have installed.
+type SystemTitle struct {
+	TitleId string `xml:"Id,attr"`
+	Version int    `xml:"Version,attr"`
+	// FsSize is the space the title occupies once installed, in bytes.
+	FsSize int64 `xml:"FsSize,attr"`
+}
+
+// TitleVersion describes a single system title within GetSystemUpdate.
+type TitleVersion struct {
+	XMLName xml.Name `xml:"TitleVersion"`
+	TitleId string   `xml:"TitleId"`
+	Version int      `xml:"Version"`
+	FsSize  int64    `xml:"FsSize"`
+}
+
+var (
+	// systemTitles are the titles offered to every region.
+	systemTitles []SystemTitle
+	// regionalSystemTitles are the titles offered to each region, with those offered to every region applied.
+	regionalSystemTitles = map[string][]SystemTitle{}
+)
+
+// registerNUS registers all actions handled by the Net Update service.
+func registerNUS(r *Route) {
+	nus := r.HandleGroup("nus")
+	{
+		nus.Unauthenticated("GetSystemUpdate", getSystemUpdate, "TitleVersion")
+	}
+}
+
+// loadSystemUpdate validates and applies the given system update manifest.
+func loadSystemUpdate(config SystemUpdateConfig) error {
+	systemTitles = nil
+	regionalSystemTitles = map[string][]SystemTitle{}
+	if config.Manifest == "" {
+		return nil
+	}
+
+	contents, err := os.ReadFile(config.Manifest)
+	if err != nil {
+		return err
+	}
+
+	var manifest SystemUpdateManifest
+	err = xml.Unmarshal(contents, &manifest)
+	if err != nil {
+		return err
+	}
+
+	err = validateSystemTitles(manifest.Titles)
+	if err != nil {
+		return err
+	}
+	systemTitles = manifest.Titles
+
+	for _, region := range manifest.Regions {
+		err = validateSystemTitles(region.Titles)
+		if err != nil {
+			return fmt.Errorf("region %s: %v", region.Name, err)
+		}
+
+		overridden := map[string]bool{}
+		for _, title := range region.Titles {
+			overridden[title.TitleId] = true
+		}
+
+		titles := append([]SystemTitle{}, region.Titles...)
+		for _, title := range systemTitles {
+			if !overridden[title.TitleId] {
+				titles = append(titles, title)
+			}
+		}
+		regionalSystemTitles[strings.ToUpper(region.Name)] = titles
+	}
+	return nil
+}
+
+// validateSystemTitles ensures each title has a 16 character hexadecimal title ID, normalizing it to uppercase.
+func validateSystemTitles(titles []SystemTitle) error {
+	for i, title := range titles {
+		decoded, err := hex.DecodeString(title.TitleId)
+		if err != nil || len(decoded) != 8 {
+			return fmt.Errorf("invalid system title ID %q", title.TitleId)
+		}
+		titles[i].TitleId = strings.ToUpper(title.TitleId)
+	}
+	return nil
+}
+
+// getSystemUpdate lists the system titles consoles within the requesting region should have installed.
+// The console compares these against its own, downloading any newer from the system content prefix.
+func getSystemUpdate(e *Envelope) {
+	titles, regional := regionalSystemTitles[strings.ToUpper(e.Region())]
+	if !regional {
+		titles = systemTitles
+	}
+
+	shopConfig := tenantFromContext(e.ctx).Shop
+	e.AddKVNode("ContentPrefixURL", shopConfig.SystemContentPrefixURL)
+	e.AddKVNode("UncachedContentPrefixURL", shopConfig.SystemUncachedContentPrefixURL)
+	for _, title := range titles {
+		e.AddCustomType(TitleVersion{
+			TitleId: title.TitleId,
+			Version: title.Version,
+			FsSize:  title.FsSize,
+		})
+	}
+	e.AddKVNode("UploadAuditData", "1")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Taxes describes the tax owed upon a price.
+type Taxes struct {
+	XMLName  xml.Name `xml:"Taxes"`
+	Amount   int      `xml:"Amount"`
+	Currency string   `xml:"Currency"`
+}
+
+// TotalPrice describes a price inclusive of all taxes.
+type TotalPrice struct {
+	XMLName  xml.Name `xml:"TotalPrice"`
+	Amount   int      `xml:"Amount"`
+	Currency string   `xml:"Currency"`
+}
+
+// TaxLocation describes the jurisdiction taxes are calculated for.
+type TaxLocation struct {
+	XMLName     xml.Name `xml:"TaxLocation"`
+	Country     string   `xml:"Country"`
+	Subdivision string   `xml:"Subdivision,omitempty"`
+	TaxRate     string   `xml:"TaxRate"`
+	TaxIncluded bool     `xml:"TaxIncluded"`
+}
+
+// taxRules returns the pricing rules for this request's country, and subdivision if one was given and is configured.
+func (e *Envelope) taxRules() (CountryPricing, string) {
+	subdivision, _ := e.getKey("Subdivision")
+	rules, known := countryPricing(e.Country()).ForSubdivision(subdivision)
+	if !known {
+		subdivision = ""
+	}
+
+	return rules, subdivision
+}
+
+// getTaxLocation reports the jurisdiction and rate taxes are calculated with.
+// Most deployments have no taxes configured, in which case a rate of zero is reported.
+func getTaxLocation(e *Envelope) {
+	rules, subdivision := e.taxRules()
+
+	e.AddCustomType(TaxLocation{
+		Country:     e.Country(),
+		Subdivision: subdivision,
+		TaxRate:     strconv.FormatFloat(rules.TaxRate, 'f', -1, 64),
+		TaxIncluded: rules.TaxIncluded,
+	})
+}
+
+// getTaxes calculates the tax owed upon a price prior to checkout.
+// Prices may be given in points, or in the currency they were displayed in.
+func getTaxes(e *Envelope) {
+	tempAmount, err := e.getKey("Price/Amount")
+	if err != nil {
+		e.Error(ErrorCodeInvalidRequest, "missing price", err)
+		return
+	}
+
+	amount, err := strconv.Atoi(tempAmount)
+	if err != nil || amount < 0 {
+		e.Error(ErrorCodeInvalidRequest, "invalid price", errors.New("price must be a non-negative integer"))
+		return
+	}
+
+	currency, err := e.getKey("Price/Currency")
+	if err != nil {
+		currency = DefaultCurrency
+	}
+
+	rules, _ := e.taxRules()
+
+	var price, tax int
+	switch currency {
+	case DefaultCurrency:
+		price, tax = rules.Convert(amount), rules.Tax(amount)
+	case rules.Currency:
+		// Displayed prices have already been converted, and have tax applied if it is included.
+		price = amount
+		if !rules.TaxIncluded {
+			tax = int(math.Round(float64(amount) * rules.TaxRate / 100))
+		}
+	default:
+		e.Error(ErrorCodeInvalidRequest, "invalid currency", errors.New("currency does not match this country's"))
+		return
+	}
+
+	e.AddCustomType(Taxes{
+		Amount:   tax,
+		Currency: rules.Currency,
+	})
+	e.AddCustomType(TotalPrice{
+		Amount:   price + tax,
+		Currency: rules.Currency,
+	})
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TenantHeader selects the tenant administrative requests apply to, by name.
+const TenantHeader = "X-WiiSOAP-Tenant"
+
+// TenantConfig describes an additional shop instance served alongside the default.
+// Requests are routed to a tenant by their Host header, or by a path prefix preceding the usual service paths.
+type TenantConfig struct {
+	Name string `xml:"Name,attr"`
+	// Host matches requests for this host and any of its subdomains, such as ecs.example.com. It defaults to BaseURL.
+	Host string `xml:"Host,attr"`
+	// PathPrefix matches requests beginning with this path, such as /community. It is removed before routing.
+	PathPrefix string `xml:"PathPrefix,attr"`
+	// Schema is the PostgreSQL schema holding this tenant's tables.
+	Schema string `xml:"Schema,attr"`
+	// BaseURL is used to generate service URLs for this tenant. It defaults to Host.
+	BaseURL string `xml:"BaseURL,attr"`
+	// Shop configures values sent via GetECConfig for this tenant.
+	Shop ShopConfig `xml:"Shop"`
+}
+
+// Tenant is a single shop instance, with its own database schema and shop configuration.
+type Tenant struct {
+	Name       string
+	Host       string
+	PathPrefix string
+	BaseURL    string
+	Shop       ShopConfig
+
+	db      *pgxpool.Pool
+	replica *pgxpool.Pool
+	breaker *circuitBreaker
+	metrics *expvar.Map
+}
+
+type tenantContextKey struct{}
+
+var (
+	// defaultTenant serves all requests not matching another tenant, as configured at the top level.
+	defaultTenant *Tenant
+	// tenants holds every tenant, including the default.
+	tenants []*Tenant
+)
+
+// tenantMetrics holds counters for every tenant, keyed by name.
+var tenantMetrics = expvar.NewMap("tenants")
+
+// connectTenant connects to the configured database for a tenant, restricted to the given schema.
+// An empty schema uses the database's default search path.
+func connectTenant(dbString string, schema string) (*pgxpool.Pool, error) {
+	dbConf, err := tenantPoolConfig(dbString, schema)
+	if err != nil {
+		return nil, err
+	}
+	return pgxpool.ConnectConfig(ctx, dbConf)
+}
+
+// tenantPoolConfig returns the tuned pool configuration for a tenant's connections, restricted to the given schema.
+func tenantPoolConfig(dbString string, schema string) (*pgxpool.Config, error) {
+	dbConf, err := pgxpool.ParseConfig(dbString)
+	if err != nil {
+		return nil, err
+	}
+
+	if schema != "" {
+		dbConf.ConnConfig.RuntimeParams["search_path"] = pgx.Identifier{schema}.Sanitize()
+	}
+	poolTuning.apply(dbConf)
+	return dbConf, nil
+}
+
+// addTenant registers a tenant, exposing its metrics.
+func addTenant(tenant *Tenant) {
+	tenant.breaker = new(circuitBreaker)
+	tenant.metrics = new(expvar.Map).Init()
+	tenantMetrics.Set(tenant.Name, tenant.metrics)
+	tenants = append(tenants, tenant)
+}
+
+// loadTenants connects the default tenant, alongside every configured tenant.
+func loadTenants(dbString string, base Tenant, config []TenantConfig) error {
+	db, err := connectTenant(dbString, "")
+	if err != nil {
+		return err
+	}
+
+	base.db = db
+	base.replica, err = connectReplica("")
+	if err != nil {
+		return err
+	}
+	base.Shop = resolveShopConfig(base.BaseURL, base.Shop)
+	defaultTenant = &base
+	addTenant(defaultTenant)
+
+	for _, tenantConfig := range config {
+		if tenantConfig.Name == "" || tenantConfig.Schema == "" {
+			return fmt.Errorf("tenants must have both a name and schema")
+		}
+		if lookupTenant(tenantConfig.Name) != nil {
+			return fmt.Errorf("tenant %s is configured more than once", tenantConfig.Name)
+		}
+		if tenantConfig.Host == "" && tenantConfig.PathPrefix == "" {
+			tenantConfig.Host = tenantConfig.BaseURL
+		}
+		if tenantConfig.BaseURL == "" {
+			tenantConfig.BaseURL = tenantConfig.Host
+		}
+
+		db, err := connectTenant(dbString, tenantConfig.Schema)
+		if err != nil {
+			return err
+		}
+
+		replicaDb, err := connectReplica(tenantConfig.Schema)
+		if err != nil {
+			return err
+		}
+
+		addTenant(&Tenant{
+			Name:       tenantConfig.Name,
+			Host:       strings.ToLower(tenantConfig.Host),
+			PathPrefix: strings.TrimSuffix(tenantConfig.PathPrefix, "/"),
+			BaseURL:    tenantConfig.BaseURL,
+			Shop:       resolveShopConfig(tenantConfig.BaseURL, tenantConfig.Shop),
+			db:         db,
+			replica:    replicaDb,
+		})
+	}
+
+	return nil
+}
+
+// closeTenants closes the database and replica connections of every tenant.
+func closeTenants() {
+	for _, tenant := range tenants {
+		tenant.db.Close()
+		if tenant.replica != nil {
+			tenant.replica.Close()
+		}
+	}
+}
+
+// lookupTenant returns the tenant with the given name, or nil if none exists.
+func lookupTenant(name string) *Tenant {
+	for _, tenant := range tenants {
+		if tenant.Name == name {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// useTenant directs all further work within a subcommand to the named tenant, exiting if it does not exist.
+// An empty name selects the default tenant.
+func useTenant(name string) {
+	if name == "" {
+		return
+	}
+
+	tenant := lookupTenant(name)
+	if tenant == nil {
+		log.Fatalf("Unknown tenant %s.", name)
+	}
+	ctx = withTenant(ctx, tenant)
+}
+
+// withTenant returns a context whose database operations are directed to the given tenant.
+func withTenant(parent context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(parent, tenantContextKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant of the given context, falling back to the default tenant.
+func tenantFromContext(ctx context.Context) *Tenant {
+	if tenant, ok := ctx.Value(tenantContextKey{}).(*Tenant); ok {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// matchesHost returns whether this tenant serves the given host, or any of its subdomains.
+func (t *Tenant) matchesHost(host string) bool {
+	if t.Host == "" {
+		return false
+	}
+	return host == t.Host || strings.HasSuffix(host, "."+t.Host)
+}
+
+// resolveTenant determines the tenant a request is for, returning the request with that tenant in its context.
+// Tenants matched by path prefix have the prefix removed, so that the remaining path may be routed as usual.
+func resolveTenant(r *http.Request) (*Tenant, *http.Request) {
+	host := strings.ToLower(r.Host)
+	if stripped, _, err := net.SplitHostPort(host); err == nil {
+		host = stripped
+	}
+
+	for _, tenant := range tenants {
+		if tenant.PathPrefix != "" && strings.HasPrefix(r.URL.Path, tenant.PathPrefix+"/") {
+			r = r.WithContext(withTenant(r.Context(), tenant))
+			path := *r.URL
+			path.Path = strings.TrimPrefix(path.Path, tenant.PathPrefix)
+			path.RawPath = ""
+			r.URL = &path
+			return tenant, r
+		}
+	}
+
+	for _, tenant := range tenants {
+		if tenant != defaultTenant && tenant.matchesHost(host) {
+			return tenant, r.WithContext(withTenant(r.Context(), tenant))
+		}
+	}
+
+	return defaultTenant, r.WithContext(withTenant(r.Context(), defaultTenant))
+}
+
+// Database directs queries to the database of the tenant within their context,
+// using prepared statements where available.
+type Database struct{}
+
+// conn returns the pool for the tenant within the given context.
+func (Database) conn(ctx context.Context) *pgxpool.Pool {
+	return tenantFromContext(ctx).db
+}
+
+func (d Database) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, span := startQuerySpan(ctx, "query", sql)
+	rows, err := d.conn(ctx).Query(ctx, prepared(sql), args...)
+	if err != nil {
+		endSpan(span, err)
+		return rows, err
+	}
+	return tracedRows{rows, span}, nil
+}
+
+func (d Database) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, span := startQuerySpan(ctx, "query", sql)
+	return tracedRow{d.conn(ctx).QueryRow(ctx, prepared(sql), args...), span}
+}
+
+func (d Database) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startQuerySpan(ctx, "exec", sql)
+	tag, err := d.conn(ctx).Exec(ctx, prepared(sql), args...)
+	endSpan(span, err)
+	return tag, err
+}
+
+func (d Database) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := d.conn(ctx).Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return preparedTx{tx}, nil
+}
+
+// Ping checks every tenant's database is reachable, as they share a server.
+func (d Database) Ping(ctx context.Context) error {
+	for _, tenant := range tenants {
+		err := tenant.db.Ping(ctx)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package testclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serviceEndpoints maps a service to the path consoles send its requests to.
+var serviceEndpoints = map[string]string{
+	"ecs": "/ecs/services/ECommerceSOAP",
+	"ias": "/ias/services/IdentityAuthenticationSOAP",
+	"cas": "/cas/services/CatalogingSOAP",
+	"nus": "/nus/services/NetUpdateSOAP",
+}
+
+// Client sends requests to a WiiSOAP instance as a single console.
+type Client struct {
+	// Server is the base URL of the instance, such as http://127.0.0.1:8080.
+	Server  string
+	Console Console
+	HTTP    *http.Client
+	// Compression requests responses be compressed via gzip or deflate.
+	Compression bool
+
+	messageId int
+}
+
+// New returns a client for the given server, acting as the given console.
+// Responses are only compressed if requested via Compression, so that their transferred size is known.
+func New(server string, console Console) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+
+	return &Client{
+		Server:  server,
+		Console: console,
+		HTTP:    &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+// Response holds the raw body of a response alongside fields of interest.
+type Response struct {
+	Status int
+	Body   []byte
+	// TransferSize is the size of the body as transferred, before decompression.
+	TransferSize int
+
+	ErrorCode    int
+	ErrorMessage string
+}
+
+// registration holds fields returned upon registering.
+type registration struct {
+	AccountId   string `xml:"Body>RegisterResponse>AccountId"`
+	DeviceToken string `xml:"Body>RegisterResponse>DeviceToken"`
+}
+
+// errorFields is used to unmarshal the common error fields of any response.
+type errorFields struct {
+	ErrorCode    int    `xml:"ErrorCode"`
+	ErrorMessage string `xml:"ErrorMessage"`
+}
+
+// Call sends the given action with the given fields, returning its response.
+func (c *Client) Call(service string, action string, fields []Field) (*Response, error) {
+	endpoint, known := serviceEndpoints[service]
+	if !known {
+		return nil, fmt.Errorf("unknown service %s", service)
+	}
+
+	c.messageId++
+	body := Envelope(service, action, c.Console, "ECons"+strconv.Itoa(c.messageId), fields)
+
+	request, err := http.NewRequest("POST", c.Server+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("SOAPAction", SOAPAction(service, action))
+	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	request.Header.Set("User-Agent", "Wii Shop Channel")
+	if c.Compression {
+		request.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+
+	response, err := c.HTTP.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	transferred, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decompress(response.Header.Get("Content-Encoding"), transferred)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Response{Status: response.StatusCode, Body: contents, TransferSize: len(transferred)}
+	if fields, err := responseFields(contents, action); err == nil {
+		result.ErrorCode = fields.ErrorCode
+		result.ErrorMessage = fields.ErrorMessage
+	}
+
+	// Subsequent requests authenticate as the registered console.
+	if action == "Register" && result.ErrorCode == 0 {
+		var registered registration
+		if xml.Unmarshal(contents, &registered) == nil && registered.AccountId != "" {
+			c.Console.AccountId = registered.AccountId
+			c.Console.DeviceToken = fmt.Sprintf("WT-%x", md5.Sum([]byte(registered.DeviceToken)))
+		}
+	}
+
+	return result, nil
+}
+
+// decompress decodes a body transferred with the given content encoding.
+func decompress(encoding string, body []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unknown content encoding %s", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// responseFields extracts the common error fields from the response element of an action.
+func responseFields(contents []byte, action string) (errorFields, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(contents))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return errorFields{}, err
+		}
+
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == action+"Response" {
+			var fields errorFields
+			err = decoder.DecodeElement(&fields, &start)
+			return fields, err
+		}
+	}
+}
+
+// Send sends a canned request on behalf of this client's console.
+func (c *Client) Send(request Request) (*Response, error) {
+	return c.Call(request.Service, request.Action, request.Fields(c.Console))
+}
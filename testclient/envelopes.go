@@ -0,0 +1,253 @@
+// Package testclient simulates the Wii Shop Channel's SOAP client against a running WiiSOAP instance.
+// It holds canned request envelopes for every supported action, shaped as real consoles send them,
+// alongside helpers comparing responses against golden files.
+package testclient
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+// Namespaces used within request envelopes, as sent by consoles.
+const (
+	SOAPEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	XSDNamespace          = "http://www.w3.org/2001/XMLSchema"
+	XSINamespace          = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// Field is a single element within a request. Fields with children, such as AttributeFilters, have no value.
+type Field struct {
+	Name     string
+	Value    string
+	Children []Field
+}
+
+// Value returns a field with the given name and value.
+func Value(name string, value string) Field {
+	return Field{Name: name, Value: value}
+}
+
+// Console describes the console a request is sent on behalf of.
+type Console struct {
+	DeviceId     int64
+	Region       string
+	Country      string
+	Language     string
+	SerialNumber string
+	DeviceCode   string
+
+	// AccountId and DeviceToken are populated upon registering.
+	AccountId   string
+	DeviceToken string
+}
+
+// DefaultConsole is a North American RVL-001 console, as used for canned envelopes.
+var DefaultConsole = Console{
+	DeviceId:     4123456789,
+	Region:       "USA",
+	Country:      "US",
+	Language:     "en",
+	SerialNumber: "LU123456789",
+	DeviceCode:   "7048129846513089",
+}
+
+// namespace returns the namespace of the given service, such as urn:ecs.wsapi.broadon.com.
+func namespace(service string) string {
+	return "urn:" + service + ".wsapi.broadon.com"
+}
+
+// SOAPAction returns the SOAPAction header value consoles send for the given action.
+func SOAPAction(service string, action string) string {
+	return namespace(service) + "/" + action
+}
+
+// writeField writes a field and its children with the given service prefix.
+func writeField(buffer *bytes.Buffer, prefix string, field Field) {
+	fmt.Fprintf(buffer, "<%s:%s>", prefix, field.Name)
+	if len(field.Children) == 0 {
+		xml.EscapeText(buffer, []byte(field.Value))
+	}
+	for _, child := range field.Children {
+		writeField(buffer, prefix, child)
+	}
+	fmt.Fprintf(buffer, "</%s:%s>", prefix, field.Name)
+}
+
+// Envelope returns a request envelope for the given action, as the console would send it.
+// Common fields are derived from the console, with authentication added if it has registered.
+func Envelope(service string, action string, console Console, messageId string, fields []Field) []byte {
+	common := []Field{
+		Value("Version", "2.0"),
+		Value("DeviceId", fmt.Sprint(console.DeviceId)),
+		Value("MessageId", messageId),
+		Value("Region", console.Region),
+		Value("Country", console.Country),
+		Value("Language", console.Language),
+	}
+	// NUS names the region and country differently to other services.
+	if service == "nus" {
+		common[3] = Value("RegionId", console.Region)
+		common[4] = Value("CountryCode", console.Country)
+	}
+	if console.AccountId != "" {
+		common = append(common, Value("AccountId", console.AccountId), Value("DeviceToken", console.DeviceToken))
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteString(xml.Header)
+	fmt.Fprintf(buffer, `<soapenv:Envelope xmlns:soapenv="%s" xmlns:xsd="%s" xmlns:xsi="%s">`, SOAPEnvelopeNamespace, XSDNamespace, XSINamespace)
+	buffer.WriteString("<soapenv:Body>")
+	fmt.Fprintf(buffer, `<%s:%s xmlns:%s="%s">`, service, action, service, namespace(service))
+	for _, field := range append(common, fields...) {
+		writeField(buffer, service, field)
+	}
+	fmt.Fprintf(buffer, "</%s:%s>", service, action)
+	buffer.WriteString("</soapenv:Body></soapenv:Envelope>")
+	return buffer.Bytes()
+}
+
+// Request is a canned request for a single action.
+type Request struct {
+	Service string
+	Action  string
+	// Fields returns the action-specific fields for the given console.
+	Fields func(console Console) []Field
+}
+
+// Name returns the request's service and action, such as ecs/GetECConfig.
+func (r Request) Name() string {
+	return r.Service + "/" + r.Action
+}
+
+// noFields is used by actions taking only common fields.
+func noFields(Console) []Field {
+	return nil
+}
+
+// Requests lists a canned request for every supported action, in an order a console could send them:
+// registering first, and unregistering last.
+var Requests = []Request{
+	{"nus", "GetSystemUpdate", func(Console) []Field {
+		return []Field{
+			{Name: "TitleVersion", Children: []Field{Value("TitleId", "0000000100000002"), Value("Version", "513")}},
+		}
+	}},
+	{"ecs", "GetECConfig", noFields},
+	{"ias", "CheckRegistration", func(c Console) []Field {
+		return []Field{Value("SerialNumber", c.SerialNumber)}
+	}},
+	{"ias", "GetChallenge", noFields},
+	{"ias", "GenerateDeviceCode", func(Console) []Field {
+		return []Field{Value("IdCounter", "0")}
+	}},
+	{"ias", "ValidateDeviceCode", func(c Console) []Field {
+		return []Field{Value("DeviceCode", c.DeviceCode)}
+	}},
+	{"ias", "Register", func(c Console) []Field {
+		return []Field{
+			Value("DeviceCode", c.DeviceCode),
+			Value("RegisterRegion", c.Region),
+			Value("SerialNumber", c.SerialNumber),
+		}
+	}},
+	{"ias", "GetRegistrationInfo", noFields},
+	{"ias", "SyncRegistration", noFields},
+	{"ecs", "CheckDeviceStatus", noFields},
+	{"cas", "ListItems", func(Console) []Field {
+		return []Field{
+			Value("TitleId", "0001000148414241"),
+			{Name: "AttributeFilters", Children: []Field{Value("Name", "TitleKind"), Value("Value", "PERMANENT")}},
+			{Name: "AttributeFilters", Children: []Field{Value("Name", "PricingCode"), Value("Value", "1")}},
+		}
+	}},
+	{"cas", "SearchItems", func(Console) []Field {
+		return []Field{
+			Value("SearchString", "homebrew"),
+			Value("ListResultOffset", "0"),
+			Value("ListResultLimit", "20"),
+		}
+	}},
+	{"cas", "ListCategories", noFields},
+	{"cas", "ListCategoryItems", func(Console) []Field {
+		return []Field{
+			Value("CategoryId", "1"),
+			Value("ListResultOffset", "0"),
+			Value("ListResultLimit", "20"),
+		}
+	}},
+	{"ecs", "PurchaseTitle", func(Console) []Field {
+		return []Field{
+			Value("ItemId", "1"),
+			Value("TitleId", "0001000148414241"),
+			Value("ReferenceId", "00000000000000000000000000000000"),
+		}
+	}},
+	{"ecs", "PurchaseSubscription", func(Console) []Field {
+		return []Field{Value("ItemId", "1"), Value("TitleId", "0001000148414241")}
+	}},
+	{"ecs", "PurchaseRental", func(Console) []Field {
+		return []Field{Value("ItemId", "1"), Value("TitleId", "0001000148414241")}
+	}},
+	{"ecs", "CheckContentRights", func(Console) []Field {
+		return []Field{Value("TitleId", "0001000148414241")}
+	}},
+	{"ecs", "GetTaxes", func(Console) []Field {
+		return []Field{{Name: "Price", Children: []Field{Value("Amount", "500"), Value("Currency", "POINTS")}}}
+	}},
+	{"ecs", "GetTaxLocation", noFields},
+	{"ecs", "ListETickets", noFields},
+	{"ecs", "GetETickets", noFields},
+	{"ecs", "NotifyETicketsSynced", noFields},
+	{"ecs", "NotifyContentsDownloaded", func(Console) []Field {
+		return []Field{
+			Value("TitleId", "0001000148414241"),
+			Value("TitleVersion", "0"),
+			Value("ContentId", "00000000"),
+			Value("ContentId", "00000001"),
+		}
+	}},
+	{"ecs", "ListTitlesUpdated", noFields},
+	{"ecs", "ListPurchaseHistory", func(Console) []Field {
+		return []Field{Value("ApplicationId", "0001000148414241")}
+	}},
+	{"ecs", "SendGift", func(c Console) []Field {
+		return []Field{
+			Value("RecipientDeviceCode", c.DeviceCode),
+			Value("TitleId", "0001000148414241"),
+			Value("ItemId", "1"),
+		}
+	}},
+	{"ecs", "ListGifts", noFields},
+	{"ecs", "ReceiveGift", func(Console) []Field {
+		return []Field{Value("GiftId", "1")}
+	}},
+	{"ecs", "PurchasePoints", func(Console) []Field {
+		return []Field{{Name: "Payment", Children: []Field{
+			Value("PaymentMethod", "ECARD"),
+			{Name: "ECardPayment", Children: []Field{Value("ECardNumber", "0000-0000-0000-0000")}},
+		}}}
+	}},
+	{"ias", "GetLinkCode", noFields},
+	{"ias", "GetPortalCode", noFields},
+	// Consoles already registered are refused, as accounts may only be recovered onto new consoles.
+	{"ias", "RecoverAccount", func(c Console) []Field {
+		return []Field{
+			Value("DeviceCode", c.DeviceCode),
+			Value("RegisterRegion", c.Region),
+			Value("SerialNumber", c.SerialNumber),
+			Value("RecoveryCode", "ABCDEFGHJK"),
+		}
+	}},
+	{"ias", "Unregister", noFields},
+}
+
+// Lookup returns the canned request for the given action, such as ias/Register.
+func Lookup(name string) (Request, bool) {
+	for _, request := range Requests {
+		if request.Name() == name {
+			return request, true
+		}
+	}
+	return Request{}, false
+}
@@ -0,0 +1,102 @@
+package testclient
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// volatileElements hold values differing between otherwise identical responses, such as timestamps and tokens.
+var volatileElements = []string{
+	"TimeStamp", "MessageId", "SyncTime", "ExtTicketTime", "Date", "ExpirationDate",
+	"AccountId", "DeviceToken", "Challenge", "LinkCode", "LinkCodeExpiration", "ETickets", "GiftId",
+}
+
+// volatilePatterns match the contents of volatileElements, regardless of prefix.
+var volatilePatterns = func() []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, name := range volatileElements {
+		patterns = append(patterns, regexp.MustCompile(`(<(?:\w+:)?`+name+`>)[^<]*(</(?:\w+:)?`+name+`>)`))
+	}
+	return patterns
+}()
+
+// Normalize replaces volatile values within a response with placeholders, so that it may be compared byte for byte.
+func Normalize(body []byte) []byte {
+	for _, pattern := range volatilePatterns {
+		body = pattern.ReplaceAll(body, []byte("${1}*${2}"))
+	}
+	return body
+}
+
+// GoldenPath returns where the golden response for a request is stored within the given directory.
+func GoldenPath(directory string, request Request) string {
+	return filepath.Join(directory, request.Service, request.Action+".xml")
+}
+
+// CompareGolden compares a response against the golden file at the given path after normalizing both.
+// If update is set, the golden file is instead replaced with the response.
+func CompareGolden(path string, body []byte, update bool) error {
+	got := Normalize(body)
+	if update {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, got, 0644)
+	}
+
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	want := Normalize(golden)
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", path, firstDifference(want, got))
+}
+
+// firstDifference describes the first line at which two documents differ.
+func firstDifference(want []byte, got []byte) string {
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var wantLine, gotLine string
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+
+		if wantLine != gotLine {
+			return fmt.Sprintf("line %d differs:\n\twant: %s\n\tgot:  %s", i+1, wantLine, gotLine)
+		}
+	}
+	return "documents differ"
+}
+
+// RunGolden sends every canned request in order, comparing each response against its golden file within the given directory.
+// All mismatches are returned, rather than stopping at the first.
+func (c *Client) RunGolden(directory string, update bool) []error {
+	var errs []error
+	for _, request := range Requests {
+		response, err := c.Send(request)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", request.Name(), err))
+			continue
+		}
+
+		err = CompareGolden(GoldenPath(directory, request), response.Body, update)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// DefaultRequestTimeout is how long actions may take to handle a request unless otherwise configured.
+const DefaultRequestTimeout = 30 * time.Second
+
+// TimeoutsConfig configures how long actions may take before their request is abandoned.
+type TimeoutsConfig struct {
+	Default string                `xml:"Default,attr"`
+	Actions []ActionTimeoutConfig `xml:"Action"`
+}
+
+// ActionTimeoutConfig overrides the timeout for a single action, in the form of "service/Action".
+type ActionTimeoutConfig struct {
+	Name    string `xml:"Name,attr"`
+	Timeout string `xml:"Timeout,attr"`
+}
+
+// WithTimeout sets how long this action may take to handle a request.
+func (a *Action) WithTimeout(timeout time.Duration) *Action {
+	a.Timeout = timeout
+	return a
+}
+
+// SetTimeouts applies the given timeout configuration to all registered actions.
+// Actions without an overridden timeout use the configured default.
+func (r *Route) SetTimeouts(config TimeoutsConfig) error {
+	if config.Default != "" {
+		timeout, err := time.ParseDuration(config.Default)
+		if err != nil {
+			return err
+		}
+
+		for _, action := range r.Actions {
+			action.Timeout = timeout
+		}
+	}
+
+	for _, override := range config.Actions {
+		service, actionName, found := strings.Cut(override.Name, "/")
+		if !found {
+			return errors.New("action " + override.Name + " is not in the form service/Action")
+		}
+
+		action, exists := r.registry[actionKey{service: service, action: actionName}]
+		if !exists {
+			return errors.New("action " + override.Name + " is not registered")
+		}
+
+		timeout, err := time.ParseDuration(override.Timeout)
+		if err != nil {
+			return err
+		}
+		action.Timeout = timeout
+	}
+
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/wii-tools/wadlib"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	UpsertTitleStatement = `INSERT INTO titles (title_id, version, name, content_size, content_count, date_imported)
+		VALUES ($1, $2, $3, $4, $5, now())
+		ON CONFLICT (title_id) DO UPDATE SET
+			version = excluded.version,
+			name = excluded.name,
+			content_size = excluded.content_size,
+			content_count = excluded.content_count,
+			date_imported = excluded.date_imported`
+
+	// ListTitleStatement lists a title for sale under an item ID allocated from its sequence, which also serves as its pricing code.
+	// Titles already listed are left as-is, retaining their pricing, as are titles whose pricing code is already in use by another item.
+	// The sequence is resolved within the current search path, so that each tenant allocates from its own.
+	ListTitleStatement = `INSERT INTO service_titles (item_id, price_code, price, title_id)
+		SELECT next.item_id, next.item_id, $2, $1
+		FROM (SELECT nextval(pg_get_serial_sequence('service_titles', 'item_id'))::integer AS item_id) AS next
+		WHERE NOT EXISTS (SELECT 1 FROM service_titles WHERE title_id = $1 OR price_code = next.item_id)
+		RETURNING item_id`
+
+	QueryTitleVersion = `SELECT version FROM titles WHERE title_id = $1`
+
+	QueryTitleMetadata = `SELECT version, name, description, content_size, content_count FROM titles WHERE title_id = $1`
+)
+
+// BannerLanguages lists languages in the order their names are present within a banner.
+var BannerLanguages = []string{"Japanese", "English", "German", "French", "Spanish", "Italian", "Dutch", "SimplifiedChinese", "TraditionalChinese", "Korean"}
+
+const (
+	// bannerNameLength is the length in bytes of a single name within an IMET header.
+	bannerNameLength = 84
+	// bannerNamesOffset is the offset of names after the IMET magic.
+	bannerNamesOffset = 0x1C
+
+	// titleNameLength is the most characters a title's name may hold within the titles table.
+	titleNameLength = 64
+)
+
+// ImportedTitle describes metadata extracted from a TMD or WAD.
+type ImportedTitle struct {
+	TitleId      string
+	Version      int
+	Name         string
+	ContentSize  uint64
+	ContentCount int
+	// Names holds the title's name per banner language, if available.
+	Names map[string]string
+}
+
+// TitleMetadata describes a title within the titles table, as returned by the admin API to federating servers.
+type TitleMetadata struct {
+	TitleId      string  `json:"title_id"`
+	Version      int     `json:"version"`
+	Name         *string `json:"name"`
+	Description  *string `json:"description"`
+	ContentSize  int64   `json:"content_size"`
+	ContentCount int     `json:"content_count"`
+}
+
+func init() {
+	registerAdminEndpoint("/titles", titlesEndpoint)
+}
+
+// lookupTitle returns metadata for the given title, preferring titles imported locally,
+// then those available from federated upstreams, over the OSC API.
+// It returns nil if the title is known to none.
+func lookupTitle(ctx context.Context, titleId string) (*OSCApp, error) {
+	var version int
+	err := pool.QueryRow(ctx, QueryTitleVersion, titleId).Scan(&version)
+	if err == nil {
+		return &OSCApp{
+			Shop: Shop{
+				TitleId: titleId,
+				Version: version,
+			},
+		}, nil
+	} else if err != pgx.ErrNoRows {
+		return nil, err
+	}
+
+	title, err := lookupFederatedTitle(ctx, titleId)
+	if err != nil {
+		return nil, err
+	} else if title != nil {
+		return &OSCApp{
+			Shop: Shop{
+				TitleId: titleId,
+				Version: title.Version,
+			},
+		}, nil
+	}
+
+	return GetOSCApp(ctx, titleId)
+}
+
+// titlesEndpoint returns the metadata of a title imported locally.
+func titlesEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	titleId := r.URL.Query().Get("title_id")
+	if titleId == "" {
+		writeAdminError(w, http.StatusBadRequest, "title_id is required")
+		return
+	}
+
+	title := TitleMetadata{TitleId: titleId}
+	err := pool.QueryRow(r.Context(), QueryTitleMetadata, titleId).Scan(&title.Version, &title.Name, &title.Description, &title.ContentSize, &title.ContentCount)
+	if err == pgx.ErrNoRows {
+		writeAdminError(w, http.StatusNotFound, "title does not exist")
+		return
+	} else if err != nil {
+		log.Printf("error querying title: %v\n", err)
+		writeAdminError(w, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, title)
+}
+
+// parseBannerNames extracts all names from an IMET header within the given banner, such as opening.bnr.
+func parseBannerNames(banner []byte) map[string]string {
+	offset := bytes.Index(banner, []byte("IMET"))
+	if offset == -1 {
+		return nil
+	}
+
+	names := map[string]string{}
+	start := offset + bannerNamesOffset
+	for index, language := range BannerLanguages {
+		nameStart := start + index*bannerNameLength
+		if nameStart+bannerNameLength > len(banner) {
+			break
+		}
+
+		// Names are null-terminated UTF-16BE.
+		raw := banner[nameStart : nameStart+bannerNameLength]
+		var runes []uint16
+		for i := 0; i < len(raw); i += 2 {
+			char := binary.BigEndian.Uint16(raw[i:])
+			if char == 0 {
+				break
+			}
+			runes = append(runes, char)
+		}
+
+		if name := strings.TrimSpace(string(utf16.Decode(runes))); name != "" {
+			names[language] = name
+		}
+	}
+
+	return names
+}
+
+// describeTMD returns metadata for the given TMD.
+func describeTMD(tmd wadlib.TMD) ImportedTitle {
+	var size uint64
+	for _, content := range tmd.Contents {
+		size += content.Size
+	}
+
+	return ImportedTitle{
+		TitleId:      fmt.Sprintf("%016X", tmd.TitleID),
+		Version:      int(tmd.TitleVersion),
+		ContentSize:  size,
+		ContentCount: len(tmd.Contents),
+	}
+}
+
+// readTitleFile extracts metadata from a WAD or TMD at the given path.
+// Titles within WADs are named after their banner, whereas TMDs are named after an opening.bnr
+// within the same directory, or otherwise their file.
+func readTitleFile(path string) (*ImportedTitle, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var wad wadlib.WAD
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".wad":
+		if len(contents) < 4 {
+			return nil, errors.New("file is too small to be a WAD")
+		}
+
+		loaded, err := wadlib.LoadWAD(contents)
+		if err != nil {
+			return nil, err
+		}
+
+		title := describeTMD(loaded.TMD)
+		title.Name = baseName
+
+		// The banner is typically the first content.
+		if banner, err := loaded.GetContent(0); err == nil {
+			title.Names = parseBannerNames(banner)
+			if name, exists := title.Names["English"]; exists {
+				title.Name = name
+			}
+		}
+
+		return &title, nil
+	case ".tmd":
+		err = wad.LoadTMD(contents)
+	default:
+		// Title metadata from NUS is often named tmd or tmd.<version>.
+		if !strings.HasPrefix(strings.ToLower(filepath.Base(path)), "tmd") {
+			return nil, nil
+		}
+		err = wad.LoadTMD(contents)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	title := describeTMD(wad.TMD)
+	title.Name = baseName
+
+	// Title metadata may be accompanied by the title's extracted banner.
+	if banner, err := os.ReadFile(filepath.Join(filepath.Dir(path), "opening.bnr")); err == nil {
+		title.Names = parseBannerNames(banner)
+		if name, exists := title.Names["English"]; exists {
+			title.Name = name
+		}
+	}
+
+	return &title, nil
+}
+
+// truncateName shortens a name to the length of the titles table's name column, such as those taken from long file names.
+func truncateName(name string) string {
+	runes := []rune(name)
+	if len(runes) <= titleNameLength {
+		return name
+	}
+	return strings.TrimSpace(string(runes[:titleNameLength]))
+}
+
+// listTitle lists an imported title for sale at the given price, returning whether it was not listed already.
+// Failures are reported rather than returned, as the title itself has been imported regardless.
+func listTitle(titleId string, price int) bool {
+	var itemId int
+	err := pool.QueryRow(ctx, ListTitleStatement, titleId, price).Scan(&itemId)
+	if err == nil {
+		return true
+	} else if err != pgx.ErrNoRows {
+		fmt.Printf("[!] Unable to list %s: %v\n", titleId, err)
+		return false
+	}
+
+	// Nothing is listed either if the title already is, or if its pricing code is in use.
+	var alreadyListed bool
+	err = pool.QueryRow(ctx, QueryTitleListed, titleId).Scan(&alreadyListed)
+	if err != nil {
+		fmt.Printf("[!] Unable to list %s: %v\n", titleId, err)
+	} else if !alreadyListed {
+		fmt.Printf("[!] Unable to list %s: its pricing code is already in use by another item; run import-titles again to allocate another\n", titleId)
+	}
+	return false
+}
+
+// importTitlesCommand scans directories for WADs and TMDs, recording their metadata within the titles table
+// and their banner names as localizations. With -list, titles not yet for sale are listed within service_titles.
+// Files which cannot be read or imported are skipped, so that one bad file does not stop the rest.
+func importTitlesCommand(args []string) {
+	flags := flag.NewFlagSet("import-titles", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print metadata without modifying the database")
+	tenant := flags.String("tenant", "", "tenant to import into, rather than the default")
+	list := flags.Bool("list", false, "list imported titles for sale if not already")
+	price := flags.Int("price", 0, "price in points of titles listed via -list")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: wiisoap import-titles [-dry-run] [-tenant name] [-list [-price points]] directory...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	useTenant(*tenant)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	imported, listed, skipped := 0, 0, 0
+	for _, directory := range flags.Args() {
+		err := filepath.WalkDir(directory, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				fmt.Printf("[!] Skipping %s: %v\n", path, err)
+				skipped++
+				return nil
+			} else if entry.IsDir() {
+				return nil
+			}
+
+			title, err := readTitleFile(path)
+			if err != nil {
+				fmt.Printf("[!] Skipping %s: %v\n", path, err)
+				skipped++
+				return nil
+			} else if title == nil {
+				return nil
+			}
+			title.Name = truncateName(title.Name)
+
+			fmt.Printf("[i] %s: %s v%d, %d contents totalling %d bytes (%s)\n", path, title.TitleId, title.Version, title.ContentCount, title.ContentSize, title.Name)
+			if *dryRun {
+				return nil
+			}
+
+			_, err = pool.Exec(ctx, UpsertTitleStatement, title.TitleId, title.Version, title.Name, int64(title.ContentSize), title.ContentCount)
+			if err == nil {
+				err = importBannerNames(ctx, title.TitleId, title.Names)
+			}
+			if err != nil {
+				fmt.Printf("[!] Skipping %s: %v\n", path, err)
+				skipped++
+				return nil
+			}
+			imported++
+
+			if *list && listTitle(title.TitleId, *price) {
+				listed++
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Printf("[!] Unable to scan %s: %v\n", directory, err)
+		}
+	}
+
+	fmt.Printf("Imported %d titles, listing %d for sale and skipping %d files.\n", imported, listed, skipped)
+}
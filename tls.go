@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// TLSConfig configures built-in HTTPS listening.
+type TLSConfig struct {
+	Enabled     bool   `xml:"Enabled"`
+	Address     string `xml:"Address"`
+	Certificate string `xml:"Certificate"`
+	Key         string `xml:"Key"`
+
+	// CompatibilityMode restricts negotiation to what the Wii's SSL library supports.
+	CompatibilityMode bool `xml:"CompatibilityMode"`
+	// ServeHTTP permits plain HTTP on the usual address alongside HTTPS, i.e. for proxied deployments.
+	ServeHTTP bool `xml:"ServeHTTP"`
+}
+
+// wiiCipherSuites are cipher suites a patched Wii client is able to negotiate.
+// The Wii only supports TLS 1.0 with RSA key exchange.
+var wiiCipherSuites = []uint16{
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_RC4_128_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+}
+
+// tlsConfig returns the TLS configuration for the given settings.
+func (c TLSConfig) tlsConfig() *tls.Config {
+	if !c.CompatibilityMode {
+		return &tls.Config{}
+	}
+	if dolphinCompatibility {
+		return dolphinTLSConfig()
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS10,
+		CipherSuites: wiiCipherSuites,
+	}
+}
+
+// listen serves the given handler over HTTP, HTTPS, or both as configured.
+// It only returns once a listener fails.
+func listen(config Config, handler http.Handler) error {
+	if !config.TLS.Enabled {
+		return newServer(config.Address, handler).ListenAndServe()
+	}
+
+	failure := make(chan error, 2)
+	if config.TLS.ServeHTTP {
+		go func() {
+			failure <- newServer(config.Address, handler).ListenAndServe()
+		}()
+	}
+
+	go func() {
+		fmt.Printf("Starting HTTPS connection (%s)...\n", config.TLS.Address)
+		server := newServer(config.TLS.Address, handler)
+		server.TLSConfig = config.TLS.tlsConfig()
+		failure <- server.ListenAndServeTLS(config.TLS.Certificate, config.TLS.Key)
+	}()
+
+	return <-failure
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenHashPrefix marks device token hashes using our current scheme.
+	// Hashes without this prefix are legacy MD5 hashes, as sent by consoles within WT- tokens.
+	TokenHashPrefix = "sha256$"
+
+	QueryDeviceTokenHash = `SELECT device_token_hashed FROM userbase WHERE account_id = $1 AND device_id = $2`
+
+	// UpgradeDeviceTokenHashStatement replaces a legacy hash, provided it has not changed in the meantime.
+	UpgradeDeviceTokenHashStatement = `UPDATE userbase SET device_token_hashed = $3
+		WHERE account_id = $1 AND device_id = $2 AND device_token_hashed = $4`
+
+	// UpgradeAllDeviceTokenHashesStatement upgrades all legacy hashes at once, equivalent to hashDeviceToken.
+	UpgradeAllDeviceTokenHashesStatement = `UPDATE userbase
+		SET device_token_hashed = 'sha256$' || encode(sha256(convert_to(device_token_hashed, 'UTF8')), 'hex')
+		WHERE device_token_hashed NOT LIKE 'sha256$%'`
+)
+
+func init() {
+	registerTenantJob("upgrade-token-hashes", time.Hour, upgradeTokenHashes)
+}
+
+// md5Token returns the MD5 of a device token as a hex string, in the form consoles send within WT- tokens.
+func md5Token(deviceToken string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(deviceToken)))
+}
+
+// hashDeviceToken returns the stored form of a device token from its MD5 hex string.
+// As consoles only ever send the MD5 of their token, our hash must be derived from it.
+func hashDeviceToken(md5Hex string) string {
+	sum := sha256.Sum256([]byte(md5Hex))
+	return TokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// verifyDeviceTokenHash returns whether the given MD5 hex string matches a stored hash,
+// alongside whether the stored hash is a legacy MD5 hash requiring upgrade.
+func verifyDeviceTokenHash(stored string, md5Hex string) (valid bool, legacy bool) {
+	if !strings.HasPrefix(stored, TokenHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(md5Hex)) == 1, true
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(hashDeviceToken(md5Hex))) == 1, false
+}
+
+// checkTokenHash authenticates a console via the MD5 of its device token, upgrading legacy hashes upon success.
+func checkTokenHash(ctx context.Context, accountId int64, deviceId int, md5Hex string) (bool, error) {
+	var stored string
+	err := pool.QueryRow(ctx, QueryDeviceTokenHash, accountId, deviceId).Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+
+	valid, legacy := verifyDeviceTokenHash(stored, strings.ToLower(md5Hex))
+	if valid && legacy {
+		_, err = pool.Exec(ctx, UpgradeDeviceTokenHashStatement, accountId, deviceId, hashDeviceToken(stored), stored)
+		if err != nil {
+			debugPrint("error occurred while upgrading token hash: ", err)
+		}
+	}
+
+	return valid, nil
+}
+
+// upgradeTokenHashes upgrades all remaining legacy hashes.
+// Consoles continue to authenticate with WT- tokens throughout, as their MD5 is what we hash.
+func upgradeTokenHashes(ctx context.Context) error {
+	_, err := pool.Exec(ctx, UpgradeAllDeviceTokenHashesStatement)
+	return err
+}
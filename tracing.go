@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultTracingServiceName is the service name spans are exported under unless configured otherwise.
+const DefaultTracingServiceName = "wiisoap"
+
+// TracingConfig configures exporting OpenTelemetry spans via OTLP over gRPC.
+// Spans are not recorded unless an endpoint is given.
+type TracingConfig struct {
+	// Endpoint is the host and port of an OTLP collector, such as localhost:4317.
+	Endpoint string `xml:"Endpoint,attr"`
+	// Insecure disables TLS towards the collector, as is typical for a local sidecar.
+	Insecure    bool   `xml:"Insecure,attr"`
+	ServiceName string `xml:"ServiceName,attr"`
+	// SampleRatio is the fraction of requests traced, defaulting to all. Sampling decisions made upstream are honoured.
+	SampleRatio *float64 `xml:"SampleRatio,attr"`
+}
+
+// tracer creates all spans within WiiSOAP. It records nothing until tracing is configured.
+var tracer = otel.Tracer("github.com/OpenShopChannel/WiiSOAP")
+
+// loadTracing begins exporting spans per the given configuration.
+func loadTracing(config TracingConfig) error {
+	if config.Endpoint == "" {
+		return nil
+	}
+
+	options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultTracingServiceName
+	}
+	ratio := 1.0
+	if config.SampleRatio != nil {
+		ratio = *config.SampleRatio
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// startQuerySpan begins a span for a statement executed against the database.
+// Statements prepared by name are identified by it, rather than their full SQL.
+func startQuerySpan(ctx context.Context, operation string, sql string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBStatementKey.String(prepared(sql)),
+		attribute.String("wiisoap.tenant", tenantFromContext(ctx).Name),
+	))
+}
+
+// endSpan ends the given span, recording the given error if one occurred.
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != pgx.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedRow ends its span once scanned.
+type tracedRow struct {
+	pgx.Row
+	span trace.Span
+}
+
+func (r tracedRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	endSpan(r.span, err)
+	return err
+}
+
+// tracedRows ends its span once closed or exhausted.
+type tracedRows struct {
+	pgx.Rows
+	span trace.Span
+}
+
+func (r tracedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+
+	endSpan(r.span, r.Rows.Err())
+	return false
+}
+
+func (r tracedRows) Close() {
+	r.Rows.Close()
+	endSpan(r.span, r.Rows.Err())
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Transaction types, as displayed within the channel's account activity.
+const (
+	TransactionPurchase     = "PURCHGAME"
+	TransactionRental       = "RENTAL"
+	TransactionSubscription = "SUBSCRIPT"
+	TransactionGiftSent     = "GIFTGAME"
+	TransactionGiftReceived = "RECVGIFT"
+)
+
+const (
+	// DefaultHistoryLimit is how many transactions are returned unless the client requests otherwise.
+	DefaultHistoryLimit = 50
+	// MaxHistoryLimit is the most transactions returned at once.
+	MaxHistoryLimit = 200
+
+	InsertTransactionStatement = `INSERT INTO transactions (account_id, type, title_id, item_id, total_paid, reference_id, date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING transaction_id`
+
+	// QueryPurchaseHistory lists an account's transactions, most recent first, alongside the name of each title if imported.
+	// Each row additionally includes the total number of transactions, prior to pagination.
+	QueryPurchaseHistory = `SELECT transactions.transaction_id, transactions.type, transactions.title_id, transactions.item_id,
+			transactions.total_paid, transactions.reference_id, transactions.date, titles.name, count(*) OVER ()
+		FROM transactions
+		LEFT JOIN titles ON titles.title_id = transactions.title_id
+		WHERE transactions.account_id = $1
+		ORDER BY transactions.date DESC, transactions.transaction_id DESC
+		LIMIT $2 OFFSET $3`
+
+	QueryPurchaseHistoryTotal = `SELECT count(*) FROM transactions WHERE account_id = $1`
+)
+
+// Transaction is a single entry within an account's history.
+type Transaction struct {
+	AccountId   int64
+	Type        string
+	TitleId     string
+	ItemId      int
+	TotalPaid   int
+	ReferenceId *string
+	Date        time.Time
+}
+
+// transactionLicences maps a transaction type to the licence it granted, for displaying its price.
+var transactionLicences = map[string]LicenceKinds{
+	TransactionPurchase:     PERMANENT,
+	TransactionRental:       RENTAL,
+	TransactionSubscription: SUBSCRIPT,
+	TransactionGiftSent:     PERMANENT,
+	TransactionGiftReceived: PERMANENT,
+}
+
+// formatTransactionId returns a transaction ID as presented to consoles.
+func formatTransactionId(transactionId int) string {
+	return fmt.Sprintf("%08d", transactionId)
+}
+
+// recordTransaction adds the given transaction to its account's history within a transaction, returning its ID.
+func recordTransaction(ctx context.Context, tx pgx.Tx, transaction Transaction) (int, error) {
+	if transaction.Date.IsZero() {
+		transaction.Date = time.Now().UTC()
+	}
+
+	// Sandboxed transactions are recorded once the purchase's other changes have been discarded.
+	if sandbox, ok := tx.(*sandboxTx); ok {
+		var transactionId int
+		err := tx.QueryRow(ctx, QueryNextTransactionId).Scan(&transactionId)
+		if err != nil {
+			return 0, err
+		}
+
+		sandbox.transactions = append(sandbox.transactions, sandboxTransaction{id: transactionId, Transaction: transaction})
+		return transactionId, nil
+	}
+
+	var transactionId int
+	err := tx.QueryRow(ctx, InsertTransactionStatement, transaction.AccountId, transaction.Type, transaction.TitleId,
+		transaction.ItemId, transaction.TotalPaid, transaction.ReferenceId, transaction.Date).Scan(&transactionId)
+	return transactionId, err
+}
+
+// listTransactionHistory responds with a page of the given account's transactions.
+func listTransactionHistory(e *Envelope, accountId int64) {
+	offset, limit := e.listPagination(DefaultHistoryLimit, MaxHistoryLimit)
+	rows, err := pool.Query(e.ctx, QueryPurchaseHistory, accountId, limit, offset)
+	if err != nil {
+		log.Printf("error executing statement: %v\n", err)
+		e.Error(ErrorCodeGenericFailure, "database error", nil)
+		return
+	}
+	defer rows.Close()
+
+	total := 0
+	transactions := []Transactions{}
+	for rows.Next() {
+		var transactionId, itemId, totalPaid int
+		var kind, titleId string
+		var referenceId, titleName *string
+		var date time.Time
+		err = rows.Scan(&transactionId, &kind, &titleId, &itemId, &totalPaid, &referenceId, &date, &titleName, &total)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", nil)
+			return
+		}
+
+		licence, known := transactionLicences[kind]
+		if !known {
+			licence = PERMANENT
+		}
+
+		transaction := Transactions{
+			TransactionId: formatTransactionId(transactionId),
+			Date:          strconv.FormatInt(date.UnixMilli(), 10),
+			Type:          kind,
+			TotalPaid:     totalPaid,
+			Currency:      "POINTS",
+			ItemId:        itemId,
+			ItemPricing:   e.ItemPrice(itemId, totalPaid, PR, licence),
+			TitleId:       titleId,
+			ItemCode:      itemId,
+		}
+		if referenceId != nil {
+			transaction.ReferenceId = *referenceId
+		}
+		if titleName != nil {
+			transaction.TitleName = *titleName
+		}
+
+		transactions = append(transactions, transaction)
+	}
+	if rows.Err() != nil {
+		log.Printf("error executing statement: %v\n", rows.Err())
+		e.Error(ErrorCodeGenericFailure, "database error", nil)
+		return
+	}
+	rows.Close()
+
+	// Pages past the end have no rows to count within, yet the console relies upon the total to stop paginating.
+	if len(transactions) == 0 && offset > 0 {
+		err = pool.QueryRow(e.ctx, QueryPurchaseHistoryTotal, accountId).Scan(&total)
+		if err != nil {
+			log.Printf("error executing statement: %v\n", err)
+			e.Error(ErrorCodeGenericFailure, "database error", nil)
+			return
+		}
+	}
+
+	e.AddCustomType(transactions)
+	e.AddKVNode("ListResultTotalSize", strconv.Itoa(total))
+}
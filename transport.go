@@ -0,0 +1,254 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCompressionMinSize is the smallest response compressed unless otherwise configured, in bytes.
+	// Smaller responses fit within a few packets regardless, and gain little.
+	DefaultCompressionMinSize = 1024
+
+	// DefaultReadHeaderTimeout is how long consoles may take to send request headers.
+	DefaultReadHeaderTimeout = 10 * time.Second
+	// DefaultReadTimeout is how long consoles may take to send an entire request.
+	DefaultReadTimeout = time.Minute
+	// DefaultIdleTimeout is how long connections are kept open between requests.
+	// The shop sends requests in bursts as pages load, and re-establishing connections is slow on the Wii, particularly over HTTPS.
+	DefaultIdleTimeout = 2 * time.Minute
+)
+
+// HTTPConfig tunes connections with consoles, and compresses responses for clients supporting it.
+type HTTPConfig struct {
+	// Compression encodes responses via gzip or deflate for clients requesting so via Accept-Encoding.
+	Compression bool `xml:"Compression,attr"`
+	// CompressionMinSize is the smallest response compressed, in bytes.
+	CompressionMinSize int `xml:"CompressionMinSize,attr"`
+	// DisableKeepAlives closes every connection once responded to.
+	DisableKeepAlives bool   `xml:"DisableKeepAlives,attr"`
+	ReadHeaderTimeout string `xml:"ReadHeaderTimeout,attr"`
+	ReadTimeout       string `xml:"ReadTimeout,attr"`
+	// WriteTimeout bounds the time taken to handle and respond to a request, and is unbounded unless set.
+	// It should exceed the longest action timeout.
+	WriteTimeout string `xml:"WriteTimeout,attr"`
+	IdleTimeout  string `xml:"IdleTimeout,attr"`
+}
+
+// serverSettings holds parsed connection settings applied to every listener serving consoles.
+type serverSettings struct {
+	compression        bool
+	compressionMinSize int
+	keepAlives         bool
+	readHeaderTimeout  time.Duration
+	readTimeout        time.Duration
+	writeTimeout       time.Duration
+	idleTimeout        time.Duration
+}
+
+// httpSettings holds the configured connection settings.
+var httpSettings = serverSettings{
+	compressionMinSize: DefaultCompressionMinSize,
+	keepAlives:         true,
+	readHeaderTimeout:  DefaultReadHeaderTimeout,
+	readTimeout:        DefaultReadTimeout,
+	idleTimeout:        DefaultIdleTimeout,
+}
+
+// loadHTTP applies the given connection settings, retaining defaults for unset values.
+func loadHTTP(config HTTPConfig) error {
+	httpSettings.compression = config.Compression
+	httpSettings.keepAlives = !config.DisableKeepAlives
+	if config.CompressionMinSize != 0 {
+		httpSettings.compressionMinSize = config.CompressionMinSize
+	}
+
+	timeouts := []struct {
+		value   string
+		timeout *time.Duration
+	}{
+		{config.ReadHeaderTimeout, &httpSettings.readHeaderTimeout},
+		{config.ReadTimeout, &httpSettings.readTimeout},
+		{config.WriteTimeout, &httpSettings.writeTimeout},
+		{config.IdleTimeout, &httpSettings.idleTimeout},
+	}
+	for _, setting := range timeouts {
+		if setting.value == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(setting.value)
+		if err != nil {
+			return err
+		}
+		*setting.timeout = parsed
+	}
+	return nil
+}
+
+// newServer returns a server for the given address with the configured connection settings.
+func newServer(address string, handler http.Handler) *http.Server {
+	if httpSettings.compression {
+		handler = compressResponses(handler)
+	}
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: httpSettings.readHeaderTimeout,
+		ReadTimeout:       httpSettings.readTimeout,
+		WriteTimeout:      httpSettings.writeTimeout,
+		IdleTimeout:       httpSettings.idleTimeout,
+	}
+	server.SetKeepAlivesEnabled(httpSettings.keepAlives)
+	return server
+}
+
+// Content encodings responses may be compressed with, in order of preference.
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// negotiateEncoding returns the preferred encoding accepted by the given Accept-Encoding header, or an empty string if none are.
+func negotiateEncoding(header string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, parameters, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if parameters = strings.TrimSpace(parameters); strings.HasPrefix(parameters, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(parameters, "q="), 64)
+			if err == nil {
+				quality = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = quality > 0
+	}
+
+	for _, encoding := range []string{EncodingGzip, EncodingDeflate} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// isCompressible returns whether responses of the given content type benefit from compression.
+// Images and other binary assets are typically compressed already.
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "xml") ||
+		strings.Contains(contentType, "json") || strings.Contains(contentType, "javascript")
+}
+
+// compressResponses compresses responses for clients accepting gzip or deflate.
+func compressResponses(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		// Ranges apply to the encoded body, which would differ from the one served to other clients.
+		if encoding == "" || r.Method == "HEAD" || r.Header.Get("Range") != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		writer := &compressingWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		defer writer.Close()
+		handler.ServeHTTP(writer, r)
+	})
+}
+
+// compressingWriter buffers the start of a response, compressing it once it reaches the minimum size.
+// Responses completing beneath the minimum size, or of incompressible types, are written as-is.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buffer   []byte
+
+	// decided is set once the response has been written either compressed or as-is.
+	decided bool
+	encoder io.WriteCloser
+}
+
+// WriteHeader records the status, deferring it until it is known whether the response is compressed.
+func (c *compressingWriter) WriteHeader(status int) {
+	if !c.decided {
+		c.status = status
+	}
+}
+
+func (c *compressingWriter) Write(b []byte) (int, error) {
+	if c.decided {
+		if c.encoder != nil {
+			return c.encoder.Write(b)
+		}
+		return c.ResponseWriter.Write(b)
+	}
+
+	c.buffer = append(c.buffer, b...)
+	if len(c.buffer) >= httpSettings.compressionMinSize {
+		err := c.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide writes the status and buffered contents, compressing should the response be large enough and of a compressible type.
+func (c *compressingWriter) decide(large bool) error {
+	c.decided = true
+	header := c.Header()
+	if large && header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified {
+		header.Set("Content-Encoding", c.encoding)
+		header.Del("Content-Length")
+
+		if c.encoding == EncodingGzip {
+			encoder := gzipWriters.Get().(*gzip.Writer)
+			encoder.Reset(c.ResponseWriter)
+			c.encoder = encoder
+		} else {
+			encoder := zlibWriters.Get().(*zlib.Writer)
+			encoder.Reset(c.ResponseWriter)
+			c.encoder = encoder
+		}
+		incrementMetric("responses_compressed")
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	_, err := c.Write(c.buffer)
+	c.buffer = nil
+	return err
+}
+
+// Close writes any response still buffered, and flushes the encoder should the response be compressed.
+func (c *compressingWriter) Close() error {
+	if !c.decided {
+		return c.decide(false)
+	}
+	if c.encoder == nil {
+		return nil
+	}
+
+	err := c.encoder.Close()
+	switch encoder := c.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(encoder)
+	case *zlib.Writer:
+		zlibWriters.Put(encoder)
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", EncodingGzip},
+		{"GZIP", EncodingGzip},
+		{"deflate", EncodingDeflate},
+		{"deflate, gzip", EncodingGzip},
+		{"gzip;q=0.5, deflate", EncodingGzip},
+		{"gzip;q=0, deflate", EncodingDeflate},
+		{"gzip; q=0, deflate; q=0", ""},
+		{"gzip;q=0.0", ""},
+		{"identity", ""},
+		{"identity, deflate", EncodingDeflate},
+		{"identity;q=0, gzip", EncodingGzip},
+		{"br", ""},
+	}
+
+	for _, tc := range cases {
+		if got := negotiateEncoding(tc.header); got != tc.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+// largeListETickets returns a ListETickets response holding the given amount of tickets, as a console owning many titles receives.
+func largeListETickets(b *testing.B, tickets int) []byte {
+	request, _ := testclient.Lookup("ecs/ListETickets")
+	body := testclient.Envelope(request.Service, request.Action, testclient.DefaultConsole, "ETBenchmark", request.Fields(testclient.DefaultConsole))
+	e, err := NewEnvelope(request.Service, request.Action, body)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < tickets; i++ {
+		e.AddCustomType(Tickets{
+			TicketId: "0",
+			TitleId:  fmt.Sprintf("00010001%08X", 0x48414000+i),
+			Version:  i % 8,
+		})
+	}
+	e.AddKVNode("ForceSyncTime", "0")
+	e.AddKVNode("ExtTicketTime", e.Timestamp())
+	e.AddKVNode("SyncTime", e.Timestamp())
+
+	success, contents := e.becomeXML()
+	if !success {
+		b.Fatal(contents)
+	}
+	return []byte(contents)
+}
+
+// BenchmarkCompression compares serving a large response as-is against compressing it with each encoding.
+// The size of the response as sent is reported alongside, as bytes/response.
+func BenchmarkCompression(b *testing.B) {
+	response := largeListETickets(b, 500)
+	handler := compressResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.Write(response)
+	}))
+
+	defer func(compressionMinSize int) {
+		httpSettings.compressionMinSize = compressionMinSize
+	}(httpSettings.compressionMinSize)
+	httpSettings.compressionMinSize = DefaultCompressionMinSize
+
+	for _, encoding := range []string{"identity", EncodingGzip, EncodingDeflate} {
+		b.Run(encoding, func(b *testing.B) {
+			request := httptest.NewRequest("POST", "/ecs/services/ECommerceSOAP", nil)
+			request.Header.Set("Accept-Encoding", encoding)
+
+			var sent int
+			b.SetBytes(int64(len(response)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, request)
+				sent = recorder.Body.Len()
+			}
+			b.ReportMetric(float64(sent), "bytes/response")
+		})
+	}
+}
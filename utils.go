@@ -18,6 +18,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
@@ -25,7 +26,6 @@ import (
 	"github.com/antchfx/xmlquery"
 	"io"
 	"log"
-	"math/rand"
 	"regexp"
 	"strconv"
 	"strings"
@@ -38,7 +38,8 @@ var namespaceParse = regexp.MustCompile(`^urn:(.{3})\.wsapi\.broadon\.com/(.*)$`
 // where "CheckDeviceStatus" is the action to be performed.
 func parseAction(original string) (string, string) {
 	// Intended to return the original string, the service's name and the name of the action.
-	matches := namespaceParse.FindStringSubmatch(original)
+	// Clients may quote the SOAPAction header as permitted by SOAP 1.1.
+	matches := namespaceParse.FindStringSubmatch(strings.Trim(original, `"`))
 	if len(matches) != 3 {
 		// It seems like the passed action was not matched properly.
 		return "", ""
@@ -73,7 +74,10 @@ func NewEnvelope(service string, action string, body []byte) (*Envelope, error)
 				TimeStamp: timestampNano,
 			},
 		},
-		doc: doc,
+		doc:     doc,
+		ctx:     context.Background(),
+		service: service,
+		action:  action,
 	}
 
 	// Obtain common request values.
@@ -135,16 +139,32 @@ func (e *Envelope) ObtainCommon() error {
 	if err != nil {
 		return err
 	}
-	e.Body.Response.DeviceId, err = strconv.Atoi(deviceIdString)
+	// Device IDs are 32-bit and unsigned, whereas erased accounts hold negative IDs.
+	deviceId, err := strconv.ParseUint(deviceIdString, 10, 32)
 	if err != nil {
 		return err
 	}
+	e.Body.Response.DeviceId = int(deviceId)
 	e.Body.Response.MessageId, err = e.getKey("MessageId")
 	if err != nil {
 		return err
 	}
 
 	// These are as well, but we do not need to send them back in our response.
+	// NUS requests instead name the region RegionId and the country CountryCode, and may omit the language.
+	if e.service == "nus" {
+		e.region, err = e.getKey("RegionId")
+		if err != nil {
+			return err
+		}
+		e.country, err = e.getKey("CountryCode")
+		if err != nil {
+			return err
+		}
+		e.language, _ = e.getKey("Language")
+		return nil
+	}
+
 	e.region, err = e.getKey("Region")
 	if err != nil {
 		return err
@@ -174,17 +194,53 @@ func (e *Envelope) AddCustomType(customType interface{}) {
 	e.Body.Response.CustomFields = append(e.Body.Response.CustomFields, customType)
 }
 
+// AddNode adds an empty element by name, returning it so that children may be added.
+// Children added after further fields are added to the envelope remain within the node.
+func (e *Envelope) AddNode(name string) *Node {
+	node := &Node{XMLName: xml.Name{Local: name}}
+	e.Body.Response.CustomFields = append(e.Body.Response.CustomFields, node)
+	return node
+}
+
+// AddKVNode adds a child in the form of <key>value</key>, returning this node for further additions.
+func (n *Node) AddKVNode(key string, value string) *Node {
+	n.Children = append(n.Children, KVField{
+		XMLName: xml.Name{Local: key},
+		Value:   value,
+	})
+	return n
+}
+
+// AddCustomType adds a structure as a child, returning this node for further additions.
+// Slices of structures are added as repeated elements, such as several Limits.
+func (n *Node) AddCustomType(customType interface{}) *Node {
+	n.Children = append(n.Children, customType)
+	return n
+}
+
+// AddNode adds an empty child element by name, returning the child so that its own children may be added.
+func (n *Node) AddNode(name string) *Node {
+	child := &Node{XMLName: xml.Name{Local: name}}
+	n.Children = append(n.Children, child)
+	return child
+}
+
 // becomeXML marshals the Envelope object, returning the intended boolean state on success.
 // ..there has to be a better way to do this, TODO.
 func (e *Envelope) becomeXML() (bool, string) {
 	// Non-zero error codes indicate a failure.
-	intendedStatus := e.Body.Response.ErrorCode == 0
+	intendedStatus := e.Body.Response.ErrorCode == ErrorCodeSuccess
 
 	var contents []byte
 	var err error
 
+	if strictCompatibility {
+		e.canonicalize()
+	}
+
 	// If we're in debug mode, pretty print XML.
-	if isDebug {
+	// Nintendo's servers never did, so strict compatibility does not either.
+	if isDebug && !strictCompatibility {
 		contents, err = xml.MarshalIndent(e, "", "  ")
 	} else {
 		contents, err = xml.Marshal(e)
@@ -200,22 +256,51 @@ func (e *Envelope) becomeXML() (bool, string) {
 }
 
 // Error sets the necessary keys for this SOAP response to reflect the given error.
-func (e *Envelope) Error(errorCode int, reason string, err error) {
+func (e *Envelope) Error(errorCode ErrorCode, reason string, err error) {
+	behavior := FailureBehaviorError
+	if override, exists := e.failureOverride(failureClass(errorCode, err)); exists {
+		if override.code != 0 {
+			errorCode = override.code
+		}
+		behavior = override.behavior
+	}
+
 	e.Body.Response.ErrorCode = errorCode
 
 	// Ensure all additional fields are empty to avoid conflict.
 	e.Body.Response.CustomFields = nil
 
-	e.AddKVNode("ErrorMessage", fmt.Sprintf("%s: %v", reason, err))
+	message := formatError(errorCode, reason, err)
+	e.AddKVNode("ErrorMessage", message)
+
+	e.fault = ""
+	switch behavior {
+	case FailureBehaviorStandby:
+		e.Body.Response.ServiceStandbyMode = true
+	case FailureBehaviorFault:
+		e.fault = message
+	}
+}
+
+// Unavailable sets the necessary keys for this SOAP response to reflect that the service is temporarily unavailable.
+// Consoles display a maintenance message rather than an error.
+func (e *Envelope) Unavailable() {
+	e.Error(ErrorCodeServiceUnavailable, "service temporarily unavailable", errors.New("the database is unreachable"))
+	e.Body.Response.ServiceStandbyMode = true
 }
 
-// parseNameValue parses the output of *xmlquery.Node.InnerText when it is a nested Name and Value node.
-func parseNameValue(s string) (string, string) {
-	s = strings.TrimSpace(s)
-	s = strings.Replace(s, " ", "", strings.Count(s, " ")-1)
-	decoded := strings.Split(s, " ")
+// parseNameValue returns the contents of the Name and Value children of a node.
+// Either is empty if not present, as their values are sent by the client.
+func parseNameValue(node *xmlquery.Node) (string, string) {
+	var name, value string
+	if child := xmlquery.FindOne(node, "Name"); child != nil {
+		name = strings.TrimSpace(child.InnerText())
+	}
+	if child := xmlquery.FindOne(node, "Value"); child != nil {
+		value = strings.TrimSpace(child.InnerText())
+	}
 
-	return strings.TrimSuffix(decoded[0], "\n"), decoded[1]
+	return name, value
 }
 
 // normalise parses a document, returning a document with only the request type's child nodes, stripped of prefix.
@@ -267,16 +352,48 @@ func (e *Envelope) getKeys(key string) ([]*xmlquery.Node, error) {
 	}
 }
 
+// listPagination returns the offset and limit requested via ListResultOffset and ListResultLimit,
+// applying the given default and maximum limits.
+func (e *Envelope) listPagination(defaultLimit int, maxLimit int) (int, int) {
+	offset, limit := 0, defaultLimit
+	if value, err := e.getKey("ListResultOffset"); err == nil {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			offset = parsed
+		}
+	}
+	if value, err := e.getKey("ListResultLimit"); err == nil {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	return offset, limit
+}
+
+// paginate returns the bounds of the requested page within a list of the given length, for slicing.
+// Lists paginated this way are small, and are returned in full unless the client requests otherwise.
+func (e *Envelope) paginate(length int) (int, int) {
+	offset, limit := e.listPagination(length, length)
+	if offset > length {
+		offset = length
+	}
+
+	end := offset + limit
+	if end > length {
+		end = length
+	}
+	return offset, end
+}
+
 // Derived from https://stackoverflow.com/a/31832326, adding numbers
 const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-// RandString generates a random string with n length.
+// RandString generates a cryptographically secure random string with n length.
 func RandString(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
-	}
-	return string(b)
+	return randomString(letterBytes, n)
 }
 
 // debugPrint logs a message only if this program is running in debug mode.
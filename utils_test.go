@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/OpenShopChannel/WiiSOAP/testclient"
+	"path/filepath"
+	"testing"
+)
+
+// nodeCases build responses via nested nodes, with fixtures recorded within testdata/nodes.
+var nodeCases = []struct {
+	name  string
+	build func(e *Envelope)
+}{
+	{
+		name: "nested",
+		build: func(e *Envelope) {
+			title := e.AddNode("Title")
+			title.AddKVNode("TitleId", "0001000148414C45").AddKVNode("Version", "2")
+			title.AddNode("Content").AddKVNode("ContentId", "00000000").AddNode("Size").AddKVNode("Bytes", "1048576")
+			e.AddKVNode("ForceSyncTime", "0")
+		},
+	},
+	{
+		name: "repeated",
+		build: func(e *Envelope) {
+			titles := e.AddNode("Titles")
+			for _, titleId := range []string{"0001000148414C45", "0001000148414D45", "0001000148414E45"} {
+				titles.AddNode("Title").AddKVNode("TitleId", titleId)
+			}
+			titles.AddCustomType([]Limits{LimitStruct(PR), LimitStruct(TR)})
+		},
+	},
+	{
+		name: "limits",
+		build: func(e *Envelope) {
+			e.AddCustomType(LimitStruct(PR))
+			e.AddNode("Rental").AddKVNode("TitleId", "0001000148414C45").AddCustomType(Limits{Limits: 604800, LimitKind: "TR"})
+		},
+	},
+}
+
+// TestNodes marshals responses built from nested nodes, comparing them byte for byte against recorded fixtures.
+// Each is compared both as normally emitted and with strict compatibility, as the latter reorders fields.
+func TestNodes(t *testing.T) {
+	request, _ := testclient.Lookup("ecs/ListETickets")
+	body := testclient.Envelope(request.Service, request.Action, testclient.DefaultConsole, "ETNodes", request.Fields(testclient.DefaultConsole))
+
+	defer func(strict bool) {
+		strictCompatibility = strict
+	}(strictCompatibility)
+
+	for _, strict := range []bool{false, true} {
+		strictCompatibility = strict
+		for _, tc := range nodeCases {
+			name := tc.name
+			if strict {
+				name += "-strict"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				e, err := NewEnvelope(request.Service, request.Action, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tc.build(e)
+
+				success, contents := e.becomeXML()
+				if !success {
+					t.Fatal(contents)
+				}
+
+				path := filepath.Join("testdata", "nodes", name+".xml")
+				err = testclient.CompareGolden(path, []byte(contents), *updateGolden)
+				if err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxWebhookAttempts is how many times delivery of an event is attempted before it is dropped.
+	MaxWebhookAttempts = 5
+	// WebhookTimeout is how long a single delivery may take.
+	WebhookTimeout = 10 * time.Second
+	// WebhookQueueSize is how many deliveries may be pending before further events are dropped.
+	WebhookQueueSize = 256
+	// WebhookSignatureHeader holds "sha256=" followed by the hex HMAC-SHA256 of the request body, keyed by the webhook's secret.
+	WebhookSignatureHeader = "X-WiiSOAP-Signature"
+	// WebhookEventHeader holds the name of the delivered event.
+	WebhookEventHeader = "X-WiiSOAP-Event"
+)
+
+// Events which may be delivered to webhooks.
+const (
+	EventDeviceRegistered = "device.registered"
+	EventTitlePurchased   = "title.purchased"
+	EventPointsRedeemed   = "points.redeemed"
+)
+
+// WebhookConfig describes a URL events are delivered to.
+type WebhookConfig struct {
+	URL string `xml:"URL,attr"`
+	// Secret signs each delivery. It is optional, though strongly recommended.
+	Secret string `xml:"Secret,attr"`
+	// Events is a comma-separated list of events to deliver. All events are delivered if empty.
+	Events string `xml:"Events,attr"`
+}
+
+// wants returns whether the given event should be delivered to this webhook.
+func (w WebhookConfig) wants(event string) bool {
+	if w.Events == "" {
+		return true
+	}
+
+	for _, name := range strings.Split(w.Events, ",") {
+		if strings.TrimSpace(name) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the JSON body POSTed to webhooks.
+type WebhookEvent struct {
+	Event  string      `json:"event"`
+	Tenant string      `json:"tenant"`
+	Date   time.Time   `json:"date"`
+	Data   interface{} `json:"data"`
+}
+
+// DeviceRegisteredEvent is delivered upon a console registering.
+type DeviceRegisteredEvent struct {
+	AccountId    string `json:"account_id"`
+	DeviceId     int    `json:"device_id"`
+	Region       string `json:"region"`
+	SerialNumber string `json:"serial_number"`
+}
+
+// TitlePurchasedEvent is delivered upon an account obtaining a title, whether purchased, rented or gifted.
+type TitlePurchasedEvent struct {
+	AccountId   string       `json:"account_id"`
+	TitleId     string       `json:"title_id"`
+	ItemId      int          `json:"item_id"`
+	LicenseKind LicenceKinds `json:"license_kind"`
+}
+
+// PointsRedeemedEvent is delivered upon an account spending points.
+type PointsRedeemedEvent struct {
+	AccountId string `json:"account_id"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+}
+
+// webhookDelivery is a pending delivery of an event to a single webhook.
+type webhookDelivery struct {
+	webhook WebhookConfig
+	event   string
+	body    []byte
+	attempt int
+}
+
+var (
+	// webhooks holds all configured webhooks.
+	webhooks []WebhookConfig
+	// webhookQueue holds deliveries awaiting the delivery goroutine.
+	webhookQueue = make(chan webhookDelivery, WebhookQueueSize)
+	// webhookClient is used for all deliveries.
+	webhookClient = &http.Client{Timeout: WebhookTimeout}
+)
+
+// startWebhooks delivers emitted events to the given webhooks in the background.
+func startWebhooks(configs []WebhookConfig) {
+	webhooks = configs
+	if len(webhooks) == 0 {
+		return
+	}
+
+	go func() {
+		for delivery := range webhookQueue {
+			deliverWebhook(delivery)
+		}
+	}()
+}
+
+// emitEvent queues the given event for delivery to all interested webhooks.
+// It never blocks: should the queue be full, the event is dropped.
+func emitEvent(ctx context.Context, event string, data interface{}) {
+	// Sandboxed purchases have no lasting effect for integrations to observe.
+	if len(webhooks) == 0 || isSandboxed(ctx) {
+		return
+	}
+
+	body, err := json.Marshal(WebhookEvent{
+		Event:  event,
+		Tenant: tenantFromContext(ctx).Name,
+		Date:   time.Now().UTC(),
+		Data:   data,
+	})
+	if err != nil {
+		log.Printf("unable to encode %s event: %v", event, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if webhook.wants(event) {
+			queueWebhook(webhookDelivery{webhook: webhook, event: event, body: body})
+		}
+	}
+}
+
+// queueWebhook adds the given delivery to the queue, dropping it if full.
+func queueWebhook(delivery webhookDelivery) {
+	select {
+	case webhookQueue <- delivery:
+	default:
+		incrementMetric("webhooks_dropped")
+		log.Printf("webhook queue is full, dropping %s event for %s", delivery.event, delivery.webhook.URL)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of the given body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook POSTs a single delivery, scheduling a retry with exponential backoff upon failure.
+func deliverWebhook(delivery webhookDelivery) {
+	err := postWebhook(delivery)
+	if err == nil {
+		incrementMetric("webhooks_delivered")
+		return
+	}
+
+	delivery.attempt++
+	if delivery.attempt >= MaxWebhookAttempts {
+		incrementMetric("webhooks_failed")
+		log.Printf("giving up delivering %s event to %s: %v", delivery.event, delivery.webhook.URL, err)
+		return
+	}
+
+	// Retries are scheduled rather than slept on, so that other deliveries are not held up.
+	backoff := time.Second << delivery.attempt
+	debugPrint("retrying webhook delivery in ", backoff, ": ", err)
+	time.AfterFunc(backoff, func() {
+		queueWebhook(delivery)
+	})
+}
+
+// postWebhook performs a single delivery attempt.
+func postWebhook(delivery webhookDelivery) error {
+	request, err := http.NewRequestWithContext(ctx, "POST", delivery.webhook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, delivery.event)
+	if delivery.webhook.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, "sha256="+signWebhook(delivery.webhook.Secret, delivery.body))
+	}
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+// serviceEndpoints maps a service type to the name of its SOAP endpoint.
+var serviceEndpoints = map[string]string{
+	"ecs": "ECommerceSOAP",
+	"ias": "IdentityAuthenticationSOAP",
+	"cas": "CatalogingSOAP",
+	"nus": "NetUpdateSOAP",
+}
+
+var (
+	// commonRequestFields are sent by the client within every request.
+	commonRequestFields = []string{"Version", "DeviceId", "MessageId", "TimeStamp", "Region", "Country", "Language"}
+	// authenticatedRequestFields are additionally sent for requests requiring authentication.
+	authenticatedRequestFields = []string{"AccountId", "DeviceToken"}
+	// commonResponseFields are present within every response we send.
+	commonResponseFields = []string{"Version", "DeviceId", "MessageId", "TimeStamp", "ErrorCode", "ServiceStandbyMode"}
+)
+
+// WSDLDefinitions represents the root element of a WSDL document, wsdl:definitions.
+type WSDLDefinitions struct {
+	XMLName         string `xml:"wsdl:definitions"`
+	Name            string `xml:"name,attr"`
+	TargetNamespace string `xml:"targetNamespace,attr"`
+	WSDL            string `xml:"xmlns:wsdl,attr"`
+	SOAP            string `xml:"xmlns:soap,attr"`
+	XSD             string `xml:"xmlns:xsd,attr"`
+	TNS             string `xml:"xmlns:tns,attr"`
+
+	Types    WSDLTypes     `xml:"wsdl:types"`
+	Messages []WSDLMessage `xml:"wsdl:message"`
+	PortType WSDLPortType  `xml:"wsdl:portType"`
+	Binding  WSDLBinding   `xml:"wsdl:binding"`
+	Service  WSDLService   `xml:"wsdl:service"`
+}
+
+// WSDLTypes contains the schema describing all request and response elements.
+type WSDLTypes struct {
+	Schema XSDSchema `xml:"xsd:schema"`
+}
+
+// XSDSchema describes elements within the target namespace.
+type XSDSchema struct {
+	TargetNamespace    string       `xml:"targetNamespace,attr"`
+	ElementFormDefault string       `xml:"elementFormDefault,attr"`
+	Elements           []XSDElement `xml:"xsd:element"`
+}
+
+// XSDElement describes a single element. Only one of Type or ComplexType is expected to be set.
+type XSDElement struct {
+	Name        string          `xml:"name,attr"`
+	Type        string          `xml:"type,attr,omitempty"`
+	MinOccurs   string          `xml:"minOccurs,attr,omitempty"`
+	ComplexType *XSDComplexType `xml:"xsd:complexType,omitempty"`
+}
+
+// XSDComplexType describes an ordered sequence of child elements.
+type XSDComplexType struct {
+	Sequence XSDSequence `xml:"xsd:sequence"`
+}
+
+// XSDSequence holds child elements, optionally permitting arbitrary additional elements.
+type XSDSequence struct {
+	Elements []XSDElement `xml:"xsd:element"`
+	Any      *XSDAny      `xml:"xsd:any,omitempty"`
+}
+
+// XSDAny permits any further elements to be present.
+type XSDAny struct {
+	MinOccurs      string `xml:"minOccurs,attr"`
+	MaxOccurs      string `xml:"maxOccurs,attr"`
+	ProcessContent string `xml:"processContents,attr"`
+}
+
+// WSDLMessage associates a message name with its schema element.
+type WSDLMessage struct {
+	Name string       `xml:"name,attr"`
+	Part WSDLPartType `xml:"wsdl:part"`
+}
+
+// WSDLPartType references an element within the schema.
+type WSDLPartType struct {
+	Name    string `xml:"name,attr"`
+	Element string `xml:"element,attr"`
+}
+
+// WSDLPortType lists abstract operations available.
+type WSDLPortType struct {
+	Name       string          `xml:"name,attr"`
+	Operations []WSDLOperation `xml:"wsdl:operation"`
+}
+
+// WSDLOperation describes an operation and its input and output messages.
+type WSDLOperation struct {
+	Name   string            `xml:"name,attr"`
+	Input  WSDLOperationBody `xml:"wsdl:input"`
+	Output WSDLOperationBody `xml:"wsdl:output"`
+}
+
+// WSDLOperationBody represents either an input or output of an operation.
+type WSDLOperationBody struct {
+	Message string    `xml:"message,attr,omitempty"`
+	Body    *SOAPBody `xml:"soap:body,omitempty"`
+}
+
+// SOAPBody specifies message parts are literal.
+type SOAPBody struct {
+	Use string `xml:"use,attr"`
+}
+
+// WSDLBinding binds a port type to SOAP over HTTP.
+type WSDLBinding struct {
+	Name       string                 `xml:"name,attr"`
+	Type       string                 `xml:"type,attr"`
+	Binding    SOAPBinding            `xml:"soap:binding"`
+	Operations []WSDLBindingOperation `xml:"wsdl:operation"`
+}
+
+// SOAPBinding describes the style and transport used.
+type SOAPBinding struct {
+	Style     string `xml:"style,attr"`
+	Transport string `xml:"transport,attr"`
+}
+
+// WSDLBindingOperation associates an operation with its SOAPAction.
+type WSDLBindingOperation struct {
+	Name      string            `xml:"name,attr"`
+	Operation SOAPOperation     `xml:"soap:operation"`
+	Input     WSDLOperationBody `xml:"wsdl:input"`
+	Output    WSDLOperationBody `xml:"wsdl:output"`
+}
+
+// SOAPOperation holds the SOAPAction header value expected for an operation.
+type SOAPOperation struct {
+	SOAPAction string `xml:"soapAction,attr"`
+}
+
+// WSDLService describes where a service can be reached.
+type WSDLService struct {
+	Name string   `xml:"name,attr"`
+	Port WSDLPort `xml:"wsdl:port"`
+}
+
+// WSDLPort holds the address of a binding.
+type WSDLPort struct {
+	Name    string      `xml:"name,attr"`
+	Binding string      `xml:"binding,attr"`
+	Address SOAPAddress `xml:"soap:address"`
+}
+
+// SOAPAddress is the location a port is served at.
+type SOAPAddress struct {
+	Location string `xml:"location,attr"`
+}
+
+// stringElements returns a list of xsd:string elements for the given names.
+func stringElements(names []string) []XSDElement {
+	var elements []XSDElement
+	for _, name := range names {
+		elements = append(elements, XSDElement{
+			Name: name,
+			Type: "xsd:string",
+		})
+	}
+	return elements
+}
+
+// GenerateWSDL describes all registered actions for the given service type.
+// It returns nil if no actions are registered for this service.
+func (route *Route) GenerateWSDL(ctx context.Context, service string) *WSDLDefinitions {
+	endpoint, known := serviceEndpoints[service]
+	if !known {
+		return nil
+	}
+
+	namespace := "urn:" + service + ".wsapi.broadon.com"
+	serviceName := strings.TrimSuffix(endpoint, "SOAP") + "Service"
+	literal := &SOAPBody{Use: "literal"}
+
+	wsdl := WSDLDefinitions{
+		Name:            serviceName,
+		TargetNamespace: namespace,
+		WSDL:            "http://schemas.xmlsoap.org/wsdl/",
+		SOAP:            "http://schemas.xmlsoap.org/wsdl/soap/",
+		XSD:             "http://www.w3.org/2001/XMLSchema",
+		TNS:             namespace,
+		Types: WSDLTypes{
+			Schema: XSDSchema{
+				TargetNamespace:    namespace,
+				ElementFormDefault: "qualified",
+			},
+		},
+		PortType: WSDLPortType{
+			Name: endpoint + "PortType",
+		},
+		Binding: WSDLBinding{
+			Name: endpoint + "Binding",
+			Type: "tns:" + endpoint + "PortType",
+			Binding: SOAPBinding{
+				Style:     "document",
+				Transport: "http://schemas.xmlsoap.org/soap/http",
+			},
+		},
+		Service: WSDLService{
+			Name: serviceName,
+			Port: WSDLPort{
+				Name:    endpoint,
+				Binding: "tns:" + endpoint + "Binding",
+				Address: SOAPAddress{
+					Location: genServiceUrl(ctx, service, endpoint),
+				},
+			},
+		},
+	}
+
+	for _, action := range route.Actions {
+		if action.ServiceType != service || action.Disabled {
+			continue
+		}
+
+		// Requests contain common fields, authentication if necessary, and any action-specific parameters.
+		requestFields := stringElements(commonRequestFields)
+		if action.NeedsAuthentication {
+			requestFields = append(requestFields, stringElements(authenticatedRequestFields)...)
+		}
+		requestFields = append(requestFields, stringElements(action.Parameters)...)
+
+		// Responses contain common fields alongside whatever the action populates.
+		responseFields := XSDSequence{
+			Elements: stringElements(commonResponseFields),
+			Any: &XSDAny{
+				MinOccurs:      "0",
+				MaxOccurs:      "unbounded",
+				ProcessContent: "lax",
+			},
+		}
+
+		name := action.ActionName
+		wsdl.Types.Schema.Elements = append(wsdl.Types.Schema.Elements,
+			XSDElement{
+				Name:        name,
+				ComplexType: &XSDComplexType{Sequence: XSDSequence{Elements: requestFields}},
+			},
+			XSDElement{
+				Name:        name + "Response",
+				ComplexType: &XSDComplexType{Sequence: responseFields},
+			},
+		)
+		wsdl.Messages = append(wsdl.Messages,
+			WSDLMessage{
+				Name: name + "Request",
+				Part: WSDLPartType{Name: "parameters", Element: "tns:" + name},
+			},
+			WSDLMessage{
+				Name: name + "Response",
+				Part: WSDLPartType{Name: "parameters", Element: "tns:" + name + "Response"},
+			},
+		)
+		wsdl.PortType.Operations = append(wsdl.PortType.Operations, WSDLOperation{
+			Name:   name,
+			Input:  WSDLOperationBody{Message: "tns:" + name + "Request"},
+			Output: WSDLOperationBody{Message: "tns:" + name + "Response"},
+		})
+		wsdl.Binding.Operations = append(wsdl.Binding.Operations, WSDLBindingOperation{
+			Name:      name,
+			Operation: SOAPOperation{SOAPAction: namespace + "/" + name},
+			Input:     WSDLOperationBody{Body: literal},
+			Output:    WSDLOperationBody{Body: literal},
+		})
+	}
+
+	if len(wsdl.PortType.Operations) == 0 {
+		return nil
+	}
+
+	return &wsdl
+}
+
+// serviceFromRequest determines the service type a request is intended for.
+// Requests are expected to be along the lines of /ias/services/ias/IdentityAuthenticationSOAP,
+// falling back to the subdomain of the requested host, such as ias.example.com.
+func serviceFromRequest(r *http.Request) string {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if _, known := serviceEndpoints[path[0]]; known {
+		return path[0]
+	}
+
+	host := strings.Split(r.Host, ".")
+	if _, known := serviceEndpoints[host[0]]; known {
+		return host[0]
+	}
+
+	return ""
+}
+
+// serveWSDL writes the WSDL document for the requested service.
+func (route *Route) serveWSDL(w http.ResponseWriter, r *http.Request) {
+	wsdl := route.GenerateWSDL(r.Context(), serviceFromRequest(r))
+	if wsdl == nil {
+		http.Error(w, "Unknown service.", http.StatusNotFound)
+		return
+	}
+
+	contents, err := xml.MarshalIndent(wsdl, "", "  ")
+	if err != nil {
+		writeFault(w, http.StatusInternalServerError, FaultCodeServer, "an error occurred marshalling WSDL: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header + string(contents)))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+)
+
+const (
+	// DefaultMaxBodySize is the largest request body accepted, in bytes. Console requests are far smaller.
+	DefaultMaxBodySize = 64 * 1024
+	// DefaultMaxDepth is the deepest nesting of elements accepted.
+	DefaultMaxDepth = 16
+	// DefaultMaxElements is the most elements accepted within a single document.
+	DefaultMaxElements = 1024
+	// DefaultMaxAttributes is the most attributes accepted within a single document.
+	DefaultMaxAttributes = 256
+)
+
+var (
+	ErrXMLTooDeep          = errors.New("document is too deeply nested")
+	ErrXMLTooManyElements  = errors.New("document contains too many elements")
+	ErrXMLTooManyAttrs     = errors.New("document contains too many attributes")
+	ErrXMLDirective        = errors.New("document type declarations are not permitted")
+	ErrXMLProcessingInstr  = errors.New("processing instructions are not permitted")
+	ErrXMLTrailingElements = errors.New("document contains more than one root element")
+)
+
+// RequestLimitsConfig bounds the size and complexity of request bodies. Any unset value uses its default.
+type RequestLimitsConfig struct {
+	MaxBodySize   int64 `xml:"MaxBodySize,attr"`
+	MaxDepth      int   `xml:"MaxDepth,attr"`
+	MaxElements   int   `xml:"MaxElements,attr"`
+	MaxAttributes int   `xml:"MaxAttributes,attr"`
+}
+
+// requestLimits holds the limits applied to all requests.
+var requestLimits = RequestLimitsConfig{
+	MaxBodySize:   DefaultMaxBodySize,
+	MaxDepth:      DefaultMaxDepth,
+	MaxElements:   DefaultMaxElements,
+	MaxAttributes: DefaultMaxAttributes,
+}
+
+// loadRequestLimits applies the given configuration, retaining defaults for unset values.
+func loadRequestLimits(config RequestLimitsConfig) {
+	if config.MaxBodySize > 0 {
+		requestLimits.MaxBodySize = config.MaxBodySize
+	}
+	if config.MaxDepth > 0 {
+		requestLimits.MaxDepth = config.MaxDepth
+	}
+	if config.MaxElements > 0 {
+		requestLimits.MaxElements = config.MaxElements
+	}
+	if config.MaxAttributes > 0 {
+		requestLimits.MaxAttributes = config.MaxAttributes
+	}
+}
+
+// checkXMLDocument scans the given document without building it, rejecting those exceeding our limits.
+// Document type declarations are refused outright, as they are the basis of entity expansion attacks
+// and are never sent by consoles.
+func checkXMLDocument(body []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	depth, elements, attributes := 0, 0, 0
+	seenRoot := false
+
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if depth == 0 && seenRoot {
+				return ErrXMLTrailingElements
+			}
+			seenRoot = true
+
+			depth++
+			elements++
+			attributes += len(token.Attr)
+			if depth > requestLimits.MaxDepth {
+				return ErrXMLTooDeep
+			}
+			if elements > requestLimits.MaxElements {
+				return ErrXMLTooManyElements
+			}
+			if attributes > requestLimits.MaxAttributes {
+				return ErrXMLTooManyAttrs
+			}
+		case xml.EndElement:
+			depth--
+		case xml.Directive:
+			return ErrXMLDirective
+		case xml.ProcInst:
+			// The XML declaration itself is permitted.
+			if token.Target != "xml" {
+				return ErrXMLProcessingInstr
+			}
+		}
+	}
+}
+
+// rejectionReason categorizes an error from checkXMLDocument for metrics.
+func rejectionReason(err error) string {
+	switch err {
+	case ErrXMLDirective, ErrXMLProcessingInstr:
+		return "declarations"
+	case ErrXMLTooDeep:
+		return "depth"
+	case ErrXMLTooManyElements, ErrXMLTooManyAttrs:
+		return "counts"
+	default:
+		return "malformed"
+	}
+}
+
+// rejectPayload records a rejected request body against its reason.
+func rejectPayload(reason string) {
+	incrementMetric("rejected_payloads")
+	incrementMetric("rejected_payloads_" + reason)
+}